@@ -14,40 +14,10 @@ import (
 	"sort"
 	"strings"
 
-	"github.com/bmatcuk/doublestar"
+	"github.com/papercutsoftware/pdfsearch/internal/utils"
 	"github.com/unidoc/unipdf/v3/common"
 )
 
-// PatternsToPaths returns a list of files matching the patterns in `patternList`.
-// The returned list is sorted alphabetically .
-func PatternsToPaths(patternList []string) ([]string, error) {
-	var pathList []string
-	common.Log.Debug("patternList=%d", len(patternList))
-	for i, pattern := range patternList {
-		pattern = ExpandUser(pattern)
-		files, err := doublestar.Glob(pattern)
-		if err != nil {
-			common.Log.Error("PatternsToPaths: Glob failed. pattern=%#q err=%v", pattern, err)
-			return pathList, err
-		}
-		common.Log.Debug("patternList[%d]=%q %d matches", i, pattern, len(files))
-		for _, filename := range files {
-			ok, err := RegularFile(filename)
-			if err != nil {
-				common.Log.Error("PatternsToPaths: RegularFile failed. pattern=%#q err=%v", pattern, err)
-				return pathList, err
-			}
-			if !ok {
-				continue
-			}
-			pathList = append(pathList, filename)
-		}
-	}
-	pathList = StringUniques(pathList)
-	sort.Strings(pathList)
-	return pathList, nil
-}
-
 // partShuffle shuffles part of `pathList` while maintanining some order by file size. The partial file
 // size ordering is to keep large PDFs away from the end of `pathList` so one worker thread doesn't
 // get a big slow file when the other work threads are done.
@@ -163,7 +133,7 @@ func NewFileFinder(pathList []string) FileFinder {
 // NewFileFinderFromCorpus returns a FileFinder for all files in our main corpus directory.
 func NewFileFinderFromCorpus() (FileFinder, error) {
 	patternList := []string{"~/testdata/**/*.pdf"}
-	pathList, err := PatternsToPaths(patternList)
+	pathList, err := utils.PatternsToPaths(patternList)
 	if err != nil {
 		return FileFinder{}, err
 	}
@@ -0,0 +1,71 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/papercutsoftware/pdfsearch"
+	"github.com/papercutsoftware/pdfsearch/examples/cmd_utils"
+)
+
+const usage = `Usage: go run fsck.go [OPTIONS]
+  Checks the consistency of the on-disk index.
+  With -repair, corrupt PDFs are removed from the index and re-indexed from their original paths,
+  and orphaned files are deleted.
+`
+
+func main() {
+	persistDir := filepath.Join(pdfsearch.DefaultPersistRoot, "my.computer")
+	repair := false
+	flag.StringVar(&persistDir, "s", persistDir, "The on-disk index is stored here.")
+	flag.BoolVar(&repair, "repair", repair, "Repair the problems that are found.")
+	cmd_utils.MakeUsage(usage)
+	flag.Parse()
+	pdfsearch.InitLogging()
+
+	ok, err := runCheck(persistDir, repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "runCheck failed. err=%v\n", err)
+		os.Exit(1)
+	}
+	if !ok {
+		os.Exit(2)
+	}
+}
+
+// runCheck checks the index in `persistDir` and shows the problems it finds. If `repair` is true
+// then the problems are repaired.
+// It returns true if there were no problems or they were all repaired.
+func runCheck(persistDir string, repair bool) (bool, error) {
+	var check pdfsearch.IndexCheck
+	var err error
+	if repair {
+		check, err = pdfsearch.RepairIndex(persistDir, report)
+	} else {
+		check, err = pdfsearch.CheckIndex(persistDir)
+	}
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("%s\n", check)
+	switch {
+	case check.OK():
+		fmt.Printf("%q is OK.\n", persistDir)
+	case !repair:
+	case check.Repaired():
+		fmt.Printf("%q has been repaired.\n", persistDir)
+		return true, nil
+	default:
+		fmt.Printf("%q could not be completely repaired.\n", persistDir)
+	}
+	return check.OK(), nil
+}
+
+// `report` is called by RepairIndex to report progress.
+func report(msg string) {
+	fmt.Fprintf(os.Stderr, ">> %s\n", msg)
+}
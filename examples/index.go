@@ -3,26 +3,40 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime/pprof"
 	"time"
 
 	"github.com/papercutsoftware/pdfsearch"
 	"github.com/papercutsoftware/pdfsearch/examples/cmd_utils"
+	"github.com/papercutsoftware/pdfsearch/internal/utils"
 )
 
 const usage = `Usage: go run index.go [OPTIONS] pcng-manual*.pdf
   Adds PDFs that match "pcng-manual*.pdf" to the index.
+  With -u, PDFs that are already in the index are skipped and the existing index is kept.
+  With -sync, the index is updated to match the PDFs that match "pcng-manual*.pdf". New PDFs are
+  added, deleted PDFs are removed, changed PDFs are re-indexed and moved PDFs are renamed.
 `
 
 func main() {
 	persistDir := filepath.Join(pdfsearch.DefaultPersistRoot, "my.computer")
 	doCPUProfile := false
+	incremental := false
+	doSync := false
+	root := ""
+	var interval time.Duration
 	flag.StringVar(&persistDir, "s", persistDir, "The on-disk index is stored here.")
 	flag.BoolVar(&doCPUProfile, "p", doCPUProfile, "Do Go CPU profiling.")
+	flag.BoolVar(&incremental, "u", incremental, "Update the existing index. Only add PDFs that aren't already indexed.")
+	flag.BoolVar(&doSync, "sync", doSync, "Synchronize the index with the PDFs that match the file patterns.")
+	flag.StringVar(&root, "root", root, "With -sync, relative file patterns are relative to this directory.")
+	flag.DurationVar(&interval, "watch", interval, "With -sync, repeat the synchronization at this interval.")
 	cmd_utils.MakeUsage(usage)
 	cmd_utils.MakeUsage(usage)
 	flag.Parse()
@@ -33,8 +47,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	if doSync {
+		if err := runSync(root, flag.Args(), persistDir, interval); err != nil {
+			fmt.Fprintf(os.Stderr, "runSync failed. err=%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Read the files to index into `pathList`.
-	pathList, err := cmd_utils.PatternsToPaths(flag.Args())
+	pathList, err := utils.PatternsToPaths(flag.Args())
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "PatternsToPaths failed. args=%#q err=%v\n", flag.Args(), err)
 		os.Exit(1)
@@ -65,7 +87,7 @@ func main() {
 	}
 
 	// Run the tests.
-	if err := runIndexShow(pathList, persistDir); err != nil {
+	if err := runIndexShow(pathList, persistDir, incremental); err != nil {
 		fmt.Fprintf(os.Stderr, "runIndexShow failed. err=%v\n", err)
 		os.Exit(1)
 	}
@@ -74,8 +96,9 @@ func main() {
 // runIndexShow creates a pdfsearch.PdfIndex for the PDFs in `pathList`, searches for `term` in this
 // index, and shows the results.
 //  `persistDir`: The directory the pdfsearch.PdfIndex is saved.
-func runIndexShow(pathList []string, persistDir string) error {
-	pdfIndex, dt, err := runIndex(pathList, persistDir)
+//  `incremental`: Add to the existing index in `persistDir` rather than replacing it.
+func runIndexShow(pathList []string, persistDir string, incremental bool) error {
+	pdfIndex, dt, err := runIndex(pathList, persistDir, incremental)
 	if err != nil {
 		return err
 	}
@@ -85,13 +108,18 @@ func runIndexShow(pathList []string, persistDir string) error {
 // runIndex creates a pdfsearch.PdfIndex for the PDFs in `pathList` and returns the
 // pdfsearch.PdfIndex, the search results and the indexing duration.
 // The pdfsearch.PdfIndex is saved in directory `persistDir`.
+// If `incremental` is true, PDFs that are already in the index in `persistDir` are skipped.
 // This is the main function. It shows you how to create or open an index.
-func runIndex(pathList []string, persistDir string) (pdfIndex pdfsearch.PdfIndex, dt time.Duration,
-	err error) {
+func runIndex(pathList []string, persistDir string, incremental bool) (pdfIndex pdfsearch.PdfIndex,
+	dt time.Duration, err error) {
 	fmt.Fprintf(os.Stderr, "Indexing %d files. Index stored in %q.\n", len(pathList), persistDir)
 
 	t0 := time.Now()
-	pdfIndex, err = pdfsearch.IndexPdfFiles(pathList, persistDir, report)
+	if incremental {
+		pdfIndex, err = pdfsearch.UpdatePdfIndex(pathList, persistDir, report)
+	} else {
+		pdfIndex, err = pdfsearch.IndexPdfFiles(pathList, persistDir, report)
+	}
 	if err != nil {
 		return pdfIndex, dt, err
 	}
@@ -99,6 +127,36 @@ func runIndex(pathList []string, persistDir string) (pdfIndex pdfsearch.PdfIndex
 	return pdfIndex, dt, nil
 }
 
+// runSync updates the index in `persistDir` to match the PDFs that match `patterns`. Relative
+// patterns are relative to directory `root`.
+// If `interval` is positive then the index is updated every `interval` until the program is
+// interrupted.
+// This shows you how to keep an index in step with a directory tree.
+func runSync(root string, patterns []string, persistDir string, interval time.Duration) error {
+	pdfIndex := pdfsearch.ReuseIndex(persistDir)
+	if interval <= 0 {
+		result, err := pdfIndex.Sync(root, patterns, report)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", result)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+	fmt.Fprintf(os.Stderr, "Synchronizing %q with %q every %s. Press Ctrl-C to stop.\n",
+		persistDir, patterns, interval)
+	pdfIndex.Watch(ctx, root, patterns, interval, report)
+	return nil
+}
+
 // showIndex writes a report on `pdfIndex` that was build from the PDFs in `pathList`.
 // `dt` is the duration of the indexing.
 func showIndex(pathList []string, pdfIndex pdfsearch.PdfIndex, dt time.Duration) error {
@@ -110,6 +168,8 @@ func showIndex(pathList []string, pdfIndex pdfsearch.PdfIndex, dt time.Duration)
 	}
 	fmt.Fprintf(os.Stderr, "%d pages from %d PDFs in %.1f secs (%.1f pages/sec)\n",
 		numPages, numFiles, dt.Seconds(), pagesSec)
+	fmt.Fprintf(os.Stderr, "%d PDFs added, %d skipped (already indexed), %d failed, %d empty\n",
+		numFiles, pdfIndex.NumSkipped(), pdfIndex.NumFailed(), pdfIndex.NumEmpty())
 	fmt.Fprintf(os.Stderr, "%s\n", pdfIndex)
 	return nil
 }
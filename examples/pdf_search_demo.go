@@ -12,16 +12,19 @@ import (
 
 	"github.com/papercutsoftware/pdfsearch"
 	"github.com/papercutsoftware/pdfsearch/examples/cmd_utils"
+	"github.com/papercutsoftware/pdfsearch/internal/utils"
 )
 
 const usage = `Usage: go run pdf_search_demo.go [OPTIONS] -f "pcng-manual*.pdf"  PaperCut NG
   Performs a full text search for "PaperCut NG" in PDFs that match "pcng-manual*.pdf".
+  With -mem, the PDFs are indexed in memory and nothing is written to disk.
 `
 
 func main() {
 	var pathPattern string
 	persistDir := filepath.Join(pdfsearch.DefaultPersistRoot, "pdf_search_demo")
 	var reuse bool
+	var inMemory bool
 	var nameOnly bool
 	maxSearchResults := 10
 	outPath := "search.results.pdf"
@@ -31,6 +34,7 @@ func main() {
 	flag.StringVar(&outPath, "o", outPath, "Name of PDF that will show marked up results.")
 	flag.StringVar(&persistDir, "s", persistDir, "The on-disk index is stored here.")
 	flag.BoolVar(&reuse, "r", reuse, "Reused stored index on disk for the last -p run.")
+	flag.BoolVar(&inMemory, "mem", inMemory, "Build an in-memory index. Nothing is written to disk.")
 	flag.BoolVar(&nameOnly, "l", nameOnly, "Show matching file names only.")
 	flag.IntVar(&maxSearchResults, "n", maxSearchResults, "Max number of search results to return.")
 
@@ -60,7 +64,7 @@ func main() {
 	var err error
 	var pathList []string
 	if !reuse {
-		pathList, err = cmd_utils.PatternsToPaths([]string{pathPattern})
+		pathList, err = utils.PatternsToPaths([]string{pathPattern})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "PatternsToPaths failed. args=%#q err=%v\n", flag.Args(), err)
 			os.Exit(1)
@@ -73,6 +77,9 @@ func main() {
 	pathList = cmd_utils.PartShuffle(pathList)
 
 	// Run the tests.
+	if inMemory {
+		persistDir = ""
+	}
 	if err := runIndexSearchShow(pathList, term, persistDir, reuse, nameOnly, maxResults, outPath); err != nil {
 		fmt.Fprintf(os.Stderr, "runIndexSearchShow failed. err=%v\n", err)
 		os.Exit(1)
@@ -89,7 +96,7 @@ func main() {
 // It also creates a marked-up PDF containing the original PDF pages with the matched terms marked
 //  and saves it to `outPath`.
 //
-//  `persistDir`: The directory the pdfsearch.PdfIndex is saved in.
+//  `persistDir`: The directory the pdfsearch.PdfIndex is saved in. "" for an in-memory index.
 //  `reuse`: Don't create a pdfsearch.PdfIndex. Reuse one that was previously persisted to disk.
 //  `nameOnly`: Show matching file names only.
 //  `maxResults`: Max number of search results to return.
@@ -107,7 +114,7 @@ func runIndexSearchShow(pathList []string, term, persistDir string, reuse, nameO
 //  durations.
 // This is the main function. It shows you how to create an index annd search it.
 //
-//  `persistDir`: The directory the pdfsearch.PdfIndex is saved.
+//  `persistDir`: The directory the pdfsearch.PdfIndex is saved. "" for an in-memory index.
 //  `reuse`: Don't create a pdfsearch.PdfIndex. Reuse one that was previously persisted to disk.
 //  `maxResults`: Max number of search results to return.
 func runIndexSearch(pathList []string, term, persistDir string, reuse bool, maxResults int) (
@@ -116,6 +123,11 @@ func runIndexSearch(pathList []string, term, persistDir string, reuse bool, maxR
 
 	if reuse {
 		pdfIndex = pdfsearch.ReuseIndex(persistDir)
+	} else if persistDir == "" {
+		pdfIndex, err = indexMemory(pathList)
+		if err != nil {
+			return pdfIndex, results, dt, dtIndex, err
+		}
 	} else {
 		pdfIndex, err = pdfsearch.IndexPdfFiles(pathList, persistDir, report)
 		if err != nil {
@@ -135,6 +147,29 @@ func runIndexSearch(pathList []string, term, persistDir string, reuse bool, maxR
 	return pdfIndex, results, dt, dtIndex, nil
 }
 
+// indexMemory returns an in-memory pdfsearch.PdfIndex for the PDFs in `pathList`.
+// This shows you how to index PDFs that you have as io.ReadSeekers rather than as files.
+// The files are left open because pdfsearch.MarkupPdfResults reads them.
+func indexMemory(pathList []string) (pdfsearch.PdfIndex, error) {
+	pdfIndex, err := pdfsearch.NewMemoryIndex()
+	if err != nil {
+		return pdfIndex, err
+	}
+	for i, inPath := range pathList {
+		f, err := os.Open(inPath)
+		if err != nil {
+			return pdfIndex, err
+		}
+		if err := pdfIndex.AddPdf(inPath, f); err != nil {
+			report(fmt.Sprintf("%3d of %d: Couldn't index %q. err=%v", i+1, len(pathList), inPath, err))
+			f.Close()
+			continue
+		}
+		report(fmt.Sprintf("%3d of %d: %q", i+1, len(pathList), inPath))
+	}
+	return pdfIndex, nil
+}
+
 // showResults writes a report on `results`, some search results (for a term that we don't show
 //  here) on `pdfIndex` that was build from the PDFs in `pathList`.
 // It also creates a marked-up PDF containing the original PDF pages with the matched terms marked
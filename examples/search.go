@@ -55,7 +55,7 @@ func main() {
 	}
 
 	// Run the tests.
-	if err := runSearchShow(term, persistDir, nameOnly, maxResults, outPath); err != nil {
+	if err := runSearchShow(term, persistDir, serialize, nameOnly, maxResults, outPath); err != nil {
 		fmt.Fprintf(os.Stderr, "runSearchShow failed. err=%v\n", err)
 		os.Exit(1)
 	}
@@ -70,10 +70,19 @@ func main() {
 // It also creates a marked-up PDF containing the original PDF pages with the matched terms marked
 //  and saves it to `outPath`.
 //
+//  `serialize`: Serialize the index to a byte array and search that.
 //  `nameOnly`: Show matching file names only.
 //  `maxResults`: Max number of search results to return.
-func runSearchShow(term, persistDir string, nameOnly bool, maxResults int, outPath string) error {
-	results, dt, err := runSearch(term, persistDir, maxResults)
+func runSearchShow(term, persistDir string, serialize, nameOnly bool, maxResults int,
+	outPath string) error {
+	var results pdfsearch.PdfMatchSet
+	var dt time.Duration
+	var err error
+	if serialize {
+		results, dt, err = runSearchSerialized(term, persistDir, maxResults)
+	} else {
+		results, dt, err = runSearch(term, persistDir, maxResults)
+	}
 	if err != nil {
 		return err
 	}
@@ -94,6 +103,29 @@ func runSearch(term, persistDir string, maxResults int) (
 	return results, dt, err
 }
 
+// runSearchSerialized serializes the PDF index stored in directory `persistDir` to a byte array,
+// searches the byte array for `term` and returns the search results and the search duration.
+// This shows you how to search an index that is stored as a flat memory buffer.
+//
+//  `maxResults`: Max number of search results to return.
+func runSearchSerialized(term, persistDir string, maxResults int) (
+	results pdfsearch.PdfMatchSet, dt time.Duration, err error) {
+	data, err := pdfsearch.ReuseIndex(persistDir).MarshalBinary()
+	if err != nil {
+		return results, dt, err
+	}
+	fmt.Fprintf(os.Stderr, "Serialized index: %d bytes\n", len(data))
+
+	t0 := time.Now()
+	pdfIndex, err := pdfsearch.LoadIndexFromBytes(data)
+	if err != nil {
+		return results, dt, err
+	}
+	results, err = pdfIndex.Search(term, maxResults)
+	dt = time.Since(t0)
+	return results, dt, err
+}
+
 // showResults writes a report on `results`, some search results (for a term that we don't show
 //  here) on `pdfIndex` that was build from the PDFs in `pathList`.
 // It also creates a marked-up PDF containing the original PDF pages with the matched terms marked
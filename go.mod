@@ -22,6 +22,7 @@ require (
 	github.com/steveyen/gtreap v0.0.0-20150807155958-0abe01ef9be2 // indirect
 	github.com/tecbot/gorocksdb v0.0.0-20190930194452-65a88f08537a // indirect
 	github.com/unidoc/unipdf/v3 v3.1.1
+	golang.org/x/text v0.3.2
 )
 
 replace github.com/unidoc/unipdf/v3 v3.1.1 => github.com/peterwilliams97/unipdf/v3 v3.1.10
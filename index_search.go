@@ -17,8 +17,11 @@
 package pdfsearch
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"image"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -28,6 +31,7 @@ import (
 	"github.com/papercutsoftware/pdfsearch/internal/doclib"
 	"github.com/papercutsoftware/pdfsearch/internal/utils"
 	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/model"
 )
 
 // InitLogging makes doclib.InitLogging public.
@@ -59,46 +63,746 @@ const (
 )
 
 // IndexPdfFiles returns an index for the PDFs in `pathList`.
-// The index is stored on disk in `persistDir`.
+// Files in `pathList` with the extensions of registered DocFormats, such as .txt, .html and .xps,
+// are indexed as documents in those formats. See RegisterFormat().
+// PDFs attached to the PDFs, including the files in PDF portfolios, are indexed as child documents
+// with paths like "outer.pdf!/schedule-a.pdf". Matches in them give the path of the PDF they are
+// attached to in PdfPageMatch.Parent.
+// ZIP archives in `pathList` are read in place. The PDFs in them are indexed as child documents of
+// the archives with paths like "batch.zip!/invoices/123.pdf".
+// The index is stored on disk in `persistDir`. Any existing index in `persistDir` is replaced.
 // `report` is a supplied function that is called to report progress.
 func IndexPdfFiles(pathList []string, persistDir string, report func(string)) (PdfIndex, error) {
-	t0 := time.Now()
-	_, bleveIdx, numFiles, numPages, dtPdf, dtBleve, err := doclib.IndexPdfFiles(pathList,
-		persistDir, true, report)
+	opts := IndexOptions{OnEvent: ReportEvents(report)}
+	return indexPdfFiles(context.Background(), pathList, persistDir, true, opts)
+}
+
+// IndexPdfFilesContext is IndexPdfFiles() with a context `ctx` that can cancel the indexing and
+// options `opts`.
+// If `ctx` is cancelled or its deadline passes, the PDFs that have already been indexed are saved
+// to `persistDir` and ctx.Err() is returned. Running UpdatePdfIndex() on the same `pathList`
+// later will index the remaining PDFs.
+// `opts`.FailurePolicy controls what happens when PDFs or pages can't be indexed. With
+// StopOnFailure, the first failure stops indexing in the same way as a cancellation.
+// `opts`.Limits limits the time and the sizes of PDFs that text is extracted from. A PDF that
+// exceeds a limit is abandoned and reported as failed while the other PDFs are indexed.
+// `opts`.Passwords supplies the passwords for encrypted PDFs. Encrypted PDFs that can't be
+// decrypted are reported as failed with ErrEncrypted.
+// `opts`.OCR recognizes the text on pages with no extractable text, such as scanned pages. If it
+// is nil, these pages are not indexed.
+// `opts`.Extractor extracts the text of the PDF pages. If it is nil, UniDocExtractor is used.
+// When indexing is stopped, the returned PdfIndex describes the PDFs indexed before it stopped.
+// `opts`.Analysis configures how the text is analyzed. It is saved with the new index. See
+// AnalysisConfig.
+// `opts`.OnEvent is a supplied function that is called with an IndexEvent for each step in
+// indexing each PDF and with a final IndexRunFinished event. The calls are made one at a time.
+// Use ReportEvents() to report progress with a `report func(string)`.
+func IndexPdfFilesContext(ctx context.Context, pathList []string, persistDir string,
+	opts IndexOptions) (PdfIndex, error) {
+	return indexPdfFiles(ctx, pathList, persistDir, true, opts)
+}
+
+// UpdatePdfIndex adds the PDFs in `pathList` to the on-disk index in `persistDir`, creating the
+// index if it doesn't exist.
+// PDFs are identified by the hash of their contents, so PDFs that are already in the index are
+// skipped without having their text extracted. NumSkipped(), NumFailed() and NumEmpty() on the
+// returned PdfIndex give the numbers of PDFs that were skipped, that could not be indexed and that
+// have no text.
+// `report` is a supplied function that is called to report progress.
+func UpdatePdfIndex(pathList []string, persistDir string, report func(string)) (PdfIndex, error) {
+	opts := IndexOptions{OnEvent: ReportEvents(report)}
+	return indexPdfFiles(context.Background(), pathList, persistDir, false, opts)
+}
+
+// UpdatePdfIndexContext is UpdatePdfIndex() with a context `ctx` that can cancel the indexing and
+// options `opts`. They work in the same way as in IndexPdfFilesContext(), except that an existing
+// index keeps the AnalysisConfig it was created with. `opts`.Analysis must be nil or the same.
+func UpdatePdfIndexContext(ctx context.Context, pathList []string, persistDir string,
+	opts IndexOptions) (PdfIndex, error) {
+	return indexPdfFiles(ctx, pathList, persistDir, false, opts)
+}
+
+// IndexOptions controls how IndexPdfFilesContext() and UpdatePdfIndexContext() index PDFs.
+// The zero value gives the same behavior as IndexPdfFiles() with no progress reporting.
+type IndexOptions struct {
+	FailurePolicy FailurePolicy     // What to do when a PDF or a page can't be indexed.
+	Limits        ExtractLimits     // Limits on the resources used to extract the text of each PDF.
+	Passwords     PasswordProvider  // Passwords for encrypted PDFs. May be nil.
+	OCR           OCREngine         // Recognizes the text on pages with no extractable text. May be nil.
+	Extractor     PageTextExtractor // Extracts the text of PDF pages. nil for UniDocExtractor.
+	OnEvent       func(IndexEvent)  // Called with progress events. May be nil.
+	Analysis      *AnalysisConfig   // How text is analyzed. nil for the index's AnalysisConfig.
+	// Where the files that link the bleve index to the PDFs are kept. nil for the index directory.
+	// The bleve index is always kept in the index directory on the local disk. Only these files are
+	// kept in Store.
+	Store IndexStore
+}
+
+// ExtractLimits makes doclib.ExtractLimits public.
+type ExtractLimits doclib.ExtractLimits
+
+// AnalysisConfig makes doclib.AnalysisConfig public.
+// It configures the stop words, stemming, synonyms and accent folding that page text and search
+// terms are analyzed with. It is saved with the index when the index is created and the same
+// analysis is used for searches.
+type AnalysisConfig doclib.AnalysisConfig
+
+// doclibOptions returns `opts` converted to doclib.IndexOptions.
+func (opts IndexOptions) doclibOptions() doclib.IndexOptions {
+	var onEvent func(doclib.IndexEvent)
+	if opts.OnEvent != nil {
+		onEvent = func(e doclib.IndexEvent) {
+			opts.OnEvent(IndexEvent(e))
+		}
+	}
+	var ocr doclib.OCREngine
+	if opts.OCR != nil {
+		ocr = ocrEngine{opts.OCR}
+	}
+	var extractor doclib.PageTextExtractor
+	if opts.Extractor != nil {
+		extractor = pageTextExtractor{opts.Extractor}
+	}
+	return doclib.IndexOptions{
+		FailurePolicy: doclib.FailurePolicy(opts.FailurePolicy),
+		Limits:        doclib.ExtractLimits(opts.Limits),
+		Passwords:     doclib.PasswordProvider(opts.Passwords),
+		Store:         doclib.IndexStore(opts.Store),
+		OCR:           ocr,
+		Extractor:     extractor,
+		OnEvent:       onEvent,
+		Analysis:      (*doclib.AnalysisConfig)(opts.Analysis),
+	}
+}
+
+// PasswordProvider makes doclib.PasswordProvider public.
+type PasswordProvider doclib.PasswordProvider
+
+// StaticPasswords makes doclib.StaticPasswords public.
+type StaticPasswords doclib.StaticPasswords
+
+// Passwords makes doclib.StaticPasswords.Passwords public.
+func (p StaticPasswords) Passwords(inPath string) []string {
+	return doclib.StaticPasswords(p).Passwords(inPath)
+}
+
+// PathPasswords makes doclib.PathPasswords public.
+type PathPasswords doclib.PathPasswords
+
+// Passwords makes doclib.PathPasswords.Passwords public.
+func (p PathPasswords) Passwords(inPath string) []string {
+	return doclib.PathPasswords(p).Passwords(inPath)
+}
+
+// PasswordFunc makes doclib.PasswordFunc public.
+type PasswordFunc doclib.PasswordFunc
+
+// Passwords makes doclib.PasswordFunc.Passwords public.
+func (f PasswordFunc) Passwords(inPath string) []string {
+	return doclib.PasswordFunc(f).Passwords(inPath)
+}
+
+// ErrEncrypted makes doclib.ErrEncrypted public.
+var ErrEncrypted = doclib.ErrEncrypted
+
+// OCREngine is the public version of doclib.OCREngine.
+// RecognizePage returns the words on `page` in reading order.
+type OCREngine interface {
+	RecognizePage(page OCRPage) ([]OCRWord, error)
+}
+
+// OCRPage makes doclib.OCRPage public.
+type OCRPage doclib.OCRPage
+
+// ImageToPage makes doclib.OCRPage.ImageToPage public.
+func (page OCRPage) ImageToPage(r image.Rectangle, size image.Point) model.PdfRectangle {
+	return doclib.OCRPage(page).ImageToPage(r, size)
+}
+
+// OCRWord makes doclib.OCRWord public.
+type OCRWord doclib.OCRWord
+
+// ocrEngine adapts an OCREngine to doclib.OCREngine.
+type ocrEngine struct {
+	engine OCREngine
+}
+
+// RecognizePage returns the words that e.engine recognizes on `page`.
+func (e ocrEngine) RecognizePage(page doclib.OCRPage) ([]doclib.OCRWord, error) {
+	words, err := e.engine.RecognizePage(OCRPage(page))
+	if err != nil {
+		return nil, err
+	}
+	docWords := make([]doclib.OCRWord, len(words))
+	for i, w := range words {
+		docWords[i] = doclib.OCRWord(w)
+	}
+	return docWords, nil
+}
+
+// PageTextExtractor is the public version of doclib.PageTextExtractor.
+// ExtractPageText returns the text of (1-offset) page `pageNum` of PDF `inPath`, whose contents
+// are read from `pdf`, and the locations of the fragments of the text on the page.
+type PageTextExtractor interface {
+	ExtractPageText(inPath string, pdf io.ReadSeeker, pageNum uint32) (string, []TextMark, error)
+}
+
+// TextMark makes doclib.TextMark public.
+type TextMark doclib.TextMark
+
+// UniDocExtractor makes doclib.UniDocExtractor public.
+type UniDocExtractor doclib.UniDocExtractor
+
+// ExtractPageText makes doclib.UniDocExtractor.ExtractPageText public.
+func (e UniDocExtractor) ExtractPageText(inPath string, pdf io.ReadSeeker, pageNum uint32) (
+	string, []TextMark, error) {
+	text, docMarks, err := doclib.UniDocExtractor(e).ExtractPageText(inPath, pdf, pageNum)
+	if err != nil {
+		return "", nil, err
+	}
+	marks := make([]TextMark, len(docMarks))
+	for i, m := range docMarks {
+		marks[i] = TextMark(m)
+	}
+	return text, marks, nil
+}
+
+// pageTextExtractor adapts a PageTextExtractor to doclib.PageTextExtractor.
+type pageTextExtractor struct {
+	extractor PageTextExtractor
+}
+
+// ExtractPageText returns the text and text locations that e.extractor extracts from page
+// `pageNum` of `pdf`.
+func (e pageTextExtractor) ExtractPageText(inPath string, pdf io.ReadSeeker, pageNum uint32) (
+	string, []doclib.TextMark, error) {
+	text, marks, err := e.extractor.ExtractPageText(inPath, pdf, pageNum)
 	if err != nil {
+		return "", nil, err
+	}
+	docMarks := make([]doclib.TextMark, len(marks))
+	for i, m := range marks {
+		docMarks[i] = doclib.TextMark(m)
+	}
+	return text, docMarks, nil
+}
+
+// FormatPDF is the PdfPageMatch.Format of matches in PDFs.
+const FormatPDF = doclib.FormatPDF
+
+// FormatXPS is the PdfPageMatch.Format of matches in XPS documents.
+const FormatXPS = doclib.FormatXPS
+
+// The sources of matched text in PdfPageMatch.Sources. Comments, sticky notes and other
+// annotations and the values of form fields are indexed with the text of the pages they are on.
+const (
+	SourcePageText   = doclib.SourcePageText
+	SourceAnnotation = doclib.SourceAnnotation
+	SourceFormField  = doclib.SourceFormField
+)
+
+// DocSource is the public version of doclib.DocSource.
+// ExtractDoc returns the pages of text in document `inPath`.
+type DocSource interface {
+	ExtractDoc(inPath string) ([]DocPage, error)
+}
+
+// DocPage is the public version of doclib.DocPage.
+type DocPage struct {
+	PageNum uint32     // 1-offset page number. Documents without pages have a single page 1.
+	Text    string     // Text of the page.
+	Marks   []TextMark // Locations of the text on the page for formats with page geometry.
+	Lines   []LineMark // Locations of the text in the source file for text formats.
+}
+
+// LineMark makes doclib.LineMark public.
+type LineMark doclib.LineMark
+
+// DocFormat is the public version of doclib.DocFormat.
+type DocFormat struct {
+	Name       string    // Name of the format. It is reported in PdfPageMatch.Format.
+	Extensions []string  // File name extensions of the format, e.g. ".txt". Case insensitive.
+	Source     DocSource // Extracts the text of documents in the format.
+	Lines      bool      // Pages have source line locations (DocPage.Lines) rather than Marks.
+}
+
+// RegisterFormat makes doclib.RegisterFormat public.
+// Files with the extensions of registered formats are indexed with the format's DocSource by
+// IndexPdfFiles() and the other indexing functions. The text, Markdown, HTML and XPS formats are
+// registered by default.
+func RegisterFormat(format DocFormat) error {
+	var source doclib.DocSource
+	if format.Source != nil {
+		source = docSource{format.Source}
+	}
+	return doclib.RegisterFormat(doclib.DocFormat{
+		Name:       format.Name,
+		Extensions: format.Extensions,
+		Source:     source,
+		Lines:      format.Lines,
+	})
+}
+
+// TextSource makes doclib.TextSource public.
+type TextSource doclib.TextSource
+
+// ExtractDoc makes doclib.TextSource.ExtractDoc public.
+func (s TextSource) ExtractDoc(inPath string) ([]DocPage, error) {
+	return publicDocPages(doclib.TextSource(s).ExtractDoc(inPath))
+}
+
+// HTMLSource makes doclib.HTMLSource public.
+type HTMLSource doclib.HTMLSource
+
+// ExtractDoc makes doclib.HTMLSource.ExtractDoc public.
+func (s HTMLSource) ExtractDoc(inPath string) ([]DocPage, error) {
+	return publicDocPages(doclib.HTMLSource(s).ExtractDoc(inPath))
+}
+
+// XPSSource makes doclib.XPSSource public.
+type XPSSource doclib.XPSSource
+
+// ExtractDoc makes doclib.XPSSource.ExtractDoc public.
+func (s XPSSource) ExtractDoc(inPath string) ([]DocPage, error) {
+	return publicDocPages(doclib.XPSSource(s).ExtractDoc(inPath))
+}
+
+// publicDocPages converts doclib.DocPages `docPages` to DocPages.
+func publicDocPages(docPages []doclib.DocPage, err error) ([]DocPage, error) {
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]DocPage, len(docPages))
+	for i, dp := range docPages {
+		page := DocPage{PageNum: dp.PageNum, Text: dp.Text}
+		for _, m := range dp.Marks {
+			page.Marks = append(page.Marks, TextMark(m))
+		}
+		for _, m := range dp.Lines {
+			page.Lines = append(page.Lines, LineMark(m))
+		}
+		pages[i] = page
+	}
+	return pages, nil
+}
+
+// docSource adapts a DocSource to doclib.DocSource.
+type docSource struct {
+	source DocSource
+}
+
+// ExtractDoc returns the pages that s.source extracts from `inPath`.
+func (s docSource) ExtractDoc(inPath string) ([]doclib.DocPage, error) {
+	pages, err := s.source.ExtractDoc(inPath)
+	if err != nil {
+		return nil, err
+	}
+	docPages := make([]doclib.DocPage, len(pages))
+	for i, page := range pages {
+		dp := doclib.DocPage{PageNum: page.PageNum, Text: page.Text}
+		for _, m := range page.Marks {
+			dp.Marks = append(dp.Marks, doclib.TextMark(m))
+		}
+		for _, m := range page.Lines {
+			dp.Lines = append(dp.Lines, doclib.LineMark(m))
+		}
+		docPages[i] = dp
+	}
+	return docPages, nil
+}
+
+// FailurePolicy makes doclib.FailurePolicy public.
+type FailurePolicy doclib.FailurePolicy
+
+// String makes doclib.FailurePolicy.String public.
+func (p FailurePolicy) String() string {
+	return doclib.FailurePolicy(p).String()
+}
+
+// The FailurePolicys. See doclib.FailurePolicy.
+const (
+	SkipFailedPages = FailurePolicy(doclib.SkipFailedPages)
+	SkipFailedFiles = FailurePolicy(doclib.SkipFailedFiles)
+	StopOnFailure   = FailurePolicy(doclib.StopOnFailure)
+)
+
+// IndexFailure makes doclib.IndexFailure public.
+type IndexFailure doclib.IndexFailure
+
+// String makes doclib.IndexFailure.String public.
+func (f IndexFailure) String() string {
+	return doclib.IndexFailure(f).String()
+}
+
+// IndexEvent makes doclib.IndexEvent public.
+type IndexEvent doclib.IndexEvent
+
+// String makes doclib.IndexEvent.String public.
+func (e IndexEvent) String() string {
+	return doclib.IndexEvent(e).String()
+}
+
+// The kinds of IndexEvent.
+const (
+	IndexFileStarted   = doclib.IndexFileStarted
+	IndexFileExtracted = doclib.IndexFileExtracted
+	IndexFileSkipped   = doclib.IndexFileSkipped
+	IndexFileIndexed   = doclib.IndexFileIndexed
+	IndexFileFailed    = doclib.IndexFileFailed
+	IndexFileEmpty     = doclib.IndexFileEmpty
+	IndexRunFinished   = doclib.IndexRunFinished
+)
+
+// ReportEvents returns an IndexEvent handler that calls `report` with the same progress lines as
+// IndexPdfFiles() and UpdatePdfIndex().
+func ReportEvents(report func(string)) func(IndexEvent) {
+	onEvent := doclib.ReportEvents(report)
+	if onEvent == nil {
+		return nil
+	}
+	return func(e IndexEvent) {
+		onEvent(doclib.IndexEvent(e))
+	}
+}
+
+// indexPdfFiles returns an index for the PDFs in `pathList` stored on disk in `persistDir`.
+// If `forceCreate` is true, any existing index in `persistDir` is replaced. Otherwise PDFs are
+// added to the existing index.
+func indexPdfFiles(ctx context.Context, pathList []string, persistDir string, forceCreate bool,
+	opts IndexOptions) (PdfIndex, error) {
+	t0 := time.Now()
+	_, bleveIdx, result, err := doclib.IndexPdfFilesContext(ctx, pathList, persistDir, forceCreate,
+		opts.doclibOptions())
+	if bleveIdx == nil {
 		return PdfIndex{}, err
 	}
-	if bleveIdx != nil {
-		bleveIdx.Close()
+	bleveIdx.Close()
+	var failures []IndexFailure
+	for _, f := range result.Failures {
+		failures = append(failures, IndexFailure(f))
 	}
 	dt := time.Since(t0)
 	return PdfIndex{
 		persistDir: persistDir,
-		numFiles:   numFiles,
-		numPages:   numPages,
+		store:      opts.Store,
+		numFiles:   result.NumAdded,
+		numPages:   result.NumPages,
+		numSkipped: result.NumSkipped,
+		numFailed:  result.NumFailed,
+		numEmpty:   result.NumEmpty,
 		dt:         dt,
-		dtPdf:      dtPdf,
-		dtBleve:    dtBleve,
+		dtPdf:      result.DtPdf,
+		dtBleve:    result.DtBleve,
+		failures:   failures,
+	}, err
+}
+
+// NewMemoryIndex returns an empty in-memory PdfIndex. PDFs are added to it with AddPdf().
+// Nothing is written to disk, so the index only lasts as long as the returned PdfIndex. This is
+// intended for short-lived indexes such as checking an incoming PDF for search terms.
+func NewMemoryIndex() (PdfIndex, error) {
+	blevePdf, bleveIdx, err := doclib.CreateMemIndex()
+	if err != nil {
+		return PdfIndex{}, err
+	}
+	return PdfIndex{
+		bleveIdx: bleveIdx,
+		blevePdf: blevePdf,
+	}, nil
+}
+
+// AddPdf adds the PDF with contents `rs` to in-memory PdfIndex `p` created by NewMemoryIndex().
+// `name` identifies the PDF in search results.
+// `rs` is read again by MarkupPdfResults() so it must remain readable while `p` is in use.
+// A PDF whose contents are already in `p` is skipped.
+func (p *PdfIndex) AddPdf(name string, rs io.ReadSeeker) error {
+	if !p.inMemory() {
+		return errors.New("AddPdf: not an in-memory index")
+	}
+	t0 := time.Now()
+	result, err := p.blevePdf.IndexPdfReader(p.bleveIdx, name, rs)
+	p.numFiles += result.NumAdded
+	p.numPages += result.NumPages
+	p.numSkipped += result.NumSkipped
+	p.numFailed += result.NumFailed
+	p.numEmpty += result.NumEmpty
+	for _, f := range result.Failures {
+		p.failures = append(p.failures, IndexFailure(f))
+	}
+	p.dt += time.Since(t0)
+	p.dtPdf += result.DtPdf
+	p.dtBleve += result.DtBleve
+	return err
+}
+
+// inMemory returns true if `p` was created by NewMemoryIndex() or LoadIndexFromBytes().
+func (p PdfIndex) inMemory() bool {
+	return p.persistDir == "" && p.bleveIdx != nil && p.blevePdf != nil
+}
+
+// MarshalBinary returns PdfIndex `p` serialized to a single byte slice that can be loaded with
+// LoadIndexFromBytes(). The slice contains the bleve index, the list of indexed PDFs and the page
+// texts and text positions of the PDFs.
+// Both in-memory and on-disk indexes can be serialized.
+func (p PdfIndex) MarshalBinary() ([]byte, error) {
+	if p.inMemory() {
+		return p.blevePdf.MarshalIndex(p.bleveIdx)
+	}
+	return doclib.MarshalPdfIndex(p.persistDir, p.store)
+}
+
+// LoadIndexFromBytes returns the PdfIndex serialized in `data` by PdfIndex.MarshalBinary().
+// The returned index is searched directly from `data` without unpacking it, so `data` must not be
+// modified while the index is in use.
+// The returned index is an in-memory index. PDFs can be added to it with AddPdf(). The PDFs that
+// were in the serialized index are read from their original paths by MarkupPdfResults().
+func LoadIndexFromBytes(data []byte) (PdfIndex, error) {
+	blevePdf, bleveIdx, err := doclib.LoadIndexFromBytes(data)
+	if err != nil {
+		return PdfIndex{}, err
+	}
+	return PdfIndex{
+		bleveIdx: bleveIdx,
+		blevePdf: blevePdf,
+		numFiles: blevePdf.Len(),
 	}, nil
 }
 
 // ReuseIndex returns an existing on-disk PdfIndex with directory `persistDir`.
 func ReuseIndex(persistDir string) PdfIndex {
+	return ReuseIndexStore(persistDir, nil)
+}
+
+// ReuseIndexStore returns an existing on-disk PdfIndex with directory `persistDir` whose files
+// that link the bleve index to the PDFs are kept in `store`. It is for indexes that were created
+// with IndexOptions.Store set to `store`. The bleve index is read from `persistDir` on the local
+// disk, not from `store`.
+func ReuseIndexStore(persistDir string, store IndexStore) PdfIndex {
 	return PdfIndex{
 		reused:     true,
 		persistDir: persistDir,
+		store:      store,
+	}
+}
+
+// RemoveFiles removes the PDFs with paths in `pathList` from PdfIndex `p`.
+// The pages of the PDFs are removed from the bleve index and their text positions are removed
+// from disk, or from memory for in-memory indexes. It returns the number of PDFs removed. Paths
+// that aren't in `p` are ignored.
+func (p PdfIndex) RemoveFiles(pathList []string) (int, error) {
+	if p.inMemory() {
+		return p.blevePdf.RemovePdfFiles(p.bleveIdx, pathList)
+	}
+	return doclib.RemovePdfFiles(p.persistDir, p.store, pathList)
+}
+
+// RemoveByHash removes the PDFs whose contents hashes are in `hashes` from PdfIndex `p`.
+// The hash of a PDF is given by FileHash(). It returns the number of PDFs removed.
+func (p PdfIndex) RemoveByHash(hashes []string) (int, error) {
+	if p.inMemory() {
+		return p.blevePdf.RemovePdfHashes(p.bleveIdx, hashes)
+	}
+	return doclib.RemovePdfHashes(p.persistDir, p.store, hashes)
+}
+
+// SyncResult makes doclib.SyncResult public.
+type SyncResult doclib.SyncResult
+
+// String makes doclib.SyncResult.String public.
+func (r SyncResult) String() string {
+	return doclib.SyncResult(r).String()
+}
+
+// Sync updates PdfIndex `p` so that it contains the PDFs that match the file patterns in
+// `patterns` and no others. Relative patterns are relative to directory `root`.
+// New PDFs are added, PDFs that no longer exist are removed, PDFs whose contents have changed are
+// re-indexed and PDFs that have been moved have their paths updated.
+// `report` is a supplied function that is called to report progress.
+func (p PdfIndex) Sync(root string, patterns []string, report func(string)) (SyncResult, error) {
+	return p.SyncContext(context.Background(), root, patterns, report)
+}
+
+// SyncContext is Sync() with a context `ctx` that can cancel the indexing of new and changed PDFs.
+// In-memory indexes can't be synced.
+func (p PdfIndex) SyncContext(ctx context.Context, root string, patterns []string,
+	report func(string)) (SyncResult, error) {
+	if p.inMemory() {
+		return SyncResult{}, errors.New("SyncContext: not an on-disk index")
+	}
+	var patternList []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(root, pattern)
+		}
+		patternList = append(patternList, pattern)
+	}
+	pathList, err := utils.PatternsToPaths(patternList)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	result, err := doclib.SyncPdfFilesContext(ctx, p.persistDir, pathList,
+		doclib.IndexOptions{OnEvent: doclib.ReportEvents(report), Store: p.store}, report)
+	return SyncResult(result), err
+}
+
+// Watch calls p.SyncContext(ctx, root, patterns, report) every `interval` until `ctx` is
+// cancelled. A failed sync is reported and doesn't stop the polling. In-memory indexes can't be
+// watched. Watch reports this and returns immediately.
+func (p PdfIndex) Watch(ctx context.Context, root string, patterns []string,
+	interval time.Duration, report func(string)) {
+	if p.inMemory() {
+		common.Log.Error("Watch: not an on-disk index. root=%q", root)
+		if report != nil {
+			report("watch failed: not an on-disk index")
+		}
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		result, err := p.SyncContext(ctx, root, patterns, report)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			common.Log.Error("Watch: Sync failed. root=%q patterns=%q err=%v", root, patterns, err)
+			if report != nil {
+				report(fmt.Sprintf("sync failed: %v", err))
+			}
+		} else if report != nil {
+			report(fmt.Sprintf("synced %s", result))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// FileHash returns the hash that identifies the contents of the file `inPath` in an index.
+func FileHash(inPath string) (string, error) {
+	return utils.FileHash(inPath)
+}
+
+// IndexCheck makes doclib.IndexCheck public.
+type IndexCheck doclib.IndexCheck
+
+// OK makes doclib.IndexCheck.OK public.
+func (c IndexCheck) OK() bool {
+	return doclib.IndexCheck(c).OK()
+}
+
+// Repaired makes doclib.IndexCheck.Repaired public.
+func (c IndexCheck) Repaired() bool {
+	return doclib.IndexCheck(c).Repaired()
+}
+
+// String makes doclib.IndexCheck.String public.
+func (c IndexCheck) String() string {
+	return doclib.IndexCheck(c).String()
+}
+
+// CheckIndex checks the consistency of the on-disk index in `persistDir` and returns a
+// description of the problems it found. The index is not modified.
+func CheckIndex(persistDir string) (IndexCheck, error) {
+	return ReuseIndex(persistDir).Check()
+}
+
+// Check is CheckIndex() for PdfIndex `p`, which may keep its files in an IndexStore.
+// In-memory indexes can't be checked.
+func (p PdfIndex) Check() (IndexCheck, error) {
+	if p.inMemory() {
+		return IndexCheck{}, errors.New("Check: not an on-disk index")
+	}
+	check, err := doclib.CheckIndex(p.persistDir, p.store)
+	return IndexCheck(check), err
+}
+
+// RepairIndex fixes the problems that CheckIndex() finds in the on-disk index in `persistDir`.
+// Corrupt PDFs are removed from the index and re-indexed from their original paths.
+// `report` is a supplied function that is called to report progress.
+// It returns the result of checking the index before it was repaired. Its Repaired() method
+// tells if the repair fixed all the problems without losing PDFs from the index.
+func RepairIndex(persistDir string, report func(string)) (IndexCheck, error) {
+	return ReuseIndex(persistDir).Repair(report)
+}
+
+// Repair is RepairIndex() for PdfIndex `p`, which may keep its files in an IndexStore.
+// In-memory indexes can't be repaired.
+func (p PdfIndex) Repair(report func(string)) (IndexCheck, error) {
+	if p.inMemory() {
+		return IndexCheck{}, errors.New("Repair: not an on-disk index")
 	}
+	check, err := doclib.RepairIndexContext(context.Background(), p.persistDir,
+		doclib.IndexOptions{OnEvent: doclib.ReportEvents(report), Store: p.store}, report)
+	return IndexCheck(check), err
+}
+
+// IndexStore makes doclib.IndexStore public.
+type IndexStore doclib.IndexStore
+
+// ObjectClient makes doclib.ObjectClient public.
+type ObjectClient doclib.ObjectClient
+
+// ErrObjectNotFound makes doclib.ErrObjectNotFound public.
+var ErrObjectNotFound = doclib.ErrObjectNotFound
+
+// NewDirStore returns an IndexStore that keeps its files in the directory tree under `root`.
+// This is the default IndexStore.
+func NewDirStore(root string) IndexStore {
+	return doclib.NewDirStore(root)
+}
+
+// NewMemStore returns an IndexStore that keeps its files in memory. The bleve index of an index
+// that uses it is still kept on the local disk. Use NewMemoryIndex() for an index that is entirely
+// in memory.
+func NewMemStore() IndexStore {
+	return doclib.NewMemStore()
+}
+
+// NewObjectStore returns an IndexStore that keeps its files in object store `client` under key
+// prefix `prefix`. The bleve index of an index that uses it is still kept on the local disk. Use
+// PdfIndex.MarshalBinary() to keep a whole index in an object store.
+func NewObjectStore(client ObjectClient, prefix string) IndexStore {
+	return doclib.NewObjectStore(client, prefix)
 }
 
 // Search does a full-text search over PdfIndex `p` for `term` and returns up to `maxResults` matches.
 // This is the main search function.
+// `term` may contain `field:value` qualifiers that filter the matches by the metadata of the PDFs,
+// e.g. `budget author:jane created:2017`. The fields are title, author, subject, keywords,
+// producer, created and modified. Values with spaces are quoted, e.g. author:"Jane Smith". A
+// qualifier with no value, e.g. `title:`, is searched for as text. The date fields take a year,
+// year-month or date with an optional <, <=, > or >= prefix, e.g. created:>=2017-06. A `term`
+// with only qualifiers returns the first page of each matching PDF.
+// The language of each page is detected when it is indexed and `term` is matched with the stemming
+// and stop words of that language. The languages are English (en), German (de), French (fr),
+// Spanish (es), Italian (it), Portuguese (pt), Chinese (zh), Japanese (ja) and Korean (ko). Chinese
+// and Japanese text is matched by pairs of characters, so words are found without spaces between
+// them. The lang qualifier filters the matches to pages in one language, e.g. `vertrag lang:de`.
+// Matches on pages that PDF bookmarks point to with titles containing `term` rank higher. The
+// titles of the bookmarks enclosing each match are returned in its Section.
 func (p PdfIndex) Search(term string, maxResults int) (PdfMatchSet, error) {
+	return p.SearchContext(context.Background(), term, maxResults)
+}
+
+// SearchContext is Search() with a context `ctx` that is passed through to the bleve search.
+// If `ctx` is cancelled or its deadline passes, ctx.Err() is returned.
+func (p PdfIndex) SearchContext(ctx context.Context, term string, maxResults int) (
+	PdfMatchSet, error) {
 	if maxResults < 0 {
 		maxResults = DefaultMaxResults
 	}
 	common.Log.Debug("maxResults=%d DefaultMaxResults=%d", maxResults, DefaultMaxResults)
 
-	s, err := doclib.SearchPdfIndex(p.persistDir, term, maxResults)
+	var s doclib.PdfMatchSet
+	var err error
+	if p.inMemory() {
+		s, err = p.blevePdf.SearchBleveIndexContext(ctx, p.bleveIdx, term, maxResults)
+	} else {
+		s, err = doclib.SearchPdfIndexContext(ctx, p.persistDir, p.store, term, maxResults)
+	}
 	if err != nil {
 		return PdfMatchSet{}, err
 	}
@@ -116,12 +820,30 @@ func (p PdfIndex) Search(term string, maxResults int) (PdfMatchSet, error) {
 
 // MarkupPdfResults adds rectangles to the text positions of all matches on their PDF pages,
 // combines these pages together and writes the resulting PDF to `outPath`.
+// PDFs from in-memory indexes are read from the io.ReadSeekers they were added with. PDFs attached
+// to other PDFs are read from the PDFs they are attached to and PDFs in ZIP archives are read from
+// the archives.
+// Matches in documents that are not PDFs are skipped.
 // The PDF will have at most 100 pages because no-one is likely to read through search results of
 // over more than 100 pages. There will at most 100 results per page.
+// Encrypted PDFs can't be opened. Use MarkupPdfResultsOptions() to supply their passwords.
 func MarkupPdfResults(results PdfMatchSet, outPath string) error {
+	return MarkupPdfResultsOptions(results, outPath, MarkupOptions{})
+}
+
+// MarkupOptions controls how MarkupPdfResultsOptions() reads the PDFs it marks up.
+type MarkupOptions struct {
+	Passwords PasswordProvider // Passwords for encrypted PDFs. May be nil.
+}
+
+// MarkupPdfResultsOptions is MarkupPdfResults() with options `opts`. Encrypted PDFs, and encrypted
+// PDFs that other PDFs are attached to, are opened with the passwords in `opts`.Passwords. These
+// are normally the passwords the PDFs were indexed with.
+func MarkupPdfResultsOptions(results PdfMatchSet, outPath string, opts MarkupOptions) error {
 	maxPages := 100
 	maxPerPage := 100
 	extractList := doclib.CreateExtractList(maxPages, maxPerPage)
+	extractList.SetPasswords(doclib.PasswordProvider(opts.Passwords))
 	common.Log.Debug("=================!!!=====================")
 	common.Log.Debug("Matches=%d", len(results.Matches))
 	for i, m := range results.Matches {
@@ -129,9 +851,16 @@ func MarkupPdfResults(results PdfMatchSet, outPath string) error {
 		pageNum := m.PageNum
 		ppos := m.PagePositions
 		common.Log.Debug("  %d: ppos=%s m=%s", i, ppos, m)
+		if m.Format != FormatPDF {
+			common.Log.Info("Skipping %s match in %q. Only PDFs can be marked up.", m.Format, inPath)
+			continue
+		}
 		if ppos.Empty() {
 			return errors.New("no Locations")
 		}
+		if rs := m.Reader(); rs != nil {
+			extractList.AddReader(inPath, rs)
+		}
 		for _, span := range m.Spans {
 			bbox, ok := ppos.BBox(span.Start, span.End)
 			if !ok {
@@ -151,10 +880,15 @@ func MarkupPdfResults(results PdfMatchSet, outPath string) error {
 // - controls and statistics.
 type PdfIndex struct {
 	persistDir string           // Root directory for storing on-disk indexes.
+	store      IndexStore       // Where the on-disk index's PDF files are kept. nil for persistDir.
 	bleveIdx   bleve.Index      // The bleve index used on text extracted from PDFs.
 	blevePdf   *doclib.BlevePdf // Mapping between the PDFs and the bleve index.
 	numFiles   int              // Number of PDFs indexes.
 	numPages   int              // Total number of PDF pages indexed.
+	numSkipped int              // Number of PDFs skipped because they were already indexed.
+	numFailed  int              // Number of PDFs that could not be indexed.
+	numEmpty   int              // Number of PDFs that were not indexed because they have no text.
+	failures   []IndexFailure   // The PDFs and pages that could not be indexed.
 	dt         time.Duration    // Total indexing time.
 	dtPdf      time.Duration    // The time it took to extract text from PDFs.
 	dtBleve    time.Duration    // The time it tool to build the bleve index.
@@ -168,8 +902,8 @@ func (p PdfIndex) String() string {
 	if p.blevePdf != nil {
 		b = fmt.Sprintf(" blevePdf=%s", p.blevePdf.String())
 	}
-	return fmt.Sprintf("PdfIndex{numFiles=%d numPages=%d Duration=%s%s}",
-		p.numFiles, p.numPages, d, b)
+	return fmt.Sprintf("PdfIndex{numFiles=%d numPages=%d numSkipped=%d numFailed=%d numEmpty=%d "+
+		"Duration=%s%s}", p.numFiles, p.numPages, p.numSkipped, p.numFailed, p.numEmpty, d, b)
 }
 
 // Duration returns a string describing how long indexing took and where the time was spent.
@@ -187,6 +921,30 @@ func (p PdfIndex) NumPages() int {
 	return p.numPages
 }
 
+// NumSkipped returns the number of PDFs that were skipped when building `p` because their contents
+// were already indexed.
+func (p PdfIndex) NumSkipped() int {
+	return p.numSkipped
+}
+
+// NumFailed returns the number of PDFs that could not be indexed when building `p`.
+func (p PdfIndex) NumFailed() int {
+	return p.numFailed
+}
+
+// NumEmpty returns the number of PDFs that were not indexed when building `p` because they have
+// no text. They are not counted as failures.
+func (p PdfIndex) NumEmpty() int {
+	return p.numEmpty
+}
+
+// Failures returns the PDFs and pages that could not be indexed when building `p`, with their
+// errors. PDFs that failed have PageNum 0. Pages that failed are from PDFs that were indexed
+// without them under the SkipFailedPages policy.
+func (p PdfIndex) Failures() []IndexFailure {
+	return p.failures
+}
+
 // ExposeErrors turns off recovery from panics in called libraries.
 func ExposeErrors() {
 	doclib.ExposeErrors = true
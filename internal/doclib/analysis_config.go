@@ -0,0 +1,438 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements AnalysisConfig, which configures how page text and search terms are
+ * broken into the terms that are indexed and searched for.
+ *  - By default the text of each language is analyzed with the bleve analyzer for the language.
+ *    See lang_detect.go.
+ *  - An AnalysisConfig replaces these with custom bleve analyzers that run the same token filters
+ *    with other stop words, without stemming, with synonyms or with accent folding.
+ *  - The custom analyzers are defined in the bleve index mapping, which bleve saves with the index.
+ *    Search terms are analyzed with the analyzers in the mapping of the index being searched, so
+ *    they are analyzed in the same way as the page text was. See SearchBleveIndexContext().
+ *  - The AnalysisConfig of an on-disk index is saved in its IndexStore when the index is created.
+ *    Later updates of the index use the saved AnalysisConfig.
+ */
+
+package doclib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve/analysis"
+	"github.com/blevesearch/bleve/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/analysis/token/stop"
+	unicodetokenizer "github.com/blevesearch/bleve/analysis/tokenizer/unicode"
+	"github.com/blevesearch/bleve/analysis/tokenmap"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/registry"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// synonymFilterType is the name the synonym token filter type is registered with in bleve.
+	synonymFilterType = "pdfsearch.synonyms"
+	// foldFilterName is the name the accent folding token filter is registered with in bleve.
+	foldFilterName = "pdfsearch.fold"
+	// customPrefix starts the names of the custom analyzers, token filters and token maps that an
+	// AnalysisConfig adds to an index mapping.
+	customPrefix = "pdfsearch_"
+)
+
+func init() {
+	registry.RegisterTokenFilter(synonymFilterType, newSynonymFilter)
+	registry.RegisterTokenFilter(foldFilterName, func(config map[string]interface{},
+		cache *registry.Cache) (analysis.TokenFilter, error) {
+		return foldFilter{}, nil
+	})
+}
+
+// AnalysisConfig configures how page text and search terms are analyzed. The zero value analyzes
+// the text of each language with the bleve analyzer for the language.
+type AnalysisConfig struct {
+	// StopWords replaces the stop words of the languages with these codes, e.g. "en". A language
+	// with an empty list has no stop words. {language code: stop words}
+	StopWords map[string][]string `json:",omitempty"`
+	// KeepWords are removed from the stop words of all languages so that they can be searched for,
+	// e.g. "shall".
+	KeepWords []string `json:",omitempty"`
+	// NoStemming turns off stemming so that words only match themselves, e.g. part numbers.
+	NoStemming bool `json:",omitempty"`
+	// SynonymFile is the path of a file of synonyms. Each line is a comma-separated group of words
+	// that match each other, e.g.
+	//    car, automobile, auto
+	// Blank lines and lines starting with # are ignored. The file is read when the index is
+	// created and its groups are saved in Synonyms.
+	SynonymFile string `json:",omitempty"`
+	// Synonyms are groups of words that match each other.
+	Synonyms [][]string `json:",omitempty"`
+	// FoldAccents removes accents and other diacritics so that e.g. "café" matches "cafe".
+	FoldAccents bool `json:",omitempty"`
+}
+
+// String returns a string describing `config`.
+func (config AnalysisConfig) String() string {
+	b, _ := json.Marshal(config)
+	return string(b)
+}
+
+// isDefault returns true if `config` analyzes text in the same way as the zero AnalysisConfig.
+func (config AnalysisConfig) isDefault() bool {
+	return len(config.StopWords) == 0 && len(config.KeepWords) == 0 && !config.NoStemming &&
+		len(config.Synonyms) == 0 && !config.FoldAccents
+}
+
+// equal returns true if `config` and `other` are the same.
+func (config AnalysisConfig) equal(other AnalysisConfig) bool {
+	return config.String() == other.String()
+}
+
+// resolve returns `config` with its words lower-cased and the synonyms in config.SynonymFile added
+// to its Synonyms. It returns an error if `config` refers to unknown languages or has synonyms that
+// aren't single words.
+func (config AnalysisConfig) resolve() (AnalysisConfig, error) {
+	resolved := AnalysisConfig{
+		KeepWords:   lowerWords(config.KeepWords),
+		NoStemming:  config.NoStemming,
+		SynonymFile: config.SynonymFile,
+		FoldAccents: config.FoldAccents,
+	}
+	if len(config.StopWords) > 0 {
+		resolved.StopWords = map[string][]string{}
+		for code, words := range config.StopWords {
+			l := languageCode(code)
+			if l == nil {
+				return config, fmt.Errorf("stop words for unknown language %q. Languages are %s",
+					code, languageCodes())
+			}
+			resolved.StopWords[l.code] = lowerWords(words)
+		}
+	}
+	groups := config.Synonyms
+	if config.SynonymFile != "" {
+		fileGroups, err := readSynonymFile(config.SynonymFile)
+		if err != nil {
+			return config, fmt.Errorf("Could not read synonym file %q. err=%v",
+				config.SynonymFile, err)
+		}
+		groups = append(groups[:len(groups):len(groups)], fileGroups...)
+	}
+	for _, group := range groups {
+		group = lowerWords(group)
+		for _, word := range group {
+			if len(strings.Fields(word)) != 1 {
+				return config, fmt.Errorf("synonym %q is not a single word", word)
+			}
+		}
+		if len(group) > 1 {
+			resolved.Synonyms = append(resolved.Synonyms, group)
+		}
+	}
+	return resolved, nil
+}
+
+// lowerWords returns `words` lower-cased and trimmed of white space. Empty words are dropped.
+func lowerWords(words []string) []string {
+	lower := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+			lower = append(lower, w)
+		}
+	}
+	return lower
+}
+
+// readSynonymFile returns the groups of synonyms in the synonym file `filename`. See
+// AnalysisConfig.SynonymFile for the format.
+func readSynonymFile(filename string) ([][]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var groups [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		groups = append(groups, strings.Split(line, ","))
+	}
+	return groups, scanner.Err()
+}
+
+// loadAnalysisConfig loads the AnalysisConfig saved in json file `name` in `store`. Indexes that
+// were created before AnalysisConfigs were saved have the zero AnalysisConfig.
+func loadAnalysisConfig(store IndexStore, name string) (AnalysisConfig, error) {
+	var config AnalysisConfig
+	b, err := store.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return config, err
+	}
+	err = json.Unmarshal(b, &config)
+	return config, err
+}
+
+// saveAnalysisConfig saves `config` to json file `name` in `store`.
+func saveAnalysisConfig(store IndexStore, name string, config AnalysisConfig) error {
+	b, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+	return store.WriteFile(name, b)
+}
+
+// setAnalysis sets the AnalysisConfig that the text in `blevePdf` is analyzed with.
+// `requested` is the AnalysisConfig the caller asked for. If it is nil, a new index gets the zero
+// AnalysisConfig and an existing index keeps the one it was created with.
+// `create` is true if a new index is being created. Its AnalysisConfig is saved in blevePdf.store.
+// An existing index can't be changed to another AnalysisConfig as its text was analyzed with the one
+// it was created with, so an error is returned if `requested` differs from that.
+func (blevePdf *BlevePdf) setAnalysis(requested *AnalysisConfig, create bool) error {
+	config := blevePdf.analysis
+	if requested != nil {
+		var err error
+		if config, err = requested.resolve(); err != nil {
+			return err
+		}
+	}
+	if !create {
+		if !config.equal(blevePdf.analysis) {
+			return fmt.Errorf("index %q was created with a different AnalysisConfig. Create it "+
+				"again to change it. index=%s requested=%s", blevePdf.root, blevePdf.analysis, config)
+		}
+		return nil
+	}
+	if requested == nil {
+		config = AnalysisConfig{}
+	}
+	blevePdf.analysis = config
+	if blevePdf.inMemory() {
+		return nil
+	}
+	return saveAnalysisConfig(blevePdf.store, blevePdf.analysisPath(), config)
+}
+
+// addAnalyzers adds the analyzers that analyze text as configured by `config` to index mapping
+// `indexMapping`. It returns the names of the analyzers. {language code: analyzer name}
+// The zero AnalysisConfig uses the bleve analyzers of the languages so no analyzers are added.
+func (config AnalysisConfig) addAnalyzers(indexMapping *mapping.IndexMappingImpl) (
+	map[string]string, error) {
+	analyzers := map[string]string{}
+	if config.isDefault() {
+		for _, l := range languages {
+			analyzers[l.code] = l.analyzer
+		}
+		return analyzers, nil
+	}
+
+	synonymFilter := ""
+	if len(config.Synonyms) > 0 {
+		groups := make([]interface{}, len(config.Synonyms))
+		for i, group := range config.Synonyms {
+			groups[i] = strings.Join(group, ",")
+		}
+		synonymFilter = customPrefix + "synonyms"
+		err := indexMapping.AddCustomTokenFilter(synonymFilter, map[string]interface{}{
+			"type":     synonymFilterType,
+			"synonyms": groups,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cache := registry.NewCache()
+	for _, l := range languages {
+		filters := append([]string{}, l.prepare...)
+		stopFilter, err := config.addStopFilter(indexMapping, cache, l)
+		if err != nil {
+			return nil, err
+		}
+		if stopFilter != "" {
+			filters = append(filters, stopFilter)
+		}
+		if synonymFilter != "" {
+			filters = append(filters, synonymFilter)
+		}
+		if config.FoldAccents {
+			filters = append(filters, foldFilterName)
+		}
+		if !config.NoStemming {
+			filters = append(filters, l.stem...)
+		}
+		name := customPrefix + l.code
+		err = indexMapping.AddCustomAnalyzer(name, map[string]interface{}{
+			"type":          custom.Name,
+			"tokenizer":     unicodetokenizer.Name,
+			"token_filters": filters,
+		})
+		if err != nil {
+			return nil, err
+		}
+		analyzers[l.code] = name
+	}
+	return analyzers, nil
+}
+
+// addStopFilter adds the stop token filter for language `l` that is configured by `config` to index
+// mapping `indexMapping`. `cache` holds the bleve stop word lists.
+// It returns the name of the filter, or "" if `l` has no stop words.
+func (config AnalysisConfig) addStopFilter(indexMapping *mapping.IndexMappingImpl,
+	cache *registry.Cache, l *language) (string, error) {
+	words, replaced := config.StopWords[l.code]
+	if !replaced {
+		if l.stop == "" {
+			return "", nil
+		}
+		if len(config.KeepWords) == 0 {
+			return l.stop, nil
+		}
+		tokenMap, err := cache.TokenMapNamed(l.stop)
+		if err != nil {
+			return "", err
+		}
+		for w := range tokenMap {
+			words = append(words, w)
+		}
+	}
+	keep := map[string]bool{}
+	for _, w := range config.KeepWords {
+		keep[w] = true
+	}
+	var tokens []interface{}
+	for _, w := range words {
+		if !keep[w] {
+			tokens = append(tokens, w)
+		}
+	}
+	if len(tokens) == 0 {
+		return "", nil
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].(string) < tokens[j].(string) })
+
+	name := customPrefix + "stop_" + l.code
+	err := indexMapping.AddCustomTokenMap(name, map[string]interface{}{
+		"type":   tokenmap.Name,
+		"tokens": tokens,
+	})
+	if err != nil {
+		return "", err
+	}
+	err = indexMapping.AddCustomTokenFilter(name, map[string]interface{}{
+		"type":           stop.Name,
+		"stop_token_map": name,
+	})
+	return name, err
+}
+
+// synonymFilter is a bleve token filter that adds the synonyms of each token after the token. The
+// synonyms have the same position and byte offsets as the token, so they match the token's text in
+// the same way as the token does. {word: synonyms of word}
+type synonymFilter map[string][]string
+
+// newSynonymFilter returns a synonymFilter for the groups of synonyms in config["synonyms"]. Each
+// group is a string of comma-separated words.
+func newSynonymFilter(config map[string]interface{}, cache *registry.Cache) (
+	analysis.TokenFilter, error) {
+	var groups []string
+	switch v := config["synonyms"].(type) {
+	case []string:
+		groups = v
+	case []interface{}:
+		for _, g := range v {
+			group, ok := g.(string)
+			if !ok {
+				return nil, fmt.Errorf("synonym group %v is not a string", g)
+			}
+			groups = append(groups, group)
+		}
+	default:
+		return nil, fmt.Errorf("must specify synonyms")
+	}
+	f := synonymFilter{}
+	for _, group := range groups {
+		words := strings.Split(group, ",")
+		for _, w := range words {
+			for _, syn := range words {
+				if syn != w && !f.has(w, syn) {
+					f[w] = append(f[w], syn)
+				}
+			}
+		}
+	}
+	return f, nil
+}
+
+// has returns true if `syn` is a synonym of `word` in `f`.
+func (f synonymFilter) has(word, syn string) bool {
+	for _, s := range f[word] {
+		if s == syn {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns `input` with the synonyms of each token added after the token.
+func (f synonymFilter) Filter(input analysis.TokenStream) analysis.TokenStream {
+	output := make(analysis.TokenStream, 0, len(input))
+	for _, tok := range input {
+		output = append(output, tok)
+		for _, syn := range f[string(tok.Term)] {
+			output = append(output, &analysis.Token{
+				Term:     []byte(syn),
+				Start:    tok.Start,
+				End:      tok.End,
+				Position: tok.Position,
+				Type:     tok.Type,
+			})
+		}
+	}
+	return output
+}
+
+// foldFilter is a bleve token filter that removes accents and other diacritics from tokens.
+type foldFilter struct{}
+
+// Filter returns `input` with the accents removed from its tokens.
+func (foldFilter) Filter(input analysis.TokenStream) analysis.TokenStream {
+	for _, tok := range input {
+		tok.Term = foldAccents(tok.Term)
+	}
+	return input
+}
+
+// foldAccents returns `term` with its accents removed. The characters in `term` are decomposed into
+// base characters and combining marks and the marks are dropped, so "é" becomes "e".
+func foldAccents(term []byte) []byte {
+	ascii := true
+	for _, b := range term {
+		if b >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return term
+	}
+	var folded bytes.Buffer
+	for _, r := range string(norm.NFD.Bytes(term)) {
+		if !unicode.Is(unicode.Mn, r) {
+			folded.WriteRune(r)
+		}
+	}
+	return norm.NFC.Bytes(folded.Bytes())
+}
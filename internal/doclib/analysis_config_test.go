@@ -0,0 +1,160 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+// TestAnalysisConfig checks that the stop words, stemming, synonyms and accent folding of an
+// AnalysisConfig are used when the index is created and searched, that the AnalysisConfig is saved
+// with the index and that matches are located in the page text.
+func TestAnalysisConfig(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "orders.pdf")
+	if err := ioutil.WriteFile(inPath, makeAttachmentsPdf(t, 2, nil), 0644); err != nil {
+		t.Fatalf("WriteFile failed. err=%v", err)
+	}
+	synonymPath := filepath.Join(dir, "synonyms.txt")
+	synonyms := "# Purchasing terms\n\nsupplier, vendor\n"
+	if err := ioutil.WriteFile(synonymPath, []byte(synonyms), 0644); err != nil {
+		t.Fatalf("WriteFile failed. err=%v", err)
+	}
+	extractor := fakePageExtractor{
+		1: "The supplier should deliver the brackets to the café",
+		2: "The vendor will ship the connectors to the cafe",
+	}
+	config := AnalysisConfig{
+		KeepWords:   []string{"Should"},
+		NoStemming:  true,
+		SynonymFile: synonymPath,
+		FoldAccents: true,
+	}
+
+	// The default analysis for comparison.
+	defaultPdf, defaultIndex, _, err := IndexPdfFilesContext(context.Background(),
+		[]string{inPath}, "", true, IndexOptions{Extractor: extractor})
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	defer defaultIndex.Close()
+
+	persistDir := filepath.Join(dir, "store")
+	blevePdf, index, _, err := IndexPdfFilesContext(context.Background(), []string{inPath},
+		persistDir, true, IndexOptions{Extractor: extractor, Analysis: &config})
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+
+	type analysisTest struct {
+		term        string
+		pageNums    []uint32 // Pages that match with `config`.
+		defaultNums []uint32 // Pages that match with the default analysis.
+		matched     string   // Text of the match on the first page in `pageNums`.
+	}
+	tests := []analysisTest{
+		{"should", []uint32{1}, nil, "should"},
+		{"connector", nil, []uint32{2}, ""},
+		{"connectors", []uint32{2}, []uint32{2}, "connectors"},
+		{"supplier", []uint32{1, 2}, []uint32{1}, "supplier"},
+		{"vendor", []uint32{1, 2}, []uint32{2}, "supplier"},
+		{"cafe", []uint32{1, 2}, []uint32{2}, "café"},
+		{"ship the connectors", []uint32{2}, []uint32{2}, "ship\nthe\nconnectors"},
+	}
+	check := func(blevePdf *BlevePdf, index bleve.Index, name string) {
+		for _, test := range tests {
+			checkAnalysisSearch(t, blevePdf, index, name, test.term, test.pageNums, test.matched)
+		}
+	}
+	check(blevePdf, index, "created")
+	for _, test := range tests {
+		checkAnalysisSearch(t, defaultPdf, defaultIndex, "default", test.term, test.defaultNums, "")
+	}
+	index.Close()
+
+	// The saved AnalysisConfig is used when the index is updated without one.
+	blevePdf, index, _, err = IndexPdfFilesContext(context.Background(), []string{inPath},
+		persistDir, false, IndexOptions{Extractor: extractor})
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	check(blevePdf, index, "reopened")
+	index.Close()
+
+	// An existing index can't be given another AnalysisConfig.
+	other := AnalysisConfig{StopWords: map[string][]string{"en": {"the", "to"}}}
+	_, index, _, err = IndexPdfFilesContext(context.Background(), []string{inPath}, persistDir,
+		false, IndexOptions{Extractor: extractor, Analysis: &other})
+	if err == nil {
+		index.Close()
+		t.Fatalf("No error for a different AnalysisConfig")
+	}
+
+	// Serialized indexes keep their analysis.
+	data, err := MarshalPdfIndex(persistDir, nil)
+	if err != nil {
+		t.Fatalf("MarshalPdfIndex failed. err=%v", err)
+	}
+	blevePdf, index, err = LoadIndexFromBytes(data)
+	if err != nil {
+		t.Fatalf("LoadIndexFromBytes failed. err=%v", err)
+	}
+	defer index.Close()
+	check(blevePdf, index, "loaded")
+
+	bad := AnalysisConfig{StopWords: map[string][]string{"xx": {"the"}}}
+	if _, err := bad.resolve(); err == nil {
+		t.Errorf("No error for stop words of an unknown language")
+	}
+}
+
+// checkAnalysisSearch checks that searching `index` for `term` matches the pages `pageNums` and
+// that the match on the first page is `matched`. `name` describes `index`.
+func checkAnalysisSearch(t *testing.T, blevePdf *BlevePdf, index bleve.Index, name, term string,
+	pageNums []uint32, matched string) {
+	t.Helper()
+	matches, err := blevePdf.SearchBleveIndex(index, term, 10)
+	if err != nil {
+		t.Fatalf("%s %q: SearchBleveIndex failed. err=%v", name, term, err)
+	}
+	var got []uint32
+	for _, m := range matches.Matches {
+		got = append(got, m.PageNum)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if len(got) != len(pageNums) {
+		t.Errorf("%s %q: matched pages %v. Expected %v", name, term, got, pageNums)
+		return
+	}
+	for i := range got {
+		if got[i] != pageNums[i] {
+			t.Errorf("%s %q: matched pages %v. Expected %v", name, term, got, pageNums)
+			return
+		}
+	}
+	if matched == "" {
+		return
+	}
+	for _, m := range matches.Matches {
+		if m.PageNum != pageNums[0] {
+			continue
+		}
+		if len(m.Spans) != 1 {
+			t.Errorf("%s %q: %d spans. Expected 1", name, term, len(m.Spans))
+			return
+		}
+		text, err := blevePdf.docPageText(m.docIdx, m.pageIdx)
+		if err != nil {
+			t.Fatalf("docPageText failed. err=%v", err)
+		}
+		if s := text[m.Spans[0].Start:m.Spans[0].End]; s != matched {
+			t.Errorf("%s %q: matched %q. Expected %q", name, term, s, matched)
+		}
+	}
+}
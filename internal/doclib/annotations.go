@@ -0,0 +1,198 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the indexing of PDF annotations and form field values.
+ *  - Comments, sticky notes and filled-in form values are not in the page content streams, so
+ *    PageTextExtractors don't see them. pageAnnotations() reads them from a page's Annots array.
+ *  - appendAnnotations() adds them to the page text after the page contents. Each word has the
+ *    bounding box of the Rect of its annotation or form field widget.
+ *  - The text positions record where each fragment came from (a MatchSource), so that matches
+ *    report whether they are in the page contents, an annotation or a form field.
+ */
+
+package doclib
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/papercutsoftware/pdfsearch/internal/serial"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// MatchSource tells where on a PDF page the matched text came from.
+type MatchSource uint8
+
+const (
+	// SourcePageText is text in the page contents. It is the source of all text in documents that
+	// are not PDFs.
+	SourcePageText MatchSource = iota
+	// SourceAnnotation is the Contents of an annotation, such as a comment or a sticky note.
+	SourceAnnotation
+	// SourceFormField is the value of a form field.
+	SourceFormField
+)
+
+// String returns a human readable name for `s`.
+func (s MatchSource) String() string {
+	switch s {
+	case SourcePageText:
+		return "page text"
+	case SourceAnnotation:
+		return "annotation"
+	case SourceFormField:
+		return "form field"
+	}
+	return "unknown"
+}
+
+// annotText is the text of an annotation or form field on a PDF page.
+type annotText struct {
+	text   string
+	bbox   model.PdfRectangle // The annotation's Rect.
+	source MatchSource
+}
+
+// pageAnnotations returns the texts of the annotations and form field widgets on `page` in the
+// order they appear in the page's Annots array. See 12.5 "Annotations" (p. 381 PDF32000_2008).
+func pageAnnotations(page *model.PdfPage) []annotText {
+	annots, ok := core.GetArray(page.Annots)
+	if !ok {
+		return nil
+	}
+	var texts []annotText
+	for _, obj := range annots.Elements() {
+		annot, ok := core.GetDict(obj)
+		if !ok {
+			continue
+		}
+		bbox, ok := annotRect(annot)
+		if !ok {
+			continue
+		}
+		a := annotText{bbox: bbox, source: SourceAnnotation}
+		subtype, _ := core.GetNameVal(annot.Get("Subtype"))
+		switch subtype {
+		case "Popup":
+			// Popups show the Contents of their parent annotations.
+			continue
+		case "Widget":
+			a.text = fieldValue(annot)
+			a.source = SourceFormField
+		default:
+			a.text = pdfText(annot.Get("Contents"))
+		}
+		if a.text = strings.Join(strings.Fields(a.text), " "); a.text == "" {
+			continue
+		}
+		texts = append(texts, a)
+	}
+	return texts
+}
+
+// annotRect returns the Rect of annotation `annot` with its corners in the usual order.
+func annotRect(annot *core.PdfObjectDictionary) (model.PdfRectangle, bool) {
+	arr, ok := core.GetArray(annot.Get("Rect"))
+	if !ok || arr.Len() != 4 {
+		return model.PdfRectangle{}, false
+	}
+	v, err := arr.ToFloat64Array()
+	if err != nil {
+		return model.PdfRectangle{}, false
+	}
+	return model.PdfRectangle{
+		Llx: math.Min(v[0], v[2]),
+		Lly: math.Min(v[1], v[3]),
+		Urx: math.Max(v[0], v[2]),
+		Ury: math.Max(v[1], v[3]),
+	}, true
+}
+
+// fieldValue returns the value of the form field of widget annotation `widget`. The value may be in
+// the widget, which is merged with its field, or inherited from an ancestor field.
+// See 12.7.3 "Field Dictionaries". Values that are names, such as the states of check boxes, are
+// not text so they are ignored.
+func fieldValue(widget *core.PdfObjectDictionary) string {
+	field := widget
+	for depth := 0; field != nil && depth < 32; depth++ {
+		if v := field.Get("V"); v != nil {
+			return pdfText(v)
+		}
+		field, _ = core.GetDict(field.Get("Parent"))
+	}
+	return ""
+}
+
+// pdfText returns the text in PDF string `obj` or the texts in the array of strings `obj`, which
+// is how multiple selections in choice fields are stored.
+func pdfText(obj core.PdfObject) string {
+	if s, ok := core.GetString(obj); ok {
+		return s.Decoded()
+	}
+	arr, ok := core.GetArray(obj)
+	if !ok {
+		return ""
+	}
+	var texts []string
+	for _, o := range arr.Elements() {
+		if s, ok := core.GetString(o); ok {
+			texts = append(texts, s.Decoded())
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// appendAnnotations returns page text `text` and its positions `ppos` with the texts of `annots`
+// appended. Each annotation starts on a new line. Each word has a position at its offset with the
+// annotation's bounding box, and the spaces and newlines between words have positions with empty
+// bounding boxes, so that PagePositions.BBox() returns the annotation's bounding box for matches in
+// it.
+func appendAnnotations(text string, ppos PagePositions, annots []annotText) (string, PagePositions) {
+	if len(annots) == 0 {
+		return text, ppos
+	}
+	var sb strings.Builder
+	sb.WriteString(text)
+	locations := append([]serial.OffsetBBox(nil), ppos.offsetBBoxes...)
+	filler := func(source MatchSource) {
+		locations = append(locations, serial.OffsetBBox{Offset: uint32(sb.Len()), Source: uint8(source)})
+	}
+	for _, a := range annots {
+		if sb.Len() > 0 {
+			filler(a.source)
+			sb.WriteString("\n")
+		}
+		for i, word := range strings.Split(a.text, " ") {
+			if i > 0 {
+				sb.WriteString(" ")
+			}
+			locations = append(locations, serial.OffsetBBox{
+				Offset: uint32(sb.Len()),
+				Llx:    float32(a.bbox.Llx),
+				Lly:    float32(a.bbox.Lly),
+				Urx:    float32(a.bbox.Urx),
+				Ury:    float32(a.bbox.Ury),
+				Source: uint8(a.source),
+			})
+			sb.WriteString(word)
+			filler(a.source)
+		}
+	}
+	sb.WriteString("\n")
+	filler(annots[len(annots)-1].source)
+	return sb.String(), PagePositions{offsetBBoxes: locations}
+}
+
+// Source returns where the text at offset `offset` on the page indexed by `ppos` came from.
+// This is the source of the last entry that starts at or before `offset`, so offsets inside
+// words have the sources of their words.
+func (ppos PagePositions) Source(offset uint32) MatchSource {
+	locations := ppos.offsetBBoxes
+	i := sort.Search(len(locations), func(i int) bool { return locations[i].Offset > offset })
+	if i == 0 {
+		return SourcePageText
+	}
+	return MatchSource(locations[i-1].Source)
+}
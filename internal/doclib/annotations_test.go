@@ -0,0 +1,164 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/papercutsoftware/pdfsearch/internal/serial"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/creator"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// TestAnnotationSearch checks that annotation contents and form field values are indexed on their
+// pages with the bounding boxes of their annotations, and that matches report their sources.
+func TestAnnotationSearch(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "annotated.pdf")
+	makeAnnotatedPdf(t, inPath)
+
+	persistDir := filepath.Join(dir, "store")
+	opts := IndexOptions{Extractor: fakePageExtractor{1: "quarterly report"}}
+	blevePdf, index, result, err := IndexPdfFilesContext(context.Background(),
+		[]string{inPath}, persistDir, true, opts)
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	defer index.Close()
+	if result.NumAdded != 1 || result.NumPages != 2 {
+		t.Fatalf("Unexpected result %s", result)
+	}
+
+	for _, test := range []struct {
+		term    string
+		pageNum uint32
+		source  MatchSource
+		bbox    model.PdfRectangle
+	}{
+		{"quarterly", 1, SourcePageText, fakeWordBBox(0)},
+		{"totals", 1, SourceAnnotation, model.PdfRectangle{Llx: 100, Lly: 700, Urx: 120, Ury: 720}},
+		{"citizen", 1, SourceFormField, model.PdfRectangle{Llx: 72, Lly: 600, Urx: 272, Ury: 620}},
+		{"perth", 1, SourceFormField, model.PdfRectangle{Llx: 72, Lly: 500, Urx: 172, Ury: 520}},
+		{"approved", 2, SourceAnnotation, model.PdfRectangle{Llx: 50, Lly: 50, Urx: 500, Ury: 400}},
+	} {
+		matches, err := blevePdf.SearchBleveIndex(index, test.term, 10)
+		if err != nil {
+			t.Fatalf("%q: SearchBleveIndex failed. err=%v", test.term, err)
+		}
+		if len(matches.Matches) != 1 {
+			t.Errorf("%q: %d matches. Expected 1. matches=%s", test.term, len(matches.Matches),
+				matches)
+			continue
+		}
+		m := matches.Matches[0]
+		if m.PageNum != test.pageNum || len(m.Spans) != 1 || len(m.Sources) != 1 {
+			t.Errorf("%q: Unexpected match %s Sources=%v", test.term, m, m.Sources)
+			continue
+		}
+		if m.Sources[0] != test.source {
+			t.Errorf("%q: source=%s. Expected %s", test.term, m.Sources[0], test.source)
+		}
+		bbox, ok := m.PagePositions.BBox(m.Spans[0].Start, m.Spans[0].End)
+		if !ok || bbox != test.bbox {
+			t.Errorf("%q: bbox=%+v ok=%t. Expected %+v", test.term, bbox, ok, test.bbox)
+		}
+	}
+
+	// Check box states aren't text.
+	matches, err := blevePdf.SearchBleveIndex(index, "yes", 10)
+	if err != nil {
+		t.Fatalf("SearchBleveIndex failed. err=%v", err)
+	}
+	if len(matches.Matches) != 0 {
+		t.Errorf("Check box state was indexed. matches=%s", matches)
+	}
+}
+
+// TestPagePositionsSource checks that offsets inside words, such as the starts of matches of
+// stemmed terms, have the sources of their words.
+func TestPagePositionsSource(t *testing.T) {
+	// "quarterly totals\nJane" where "totals" is in an annotation and "Jane" in a form field. There
+	// are no entries for the separators, as with extractors that only return marks for words.
+	ppos := PagePositions{[]serial.OffsetBBox{
+		{Offset: 0},
+		{Offset: 10, Source: uint8(SourceAnnotation)},
+		{Offset: 17, Source: uint8(SourceFormField)},
+	}}
+	for _, test := range []struct {
+		offset uint32
+		source MatchSource
+	}{
+		{0, SourcePageText},
+		{4, SourcePageText},
+		{10, SourceAnnotation},
+		{13, SourceAnnotation},
+		{16, SourceAnnotation},
+		{17, SourceFormField},
+		{19, SourceFormField},
+	} {
+		if source := ppos.Source(test.offset); source != test.source {
+			t.Errorf("offset=%d: source=%s. Expected %s", test.offset, source, test.source)
+		}
+	}
+}
+
+// makeAnnotatedPdf writes a 2 page PDF with annotations and form fields to `outPath`.
+//
+//	Page 1: A comment with a popup, a text field, a choice field whose value is in its parent
+//	        field and a check box.
+//	Page 2: A large free text annotation.
+func makeAnnotatedPdf(t *testing.T, outPath string) {
+	annot := func(subtype string, rect []float64, entries ...core.PdfObject) core.PdfObject {
+		d := core.MakeDict()
+		d.Set("Type", core.MakeName("Annot"))
+		d.Set("Subtype", core.MakeName(subtype))
+		d.Set("Rect", core.MakeArrayFromFloats(rect))
+		for i := 0; i+1 < len(entries); i += 2 {
+			d.Set(*entries[i].(*core.PdfObjectName), entries[i+1])
+		}
+		return core.MakeIndirectObject(d)
+	}
+	name := func(s string) core.PdfObject { return core.MakeName(s) }
+	str := func(s string) core.PdfObject { return core.MakeString(s) }
+
+	cityField := model.NewPdfField()
+	cityField.FT = core.MakeName("Ch")
+	cityField.T = core.MakeString("cities")
+	cityField.V = core.MakeArray(core.MakeString("Sydney"), core.MakeString("Perth"))
+
+	comment := annot("Text", []float64{100, 700, 120, 720}, name("Contents"),
+		str("Please check the totals"))
+	popup := annot("Popup", []float64{120, 600, 300, 700}, name("Contents"),
+		str("Please check the totals"), name("Parent"), comment)
+	annots := [][]core.PdfObject{
+		{
+			comment,
+			popup,
+			annot("Widget", []float64{272, 620, 72, 600}, name("FT"), name("Tx"),
+				name("T"), str("name"), name("V"), str("Jane Citizen")),
+			annot("Widget", []float64{72, 500, 172, 520}, name("Parent"),
+				cityField.ToPdfObject()),
+			annot("Widget", []float64{72, 400, 92, 420}, name("FT"), name("Btn"),
+				name("T"), str("agree"), name("V"), name("Yes")),
+		},
+		{
+			annot("FreeText", []float64{50, 50, 500, 400}, name("Contents"), str("Approved")),
+		},
+	}
+
+	// The choice field is written because it is in the form.
+	form := model.NewPdfAcroForm()
+	form.Fields = &[]*model.PdfField{cityField}
+
+	writeTestPdf(t, outPath, len(annots), func(c *creator.Creator, page *model.PdfPage,
+		pageNum int) error {
+		page.Annots = core.MakeArray(annots[pageNum-1]...)
+		if pageNum == 1 {
+			return c.SetForms(form)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the indexing of PDFs in ZIP archives.
+ *  - ZIP archives in the list of files to index are opened in place. The PDFs in them are read into
+ *    memory one at a time and indexed as child documents of the archive with paths like
+ *      batch.zip!/invoices/123.pdf
+ *    in the same way as PDFs embedded in other PDFs. See embedded.go.
+ *  - PDFs in archives are identified by the archive's contents hash and their names in the archive.
+ *    This lets PDFs in archives that are already indexed be skipped without being decompressed.
+ *  - openDocReader() re-opens PDFs in archives so that matches in them can be marked up.
+ */
+
+package doclib
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/papercutsoftware/pdfsearch/internal/utils"
+	"github.com/unidoc/unipdf/v3/common"
+)
+
+// isArchivePath returns true if `inPath` is the path of a ZIP archive.
+func isArchivePath(inPath string) bool {
+	return strings.EqualFold(filepath.Ext(inPath), ".zip")
+}
+
+// archiveMemberHash returns the identity of the PDF named `name` in the ZIP archive with contents
+// hash `archiveHash`. It is used in place of the PDF's contents hash.
+func archiveMemberHash(archiveHash, name string) string {
+	hash, _, _ := utils.ReaderHash(strings.NewReader(archiveHash + embeddedSep + name))
+	return hash
+}
+
+// archivePdfs returns the members of the ZIP archive opened in `zr` that are PDFs, in archive
+// order. Members are recognized as PDFs by their extensions.
+func archivePdfs(zr *zip.Reader) []*zip.File {
+	var files []*zip.File
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !strings.EqualFold(path.Ext(f.Name), ".pdf") {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// readArchiveMember returns the decompressed contents of ZIP archive member `f`.
+func readArchiveMember(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// openArchiveMember returns the contents of the PDF named `name` in ZIP archive `archivePath`.
+func openArchiveMember(archivePath, name string) ([]byte, error) {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.Name == name {
+			return readArchiveMember(f)
+		}
+	}
+	return nil, fmt.Errorf("%q has no member %q", archivePath, name)
+}
+
+// extractArchiveText extracts the text of the PDFs in ZIP archive `fd`, which is `op`.inPath, and
+// writes them to `extractedChan` as child documents of the archive in the same way as
+// extractPDFText(). PDFs whose identities are in `knownHashes` are passed on without being
+// decompressed. The PDFs embedded in the PDFs in the archive are extracted too.
+// It updates worker `workerNum`'s `profile`. It returns false if `ctx` was done.
+func extractArchiveText(ctx context.Context, workerNum int, op orderedPath, fd fileDesc,
+	extractedChan chan<- extractedDoc, knownHashes map[string]bool, opts IndexOptions,
+	ev *indexEvents, profile *ExtractorProfile) bool {
+	zr, err := zip.OpenReader(fd.InPath)
+	if err != nil {
+		common.Log.Error("extractArchiveText: Could not open %q. err=%v", fd.InPath, err)
+		e := extractedDoc{i: op.i, inPath: op.inPath, fd: fd, err: err}
+		return sendExtracted(ctx, extractedChan, e)
+	}
+	defer zr.Close()
+
+	members := archivePdfs(&zr.Reader)
+	common.Log.Debug("extractArchiveText: %q has %d PDFs.", fd.InPath, len(members))
+	for _, f := range members {
+		if ctx.Err() != nil {
+			return false
+		}
+		member := fileDesc{
+			InPath:   embeddedPath(fd.InPath, f.Name),
+			Hash:     archiveMemberHash(fd.Hash, f.Name),
+			SizeMB:   float64(f.UncompressedSize64) / 1024.0 / 1024.0,
+			Parent:   fd.InPath,
+			RootHash: fd.Hash,
+		}
+		e := extractedDoc{i: op.i, inPath: member.InPath, fd: member}
+		if knownHashes[member.Hash] {
+			e.skipped = true
+			if !sendExtracted(ctx, extractedChan, e) {
+				return false
+			}
+			continue
+		}
+		ev.send(IndexEvent{Kind: IndexFileStarted, InPath: e.inPath, Parent: fd.InPath,
+			PathIdx: op.i, Worker: workerNum})
+		// The member is decompressed by the extractor so that members over the size limit aren't.
+		extract := func(fd fileDesc, opts extractOptions, watch *extractWatch) ([]pageContents,
+			[]IndexFailure, error) {
+			data, err := readArchiveMember(f)
+			if err != nil {
+				return nil, nil, err
+			}
+			return dataExtractor(data)(fd, opts, watch)
+		}
+		t0 := time.Now()
+		var embedded []embeddedDoc
+		e.docContents, e.pageFailures, embedded, e.err = extractLimited(ctx, member, opts, extract)
+		e.dt = time.Since(t0)
+		profile.NumDocs++
+		profile.NumPages += len(e.docContents)
+		profile.DtProcess += e.dt
+		ev.setProfile(workerNum, *profile)
+		if e.err == nil {
+			ev.send(IndexEvent{
+				Kind:      IndexFileExtracted,
+				InPath:    e.inPath,
+				Parent:    fd.InPath,
+				PathIdx:   op.i,
+				Worker:    workerNum,
+				SizeMB:    member.SizeMB,
+				NumPages:  len(e.docContents),
+				DtExtract: e.dt,
+			})
+		}
+		if !sendExtracted(ctx, extractedChan, e) {
+			return false
+		}
+		if !extractEmbeddedText(ctx, workerNum, op, embedded, extractedChan, knownHashes, opts, ev,
+			profile) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/papercutsoftware/pdfsearch/internal/utils"
+)
+
+// TestArchiveSearch checks that PDFs in ZIP archives, and the PDFs attached to them, are indexed
+// as child documents of the archives that can be searched, skipped when they are already indexed,
+// marked up, moved and removed with the archives.
+func TestArchiveSearch(t *testing.T) {
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "batch.zip")
+	rates := makeAttachmentsPdf(t, 3, nil)
+	writeZip(t, zipPath, []attachment{
+		{"invoices/123.pdf", makeAttachmentsPdf(t, 2, nil)},
+		{"contract.pdf", makeAttachmentsPdf(t, 1, []attachment{{"rates.pdf", rates}})},
+		{"readme.txt", []byte("This is not a PDF.")},
+	})
+	invoicePath := zipPath + "!/invoices/123.pdf"
+	contractPath := zipPath + "!/contract.pdf"
+	ratesPath := contractPath + "!/rates.pdf"
+
+	// The number of pages tells which PDF a match is in.
+	persistDir := filepath.Join(dir, "store")
+	opts := IndexOptions{Extractor: fakePageExtractor{1: "terms", 2: "rates", 3: "costs"}}
+	blevePdf, index, result, err := IndexPdfFilesContext(context.Background(),
+		[]string{zipPath}, persistDir, true, opts)
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	if result.NumAdded != 3 || result.NumPages != 6 || result.NumFailed != 0 {
+		index.Close()
+		t.Fatalf("Unexpected result %s", result)
+	}
+
+	zipHash, err := utils.FileHash(zipPath)
+	if err != nil {
+		index.Close()
+		t.Fatalf("FileHash failed. err=%v", err)
+	}
+	parents := map[string]string{invoicePath: zipPath, contractPath: zipPath, ratesPath: contractPath}
+	for _, fd := range blevePdf.fdList {
+		if parent, ok := parents[fd.InPath]; !ok || fd.Parent != parent || fd.RootHash != zipHash {
+			t.Errorf("Unexpected entry %s Parent=%q RootHash=%q", fd, fd.Parent, fd.RootHash)
+		}
+		if fd.InPath == invoicePath && fd.Hash != archiveMemberHash(zipHash, "invoices/123.pdf") {
+			t.Errorf("%q has hash %q", fd.InPath, fd.Hash)
+		}
+	}
+
+	matches, err := blevePdf.SearchBleveIndex(index, "rates", 10)
+	index.Close()
+	if err != nil {
+		t.Fatalf("SearchBleveIndex failed. err=%v", err)
+	}
+	found := map[string]bool{}
+	for _, m := range matches.Matches {
+		found[m.InPath] = true
+	}
+	if len(found) != 2 || !found[invoicePath] || !found[ratesPath] {
+		t.Fatalf("Unexpected matches %s", matches)
+	}
+
+	// The PDFs in the archive are already indexed.
+	_, index, result, err = IndexPdfFilesContext(context.Background(), []string{zipPath},
+		persistDir, false, opts)
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	index.Close()
+	if result.NumAdded != 0 || result.NumSkipped != 2 {
+		t.Fatalf("Unexpected result %s", result)
+	}
+
+	// Mark up the PDFs in the archive.
+	extractList := CreateExtractList(10, 10)
+	for _, m := range matches.Matches {
+		bbox, ok := m.PagePositions.BBox(m.Spans[0].Start, m.Spans[0].End)
+		if !ok {
+			t.Fatalf("No bbox for %q", m.InPath)
+		}
+		extractList.AddRect(m.InPath, m.PageNum, bbox)
+	}
+	if err := extractList.SaveOutputPdf(filepath.Join(dir, "markup.pdf")); err != nil {
+		t.Fatalf("SaveOutputPdf failed. err=%v", err)
+	}
+	if _, err := openDocReader(zipPath+"!/invoices/124.pdf", nil); err == nil {
+		t.Errorf("Opened a missing PDF in an archive")
+	}
+
+	// Syncing an unchanged archive changes nothing and moving it moves the PDFs in it.
+	syncResult, err := SyncPdfFiles(persistDir, []string{zipPath}, nil)
+	if err != nil {
+		t.Fatalf("SyncPdfFiles failed. err=%v", err)
+	}
+	if syncResult.NumMoved != 0 || syncResult.NumRemoved != 0 || syncResult.NumAdded != 0 {
+		t.Fatalf("Unexpected sync result %s", syncResult)
+	}
+	movedPath := filepath.Join(dir, "moved.zip")
+	if err := os.Rename(zipPath, movedPath); err != nil {
+		t.Fatalf("Rename failed. err=%v", err)
+	}
+	syncResult, err = SyncPdfFiles(persistDir, []string{movedPath}, nil)
+	if err != nil {
+		t.Fatalf("SyncPdfFiles failed. err=%v", err)
+	}
+	if syncResult.NumMoved != 3 || syncResult.NumRemoved != 0 || syncResult.NumAdded != 0 {
+		t.Fatalf("Unexpected sync result %s", syncResult)
+	}
+	blevePdf, err = openBlevePdf(persistDir, nil, false)
+	if err != nil {
+		t.Fatalf("openBlevePdf failed. err=%v", err)
+	}
+	for _, fd := range blevePdf.fdList {
+		if !strings.HasPrefix(fd.InPath, movedPath+embeddedSep) || fd.Parent != parentPath(fd.InPath) {
+			t.Errorf("Not moved: %s Parent=%q", fd, fd.Parent)
+		}
+	}
+
+	// Removing the archive removes the PDFs in it.
+	numRemoved, err := RemovePdfFiles(persistDir, nil, []string{movedPath})
+	if err != nil {
+		t.Fatalf("RemovePdfFiles failed. err=%v", err)
+	}
+	if numRemoved != 3 {
+		t.Fatalf("Removed %d PDFs. Expected 3", numRemoved)
+	}
+}
+
+// writeZip writes a ZIP archive holding `members` to `zipPath`.
+func writeZip(t *testing.T, zipPath string, members []attachment) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, m := range members {
+		w, err := zw.Create(m.name)
+		if err != nil {
+			t.Fatalf("Create failed. err=%v", err)
+		}
+		if _, err := w.Write(m.data); err != nil {
+			t.Fatalf("Write failed. err=%v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Close failed. err=%v", err)
+	}
+	if err := ioutil.WriteFile(zipPath, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("WriteFile failed. err=%v", err)
+	}
+}
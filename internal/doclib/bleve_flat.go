@@ -0,0 +1,377 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements serialization of in-memory bleve indexes to flat byte buffers.
+ *  - ExportBleveMem() serializes an in-memory bleve index.
+ *  - ImportBleveMem() returns a bleve index that is searched directly from a serialized buffer.
+ *
+ * In-memory bleve indexes are upsidedown indexes over a key-value store. ExportBleveMem() writes
+ * the key-value pairs in key order as
+ *    <uvarint key length><key><uvarint value length><value>
+ * ImportBleveMem() opens an upsidedown index over a flatStore, a read-mostly key-value store whose
+ * keys and values are slices of the serialized buffer.
+ */
+
+package doclib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/index/store"
+	"github.com/blevesearch/bleve/index/upsidedown"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/registry"
+)
+
+const (
+	// flatStoreName is the name flatStore is registered with in bleve.
+	flatStoreName = "pdfsearch.flat"
+	// flatStoreDataKey is the flatStore config key of the serialized buffer.
+	flatStoreDataKey = "data"
+	// bleveMappingKey is the internal key that bleve saves the index mapping of an index under.
+	bleveMappingKey = "_mapping"
+)
+
+func init() {
+	registry.RegisterKVStore(flatStoreName, newFlatStore)
+}
+
+// ExportBleveMem returns the in-memory bleve index `index` serialized to a byte slice.
+// `index` must be an upsidedown index such as those created by createBleveMemIndex() or
+// ImportBleveMem().
+func ExportBleveMem(index bleve.Index) ([]byte, error) {
+	_, kvStore, err := index.Advanced()
+	if err != nil {
+		return nil, err
+	}
+	if kvStore == nil {
+		return nil, errors.New("bleve index has no key-value store. Not an in-memory index?")
+	}
+	reader, err := kvStore.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	it := reader.RangeIterator(nil, nil)
+	defer it.Close()
+
+	var buf bytes.Buffer
+	var lenBuf [binary.MaxVarintLen64]byte
+	for ; it.Valid(); it.Next() {
+		k, v, _ := it.Current()
+		for _, b := range [][]byte{k, v} {
+			n := binary.PutUvarint(lenBuf[:], uint64(len(b)))
+			buf.Write(lenBuf[:n])
+			buf.Write(b)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// ImportBleveMem returns the bleve index serialized in `data` by ExportBleveMem().
+// The index is searched directly from `data`, so `data` must not be modified while the index is
+// in use. Changes to the index are kept in memory and do not change `data`.
+func ImportBleveMem(data []byte) (bleve.Index, error) {
+	indexMapping, err := flatMapping(data)
+	if err != nil {
+		return nil, err
+	}
+	kvconfig := map[string]interface{}{flatStoreDataKey: data}
+	return bleve.NewUsing("", indexMapping, upsidedown.Name, flatStoreName, kvconfig)
+}
+
+// flatMapping returns the index mapping that bleve saved in the index serialized in `data`. The
+// mapping holds the custom analyzers of indexes created with an AnalysisConfig. Serialized indexes
+// without a saved mapping get the default mapping.
+func flatMapping(data []byte) (mapping.IndexMapping, error) {
+	kvs, err := parseFlatKVs(data)
+	if err != nil {
+		return nil, err
+	}
+	// bleve saves the mapping as an upsidedown internal row, whose key is 'i' + the internal key.
+	key := []byte("i" + bleveMappingKey)
+	i := sort.Search(len(kvs), func(i int) bool { return bytes.Compare(kvs[i].k, key) >= 0 })
+	if i == len(kvs) || !bytes.Equal(kvs[i].k, key) {
+		return buildIndexMapping(AnalysisConfig{})
+	}
+	var indexMapping mapping.IndexMappingImpl
+	if err := json.Unmarshal(kvs[i].v, &indexMapping); err != nil {
+		return nil, fmt.Errorf("corrupt bleve index mapping. err=%v", err)
+	}
+	return &indexMapping, nil
+}
+
+// flatKV is a key-value pair in a flatStore.
+type flatKV struct {
+	k, v []byte
+}
+
+// flatStore is a bleve key-value store over a sorted list of key-value pairs. The pairs loaded from
+// a serialized buffer are slices of that buffer.
+// Writes replace the list with an updated copy so that readers see a consistent snapshot. This is
+// slow for big writes, but a loaded index is mostly searched.
+type flatStore struct {
+	m   sync.Mutex
+	kvs []flatKV // Key-value pairs sorted by key.
+	mo  store.MergeOperator
+}
+
+// newFlatStore returns a flatStore over the buffer in `config[flatStoreDataKey]`. If there is no
+// buffer, an empty flatStore is returned.
+func newFlatStore(mo store.MergeOperator, config map[string]interface{}) (store.KVStore, error) {
+	s := flatStore{mo: mo}
+	if data, ok := config[flatStoreDataKey].([]byte); ok {
+		kvs, err := parseFlatKVs(data)
+		if err != nil {
+			return nil, err
+		}
+		s.kvs = kvs
+	}
+	return &s, nil
+}
+
+// parseFlatKVs returns the key-value pairs serialized in `data` by ExportBleveMem().
+func parseFlatKVs(data []byte) ([]flatKV, error) {
+	var kvs []flatKV
+	for len(data) > 0 {
+		var kv flatKV
+		for _, b := range []*[]byte{&kv.k, &kv.v} {
+			n, size := binary.Uvarint(data)
+			if size <= 0 || uint64(len(data)-size) < n {
+				return nil, errors.New("corrupt bleve index data")
+			}
+			*b = data[size : size+int(n)]
+			data = data[size+int(n):]
+		}
+		if len(kvs) > 0 && bytes.Compare(kvs[len(kvs)-1].k, kv.k) >= 0 {
+			return nil, fmt.Errorf("bleve index data not sorted at key %q", kv.k)
+		}
+		kvs = append(kvs, kv)
+	}
+	return kvs, nil
+}
+
+// Close closes `s`.
+func (s *flatStore) Close() error {
+	return nil
+}
+
+// Reader returns a reader of a snapshot of `s`.
+func (s *flatStore) Reader() (store.KVReader, error) {
+	s.m.Lock()
+	kvs := s.kvs
+	s.m.Unlock()
+	return &flatReader{kvs: kvs}, nil
+}
+
+// Writer returns a writer for `s`.
+func (s *flatStore) Writer() (store.KVWriter, error) {
+	return &flatWriter{s: s}, nil
+}
+
+// flatReader reads a snapshot of a flatStore.
+type flatReader struct {
+	kvs []flatKV
+}
+
+// search returns the index of the first pair in `r` with a key >= `k`.
+func (r *flatReader) search(k []byte) int {
+	return sort.Search(len(r.kvs), func(i int) bool {
+		return bytes.Compare(r.kvs[i].k, k) >= 0
+	})
+}
+
+// Get returns a copy of the value for key `k` or nil if there is no such key.
+func (r *flatReader) Get(k []byte) ([]byte, error) {
+	i := r.search(k)
+	if i >= len(r.kvs) || !bytes.Equal(r.kvs[i].k, k) {
+		return nil, nil
+	}
+	v := make([]byte, len(r.kvs[i].v))
+	copy(v, r.kvs[i].v)
+	return v, nil
+}
+
+// MultiGet returns the values for keys `keys`.
+func (r *flatReader) MultiGet(keys [][]byte) ([][]byte, error) {
+	vals := make([][]byte, len(keys))
+	for i, k := range keys {
+		v, err := r.Get(k)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// PrefixIterator returns an iterator over the pairs in `r` whose keys start with `prefix`.
+func (r *flatReader) PrefixIterator(prefix []byte) store.KVIterator {
+	it := flatIterator{kvs: r.kvs, prefix: prefix}
+	it.Seek(prefix)
+	return &it
+}
+
+// RangeIterator returns an iterator over the pairs in `r` with keys in [`start`, `end`).
+// nil `start` and `end` mean the start and end of `r`.
+func (r *flatReader) RangeIterator(start, end []byte) store.KVIterator {
+	it := flatIterator{kvs: r.kvs, start: start, end: end}
+	it.Seek(start)
+	return &it
+}
+
+// Close closes `r`.
+func (r *flatReader) Close() error {
+	return nil
+}
+
+// flatIterator iterates over the key-value pairs of a flatStore snapshot.
+type flatIterator struct {
+	kvs    []flatKV
+	i      int // Index of the current pair in `kvs`.
+	prefix []byte
+	start  []byte
+	end    []byte
+}
+
+// Seek moves `it` to the first pair with a key >= `k` that is in the iterator's range.
+func (it *flatIterator) Seek(k []byte) {
+	if it.start != nil && bytes.Compare(k, it.start) < 0 {
+		k = it.start
+	}
+	if it.prefix != nil && bytes.Compare(k, it.prefix) < 0 {
+		k = it.prefix
+	}
+	it.i = sort.Search(len(it.kvs), func(i int) bool {
+		return bytes.Compare(it.kvs[i].k, k) >= 0
+	})
+}
+
+// Next moves `it` to the next pair.
+func (it *flatIterator) Next() {
+	it.i++
+}
+
+// Current returns the key and value of the current pair and whether `it` is valid.
+func (it *flatIterator) Current() ([]byte, []byte, bool) {
+	if !it.Valid() {
+		return nil, nil, false
+	}
+	kv := it.kvs[it.i]
+	return kv.k, kv.v, true
+}
+
+// Key returns the key of the current pair.
+func (it *flatIterator) Key() []byte {
+	k, _, _ := it.Current()
+	return k
+}
+
+// Value returns the value of the current pair.
+func (it *flatIterator) Value() []byte {
+	_, v, _ := it.Current()
+	return v
+}
+
+// Valid returns true if `it` is positioned on a pair in its range.
+func (it *flatIterator) Valid() bool {
+	if it.i >= len(it.kvs) {
+		return false
+	}
+	k := it.kvs[it.i].k
+	if it.prefix != nil && !bytes.HasPrefix(k, it.prefix) {
+		return false
+	}
+	if it.end != nil && bytes.Compare(k, it.end) >= 0 {
+		return false
+	}
+	return true
+}
+
+// Close closes `it`.
+func (it *flatIterator) Close() error {
+	it.kvs = nil
+	return nil
+}
+
+// flatWriter writes to a flatStore.
+type flatWriter struct {
+	s *flatStore
+}
+
+// NewBatch returns a new batch of writes.
+func (w *flatWriter) NewBatch() store.KVBatch {
+	return store.NewEmulatedBatch(w.s.mo)
+}
+
+// NewBatchEx returns a new batch of writes.
+func (w *flatWriter) NewBatchEx(options store.KVBatchOptions) ([]byte, store.KVBatch, error) {
+	return make([]byte, options.TotalBytes), w.NewBatch(), nil
+}
+
+// ExecuteBatch applies the writes in `batch` to the flatStore. Merges are applied before sets and
+// deletes, as in bleve's gtreap store.
+func (w *flatWriter) ExecuteBatch(batch store.KVBatch) error {
+	emulatedBatch, ok := batch.(*store.EmulatedBatch)
+	if !ok {
+		return errors.New("wrong type of batch")
+	}
+
+	w.s.m.Lock()
+	defer w.s.m.Unlock()
+	r := flatReader{kvs: w.s.kvs}
+
+	// {key: new value}. A nil value is a delete.
+	changes := map[string][]byte{}
+	for k, mergeOps := range emulatedBatch.Merger.Merges {
+		kb := []byte(k)
+		existingVal, _ := r.Get(kb)
+		mergedVal, fullMergeOk := w.s.mo.FullMerge(kb, existingVal, mergeOps)
+		if !fullMergeOk {
+			return errors.New("merge operator returned failure")
+		}
+		changes[k] = mergedVal
+	}
+	for _, op := range emulatedBatch.Ops {
+		changes[string(op.K)] = op.V
+	}
+
+	var keys []string
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// Merge the sorted changes into a copy of the sorted pairs.
+	kvs := make([]flatKV, 0, len(r.kvs)+len(keys))
+	i := 0
+	for _, k := range keys {
+		kb := []byte(k)
+		for ; i < len(r.kvs) && bytes.Compare(r.kvs[i].k, kb) < 0; i++ {
+			kvs = append(kvs, r.kvs[i])
+		}
+		if i < len(r.kvs) && bytes.Equal(r.kvs[i].k, kb) {
+			i++
+		}
+		if v := changes[k]; v != nil {
+			kvs = append(kvs, flatKV{k: kb, v: v})
+		}
+	}
+	kvs = append(kvs, r.kvs[i:]...)
+	w.s.kvs = kvs
+	return nil
+}
+
+// Close closes `w`.
+func (w *flatWriter) Close() error {
+	w.s = nil
+	return nil
+}
@@ -4,21 +4,29 @@ package doclib
 
 import (
 	"path/filepath"
+
 	"github.com/blevesearch/bleve"
-	"github.com/blevesearch/bleve/analysis/lang/en"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/analysis/analyzer/standard"
 	"github.com/blevesearch/bleve/index/scorch"
 	"github.com/blevesearch/bleve/mapping"
 	"github.com/papercutsoftware/pdfsearch/internal/utils"
 	"github.com/unidoc/unipdf/v3/common"
 )
 
-// createBleveDiskIndex creates a new persistent bleve index at `indexPath`.
-// If `forceCreate` is true then an existing index will be deleted.
-func createBleveDiskIndex(indexPath string, forceCreate bool) (bleve.Index, error) {
-	mapping := buildIndexMapping()
+// createBleveDiskIndex creates a new persistent bleve index at `indexPath` whose text is analyzed
+// as configured by `config`.
+// If `forceCreate` is true then an existing index will be deleted. Otherwise an existing index is
+// opened with the analysis it was created with.
+func createBleveDiskIndex(indexPath string, forceCreate bool, config AnalysisConfig) (bleve.Index,
+	error) {
+	mapping, err := buildIndexMapping(config)
+	if err != nil {
+		return nil, err
+	}
 	index, err := bleve.NewUsing(indexPath, mapping, scorch.Name, scorch.Name, nil)
 	if err == bleve.ErrorIndexPathExists {
-		common.Log.Error("Bleve index %q exists.", indexPath)
+		common.Log.Debug("Bleve index %q exists.", indexPath)
 		if forceCreate {
 			common.Log.Info("Removing %q.", indexPath)
 			removeBleveDiskIndex(indexPath)
@@ -31,33 +39,86 @@ func createBleveDiskIndex(indexPath string, forceCreate bool) (bleve.Index, erro
 	return index, err
 }
 
-// createBleveMemIndex creates a new in-memory (unpersisted) bleve index.
-func createBleveMemIndex() (bleve.Index, error) {
-	mapping := buildIndexMapping()
+// createBleveMemIndex creates a new in-memory (unpersisted) bleve index whose text is analyzed as
+// configured by `config`.
+func createBleveMemIndex(config AnalysisConfig) (bleve.Index, error) {
+	mapping, err := buildIndexMapping(config)
+	if err != nil {
+		return nil, err
+	}
 	return bleve.NewMemOnly(mapping)
 }
 
 // buildIndexMapping is from the bleve beer example code.
-// It returns an IndexMapping that gives an English text Analyer of the Text field
-func buildIndexMapping() mapping.IndexMapping {
+// It returns an IndexMapping that gives an English text Analyer of the Text field, the analyzers
+// of the other detected languages to the LangText fields and maps the document metadata fields in
+// IDText. The analyzers are customized by `config`. See analysis_config.go.
+func buildIndexMapping(config AnalysisConfig) (mapping.IndexMapping, error) {
+	indexMapping := bleve.NewIndexMapping()
+	analyzers, err := config.addAnalyzers(indexMapping)
+	if err != nil {
+		return nil, err
+	}
+	englishAnalyzer := analyzers[languages[0].code]
+
 	// a generic reusable mapping for english text
 	englishTextFieldMapping := bleve.NewTextFieldMapping()
-	englishTextFieldMapping.Analyzer = en.AnalyzerName
+	englishTextFieldMapping.Analyzer = englishAnalyzer
 
 	// // a generic reusable mapping for keyword text
 	// keywordFieldMapping := bleve.NewTextFieldMapping()
 	// keywordFieldMapping.Analyzer = keyword.Name
 
+	// Document metadata fields. They are searched with field-qualified queries, so they are not
+	// stored or included in the _all field that plain text searches use.
+	metaField := func(m *mapping.FieldMapping, analyzer string) *mapping.FieldMapping {
+		m.Analyzer = analyzer
+		m.Store = false
+		m.IncludeInAll = false
+		m.IncludeTermVectors = false
+		return m
+	}
+
 	pdfMapping := bleve.NewDocumentMapping()
 
 	// Text
-	pdfMapping.AddFieldMappingsAt("Text", englishTextFieldMapping)
+	pdfMapping.AddFieldMappingsAt(fieldText, englishTextFieldMapping)
 
-	indexMapping := bleve.NewIndexMapping()
+	// Text in languages other than English. See lang_detect.go.
+	langTextMapping := bleve.NewDocumentMapping()
+	for _, l := range languages[1:] {
+		m := bleve.NewTextFieldMapping()
+		m.Analyzer = analyzers[l.code]
+		m.IncludeInAll = false
+		langTextMapping.AddFieldMappingsAt(l.code, m)
+	}
+	pdfMapping.AddSubDocumentMapping(fieldLangText, langTextMapping)
+	pdfMapping.AddFieldMappingsAt(fieldLang, metaField(bleve.NewTextFieldMapping(), keyword.Name))
+
+	// Metadata
+	pdfMapping.AddFieldMappingsAt(fieldTitle, metaField(bleve.NewTextFieldMapping(), englishAnalyzer))
+	pdfMapping.AddFieldMappingsAt(fieldSubject, metaField(bleve.NewTextFieldMapping(), englishAnalyzer))
+	pdfMapping.AddFieldMappingsAt(fieldAuthor, metaField(bleve.NewTextFieldMapping(), standard.Name))
+	pdfMapping.AddFieldMappingsAt(fieldProducer, metaField(bleve.NewTextFieldMapping(), standard.Name))
+	pdfMapping.AddFieldMappingsAt(fieldKeywords, metaField(bleve.NewTextFieldMapping(), keyword.Name))
+	pdfMapping.AddFieldMappingsAt(fieldCreated, metaField(bleve.NewDateTimeFieldMapping(), ""))
+	pdfMapping.AddFieldMappingsAt(fieldModified, metaField(bleve.NewDateTimeFieldMapping(), ""))
+	pdfMapping.AddFieldMappingsAt(fieldFirstPage, metaField(bleve.NewBooleanFieldMapping(), ""))
+
+	// Bookmark titles. They boost matches of the text in section headings.
+	pdfMapping.AddFieldMappingsAt(fieldHeadings, metaField(bleve.NewTextFieldMapping(), englishAnalyzer))
+
+	// IDText has no type field so it is indexed with the default mapping.
+	indexMapping.DefaultMapping = pdfMapping
 	indexMapping.AddDocumentMapping("pdf", pdfMapping)
 	indexMapping.TypeField = "type"
-	indexMapping.DefaultAnalyzer = "en"
-	return indexMapping
+	indexMapping.DefaultAnalyzer = englishAnalyzer
+	return indexMapping, nil
+}
+
+// bleveIndexExists returns true if there is a bleve index in `indexPath`.
+func bleveIndexExists(indexPath string) bool {
+	return utils.Exists(filepath.Join(indexPath, "index_meta.json"))
 }
 
 // removeBleveDiskIndex removes the bleve index persistent data in `indexPath` from disk.
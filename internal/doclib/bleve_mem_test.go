@@ -33,15 +33,21 @@ func testMem(t *testing.T, term string, numDocs, docLen int) {
 	common.Log.Debug("allWords=%d %q", len(allWords), allWords)
 
 	index, matchedIDs := makeMemIndex(t, term, numDocs, docLen)
-	// index2 := roundTrip(t, index)
+	index2 := roundTrip(t, index)
 
 	sr := doQuery(t, index, term, numDocs)
-	// sr2 := doQuery(t, index2, term, 10)
-	// if len(sr.Hits) != len(sr2.Hits) {
-	// 	t.Fatalf("len(sr.Hits)=%d != len(sr2.Hits)=%d", len(sr.Hits), len(sr2.Hits))
-	// }
+	sr2 := doQuery(t, index2, term, numDocs)
+	if len(sr.Hits) != len(sr2.Hits) {
+		t.Fatalf("len(sr.Hits)=%d != len(sr2.Hits)=%d", len(sr.Hits), len(sr2.Hits))
+	}
 
 	srIDs := searchResultIDs(sr)
+	sr2IDs := searchResultIDs(sr2)
+	for i, id := range srIDs {
+		if id != sr2IDs[i] {
+			t.Fatalf("%4d: id=%#q != id2=%#q", i, id, sr2IDs[i])
+		}
+	}
 	common.Log.Debug("matchedIDs=%d", len(matchedIDs))
 	for i, id := range srIDs {
 		common.Log.Debug("%4d: %#q", i, id)
@@ -64,7 +70,7 @@ func testMem(t *testing.T, term string, numDocs, docLen int) {
 // makeMemIndex creates an in-memory (unpersisted) bleve index and populates it with `numDocs`
 // documents, some of which contain the substring `term`.
 func makeMemIndex(t *testing.T, term string, numDocs, docLen int) (bleve.Index, []string) {
-	index, err := createBleveMemIndex()
+	index, err := createBleveMemIndex(AnalysisConfig{})
 	if err != nil {
 		t.Fatalf("createBleveMemIndex failed. err=%v", err)
 	}
@@ -108,7 +114,7 @@ func roundTrip(t *testing.T, index bleve.Index) bleve.Index {
 	if err != nil {
 		t.Fatalf("ImportBleveMem failed.err=%v", err)
 	}
-	common.Log.Info("!!!! data=%d", len(data))
+	common.Log.Debug("roundTrip: data=%d", len(data))
 	return index2
 }
 
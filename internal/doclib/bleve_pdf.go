@@ -5,14 +5,14 @@ package doclib
 import (
 	"errors"
 	"fmt"
-	"os"
+	"io"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/blevesearch/bleve"
-	"github.com/papercutsoftware/pdfsearch/internal/utils"
 	"github.com/unidoc/unipdf/v3/common"
 	"github.com/unidoc/unipdf/v3/model"
 )
@@ -21,22 +21,58 @@ import (
 type IDText struct {
 	// ID identifies the document + page index.
 	ID string
-	// Text is the text that bleve indexes.
+	// Text is the text that bleve indexes. It is empty for pages that are not in English.
 	Text string
+	// LangText holds the text of pages in languages other than English, keyed by language code.
+	// Each language's text is indexed with the analyzer for that language. See lang_detect.go.
+	LangText map[string]string
+	// Lang is the code of the language the page was indexed in.
+	Lang string
+	// The metadata of the PDF. It is the same for all pages. See DocMetadata.
+	Title    string
+	Author   string
+	Subject  string
+	Keywords []string // Lower case.
+	Producer string
+	Created  *time.Time // nil if unknown.
+	Modified *time.Time // nil if unknown.
+	// FirstPage is true for the first indexed page of the PDF. Searches on the metadata alone
+	// match only this page so that they return one match per PDF.
+	FirstPage bool
+	// Headings are the titles of the PDF's bookmarks that point to the page. See outline.go.
+	Headings string
 }
 
 // indexDocPagesLoc adds the text of all the pages in the PDF `fd.InPath` to `blevePdf` and to bleve
 // index `index`.
-// writeDocContents updates blevePdf with `fd` which describes a PDF on disk and `docContents`, the
-// document contents of the PDF`fd.InPath`.
+// The PDF is added atomically. Either all its pages are added to `blevePdf` and `index` or none
+// are. This is done in 4 steps.
+//  1) writeDocContents() writes the text positions of the pages to staged (temporary) files.
+//  2) The file list, which now has an entry for the PDF, is saved.
+//  3) All the pages are added to `index` in one bleve batch.
+//  4) The staged files are published by moving them to their final paths. In-memory documents are
+//     published by adding them to `blevePdf`.hashDoc.
+// If a step fails, the steps before it are rolled back. The PDF's file list entry is kept and
+// marked as deleted so that its document index is not reused. See unaddFile().
+// Saving the file list before the bleve batch means that every page in the bleve index belongs to
+// a PDF in the saved file list, even if the process stops before the next flush().
 func (blevePdf *BlevePdf) indexDocPagesLoc(index bleve.Index, fd fileDesc, docContents []pageContents) (
 	dtPdf, dtBleve time.Duration, err error) {
 	defer blevePdf.check()
 
 	t0 := time.Now()
 
+	// The outline and metadata are kept in `fd` so that PDFs re-indexed from their stored page
+	// contents, which have neither, keep them.
+	if len(docContents) > 0 && docContents[0].outline != nil {
+		fd.Outline = docContents[0].outline
+	}
+	if len(docContents) > 0 && docContents[0].meta != nil && !docContents[0].meta.Empty() {
+		fd.Meta = docContents[0].meta
+	}
+
 	// Update blevePdf, the PDF <-> bleve mapping.
-	docPages, err := blevePdf.writeDocContents(fd, docContents)
+	docPos, docPages, err := blevePdf.writeDocContents(fd, docContents)
 	if err != nil {
 		common.Log.Error("indexDocPagesLoc: Couldn't add doc contents to blevePdf %q err=%v",
 			fd.InPath, err)
@@ -49,47 +85,102 @@ func (blevePdf *BlevePdf) indexDocPagesLoc(index bleve.Index, fd fileDesc, docCo
 	common.Log.Debug("indexDocPagesLoc: inPath=%q docPages=%d", fd.InPath, len(docPages))
 
 	t0 = time.Now()
-	// Prepare `batch` for the bleve index update.
+	// Prepare `batch` for the bleve index update. All the document's pages go in one batch so that
+	// bleve applies them atomically.
 	batch := index.NewBatch()
 	for i, dp := range docPages {
 		// Don't weigh down the bleve index with the text bounding boxes, just give it the bare
 		// mininum it needs: an id that encodes the document number and page number; and text.
-		id := fmt.Sprintf("%04X.%d", dp.DocIdx, dp.PageIdx)
-		idText := IDText{ID: id, Text: dp.Text}
+		id := encodeID(dp.DocIdx, dp.PageIdx)
+		idText := newIDText(id, dp.Text, fd.Meta, i == 0)
+		idText.Headings = pageHeadings(fd.Outline, dp.PageNum)
 
 		err = batch.Index(id, idText)
 		if err != nil {
+			blevePdf.abortDoc(docPos)
 			return dtPdf, dtBleve, err
 		}
-		if batch.Size() >= 100 {
-			// Update `index`, the bleve index.
-			err = index.Batch(batch)
-			if err != nil {
-				return dtPdf, dtBleve, err
-			}
-			batch = index.NewBatch()
-		}
 		dt := time.Since(t0)
 		if i%100 == 0 {
-			common.Log.Debug("\tIndexed %2d of %d pages in %5.1f sec (%.2f sec/page)",
+			common.Log.Debug("\tBatched %2d of %d pages in %5.1f sec (%.2f sec/page)",
 				i+1, len(docPages), dt.Seconds(), dt.Seconds()/float64(i+1))
 			common.Log.Debug("\tid=%q text=%d", id, len(idText.Text))
 		}
 	}
-	if batch.Size() > 0 {
-		err = index.Batch(batch)
-		if err != nil {
-			return dtPdf, dtBleve, err
-		}
+	// Save the file list with the PDF's entry before bleve has the pages.
+	err = blevePdf.flush()
+	if err != nil {
+		common.Log.Error("indexDocPagesLoc: Couldn't save file list %q err=%v", fd.InPath, err)
+		blevePdf.abortDoc(docPos)
+		return dtPdf, dtBleve, err
+	}
+	// Update `index`, the bleve index.
+	err = index.Batch(batch)
+	if err != nil {
+		common.Log.Error("indexDocPagesLoc: Couldn't add pages to bleve %q err=%v", fd.InPath, err)
+		blevePdf.abortSavedDoc(docPos)
+		return dtPdf, dtBleve, err
 	}
-
 	dtBleve = time.Since(t0)
+
+	// Publish the text positions now that bleve has the pages.
+	err = blevePdf.publishDoc(fd.Hash, docPos)
+	if err != nil {
+		common.Log.Error("indexDocPagesLoc: Couldn't publish doc contents %q err=%v", fd.InPath, err)
+		unindexDocPages(index, docPages)
+		blevePdf.abortSavedDoc(docPos)
+		return dtPdf, dtBleve, err
+	}
+
 	dt := dtPdf + dtBleve
 	common.Log.Debug("\tIndexed %d pages in %.1f (Pdf) + %.1f (bleve) = %.1f sec (%.3f sec/page)\n",
 		len(docPages), dtPdf.Seconds(), dtBleve.Seconds(), dt.Seconds(), dt.Seconds()/float64(len(docPages)))
 	return dtPdf, dtBleve, err
 }
 
+// unindexDocPages deletes the pages `docPages` from bleve index `index`. It is used to roll back
+// the addition of a document's pages. If it fails, the pages are left in `index`. They are ignored
+// because their document is marked as deleted, and RepairIndex() removes them.
+func unindexDocPages(index bleve.Index, docPages []DocPageText) {
+	batch := index.NewBatch()
+	for _, dp := range docPages {
+		batch.Delete(encodeID(dp.DocIdx, dp.PageIdx))
+	}
+	if err := index.Batch(batch); err != nil {
+		common.Log.Error("unindexDocPages: Couldn't delete %d pages from bleve. err=%v",
+			len(docPages), err)
+	}
+}
+
+// publishDoc makes the document `docPos` with contents hash `hash` visible to searches. The staged
+// files of on-disk documents are moved to their final paths. In-memory documents are added to
+// `blevePdf`.hashDoc.
+func (blevePdf *BlevePdf) publishDoc(hash string, docPos *DocPositions) error {
+	if docPos.docPersist == nil {
+		blevePdf.hashDoc[hash] = docPos
+		return nil
+	}
+	return docPos.publish()
+}
+
+// abortDoc rolls back the addition of the document `docPos` to `blevePdf`. The document's files are
+// deleted and its entry is removed from `blevePdf.fdList`.
+func (blevePdf *BlevePdf) abortDoc(docPos *DocPositions) {
+	if err := blevePdf.deleteDocPositions(docPos); err != nil {
+		common.Log.Error("abortDoc: Couldn't delete docPos err=%v", err)
+	}
+	blevePdf.unaddFile(docPos.docIdx)
+}
+
+// abortSavedDoc is abortDoc() for a document whose file list entry has been saved. The file list
+// is saved again with the entry marked as deleted.
+func (blevePdf *BlevePdf) abortSavedDoc(docPos *DocPositions) {
+	blevePdf.abortDoc(docPos)
+	if err := blevePdf.flush(); err != nil {
+		common.Log.Error("abortSavedDoc: Couldn't save file list. err=%v", err)
+	}
+}
+
 /*
    BlevePdf is for serializing and accessing PagePositions.
 
@@ -129,20 +220,24 @@ func (blevePdf *BlevePdf) indexDocPagesLoc(index bleve.Index, fd fileDesc, docCo
           ...
 */
 
-const storeUpdatePeriodSec = 60.0
-
 // BlevePdf links a bleve index over texts to the PDFs that the texts were extracted from,
 // using the hashDoc {file hash: DocPositions} map. For each PDF, the DocPositions maps
 // extracted text to the location of text on the PDF page it was extracted from.
-// A BlevePdf can be saved to and retrieved from disk.
+// A BlevePdf can be saved to and retrieved from an IndexStore, by default a directory on disk.
+// A BlevePdf with an empty `root` is held in memory. Its DocPositions are kept in hashDoc and
+// nothing is written to disk.
 // BlevePdf is intentionally opaque.
 type BlevePdf struct {
-	root   string     // Top level directory of the data saved to disk.
+	root   string     // Top level directory of the index. The bleve index is kept here.
+	store  IndexStore // The BlevePdf data is saved here. nil for in-memory BlevePdfs.
 	fdList []fileDesc // List of fileDescs of PDFs the indexed data was extracted from.
 	// Should these be disk access functions? !@#$
 	hashDoc    map[string]*DocPositions // {file hash: DocPositions}
+	hashIndex  map[string]uint64        // {file hash: index into fdList}
 	indexHash  map[uint64]string        // Reverse map of hashDoc. !@#$ Needed for persistent case?
+	hashReader map[string]io.ReadSeeker // {file hash: PDF contents}. In-memory indexes only.
 	updateTime time.Time                // Time of last flush()
+	analysis   AnalysisConfig           // How the indexed text is analyzed. See analysis_config.go.
 }
 
 // String returns a string describing `blevePdf`.
@@ -171,7 +266,27 @@ func (blevePdf *BlevePdf) remove(hash string) {
 	if doc, ok := blevePdf.hashDoc[hash]; ok {
 		delete(blevePdf.indexHash, doc.docIdx)
 	}
+	if docIdx, ok := blevePdf.hashIndex[hash]; ok {
+		delete(blevePdf.indexHash, docIdx)
+	}
 	delete(blevePdf.hashDoc, hash)
+	delete(blevePdf.hashIndex, hash)
+	delete(blevePdf.hashReader, hash)
+}
+
+// hasHash returns true if a PDF with contents hash `hash` is in `blevePdf`.
+func (blevePdf *BlevePdf) hasHash(hash string) bool {
+	_, ok := blevePdf.hashIndex[hash]
+	return ok
+}
+
+// hashSet returns the set of hashes of the PDFs in `blevePdf`.
+func (blevePdf *BlevePdf) hashSet() map[string]bool {
+	set := map[string]bool{}
+	for hash := range blevePdf.hashIndex {
+		set[hash] = true
+	}
+	return set
 }
 
 // CheckConsistency should be set true to regularly check the BlevePdf consistency.
@@ -222,21 +337,39 @@ func (blevePdf BlevePdf) check() {
 	}
 }
 
-// pdfXrefDir returns the full path of PDF content <-> bleve index mappings on disk.
+// inMemory returns true if `blevePdf` is held in memory and not saved to disk.
+func (blevePdf BlevePdf) inMemory() bool {
+	return blevePdf.root == ""
+}
+
+// pdfXrefDir returns the name of the directory of PDF content <-> bleve index mappings in
+// `blevePdf`.store.
 func (blevePdf BlevePdf) pdfXrefDir() string {
-	return filepath.Join(blevePdf.root, "pdf.xref")
+	return "pdf.xref"
 }
 
 // openBlevePdf loads indexes from an existing locations directory `root` or creates one if it
-// doesn't exist.
+// doesn't exist. If `root` is empty, an empty in-memory BlevePdf is returned.
+// The BlevePdf data is kept in `store`, or in `root` if `store` is nil.
 // When opening for writing, do the following to ensure the final index is written to disk:
-//    blevePdf, err := doclib.openBlevePdf(persistDir, forceCreate)
+//    blevePdf, err := doclib.openBlevePdf(persistDir, store, forceCreate)
 //    defer blevePdf.flush()
 // !@#$ Doesn't load hashDoc
-func openBlevePdf(root string, forceCreate bool) (*BlevePdf, error) {
+func openBlevePdf(root string, store IndexStore, forceCreate bool) (*BlevePdf, error) {
 	blevePdf := BlevePdf{
-		root:      root,
-		indexHash: map[uint64]string{},
+		root:       root,
+		hashDoc:    map[string]*DocPositions{},
+		hashIndex:  map[string]uint64{},
+		indexHash:  map[uint64]string{},
+		hashReader: map[string]io.ReadSeeker{},
+		updateTime: time.Now(),
+	}
+	if blevePdf.inMemory() {
+		return &blevePdf, nil
+	}
+	blevePdf.store = store
+	if store == nil {
+		blevePdf.store = NewDirStore(root)
 	}
 
 	if forceCreate {
@@ -244,13 +377,20 @@ func openBlevePdf(root string, forceCreate bool) (*BlevePdf, error) {
 			return nil, err
 		}
 	}
-	filename := blevePdf.fileListPath()
-	fdList, err := loadFileDescList(filename)
+	fdList, err := loadFileDescList(blevePdf.store, blevePdf.fileListPath())
 	if err != nil {
 		return nil, err
 	}
 	blevePdf.fdList = fdList
+	blevePdf.analysis, err = loadAnalysisConfig(blevePdf.store, blevePdf.analysisPath())
+	if err != nil {
+		return nil, err
+	}
 	for i, fd := range fdList {
+		if fd.Deleted {
+			continue
+		}
+		blevePdf.hashIndex[fd.Hash] = uint64(i)
 		blevePdf.indexHash[uint64(i)] = fd.Hash
 	}
 
@@ -261,61 +401,115 @@ func openBlevePdf(root string, forceCreate bool) (*BlevePdf, error) {
 
 // pageContents are the result of text extraction on a PDF page
 type pageContents struct {
-	pageNum uint32        // (1-offset) PDF page number.
-	ppos    PagePositions // Positions of PDF text fragments on page.
-	text    string        // Extracted page text.
+	pageNum uint32         // (1-offset) PDF page number.
+	ppos    PagePositions  // Positions of PDF text fragments on page.
+	text    string         // Extracted page text.
+	meta    *DocMetadata   // Metadata of the document. The same for all pages. May be nil.
+	outline []outlineEntry // Outline of the document. The same for all pages. May be nil.
 }
 
-// extractDocPagePositions computes a fileDesc for the PDF `inPath` and extracts the text and text
-// positions for all the pages in the PDF. It returns this as a pageContents per page.
-func extractDocPagePositions(inPath string) (fileDesc, []pageContents, error) {
-	fd, err := createFileDesc(inPath)
-	if err != nil {
-		panic(err) // !@#$ should never happen
-		return fileDesc{}, nil, err
-	}
+// extractOptions controls the extraction of the text of a PDF.
+type extractOptions struct {
+	policy    FailurePolicy     // How pages that text can't be extracted from are handled.
+	maxPages  int               // PDFs with more pages than this fail. 0 for no limit.
+	passwords PasswordProvider  // Passwords for encrypted PDFs. May be nil.
+	ocr       OCREngine         // Recognizes the text on pages with no extractable text. May be nil.
+	extractor PageTextExtractor // Extracts the text of the pages. nil for UniDocExtractor.
+	maxSizeMB float64           // Embedded PDFs larger than this are skipped. 0 for no limit.
+}
 
-	// Compute the document contents.
-	docContents, err := extractDocContents(fd)
+// extractDocContents extracts page text and positions from the PDF described by `fd` according to
+// `opts`. See docContents() for `watch`.
+func extractDocContents(fd fileDesc, opts extractOptions, watch *extractWatch) (
+	[]pageContents, []IndexFailure, error) {
+	pdfPageProcessor, err := CreatePDFPageProcessorFile(fd.InPath, opts.passwords)
 	if err != nil {
-		return fileDesc{}, nil, err
+		return nil, nil, err
 	}
-	return fd, docContents, nil
+	defer pdfPageProcessor.Close()
+	return pdfPageProcessor.docContents(fd, opts, watch)
 }
 
-// extractDocContents extracts page text and positions from the PDF described by `fd`.
-func extractDocContents(fd fileDesc) ([]pageContents, error) {
-	pdfPageProcessor, err := CreatePDFPageProcessorFile(fd.InPath)
+// extractReaderContents extracts page text and positions from the PDF described by `fd` whose
+// contents are read from `rs` according to `opts`.
+func extractReaderContents(fd fileDesc, rs io.ReadSeeker, opts extractOptions) ([]pageContents,
+	[]IndexFailure, error) {
+	pdfPageProcessor, err := CreatePDFPageProcessorReader(fd.InPath, rs, opts.passwords)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer pdfPageProcessor.Close()
+	return pdfPageProcessor.docContents(fd, opts, nil)
+}
 
+// docContents extracts page text and positions from the PDF described by `fd` that is opened in
+// `pdfPageProcessor`.
+// If text can't be extracted from a page and `opts`.policy is SkipFailedPages, the page is skipped
+// and returned in the list of failed pages. Otherwise the PDF fails with the page's error.
+// If `opts`.maxPages > 0, PDFs with more than that many pages fail without being processed.
+// If `opts`.ocr is not nil, it is used to recognize the text on pages with no extractable text.
+// Otherwise these pages are skipped.
+// `watch` is told as each page is started and stops the extraction if a watchdog has abandoned it.
+// If `watch` is not nil, it is also given the PDFs embedded in the PDF. These are read from the
+// same PDF reader so that the PDF isn't parsed again. `watch` may be nil.
+func (pdfPageProcessor *PDFPageProcessor) docContents(fd fileDesc, opts extractOptions,
+	watch *extractWatch) ([]pageContents, []IndexFailure, error) {
 	numPages, err := pdfPageProcessor.NumPages()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if opts.maxPages > 0 && int(numPages) > opts.maxPages {
+		return nil, nil, fmt.Errorf("%d pages is over the limit of %d pages", numPages,
+			opts.maxPages)
 	}
 	common.Log.Debug("extractDocContents: %s numPages=%d", fd, numPages)
+	meta := pdfPageProcessor.Metadata()
+	outline := pdfPageProcessor.Outline()
 
 	var docContents []pageContents
+	var failures []IndexFailure
 	err = pdfPageProcessor.Process(func(pageNum uint32, page *model.PdfPage) error {
 		common.Log.Trace("extractDocContents: page %d of %d", pageNum, numPages)
-		text, textMarks, err := ExtractPageTextMarks(page)
+		if err := watch.startPage(pageNum); err != nil {
+			return err
+		}
+		text, marks, err := pdfPageProcessor.extractPageText(opts.extractor, pageNum, page)
 		if err != nil {
-			common.Log.Debug("ExtractDocPagePositions: ExtractPageTextMarks failed. "+
+			common.Log.Debug("ExtractDocPagePositions: ExtractPageText failed. "+
 				"%s pageNum=%d err=%v", fd, pageNum, err)
-			return nil // Skip errors for now. TODO: Make error handling configurable.
+			if opts.policy != SkipFailedPages {
+				return fmt.Errorf("page %d: %v", pageNum, err)
+			}
+			failures = append(failures, IndexFailure{InPath: fd.InPath, PageNum: pageNum, Err: err})
+			return nil
+		}
+		var ppos PagePositions
+		if opts.ocr != nil && strings.TrimSpace(text) == "" {
+			text, ppos, err = ocrPage(opts.ocr, fd.InPath, pageNum, page)
+			if err != nil {
+				common.Log.Debug("extractDocContents: OCR failed. %s pageNum=%d err=%v",
+					fd, pageNum, err)
+				err = fmt.Errorf("OCR failed: %v", err)
+				if opts.policy != SkipFailedPages {
+					return fmt.Errorf("page %d: %v", pageNum, err)
+				}
+				failures = append(failures, IndexFailure{InPath: fd.InPath, PageNum: pageNum, Err: err})
+				return nil
+			}
+		} else {
+			ppos = PagePositionsFromMarks(marks)
 		}
+		text, ppos = appendAnnotations(text, ppos, pageAnnotations(page))
 		if text == "" {
 			common.Log.Debug("extractDocContents: No text. %s page %d of %d", fd, pageNum, numPages)
 			return nil
 		}
 
-		ppos := PagePositionsFromTextMarks(textMarks)
 		docContents = append(docContents, pageContents{
 			pageNum: pageNum,
 			ppos:    ppos,
 			text:    text,
+			meta:    meta,
+			outline: outline,
 		})
 		if len(docContents)%100 == 99 {
 			common.Log.Debug("  pageNum=%d of %d docContents=%d %q", pageNum, numPages, len(docContents),
@@ -323,32 +517,36 @@ func extractDocContents(fd fileDesc) ([]pageContents, error) {
 		}
 		return nil
 	})
+	if err == nil && watch != nil && readEmbedded(fd.InPath) {
+		files := pdfPageProcessor.EmbeddedFiles(opts.maxSizeMB)
+		watch.setEmbedded(embeddedPdfDocs(fd, files))
+	}
 
-	return docContents, err
+	return docContents, failures, err
 }
 
 // writeDocContents updates blevePdf with `fd` which describes a PDF on disk and `docContents`, the
 // document contents of the PDF `fd.InPath`.
-// It returns the docContents as a []DocPageText. !@#$ Why?
-// This function is supposed to be atomic. If writing the document contents to disk fails at any
-// stage, all references to the document are removed. !@#$ Remove from bleve too.
-func (blevePdf *BlevePdf) writeDocContents(fd fileDesc, docContents []pageContents) ([]DocPageText,
-	error) {
+// It returns the DocPositions and the docContents as a []DocPageText. !@#$ Why?
+// The document contents are written to staged files that are not visible to searches until
+// docPos.publish() is called. If writing the document contents fails at any stage, all references
+// to the document are removed.
+func (blevePdf *BlevePdf) writeDocContents(fd fileDesc, docContents []pageContents) (*DocPositions,
+	[]DocPageText, error) {
 	defer blevePdf.check()
 	docPos, err := blevePdf.createDocPositions(fd)
 	if err != nil {
-		return nil, err
+		if docPos != nil {
+			blevePdf.abortDoc(docPos)
+		}
+		return nil, nil, err
 	}
 	docPages, err := blevePdf.addDocContents(docContents, docPos)
 	if err != nil {
-		//  This should delete the document directory from disk.
-		if err2 := blevePdf.deleteDocPositions(docPos); err2 != nil {
-			common.Log.Error("writeDocContents. Couldn't delete docPos err=%v", err2)
-		}
-		blevePdf.remove(fd.Hash)
-		return nil, err
+		blevePdf.abortDoc(docPos)
+		return nil, nil, err
 	}
-	return docPages, err
+	return docPos, docPages, err
 }
 
 // addDocContents writes `docContents` to the files in `docPos`.
@@ -394,72 +592,78 @@ func (blevePdf *BlevePdf) addDocContents(docContents []pageContents, docPos *Doc
 // When done submit back to index atomically
 func (blevePdf *BlevePdf) addFile(fd fileDesc) (uint64, string, bool) {
 	hash := fd.Hash
+	if docIdx, ok := blevePdf.hashIndex[hash]; ok {
+		return docIdx, blevePdf.fdList[docIdx].InPath, true
+	}
 
 	blevePdf.fdList = append(blevePdf.fdList, fd)
 	docIdx := uint64(len(blevePdf.fdList) - 1)
+	blevePdf.hashIndex[hash] = docIdx
 	blevePdf.indexHash[docIdx] = hash
-	dt := time.Since(blevePdf.updateTime)
-	if dt.Seconds() > storeUpdatePeriodSec {
-		blevePdf.flush()
-		blevePdf.updateTime = time.Now()
-	}
-	common.Log.Trace("addFile=%#q docIdx=%d dt=%.1f secs", hash, docIdx, dt.Seconds())
+	common.Log.Trace("addFile=%#q docIdx=%d", hash, docIdx)
 
 	return docIdx, fd.InPath, false
 }
 
-// flush saves `blevePdf` to disk.
+// unaddFile undoes the addFile() call that added the PDF with document index `docIdx` to
+// `blevePdf`.
+// The PDF's entry in `blevePdf.fdList` is kept and marked as deleted. It is not removed, even if it
+// is the last entry, because its document index must not be reused. Pages with this index may be
+// in the bleve index if the rollback of a bleve update failed, and they must not be mistaken for
+// pages of a PDF that is added later.
+func (blevePdf *BlevePdf) unaddFile(docIdx uint64) {
+	if int(docIdx) >= len(blevePdf.fdList) {
+		return
+	}
+	blevePdf.fdList[docIdx].Deleted = true
+	blevePdf.remove(blevePdf.fdList[docIdx].Hash)
+}
+
+// flush saves `blevePdf` to its IndexStore. In-memory BlevePdfs are not saved.
 func (blevePdf *BlevePdf) flush() error {
+	if blevePdf.inMemory() {
+		return nil
+	}
 	dt := time.Since(blevePdf.updateTime)
 	docIdx := uint64(len(blevePdf.fdList) - 1)
 	common.Log.Debug("*** flush %3d files (%4.1f sec) %s",
 		docIdx+1, dt.Seconds(), blevePdf.updateTime)
-	return saveFileDescList(blevePdf.fileListPath(), blevePdf.fdList)
+	if err := saveFileDescList(blevePdf.store, blevePdf.fileListPath(), blevePdf.fdList); err != nil {
+		return err
+	}
+	blevePdf.updateTime = time.Now()
+	return nil
 }
 
-// fileListPath is the path where blevePdf.fdList is stored on disk.
+// fileListPath is the name of the file in `blevePdf`.store where blevePdf.fdList is saved.
 func (blevePdf *BlevePdf) fileListPath() string {
-	return filepath.Join(blevePdf.root, "file_list.json")
+	return "file_list.json"
+}
+
+// analysisPath is the name of the file in `blevePdf`.store where blevePdf.analysis is saved.
+func (blevePdf *BlevePdf) analysisPath() string {
+	return "analysis.json"
 }
 
-// removeBlevePdf removes the BlevePdf persistent data in the directory tree under `root` from disk.
+// removeBlevePdf removes the BlevePdf persistent data from `blevePdf`.store. The bleve index is
+// not removed.
 // TODO: Improve name. Mayb removeFromDisk() ?
 func (blevePdf *BlevePdf) removeBlevePdf() error {
-	if !utils.Exists(blevePdf.root) {
-		return nil
-	}
-	flPath := blevePdf.fileListPath()
-	if !utils.Exists(flPath) && !strings.HasPrefix(flPath, "store.") {
-		common.Log.Error("%q doesn't appear to a be a BlevePdf directory. %q doesn't exist.",
-			blevePdf.root, flPath)
-		return errors.New("not a BlevePdf directory")
-	}
-	err := utils.RemoveDirectory(blevePdf.root)
-	if err != nil {
-		common.Log.Error("RemoveDirectory(%q) failed. err=%v", blevePdf.root, err)
+	for _, name := range []string{blevePdf.fileListPath(), blevePdf.analysisPath(),
+		blevePdf.pdfXrefDir()} {
+		if err := blevePdf.store.RemoveAll(name); err != nil {
+			common.Log.Error("removeBlevePdf: RemoveAll(%q) failed. root=%q err=%v",
+				name, blevePdf.root, err)
+			return err
+		}
 	}
-	return err
+	return nil
 }
 
-// docPath returns the file path to the PDF<-bleve cross-reference files for PDF with hash `hash`.
+// docPath returns the name of the PDF<-bleve cross-reference files for PDF with hash `hash`.
 func (blevePdf *BlevePdf) docPath(hash string) string {
 	common.Log.Trace("docPath: %q %s", blevePdf.pdfXrefDir(), hash)
-	return filepath.Join(blevePdf.pdfXrefDir(), hash)
-}
-
-// createIfNecessary creates `blevePdf`.pdfXrefDir if it doesn't already exist.
-// It is called at the start of createDocPositions() which allows us to avoid creating our directory
-// structure until we have successfully extracted the text from PDF pages.
-func (blevePdf *BlevePdf) createIfNecessary() error {
-	if blevePdf.root == "" {
-		return fmt.Errorf("blevePdf=%s", *blevePdf)
-	}
-	d := blevePdf.pdfXrefDir()
-	common.Log.Trace("createIfNecessary: 1 pdfXrefDir=%q", d)
-	if utils.Exists(d) {
-		return nil
-	}
-	return utils.MkDir(d)
+	return path.Join(blevePdf.pdfXrefDir(), hash)
 }
 
 // docPageText returns the text extracted from the PDF page with document and page indices
@@ -496,7 +700,10 @@ func (blevePdf *BlevePdf) docPagePositions(docIdx uint64, pageIdx uint32) (
 
 // createDocPositions adds fileDesc `fd` to `blevePdf` and returns a DocPositions for writing.
 // createDocPositions always populates the returned DocPositions with base fields.
-// Necessary directories are created and files are opened.
+// The DocPositions' files are written to staged paths. They are moved to their final paths by
+// docPos.publish().
+// If createDocPositions returns an error along with a DocPositions, the caller must roll back the
+// add with blevePdf.abortDoc().
 func (blevePdf *BlevePdf) createDocPositions(fd fileDesc) (*DocPositions, error) {
 	common.Log.Debug("createDocPositions: blevePdf.pdfXrefDir=%q", blevePdf.pdfXrefDir())
 	docIdx, inPath, exists := blevePdf.addFile(fd)
@@ -507,37 +714,28 @@ func (blevePdf *BlevePdf) createDocPositions(fd fileDesc) (*DocPositions, error)
 	}
 	docPos, err := blevePdf.baseFields(docIdx)
 	if err != nil {
+		blevePdf.unaddFile(docIdx)
 		return nil, err
 	}
-	// Persistent case.
-	if err = blevePdf.createIfNecessary(); err != nil {
-		return nil, err
+	if blevePdf.inMemory() {
+		return docPos, nil
 	}
-	docPos.dataFile, err = os.Create(docPos.dataPath)
-	if err != nil {
-		return nil, err
-	}
-	err = utils.MkDir(docPos.textDir)
-	return docPos, err
+	docPos.stage()
+	return docPos, nil
 }
 
-// !@#$ also delete from bleve
+// deleteDocPositions removes the PDF<-bleve cross-reference files for `docPos` from
+// `blevePdf`.store.
+// It doesn't change the bleve index. removeDoc() removes a document from the bleve index and from
+// `blevePdf`.
 func (blevePdf *BlevePdf) deleteDocPositions(docPos *DocPositions) error {
+	if docPos.docPersist == nil {
+		return nil
+	}
 	common.Log.Info("deleteDocPositions:\n\tblevePdf.pdfXrefDir=%q\n\tdataPath=%q\n\ttextDir=%q",
 		blevePdf.pdfXrefDir(), docPos.dataPath, docPos.textDir)
-	if utils.Exists(docPos.dataPath) {
-		if err := os.Remove(docPos.dataPath); err != nil {
-			return err
-		}
-	}
-	if utils.Exists(docPos.partitionsPath) {
-		// partitionsPath is written after this function is called, so this isn't necessary right now
-		if err := os.Remove(docPos.partitionsPath); err != nil {
-			return err
-		}
-	}
-	if utils.Exists(docPos.textDir) {
-		if err := os.RemoveAll(docPos.textDir); err != nil {
+	for _, name := range docPos.paths() {
+		if err := blevePdf.store.RemoveAll(*name); err != nil {
 			return err
 		}
 	}
@@ -545,12 +743,20 @@ func (blevePdf *BlevePdf) deleteDocPositions(docPos *DocPositions) error {
 }
 
 // openDocPosition opens a DocPositions for reading.
-// Necessary files are opened in docPos.openDoc().
+// The positions data and page partitions are read in docPos.openDoc(). In-memory DocPositions are
+// looked up in `blevePdf`.hashDoc.
 func (blevePdf *BlevePdf) openDocPosition(docIdx uint64) (*DocPositions, error) {
 	docPos, err := blevePdf.baseFields(docIdx)
 	if err != nil {
 		return nil, err
 	}
+	if blevePdf.inMemory() {
+		docPos, ok := blevePdf.hashDoc[blevePdf.fdList[docIdx].Hash]
+		if !ok {
+			return nil, ErrNoPositions
+		}
+		return docPos, nil
+	}
 	err = docPos.openDoc()
 	return docPos, err
 }
@@ -562,6 +768,10 @@ func (blevePdf *BlevePdf) baseFields(docIdx uint64) (*DocPositions, error) {
 		common.Log.Error("docIdx=%d blevePdf=%s\n=%#v", docIdx, *blevePdf, *blevePdf)
 		return nil, errors.New("out of range")
 	}
+	if blevePdf.fdList[docIdx].Deleted {
+		common.Log.Debug("baseFields: docIdx=%d %s", docIdx, blevePdf.fdList[docIdx])
+		return nil, ErrDeleted
+	}
 	inPath := blevePdf.fdList[docIdx].InPath
 	hash := blevePdf.fdList[docIdx].Hash
 
@@ -570,10 +780,14 @@ func (blevePdf *BlevePdf) baseFields(docIdx uint64) (*DocPositions, error) {
 		docIdx:        docIdx,
 		pagePositions: map[uint32]PagePositions{},
 	}
+	if blevePdf.inMemory() {
+		return &docPos, nil
+	}
 
 	locPath := blevePdf.docPath(hash)
 	// !@#$ No need for this
 	persist := docPersist{
+		store:          blevePdf.store,
 		dataPath:       locPath + ".dat",
 		partitionsPath: locPath + ".idx.json",
 		textDir:        locPath + ".page.contents",
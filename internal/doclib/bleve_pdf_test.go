@@ -0,0 +1,194 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/papercutsoftware/pdfsearch/internal/serial"
+)
+
+// errInjected is the error returned by failingStore and failingIndex.
+var errInjected = errors.New("injected failure")
+
+// failingStore is an IndexStore whose Rename fails when `failRename` is set.
+type failingStore struct {
+	IndexStore
+	failRename bool
+}
+
+// Rename renames `oldName` to `newName` or fails if s.failRename is set.
+func (s *failingStore) Rename(oldName, newName string) error {
+	if s.failRename {
+		return errInjected
+	}
+	return s.IndexStore.Rename(oldName, newName)
+}
+
+// bleveIndex lets failingIndex embed a bleve.Index. An embedded bleve.Index would be a field
+// called Index, which hides the Index method.
+type bleveIndex = bleve.Index
+
+// failingIndex is a bleve.Index whose Batch fails from its `failFrom`th call. (1-offset.
+// 0 means never.)
+type failingIndex struct {
+	bleveIndex
+	numBatches int
+	failFrom   int
+}
+
+// Batch executes `b` or fails if it is the i.failFrom'th or a later call.
+func (i *failingIndex) Batch(b *bleve.Batch) error {
+	i.numBatches++
+	if i.failFrom > 0 && i.numBatches >= i.failFrom {
+		return errInjected
+	}
+	return i.bleveIndex.Batch(b)
+}
+
+// TestIndexDocRollback checks that a PDF whose addition to an index fails part way is rolled back:
+// its text positions files are removed, its pages are not in the bleve index and its saved file
+// list entry is marked as deleted. It checks that the document index of a rolled back PDF is not
+// reused, so pages that couldn't be removed from the bleve index aren't matched.
+func TestIndexDocRollback(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "rollback")
+	store := &failingStore{IndexStore: NewMemStore()}
+	blevePdf, err := openBlevePdf(root, store, false)
+	if err != nil {
+		t.Fatalf("openBlevePdf failed. err=%v", err)
+	}
+	memIndex, err := createBleveMemIndex(AnalysisConfig{})
+	if err != nil {
+		t.Fatalf("createBleveMemIndex failed. err=%v", err)
+	}
+	defer memIndex.Close()
+	index := &failingIndex{bleveIndex: memIndex}
+
+	// addDoc adds a PDF with contents hash `hash` whose pages contain `word` to `blevePdf`.
+	addDoc := func(hash, word string) error {
+		fd := fileDesc{InPath: word + ".pdf", Hash: hash}
+		_, _, err := blevePdf.indexDocPagesLoc(index, fd, rollbackContents(word))
+		return err
+	}
+	// checkDocs checks that the saved file list has an entry for each of `hashes` and that the
+	// entries whose hashes are in `deleted` are marked as deleted.
+	checkDocs := func(desc string, hashes []string, deleted map[string]bool) {
+		t.Helper()
+		fdList, err := loadFileDescList(store, blevePdf.fileListPath())
+		if err != nil {
+			t.Fatalf("%s: loadFileDescList failed. err=%v", desc, err)
+		}
+		if len(fdList) != len(hashes) {
+			t.Fatalf("%s: %d saved files. Expected %d", desc, len(fdList), len(hashes))
+		}
+		for i, fd := range fdList {
+			if fd.Hash != hashes[i] || fd.Deleted != deleted[fd.Hash] {
+				t.Fatalf("%s: fdList[%d]=%+v. Expected hash=%q deleted=%t", desc, i, fd,
+					hashes[i], deleted[hashes[i]])
+			}
+			if blevePdf.hasHash(fd.Hash) == fd.Deleted {
+				t.Fatalf("%s: hasHash(%q)=%t", desc, fd.Hash, !fd.Deleted)
+			}
+		}
+		names, err := store.List(blevePdf.pdfXrefDir())
+		if err != nil {
+			t.Fatalf("%s: List failed. err=%v", desc, err)
+		}
+		for _, name := range names {
+			hash := strings.Split(name, ".")[0]
+			if deleted[hash] || strings.HasSuffix(name, stagedExt) {
+				t.Fatalf("%s: %q was not removed", desc, name)
+			}
+		}
+	}
+	// checkSearch checks that searching `index` for `word` matches the pages of the PDF with
+	// document index `docIdx`, or no pages if `docIdx` is negative.
+	checkSearch := func(desc, word string, docIdx int) {
+		t.Helper()
+		matches, err := blevePdf.SearchBleveIndex(index, word, 10)
+		if err != nil {
+			t.Fatalf("%s: SearchBleveIndex failed. err=%v", desc, err)
+		}
+		numPages := len(rollbackContents(word))
+		if docIdx < 0 {
+			numPages = 0
+		}
+		if len(matches.Matches) != numPages {
+			t.Fatalf("%s: %q matched %d pages. Expected %d. matches=%s", desc, word,
+				len(matches.Matches), numPages, matches)
+		}
+		for _, m := range matches.Matches {
+			if m.docIdx != uint64(docIdx) {
+				t.Fatalf("%s: %q matched docIdx=%d. Expected %d", desc, word, m.docIdx, docIdx)
+			}
+		}
+	}
+
+	if err := addDoc("aaaa", "apple"); err != nil {
+		t.Fatalf("addDoc failed. err=%v", err)
+	}
+	checkDocs("added", []string{"aaaa"}, nil)
+	checkSearch("added", "apple", 0)
+
+	// The bleve update fails.
+	index.failFrom = index.numBatches + 1
+	if err := addDoc("bbbb", "banana"); err != errInjected {
+		t.Fatalf("bleve failure: err=%v. Expected %v", err, errInjected)
+	}
+	index.failFrom = 0
+	checkDocs("bleve failure", []string{"aaaa", "bbbb"}, map[string]bool{"bbbb": true})
+	checkSearch("bleve failure", "banana", -1)
+
+	// Publishing the text positions fails and the pages are removed from bleve.
+	store.failRename = true
+	if err := addDoc("cccc", "cherry"); err != errInjected {
+		t.Fatalf("publish failure: err=%v. Expected %v", err, errInjected)
+	}
+	store.failRename = false
+	deleted := map[string]bool{"bbbb": true, "cccc": true}
+	checkDocs("publish failure", []string{"aaaa", "bbbb", "cccc"}, deleted)
+	checkSearch("publish failure", "cherry", -1)
+
+	// Publishing fails and so does removing the pages from bleve. The pages stay in bleve but
+	// don't match because their document is marked as deleted.
+	store.failRename = true
+	index.failFrom = index.numBatches + 2
+	if err := addDoc("dddd", "date"); err != errInjected {
+		t.Fatalf("unindex failure: err=%v. Expected %v", err, errInjected)
+	}
+	store.failRename = false
+	index.failFrom = 0
+	deleted["dddd"] = true
+	checkDocs("unindex failure", []string{"aaaa", "bbbb", "cccc", "dddd"}, deleted)
+	checkSearch("unindex failure", "date", -1)
+	if n, err := memIndex.DocCount(); err != nil || n != 4 {
+		t.Fatalf("unindex failure: bleve has %d pages. Expected 4. err=%v", n, err)
+	}
+
+	// A PDF added after the failures gets a new document index.
+	if err := addDoc("eeee", "elderberry"); err != nil {
+		t.Fatalf("addDoc failed. err=%v", err)
+	}
+	checkDocs("added again", []string{"aaaa", "bbbb", "cccc", "dddd", "eeee"}, deleted)
+	checkSearch("added again", "elderberry", 4)
+	checkSearch("added again", "date", -1)
+	checkSearch("added again", "apple", 0)
+}
+
+// rollbackContents returns the contents of the 2 pages of a test PDF whose text includes `word`.
+func rollbackContents(word string) []pageContents {
+	var docContents []pageContents
+	for pageNum := uint32(1); pageNum <= 2; pageNum++ {
+		ppos := PagePositions{[]serial.OffsetBBox{
+			{Offset: 0, Llx: 10, Lly: 20, Urx: 30, Ury: 40},
+		}}
+		text := fmt.Sprintf("Page %d has a %s", pageNum, word)
+		docContents = append(docContents, pageContents{pageNum: pageNum, ppos: ppos, text: text})
+	}
+	return docContents
+}
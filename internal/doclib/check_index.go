@@ -0,0 +1,410 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements consistency checking and repair of on-disk indexes.
+ *  - CheckIndex()
+ *  - RepairIndex()
+ *  - RepairIndexContext()
+ */
+
+package doclib
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/papercutsoftware/pdfsearch/internal/utils"
+	"github.com/unidoc/unipdf/v3/common"
+)
+
+// IndexCheck is the result of checking the consistency of an on-disk index with CheckIndex().
+type IndexCheck struct {
+	NumDocs     int      // Number of PDFs in the index.
+	NumPages    int      // Number of pages in the text positions of the PDFs in the index.
+	DocCount    uint64   // Number of pages in the bleve index.
+	CorruptDocs []string // Paths of PDFs with missing or corrupt text positions.
+	EmptyDocs   []string // Paths of PDFs that have no pages in the bleve index.
+	BadIDs      []string // bleve IDs that don't refer to a page of a PDF in the index.
+	OrphanFiles []string // Files in pdf.xref in the IndexStore that don't belong to a PDF in the index.
+	Problems    []string // Descriptions of all the problems that were found.
+	// Unrepaired are the paths of the PDFs that RepairIndex() removed from the index and couldn't
+	// re-index, either because they no longer exist or because indexing them failed.
+	Unrepaired []string
+	// Remaining are the descriptions of the problems that CheckIndex() found after RepairIndex().
+	Remaining []string
+
+	badDocs map[uint64]bool // Document indexes of `CorruptDocs` and `EmptyDocs`.
+}
+
+// OK returns true if no problems were found in the index.
+func (c IndexCheck) OK() bool {
+	return len(c.Problems) == 0
+}
+
+// Repaired returns true if RepairIndex() returned `c` and it fixed all the problems in `c` without
+// losing any PDFs from the index.
+func (c IndexCheck) Repaired() bool {
+	return len(c.Unrepaired) == 0 && len(c.Remaining) == 0
+}
+
+// String returns a human readable description of `c`.
+func (c IndexCheck) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "IndexCheck{docs=%d pages=%d bleve pages=%d corrupt=%d empty=%d badIDs=%d orphans=%d}",
+		c.NumDocs, c.NumPages, c.DocCount, len(c.CorruptDocs), len(c.EmptyDocs), len(c.BadIDs),
+		len(c.OrphanFiles))
+	for i, problem := range c.Problems {
+		fmt.Fprintf(&sb, "\n%4d: %s", i+1, problem)
+	}
+	for _, inPath := range c.Unrepaired {
+		fmt.Fprintf(&sb, "\nnot re-indexed: %q", inPath)
+	}
+	for _, problem := range c.Remaining {
+		fmt.Fprintf(&sb, "\nnot repaired: %s", problem)
+	}
+	return sb.String()
+}
+
+// addProblem records a problem described by format string `format` and `args` in `c`.
+func (c *IndexCheck) addProblem(format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+	common.Log.Info("IndexCheck: %s", problem)
+	c.Problems = append(c.Problems, problem)
+}
+
+// CheckIndex checks the consistency of the on-disk index in `persistDir`. It checks that
+//  - the text positions of every page of every PDF in the index pass their CRC checks,
+//  - every bleve ID refers to a page of a PDF in the index,
+//  - every PDF in the index has pages in the bleve index,
+//  - there are no files in the pdf.xref directory that don't belong to a PDF in the index,
+//  - the number of pages in the bleve index matches the number in the text positions.
+// The files that link the bleve index to the PDFs are read from `store`, or from `persistDir` if
+// `store` is nil.
+func CheckIndex(persistDir string, store IndexStore) (IndexCheck, error) {
+	blevePdf, index, err := openIndexForUpdate(persistDir, store)
+	if err != nil {
+		return IndexCheck{}, err
+	}
+	defer index.Close()
+	return blevePdf.checkIndex(index)
+}
+
+// RepairIndex checks the on-disk index in `persistDir` with CheckIndex() then fixes the problems
+// that were found. PDFs with corrupt or missing pages are removed from the index then re-indexed
+// from their original paths, if they still exist. PDFs embedded in other PDFs and PDFs in ZIP
+// archives are re-indexed with the files that hold them. Bad bleve IDs and orphaned files are deleted.
+// `report` is a supplied function that is called to report progress.
+// It returns the IndexCheck from before the repair with the PDFs that couldn't be re-indexed in
+// Unrepaired and the problems that CheckIndex() finds after the repair in Remaining. Use
+// IndexCheck.Repaired() to tell if the repair succeeded.
+func RepairIndex(persistDir string, report func(string)) (IndexCheck, error) {
+	return RepairIndexContext(context.Background(), persistDir,
+		IndexOptions{OnEvent: ReportEvents(report)}, report)
+}
+
+// RepairIndexContext is RepairIndex() with a context `ctx` that can cancel the re-indexing and
+// options `opts` for re-indexing the PDFs. See IndexPdfFilesContext().
+// `report` is called to report the PDFs that can't be re-indexed. `opts`.OnEvent is called to
+// report the PDFs that are re-indexed.
+func RepairIndexContext(ctx context.Context, persistDir string, opts IndexOptions,
+	report func(string)) (IndexCheck, error) {
+	blevePdf, index, err := openIndexForUpdate(persistDir, opts.Store)
+	if err != nil {
+		return IndexCheck{}, err
+	}
+	check, err := blevePdf.checkIndex(index)
+	if err != nil || check.OK() {
+		index.Close()
+		return check, err
+	}
+
+	if len(check.BadIDs) > 0 {
+		batch := index.NewBatch()
+		for _, id := range check.BadIDs {
+			batch.Delete(id)
+		}
+		if err := index.Batch(batch); err != nil {
+			index.Close()
+			return check, err
+		}
+	}
+
+	var reindexList []string
+	reindexSet := map[string]bool{}
+	var removedList []string // Paths of the removed PDFs that are to be re-indexed.
+	for docIdx := range check.badDocs {
+		fd := blevePdf.fdList[docIdx]
+		if fd.Deleted {
+			// Already removed as the file holding an embedded PDF.
+			continue
+		}
+		if err := blevePdf.removeDoc(index, docIdx); err != nil {
+			index.Close()
+			blevePdf.flush()
+			return check, err
+		}
+		inPath := fd.InPath
+		if fd.Parent != "" {
+			// Embedded PDFs and PDFs in ZIP archives are re-indexed with the files that hold them.
+			// The documents that hold them are removed from the index so that they aren't skipped
+			// as already indexed.
+			inPath = rootPath(fd.InPath)
+			ancestors := map[string]bool{}
+			for p := fd.Parent; p != ""; p = parentPath(p) {
+				ancestors[p] = true
+			}
+			for i, doc := range blevePdf.fdList {
+				if doc.Deleted || !ancestors[doc.InPath] {
+					continue
+				}
+				if err := blevePdf.removeDoc(index, uint64(i)); err != nil {
+					index.Close()
+					blevePdf.flush()
+					return check, err
+				}
+			}
+		}
+		if !utils.Exists(inPath) {
+			check.Unrepaired = append(check.Unrepaired, fd.InPath)
+			if report != nil {
+				report(fmt.Sprintf("removed %q. It no longer exists so it can't be re-indexed.",
+					fd.InPath))
+			}
+			continue
+		}
+		removedList = append(removedList, fd.InPath)
+		if !reindexSet[inPath] {
+			reindexSet[inPath] = true
+			reindexList = append(reindexList, inPath)
+		}
+	}
+
+	for _, name := range check.OrphanFiles {
+		if err := blevePdf.store.RemoveAll(name); err != nil {
+			common.Log.Error("RepairIndex: Couldn't remove %q. err=%v", name, err)
+		}
+	}
+
+	if err := blevePdf.flush(); err != nil {
+		index.Close()
+		return check, err
+	}
+	if err := index.Close(); err != nil {
+		return check, err
+	}
+
+	if len(reindexList) > 0 {
+		sort.Strings(reindexList)
+		blevePdf, index, result, err := IndexPdfFilesContext(ctx, reindexList, persistDir, false,
+			opts)
+		if index != nil {
+			index.Close()
+		}
+		if err != nil {
+			return check, err
+		}
+		common.Log.Info("RepairIndex: re-indexed %d of %d PDFs. %s", result.NumAdded,
+			len(reindexList), result)
+		indexed := map[string]bool{}
+		for _, fd := range blevePdf.fdList {
+			if !fd.Deleted {
+				indexed[fd.InPath] = true
+			}
+		}
+		for _, inPath := range removedList {
+			if !indexed[inPath] {
+				check.Unrepaired = append(check.Unrepaired, inPath)
+			}
+		}
+	}
+	sort.Strings(check.Unrepaired)
+
+	after, err := CheckIndex(persistDir, opts.Store)
+	if err != nil {
+		return check, err
+	}
+	check.Remaining = after.Problems
+	return check, nil
+}
+
+// checkIndex checks the consistency of `blevePdf` and `index`. See CheckIndex().
+func (blevePdf *BlevePdf) checkIndex(index bleve.Index) (IndexCheck, error) {
+	check := IndexCheck{badDocs: map[uint64]bool{}}
+
+	ids, err := bleveIDs(index)
+	if err != nil {
+		return check, err
+	}
+	check.DocCount, err = index.DocCount()
+	if err != nil {
+		return check, err
+	}
+
+	// The number of partitions of each valid PDF in the index.
+	docPages := map[uint64]int{}
+	for i, fd := range blevePdf.fdList {
+		if fd.Deleted {
+			continue
+		}
+		docIdx := uint64(i)
+		check.NumDocs++
+		numPages, err := blevePdf.checkDocPositions(docIdx)
+		if err != nil {
+			check.addProblem("%q: corrupt text positions. %v", fd.InPath, err)
+			check.CorruptDocs = append(check.CorruptDocs, fd.InPath)
+			check.badDocs[docIdx] = true
+			continue
+		}
+		docPages[docIdx] = numPages
+		check.NumPages += numPages
+	}
+
+	// The number of bleve pages of each PDF in the index.
+	blevePages := map[uint64]int{}
+	for _, id := range ids {
+		docIdx, pageIdx, err := decodeID(id)
+		if err != nil {
+			check.addProblem("bleve ID %q: can't be decoded. %v", id, err)
+			check.BadIDs = append(check.BadIDs, id)
+			continue
+		}
+		if int(docIdx) >= len(blevePdf.fdList) || blevePdf.fdList[docIdx].Deleted {
+			check.addProblem("bleve ID %q: no PDF with docIdx=%d", id, docIdx)
+			check.BadIDs = append(check.BadIDs, id)
+			continue
+		}
+		numPages, ok := docPages[docIdx]
+		if !ok {
+			// The PDF's text positions are corrupt. This has been reported.
+			continue
+		}
+		if int(pageIdx) >= numPages {
+			check.addProblem("bleve ID %q: pageIdx=%d out of range. %q has %d pages", id, pageIdx,
+				blevePdf.fdList[docIdx].InPath, numPages)
+			check.BadIDs = append(check.BadIDs, id)
+			continue
+		}
+		blevePages[docIdx]++
+	}
+
+	for docIdx, numPages := range docPages {
+		fd := blevePdf.fdList[docIdx]
+		switch n := blevePages[docIdx]; {
+		case numPages == 0 || n == 0:
+			check.addProblem("%q: no pages. %d positions pages, %d bleve pages", fd.InPath,
+				numPages, n)
+			check.EmptyDocs = append(check.EmptyDocs, fd.InPath)
+			check.badDocs[docIdx] = true
+		case n != numPages:
+			check.addProblem("%q: %d positions pages != %d bleve pages", fd.InPath, numPages, n)
+			check.CorruptDocs = append(check.CorruptDocs, fd.InPath)
+			check.badDocs[docIdx] = true
+		}
+	}
+
+	if check.DocCount != uint64(check.NumPages) {
+		check.addProblem("bleve DocCount=%d != %d pages in text positions", check.DocCount,
+			check.NumPages)
+	}
+
+	orphans, err := blevePdf.orphanFiles()
+	if err != nil {
+		return check, err
+	}
+	for _, path := range orphans {
+		check.addProblem("orphaned file %q", path)
+	}
+	check.OrphanFiles = orphans
+
+	sort.Strings(check.CorruptDocs)
+	sort.Strings(check.EmptyDocs)
+	common.Log.Info("checkIndex: %s", check)
+	return check, nil
+}
+
+// checkDocPositions checks the text positions of the PDF with document index `docIdx` in
+// `blevePdf` and returns its number of pages.
+// The positions of every page must be in the data file and match their CRC checksum, and the
+// extracted text of every page must be in the index's IndexStore.
+func (blevePdf *BlevePdf) checkDocPositions(docIdx uint64) (int, error) {
+	docPos, err := blevePdf.baseFields(docIdx)
+	if err != nil {
+		return 0, err
+	}
+	pagePartitions, err := docPos.loadPartitions()
+	if err != nil {
+		return 0, err
+	}
+	data, err := blevePdf.store.ReadFile(docPos.dataPath)
+	if err != nil {
+		return 0, err
+	}
+	for pageIdx, e := range pagePartitions {
+		if e.PageNum == 0 {
+			return 0, fmt.Errorf("pageIdx=%d: bad page number %+v", pageIdx, e)
+		}
+		if int(e.Offset)+int(e.Size) > len(data) {
+			return 0, fmt.Errorf("pageIdx=%d: partition %+v past end of data (%d bytes)",
+				pageIdx, e, len(data))
+		}
+		buf := data[e.Offset : e.Offset+e.Size]
+		if check := crc32.ChecksumIEEE(buf); check != e.Check {
+			return 0, fmt.Errorf("pageIdx=%d: bad checksum %d. partition=%+v", pageIdx, check, e)
+		}
+		if textPath := docPos.textPath(uint32(pageIdx)); !blevePdf.store.Exists(textPath) {
+			return 0, fmt.Errorf("pageIdx=%d: no text %q", pageIdx, textPath)
+		}
+	}
+	return len(pagePartitions), nil
+}
+
+// orphanFiles returns the files in `blevePdf`.pdfXrefDir() that don't belong to a PDF in
+// `blevePdf`. These include the staged files of PDFs that were not completely added.
+func (blevePdf *BlevePdf) orphanFiles() ([]string, error) {
+	d := blevePdf.pdfXrefDir()
+	names, err := blevePdf.store.List(d)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	for _, name := range names {
+		hash := strings.Split(name, ".")[0]
+		if strings.HasSuffix(name, stagedExt) || !blevePdf.hasHash(hash) {
+			orphans = append(orphans, path.Join(d, name))
+		}
+	}
+	return orphans, nil
+}
+
+// bleveIDs returns the IDs of all the documents in `index` in ascending order.
+// The IDs are read a page at a time by a search sorted by ID. Each page starts after the last ID of
+// the page before it, so the search doesn't have to skip over the earlier IDs.
+func bleveIDs(index bleve.Index) ([]string, error) {
+	const pageSize = 1000
+	var ids []string
+	var after []string
+	for {
+		search := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), pageSize, 0, false)
+		search.SortBy([]string{"_id"})
+		if after != nil {
+			search.SetSearchAfter(after)
+		}
+		sr, err := index.Search(search)
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range sr.Hits {
+			ids = append(ids, hit.ID)
+		}
+		if len(sr.Hits) < pageSize {
+			break
+		}
+		after = []string{sr.Hits[len(sr.Hits)-1].ID}
+	}
+	return ids, nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/papercutsoftware/pdfsearch/internal/utils"
+)
+
+// TestRepairIndex checks that CheckIndex finds corrupt text positions, bad bleve IDs and orphaned
+// files in an on-disk index, that RepairIndex fixes them and that RepairIndex reports the PDFs it
+// couldn't re-index.
+func TestRepairIndex(t *testing.T) {
+	dir := t.TempDir()
+	paths := map[string]string{}
+	var pathList []string
+	for _, test := range []struct {
+		name  string
+		texts []string
+	}{
+		{"one.pdf", []string{"alpha"}},
+		{"two.pdf", []string{"beta", "more beta"}},
+		{"three.pdf", []string{"gamma", "more gamma", "last gamma"}},
+	} {
+		inPath := filepath.Join(dir, test.name)
+		writeTestPdf(t, inPath, len(test.texts), drawTexts(test.texts...))
+		paths[test.name] = inPath
+		pathList = append(pathList, inPath)
+	}
+	persistDir := filepath.Join(dir, "store")
+	_, index, _, err := IndexPdfFiles(pathList, persistDir, true, nil)
+	if err != nil {
+		t.Fatalf("IndexPdfFiles failed. err=%v", err)
+	}
+	index.Close()
+
+	check, err := CheckIndex(persistDir, nil)
+	if err != nil {
+		t.Fatalf("CheckIndex failed. err=%v", err)
+	}
+	if !check.OK() || check.NumDocs != 3 || check.NumPages != 6 || check.DocCount != 6 {
+		t.Fatalf("New index: %s", check)
+	}
+
+	// corruptPositions overwrites the text positions data of the PDF called `name`.
+	corruptPositions := func(name string) {
+		hash, err := utils.FileHash(paths[name])
+		if err != nil {
+			t.Fatalf("FileHash failed. err=%v", err)
+		}
+		dataPath := filepath.Join(persistDir, "pdf.xref", hash+".dat")
+		data, err := ioutil.ReadFile(dataPath)
+		if err != nil {
+			t.Fatalf("ReadFile failed. err=%v", err)
+		}
+		for i := range data {
+			data[i] ^= 0xFF
+		}
+		if err := ioutil.WriteFile(dataPath, data, 0644); err != nil {
+			t.Fatalf("WriteFile failed. err=%v", err)
+		}
+	}
+
+	// Corrupt one.pdf's text positions, add a page of a PDF that isn't in the index to bleve and
+	// add a file that doesn't belong to any PDF.
+	corruptPositions("one.pdf")
+	bleveIndex, err := bleve.Open(filepath.Join(persistDir, "bleve"))
+	if err != nil {
+		t.Fatalf("bleve.Open failed. err=%v", err)
+	}
+	badID := encodeID(99, 0)
+	if err := bleveIndex.Index(badID, IDText{ID: badID, Text: "delta"}); err != nil {
+		t.Fatalf("Index failed. err=%v", err)
+	}
+	bleveIndex.Close()
+	orphanName := "pdf.xref/0000000000.dat"
+	if err := NewDirStore(persistDir).WriteFile(orphanName, []byte("orphan")); err != nil {
+		t.Fatalf("WriteFile failed. err=%v", err)
+	}
+
+	check, err = CheckIndex(persistDir, nil)
+	if err != nil {
+		t.Fatalf("CheckIndex failed. err=%v", err)
+	}
+	if check.OK() ||
+		!reflect.DeepEqual(check.CorruptDocs, []string{paths["one.pdf"]}) ||
+		!reflect.DeepEqual(check.BadIDs, []string{badID}) ||
+		!reflect.DeepEqual(check.OrphanFiles, []string{orphanName}) {
+		t.Fatalf("Corrupted index: %s", check)
+	}
+
+	check, err = RepairIndex(persistDir, nil)
+	if err != nil {
+		t.Fatalf("RepairIndex failed. err=%v", err)
+	}
+	if !reflect.DeepEqual(check.CorruptDocs, []string{paths["one.pdf"]}) || !check.Repaired() {
+		t.Fatalf("Repair: %s", check)
+	}
+	check, err = CheckIndex(persistDir, nil)
+	if err != nil {
+		t.Fatalf("CheckIndex failed. err=%v", err)
+	}
+	if !check.OK() || check.NumDocs != 3 || check.NumPages != 6 {
+		t.Fatalf("Repaired index: %s", check)
+	}
+	checkSearchPaths(t, persistDir, "alpha", []string{paths["one.pdf"]})
+	checkSearchPaths(t, persistDir, "delta", nil)
+
+	// A PDF that no longer exists can't be re-indexed. The repair removes it and reports it.
+	corruptPositions("three.pdf")
+	if err := os.Remove(paths["three.pdf"]); err != nil {
+		t.Fatalf("Remove failed. err=%v", err)
+	}
+	check, err = RepairIndex(persistDir, nil)
+	if err != nil {
+		t.Fatalf("RepairIndex failed. err=%v", err)
+	}
+	if check.Repaired() || !reflect.DeepEqual(check.Unrepaired, []string{paths["three.pdf"]}) ||
+		len(check.Remaining) != 0 {
+		t.Fatalf("Repair of missing PDF: %s", check)
+	}
+	check, err = CheckIndex(persistDir, nil)
+	if err != nil {
+		t.Fatalf("CheckIndex failed. err=%v", err)
+	}
+	if !check.OK() || check.NumDocs != 2 || check.NumPages != 3 {
+		t.Fatalf("Repaired index: %s", check)
+	}
+	checkSearchPaths(t, persistDir, "gamma", nil)
+	checkSearchPaths(t, persistDir, "beta", []string{paths["two.pdf"]})
+}
+
+// TestBleveIDs checks that bleveIDs returns all the IDs in an index with more IDs than it reads
+// at a time.
+func TestBleveIDs(t *testing.T) {
+	index, err := createBleveMemIndex(AnalysisConfig{})
+	if err != nil {
+		t.Fatalf("createBleveMemIndex failed. err=%v", err)
+	}
+	defer index.Close()
+	var expected []string
+	batch := index.NewBatch()
+	for docIdx := uint64(0); docIdx < 1234; docIdx++ {
+		for pageIdx := uint32(0); pageIdx < 2; pageIdx++ {
+			id := encodeID(docIdx, pageIdx)
+			if err := batch.Index(id, IDText{ID: id, Text: "page"}); err != nil {
+				t.Fatalf("batch.Index failed. err=%v", err)
+			}
+			expected = append(expected, id)
+		}
+	}
+	if err := index.Batch(batch); err != nil {
+		t.Fatalf("Batch failed. err=%v", err)
+	}
+	sort.Strings(expected)
+
+	ids, err := bleveIDs(index)
+	if err != nil {
+		t.Fatalf("bleveIDs failed. err=%v", err)
+	}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("bleveIDs returned %d IDs. Expected %d", len(ids), len(expected))
+	}
+}
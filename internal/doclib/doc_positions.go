@@ -7,37 +7,89 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
-	"io"
-	"io/ioutil"
-	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
 
 	flatbuffers "github.com/google/flatbuffers/go"
 	"github.com/papercutsoftware/pdfsearch/internal/serial"
+	"github.com/papercutsoftware/pdfsearch/internal/serial/pdf_index"
 	"github.com/unidoc/unipdf/v3/common"
 )
 
 // DocPositions is used to the link per-document data in a bleve index to the PDF the data was
 // extracted from.
 // There is one DocPositions per PDF.
+// DocPositions for in-memory indexes have a nil docPersist and keep their page numbers and page
+// texts in `pageNums` and `pageTexts`.
+// DocPositions for indexes loaded by LoadIndexFromBytes() read their pages from the serialized
+// buffer through `flat`.
 type DocPositions struct {
 	inPath        string                   // Path of input PDF.
 	docIdx        uint64                   // Index into blevePdf.fileList.
 	pagePositions map[uint32]PagePositions // {(1-offset) PDF pageNum: locations of text on page}
+	pageNums      []uint32                 // {pageIdx: (1-offset) PDF pageNum}. In-memory only.
+	pageTexts     []string                 // {pageIdx: extracted page text}. In-memory only.
+	flat          *pdf_index.DocPositions  // Serialized pages. Loaded indexes only.
 	*docPersist                            // Optional extra fields for on-disk indexes.
 }
 
-// docPersist tracks the info for indexing a PDF on disk.
+// docPersist tracks the info for indexing a PDF in an IndexStore.
 type docPersist struct {
-	dataFile       *os.File        // Positions are stored in this file.
-	pagePartitions []pagePartition // Indexes into `dataFile`. There is a pagePartition per page.
-	dataPath       string          // Path of `dataFile`.
-	partitionsPath string          // Path where `pagePartitions` is saved.
+	store          IndexStore      // The files are kept here.
+	data           []byte          // Positions data. It is saved in the file `dataPath`.
+	dirty          bool            // `data` and `pagePartitions` have changed since they were read.
+	pagePartitions []pagePartition // Indexes into `data`. There is a pagePartition per page.
+	dataPath       string          // Name of the file where `data` is saved.
+	partitionsPath string          // Name of the file where `pagePartitions` is saved.
 	textDir        string          // Extracted text. Used for debugging
 }
 
+// stagedExt is appended to the paths of a docPersist's files while they are being written.
+const stagedExt = ".tmp"
+
+// stage switches `d` to writing its files to temporary paths. Any files left at these paths by an
+// earlier failed run are removed. publish() moves the files to their final paths.
+func (d *docPersist) stage() {
+	for _, path := range d.paths() {
+		*path += stagedExt
+		if d.store.Exists(*path) {
+			if err := d.store.RemoveAll(*path); err != nil {
+				common.Log.Error("stage: Couldn't remove %q. err=%v", *path, err)
+			}
+		}
+	}
+}
+
+// publish moves the files of `d` from their staged paths to their final paths.
+// If publish fails, the paths in `d` are those of the files that have been moved or not, so
+// BlevePdf.deleteDocPositions() will remove all the files.
+func (d *docPersist) publish() error {
+	for _, path := range d.paths() {
+		if !strings.HasSuffix(*path, stagedExt) {
+			continue
+		}
+		final := strings.TrimSuffix(*path, stagedExt)
+		if err := d.store.RemoveAll(final); err != nil {
+			return err
+		}
+		// Documents with no pages have no page text files to publish.
+		if d.store.Exists(*path) {
+			if err := d.store.Rename(*path, final); err != nil {
+				return err
+			}
+		}
+		*path = final
+	}
+	return nil
+}
+
+// paths returns pointers to the paths of the files in `d`.
+func (d *docPersist) paths() []*string {
+	return []*string{&d.dataPath, &d.partitionsPath, &d.textDir}
+}
+
 // pagePartition is the location of the bytes of a PagePositions in a data file.
 // The partition is over [Offset, Offset+Size).
 // There is one pagePartition (corresponding to a PagePositions) per page.
@@ -52,7 +104,13 @@ type pagePartition struct {
 func (docPos DocPositions) String() string {
 	var sb strings.Builder
 	fmt.Fprintf(&sb, "DocPositions{%q docIdx=%d", filepath.Base(docPos.inPath), docPos.docIdx)
-	sb.WriteString(docPos.docPersist.String())
+	if docPos.docPersist != nil {
+		sb.WriteString(docPos.docPersist.String())
+	} else if docPos.flat != nil {
+		fmt.Fprintf(&sb, " serialized pages=%d", docPos.flat.PageNumsLength())
+	} else {
+		fmt.Fprintf(&sb, " in-memory pages=%d", len(docPos.pageNums))
+	}
 	sb.WriteString("}")
 	return sb.String()
 }
@@ -62,6 +120,18 @@ func (docPos DocPositions) Len() int {
 	return len(docPos.pageKeys()) // !@#$
 }
 
+// numPages returns the number of pages that have been added to `docPos`. Unlike Len(), it works
+// for DocPositions that have been opened for reading.
+func (docPos DocPositions) numPages() int {
+	switch {
+	case docPos.docPersist != nil:
+		return len(docPos.pagePartitions)
+	case docPos.flat != nil:
+		return docPos.flat.PageNumsLength()
+	}
+	return len(docPos.pageNums)
+}
+
 // check panics is `docPos` is an inconsistent state, which should never happen.
 func (docPos DocPositions) check() {
 	keys := docPos.pageKeys()
@@ -84,41 +154,58 @@ func (d docPersist) String() string {
 	return fmt.Sprintf("docPersist{%s}", strings.Join(parts, "\n"))
 }
 
-// openDoc opens `docPos`. The necessary files are opened.
+// openDoc opens `docPos`. The positions data and page partitions are read.
 func (docPos *DocPositions) openDoc() error {
-	f, err := os.Open(docPos.dataPath)
+	data, err := docPos.store.ReadFile(docPos.dataPath)
 	if err != nil {
 		return err
 	}
-	docPos.dataFile = f
+	docPos.data = data
 
-	b, err := ioutil.ReadFile(docPos.partitionsPath)
+	pagePartitions, err := docPos.loadPartitions()
 	if err != nil {
 		return err
 	}
+	docPos.pagePartitions = pagePartitions
+	return nil
+}
+
+// loadPartitions returns the pagePartitions saved in `docPos`.partitionsPath.
+func (docPos *DocPositions) loadPartitions() ([]pagePartition, error) {
+	b, err := docPos.store.ReadFile(docPos.partitionsPath)
+	if err != nil {
+		return nil, err
+	}
 	var pagePartitions []pagePartition
 	if err := json.Unmarshal(b, &pagePartitions); err != nil {
-		return err
+		return nil, err
 	}
-	docPos.pagePartitions = pagePartitions
-	return nil
+	return pagePartitions, nil
 }
 
-// Save saves `docPos` to disk.
+// Save saves the positions data and page partitions of `docPos` to its IndexStore.
 func (docPos *DocPositions) Save() error {
+	if err := docPos.store.WriteFile(docPos.dataPath, docPos.data); err != nil {
+		return err
+	}
 	b, err := json.MarshalIndent(docPos.pagePartitions, "", "\t")
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(docPos.partitionsPath, b, 0666)
+	return docPos.store.WriteFile(docPos.partitionsPath, b)
 }
 
-// Close closes `docPos`'s open files.
+// Close closes `docPos`. Pages that have been added to `docPos` are saved. In-memory
+// DocPositions are not saved.
 func (docPos *DocPositions) Close() error {
+	if docPos.docPersist == nil || !docPos.dirty {
+		return nil
+	}
 	if err := docPos.Save(); err != nil {
 		return err
 	}
-	return docPos.dataFile.Close()
+	docPos.dirty = false
+	return nil
 }
 
 // AddDocPage adds a page with (1-offset) page number `pageNum` and contents `ppos` to `docPos`.
@@ -131,37 +218,41 @@ func (docPos *DocPositions) AddDocPage(pageNum uint32, ppos PagePositions, text
 		return 0, errors.New("pageNum=0")
 	}
 	docPos.pagePositions[pageNum] = ppos
+	if docPos.docPersist == nil {
+		return docPos.addDocPageMem(pageNum, text), nil
+	}
 	return docPos.addDocPagePersist(pageNum, ppos, text)
 }
 
+// addDocPageMem adds the page number `pageNum` and text `text` of a page to in-memory `docPos` and
+// returns the page's page index.
+func (docPos *DocPositions) addDocPageMem(pageNum uint32, text string) uint32 {
+	docPos.pageNums = append(docPos.pageNums, pageNum)
+	docPos.pageTexts = append(docPos.pageTexts, text)
+	return uint32(len(docPos.pageNums) - 1)
+}
+
 // !@#$ Do we need to be writing to disk here?
 func (docPos *DocPositions) addDocPagePersist(pageNum uint32, ppos PagePositions, text string) (
 	uint32, error) {
 	b := flatbuffers.NewBuilder(0)
 	buf := serial.MakeDocPageLocations(b, ppos.offsetBBoxes)
 	check := crc32.ChecksumIEEE(buf) // uint32
-	offset, err := docPos.dataFile.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return 0, err
-	}
 
 	partition := pagePartition{
-		Offset:  uint32(offset),
+		Offset:  uint32(len(docPos.data)),
 		Size:    uint32(len(buf)),
 		Check:   check,
 		PageNum: uint32(pageNum),
 	}
 
-	if _, err := docPos.dataFile.Write(buf); err != nil {
-		return 0, err
-	}
-
+	docPos.data = append(docPos.data, buf...)
 	docPos.pagePartitions = append(docPos.pagePartitions, partition)
+	docPos.dirty = true
 	pageIdx := uint32(len(docPos.pagePartitions) - 1)
 
 	// !@#$ Remove. Maybe record line numbers.
-	filename := docPos.textPath(pageIdx)
-	err = ioutil.WriteFile(filename, []byte(text), 0644)
+	err := docPos.store.WriteFile(docPos.textPath(pageIdx), []byte(text))
 	if err != nil {
 		return 0, err
 	}
@@ -171,6 +262,18 @@ func (docPos *DocPositions) addDocPagePersist(pageNum uint32, ppos PagePositions
 // pageText returns the text extracted for page with in `docPos` with page index `pageIdx`.
 // TODO: Can we remove this? It seems to be called after the extracted text is indexed.
 func (docPos *DocPositions) pageText(pageIdx uint32) (string, error) {
+	if docPos.flat != nil {
+		if int(pageIdx) >= docPos.flat.PageTextsLength() {
+			return "", fmt.Errorf("Bad pageIdx=%d. %d pages", pageIdx, docPos.flat.PageTextsLength())
+		}
+		return string(docPos.flat.PageTexts(int(pageIdx))), nil
+	}
+	if docPos.docPersist == nil {
+		if int(pageIdx) >= len(docPos.pageTexts) {
+			return "", fmt.Errorf("Bad pageIdx=%d. %d pages", pageIdx, len(docPos.pageTexts))
+		}
+		return docPos.pageTexts[pageIdx], nil
+	}
 	return docPos.readPersistedPageText(pageIdx)
 }
 
@@ -178,8 +281,7 @@ func (docPos *DocPositions) pageText(pageIdx uint32) (string, error) {
 // `pageIdx` for a persisted index.
 // TODO: Can we remove this? See pageText(). !@#$
 func (docPos *DocPositions) readPersistedPageText(pageIdx uint32) (string, error) {
-	filename := docPos.textPath(pageIdx)
-	b, err := ioutil.ReadFile(filename)
+	b, err := docPos.store.ReadFile(docPos.textPath(pageIdx))
 	if err != nil {
 		return "", err
 	}
@@ -189,6 +291,17 @@ func (docPos *DocPositions) readPersistedPageText(pageIdx uint32) (string, error
 // pageNumPositions returns the page number (1-offset) and PagePositions of the text on the `pageIdx`
 // (0-offset) in `docPos`.
 func (docPos *DocPositions) pageNumPositions(pageIdx uint32) (uint32, PagePositions, error) {
+	if docPos.flat != nil {
+		return docPos.readFlatPagePositions(pageIdx)
+	}
+	if docPos.docPersist == nil {
+		if int(pageIdx) >= len(docPos.pageNums) {
+			return 0, PagePositions{}, fmt.Errorf("Bad pageIdx=%d. %d pages", pageIdx,
+				len(docPos.pageNums))
+		}
+		pageNum := docPos.pageNums[pageIdx]
+		return pageNum, docPos.pagePositions[pageNum], nil
+	}
 	return docPos.readPersistedPagePositions(pageIdx)
 }
 
@@ -204,21 +317,21 @@ func (docPos *DocPositions) pageKeys() []int {
 
 func (docPos *DocPositions) readPersistedPagePositions(pageIdx uint32) (
 	uint32, PagePositions, error) {
+	if int(pageIdx) >= len(docPos.pagePartitions) {
+		return 0, PagePositions{}, fmt.Errorf("Bad pageIdx=%d. %d pages", pageIdx,
+			len(docPos.pagePartitions))
+	}
 	e := docPos.pagePartitions[pageIdx]
 	if e.PageNum == 0 {
 		return 0, PagePositions{}, fmt.Errorf("Bad span pageIdx=%d e=%+v", pageIdx, e)
 	}
 
-	offset, err := docPos.dataFile.Seek(int64(e.Offset), io.SeekStart)
-	if err != nil || uint32(offset) != e.Offset {
-		common.Log.Error("ReadPagePositions: Seek failed e=%+v offset=%d err=%v",
-			e, offset, err)
-		return 0, PagePositions{}, err
-	}
-	buf := make([]byte, e.Size)
-	if _, err := docPos.dataFile.Read(buf); err != nil {
-		return 0, PagePositions{}, err
+	if int(e.Offset)+int(e.Size) > len(docPos.data) {
+		common.Log.Error("ReadPagePositions: Partition past end of data e=%+v data=%d",
+			e, len(docPos.data))
+		return 0, PagePositions{}, errors.New("partition past end of data")
 	}
+	buf := docPos.data[e.Offset : e.Offset+e.Size]
 	size := len(buf)
 	check := crc32.ChecksumIEEE(buf)
 	if check != e.Check {
@@ -229,9 +342,21 @@ func (docPos *DocPositions) readPersistedPagePositions(pageIdx uint32) (
 	return e.PageNum, PagePositions{locations}, err
 }
 
+// readFlatPagePositions returns the page number (1-offset) and PagePositions of the text on the
+// `pageIdx` (0-offset) in `docPos` for an index loaded from a serialized buffer.
+func (docPos *DocPositions) readFlatPagePositions(pageIdx uint32) (uint32, PagePositions, error) {
+	if int(pageIdx) >= docPos.flat.PageNumsLength() {
+		return 0, PagePositions{}, fmt.Errorf("Bad pageIdx=%d. %d pages", pageIdx,
+			docPos.flat.PageNumsLength())
+	}
+	pageNum := docPos.flat.PageNums(int(pageIdx))
+	locations, err := serial.ReadPagePositions(docPos.flat, int(pageIdx))
+	return pageNum, PagePositions{locations}, err
+}
+
 // textPath returns the path to the file holding the extracted text of the page with index `pageIdx`.
 func (docPos *DocPositions) textPath(pageIdx uint32) string {
-	return filepath.Join(docPos.textDir, fmt.Sprintf("%03d.txt", pageIdx))
+	return path.Join(docPos.textDir, fmt.Sprintf("%03d.txt", pageIdx))
 }
 
 // DocPageText contains doc:page indexes, the PDF page number and the text extracted from the PDF page.
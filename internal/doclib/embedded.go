@@ -0,0 +1,430 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the indexing of PDFs that are embedded in other PDFs.
+ *  - embeddedFiles() reads the files in the EmbeddedFiles name tree of a PDF. This is where both
+ *    file attachments and the files in PDF portfolios (collections) are kept. The names of files in
+ *    portfolio folders are prefixed with their folder paths.
+ *  - embeddedPdfDocs() returns the attached PDFs as child documents. A child document's path is
+ *    its parent's path, "!/" and its name, e.g.
+ *      contract.pdf!/schedule-a.pdf
+ *      contract.pdf!/appendices/costs.pdf!/rates.pdf
+ *    When PDFs are indexed from disk, the attachments of each PDF are read while its text is
+ *    extracted, from the same PDF reader. See PDFPageProcessor.docContents().
+ *  - embeddedDocs() returns the attached PDFs, and the PDFs attached to them, of a PDF that is
+ *    read from an io.ReadSeeker. It is used for in-memory indexes.
+ *  - openDocReader() opens the document at a path like this by extracting it from the PDFs on disk
+ *    that hold it, so that matches in child documents can be marked up.
+ *  - PDFs in ZIP archives are child documents of the archives in the same way. See archive.go.
+ *
+ * The paths of the files on disk that hold child documents must not contain "!/".
+ */
+
+package doclib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/papercutsoftware/pdfsearch/internal/utils"
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// embeddedSep separates the path of a document from the name of a document embedded in it.
+const embeddedSep = "!/"
+
+const (
+	// maxEmbeddedDepth is the maximum depth of PDFs embedded in PDFs that are indexed.
+	maxEmbeddedDepth = 8
+	// maxEmbeddedFiles is the maximum number of embedded files read from a PDF. It guards against
+	// loops in corrupt name trees.
+	maxEmbeddedFiles = 10000
+)
+
+// embeddedFile is a file embedded in a PDF.
+type embeddedFile struct {
+	name string // Unique name of the file in the PDF. Files in portfolio folders have folder paths.
+	data []byte // Decoded contents of the file.
+}
+
+// embeddedDoc is a PDF embedded in another PDF.
+type embeddedDoc struct {
+	fd   fileDesc
+	data []byte
+}
+
+// embeddedPath returns the path of the document named `name` that is embedded in document
+// `parent`.
+func embeddedPath(parent, name string) string {
+	return parent + embeddedSep + name
+}
+
+// rootPath returns the path of the file on disk that holds document `inPath`. This is `inPath`
+// for documents that aren't embedded in other documents.
+func rootPath(inPath string) string {
+	if i := strings.Index(inPath, embeddedSep); i >= 0 {
+		return inPath[:i]
+	}
+	return inPath
+}
+
+// parentPath returns the path of the document that document `inPath` is embedded in, or "" if it
+// isn't embedded in another document.
+func parentPath(inPath string) string {
+	if i := strings.LastIndex(inPath, embeddedSep); i >= 0 {
+		return inPath[:i]
+	}
+	return ""
+}
+
+// embeddedLevel returns the number of PDFs that hold the document `inPath`. It is 0 for documents
+// on disk and for the PDFs in ZIP archives.
+func embeddedLevel(inPath string) int {
+	level := strings.Count(inPath, embeddedSep)
+	if level > 0 && isArchivePath(rootPath(inPath)) {
+		level--
+	}
+	return level
+}
+
+// readEmbedded returns true if the attachments of PDF `inPath` are to be indexed. PDFs that are
+// embedded maxEmbeddedDepth levels deep don't have their attachments indexed.
+func readEmbedded(inPath string) bool {
+	if embeddedLevel(inPath) >= maxEmbeddedDepth {
+		common.Log.Info("readEmbedded: %q is embedded too deeply. Not reading its attachments.",
+			inPath)
+		return false
+	}
+	return true
+}
+
+// embeddedDocs returns the PDFs embedded in the PDF described by `parent` whose contents are `rs`,
+// followed by the PDFs embedded in each of them, down to maxEmbeddedDepth levels.
+// Encrypted PDFs are decrypted with the passwords supplied by `passwords`, which may be nil.
+// Embedded files are not essential, so PDFs whose embedded files can't be read are treated as
+// having none.
+func embeddedDocs(parent fileDesc, rs io.ReadSeeker, passwords PasswordProvider) []embeddedDoc {
+	if !readEmbedded(parent.InPath) {
+		return nil
+	}
+	pdfPageProcessor, err := CreatePDFPageProcessorReader(parent.InPath, rs, passwords)
+	if err != nil {
+		common.Log.Debug("embeddedDocs: Could not open %q. err=%v", parent.InPath, err)
+		return nil
+	}
+	var docs []embeddedDoc
+	for _, doc := range embeddedPdfDocs(parent, pdfPageProcessor.EmbeddedFiles(0)) {
+		docs = append(docs, doc)
+		docs = append(docs, embeddedDocs(doc.fd, bytes.NewReader(doc.data), passwords)...)
+	}
+	return docs
+}
+
+// embeddedPdfDocs returns the PDFs in `files`, which are embedded in the PDF described by
+// `parent`, as child documents of `parent`. Embedded files that aren't PDFs are skipped.
+func embeddedPdfDocs(parent fileDesc, files []embeddedFile) []embeddedDoc {
+	var docs []embeddedDoc
+	for _, f := range files {
+		if !isPdfData(f.data) {
+			common.Log.Debug("embeddedPdfDocs: %q in %q is not a PDF.", f.name, parent.InPath)
+			continue
+		}
+		hash, size, err := utils.ReaderHash(bytes.NewReader(f.data))
+		if err != nil {
+			common.Log.Error("embeddedPdfDocs: Could not hash %q in %q. err=%v", f.name,
+				parent.InPath, err)
+			continue
+		}
+		fd := fileDesc{
+			InPath:   embeddedPath(parent.InPath, f.name),
+			Hash:     hash,
+			SizeMB:   float64(size) / 1024.0 / 1024.0,
+			Parent:   parent.InPath,
+			RootHash: parent.rootHash(),
+		}
+		docs = append(docs, embeddedDoc{fd: fd, data: f.data})
+	}
+	return docs
+}
+
+// dataExtractor returns a docExtractor that extracts the text of the PDF whose contents are `data`.
+func dataExtractor(data []byte) docExtractor {
+	return func(fd fileDesc, opts extractOptions, watch *extractWatch) ([]pageContents,
+		[]IndexFailure, error) {
+		pdfPageProcessor, err := CreatePDFPageProcessorReader(fd.InPath, bytes.NewReader(data),
+			opts.passwords)
+		if err != nil {
+			return nil, nil, err
+		}
+		return pdfPageProcessor.docContents(fd, opts, watch)
+	}
+}
+
+// isPdfData returns true if `data` looks like the contents of a PDF. The PDF header may follow
+// other data, so the first kilobyte is searched for it.
+func isPdfData(data []byte) bool {
+	if len(data) > 1024 {
+		data = data[:1024]
+	}
+	return bytes.Contains(data, []byte("%PDF-"))
+}
+
+// embeddedFiles returns the files in the EmbeddedFiles name tree of the PDF opened in
+// `pdfReader`. See 7.11.4 "Embedded File Streams" (p. 102 PDF32000_2008) and, for portfolios,
+// 12.3.5 "Collections" and its folders extension in Adobe Supplement to ISO 32000, Extension
+// Level 3.
+// Files that are larger than `maxSizeMB` megabytes are skipped without being decoded. 0 means no
+// limit.
+func embeddedFiles(pdfReader *model.PdfReader, maxSizeMB float64) []embeddedFile {
+	trailer, err := pdfReader.GetTrailer()
+	if err != nil {
+		return nil
+	}
+	catalog, ok := core.GetDict(trailer.Get("Root"))
+	if !ok {
+		return nil
+	}
+	names, ok := core.GetDict(catalog.Get("Names"))
+	if !ok {
+		return nil
+	}
+	folders := map[int]string{}
+	if collection, ok := core.GetDict(catalog.Get("Collection")); ok {
+		if root, ok := core.GetDict(collection.Get("Folders")); ok {
+			// The root folder's name is the name of the portfolio, not part of the file paths.
+			readFolders(root.Get("Child"), "", folders, map[*core.PdfObjectDictionary]bool{}, 0)
+		}
+	}
+
+	var files []embeddedFile
+	used := map[string]bool{}
+	nameTreeWalk(names.Get("EmbeddedFiles"), 0, func(key string, value core.PdfObject) bool {
+		spec, ok := core.GetDict(value)
+		if !ok {
+			return true
+		}
+		name := embeddedName(key, spec, folders)
+		data, ok := fileSpecData(spec, name, maxSizeMB)
+		if !ok {
+			return true
+		}
+		files = append(files, embeddedFile{name: uniqueName(name, used), data: data})
+		return len(files) < maxEmbeddedFiles
+	})
+	return files
+}
+
+// nameTreeWalk calls `visit` with the keys and values in name tree `node` in order until `visit`
+// returns false. It returns false if `visit` did. See 7.9.6 "Name Trees".
+func nameTreeWalk(node core.PdfObject, depth int, visit func(key string, value core.PdfObject) bool) bool {
+	dict, ok := core.GetDict(node)
+	if !ok || depth > 32 {
+		return true
+	}
+	if names, ok := core.GetArray(dict.Get("Names")); ok {
+		for i := 0; i+1 < names.Len(); i += 2 {
+			s, ok := core.GetString(names.Get(i))
+			if !ok {
+				continue
+			}
+			if !visit(s.Decoded(), names.Get(i+1)) {
+				return false
+			}
+		}
+	}
+	if kids, ok := core.GetArray(dict.Get("Kids")); ok {
+		for _, kid := range kids.Elements() {
+			if !nameTreeWalk(kid, depth+1, visit) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// readFolders adds the paths of portfolio folder `folder` and its siblings and their descendants to
+// `folders`, a {folder ID: folder path} map. `prefix` is the path of the folders' parent.
+func readFolders(folder core.PdfObject, prefix string, folders map[int]string,
+	visited map[*core.PdfObjectDictionary]bool, depth int) {
+	for obj := folder; obj != nil && depth <= 32; {
+		dict, ok := core.GetDict(obj)
+		if !ok || visited[dict] {
+			return
+		}
+		visited[dict] = true
+		name := cleanName(pdfText(dict.Get("Name")))
+		if prefix != "" {
+			name = prefix + "/" + name
+		}
+		if id, ok := core.GetIntVal(dict.Get("ID")); ok {
+			folders[id] = name
+		}
+		readFolders(dict.Get("Child"), name, folders, visited, depth+1)
+		obj = dict.Get("Next")
+	}
+}
+
+// fileSpecData returns the decoded contents of the embedded file `name` in file specification
+// `spec`. Files larger than `maxSizeMB` megabytes are skipped. Their sizes are checked before they
+// are decoded, using the size in the embedded file's parameters if it has one and the size of its
+// encoded contents otherwise. 0 means no limit.
+func fileSpecData(spec *core.PdfObjectDictionary, name string, maxSizeMB float64) ([]byte, bool) {
+	ef, ok := core.GetDict(spec.Get("EF"))
+	if !ok {
+		return nil, false
+	}
+	var stream *core.PdfObjectStream
+	for _, key := range []core.PdfObjectName{"UF", "F"} {
+		if stream, ok = core.GetStream(ef.Get(key)); ok {
+			break
+		}
+	}
+	if stream == nil {
+		return nil, false
+	}
+	if maxSizeMB > 0 {
+		size := int64(len(stream.Stream))
+		if params, ok := core.GetDict(stream.Get("Params")); ok {
+			if n, ok := core.GetIntVal(params.Get("Size")); ok && int64(n) > size {
+				size = int64(n)
+			}
+		}
+		if sizeMB := float64(size) / 1024.0 / 1024.0; sizeMB > maxSizeMB {
+			common.Log.Info("fileSpecData: Skipping %q. size %.1f MB is over the limit of %.1f MB",
+				name, sizeMB, maxSizeMB)
+			return nil, false
+		}
+	}
+	data, err := core.DecodeStream(stream)
+	if err != nil {
+		common.Log.Debug("fileSpecData: Could not decode embedded file %q. err=%v", name, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// embeddedName returns the name of the embedded file in file specification `spec` whose key in the
+// EmbeddedFiles name tree is `key`. It is the file name in `spec` without any directories. Files in
+// portfolio folders, whose keys start with "<folder ID>", are given the folder paths in `folders`.
+func embeddedName(key string, spec *core.PdfObjectDictionary, folders map[int]string) string {
+	folder := ""
+	if strings.HasPrefix(key, "<") {
+		if i := strings.Index(key, ">"); i > 0 {
+			if id, err := strconv.Atoi(key[1:i]); err == nil {
+				folder = folders[id]
+				key = key[i+1:]
+			}
+		}
+	}
+	var name string
+	for _, k := range []core.PdfObjectName{"UF", "F"} {
+		if name = cleanName(pdfText(spec.Get(k))); name != "" {
+			break
+		}
+	}
+	if name == "" {
+		name = cleanName(key)
+	}
+	if name == "" {
+		name = "attachment.pdf"
+	}
+	if folder != "" {
+		name = folder + "/" + name
+	}
+	return strings.Replace(name, embeddedSep, "!_", -1)
+}
+
+// cleanName returns file name `name` without any directories and surrounding whitespace. File
+// specifications may use / or \ as separators.
+func cleanName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.TrimSpace(name)
+}
+
+// uniqueName returns `name` or, if `name` is in `used`, `name` with a number before its extension
+// that makes it unique. The returned name is added to `used`.
+func uniqueName(name string, used map[string]bool) string {
+	unique := name
+	ext := path.Ext(name)
+	for n := 2; used[unique]; n++ {
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+	}
+	used[unique] = true
+	return unique
+}
+
+// openDocReader returns the contents of the document `inPath`. Documents embedded in PDFs are
+// extracted from the PDFs on disk that hold them and PDFs in ZIP archives are read from the
+// archives. Encrypted PDFs that hold other PDFs are decrypted with the passwords supplied by
+// `passwords`, which may be nil. Caller must close the returned ReadSeekCloser.
+func openDocReader(inPath string, passwords PasswordProvider) (readSeekCloser, error) {
+	parts := strings.Split(inPath, embeddedSep)
+	if len(parts) == 1 || !isArchivePath(parts[0]) {
+		f, err := os.Open(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 1 {
+			return f, nil
+		}
+		defer f.Close()
+		return openEmbedded(parts, 1, f, passwords)
+	}
+	data, err := openArchiveMember(parts[0], parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return openEmbedded(parts, 2, bytes.NewReader(data), passwords)
+}
+
+// openEmbedded returns the contents of the document whose path is split into `parts` by
+// embeddedSep. `rs` is the contents of the document whose path is made up of the first `n` parts.
+// The remaining parts are the names of PDFs embedded in the previous parts. Encrypted PDFs are
+// decrypted with the passwords supplied by `passwords`, which may be nil.
+func openEmbedded(parts []string, n int, rs io.ReadSeeker, passwords PasswordProvider) (
+	readSeekCloser, error) {
+	for i := n; i < len(parts); i++ {
+		parent, name := strings.Join(parts[:i], embeddedSep), parts[i]
+		pdfPageProcessor, err := CreatePDFPageProcessorReader(parent, rs, passwords)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open %q. err=%v", parent, err)
+		}
+		var data []byte
+		for _, f := range pdfPageProcessor.EmbeddedFiles(0) {
+			if f.name == name {
+				data = f.data
+				break
+			}
+		}
+		if data == nil {
+			return nil, fmt.Errorf("%q has no embedded file %q", parent, name)
+		}
+		rs = bytes.NewReader(data)
+	}
+	return nopCloser{rs}, nil
+}
+
+// readSeekCloser is an io.ReadSeeker that must be closed.
+type readSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// nopCloser is a readSeekCloser whose Close does nothing.
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+// Close does nothing.
+func (nopCloser) Close() error {
+	return nil
+}
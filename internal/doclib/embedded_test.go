@@ -0,0 +1,275 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/creator"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// TestEmbeddedName checks the names given to embedded files.
+func TestEmbeddedName(t *testing.T) {
+	folders := map[int]string{3: "Contracts/2019"}
+	used := map[string]bool{}
+	for _, test := range []struct {
+		key      string
+		file     string
+		expected string
+	}{
+		{"a", "schedule.pdf", "schedule.pdf"},
+		{"b", `C:\scans\schedule.pdf`, "schedule (2).pdf"},
+		{"<3>rates.pdf", "rates.pdf", "Contracts/2019/rates.pdf"},
+		{"<9>costs.pdf", "", "costs.pdf"},
+		{"", "", "attachment.pdf"},
+		{"c", "odd!/name.pdf", "name.pdf"},
+	} {
+		spec := core.MakeDict()
+		if test.file != "" {
+			spec.Set("F", core.MakeString(test.file))
+		}
+		name := uniqueName(embeddedName(test.key, spec, folders), used)
+		if name != test.expected {
+			t.Errorf("key=%q file=%q: name=%q expected=%q", test.key, test.file, name, test.expected)
+		}
+	}
+}
+
+// TestEmbeddedSearch checks that PDFs attached to PDFs, and the PDFs attached to them, are indexed
+// as child documents that can be searched, marked up, moved and removed with the PDFs on disk that
+// hold them.
+func TestEmbeddedSearch(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "contract.pdf")
+	rates := makeAttachmentsPdf(t, 3, nil)
+	schedule := makeAttachmentsPdf(t, 2, []attachment{{"rates.pdf", rates}})
+	outer := makeAttachmentsPdf(t, 1, []attachment{
+		{"schedule-a.pdf", schedule},
+		{"notes.txt", []byte("These notes are not a PDF.")},
+	})
+	if err := ioutil.WriteFile(inPath, outer, 0644); err != nil {
+		t.Fatalf("WriteFile failed. err=%v", err)
+	}
+	schedulePath := inPath + "!/schedule-a.pdf"
+	ratesPath := schedulePath + "!/rates.pdf"
+
+	// The number of pages tells which PDF a match is in.
+	persistDir := filepath.Join(dir, "store")
+	opts := IndexOptions{Extractor: fakePageExtractor{1: "terms", 2: "rates", 3: "costs"}}
+	blevePdf, index, result, err := IndexPdfFilesContext(context.Background(),
+		[]string{inPath}, persistDir, true, opts)
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	if result.NumAdded != 3 || result.NumPages != 6 {
+		index.Close()
+		t.Fatalf("Unexpected result %s", result)
+	}
+
+	parents := map[string]string{inPath: "", schedulePath: inPath, ratesPath: schedulePath}
+	for _, test := range []struct {
+		term  string
+		paths []string
+	}{
+		{"terms", []string{inPath, schedulePath, ratesPath}},
+		{"rates", []string{schedulePath, ratesPath}},
+		{"costs", []string{ratesPath}},
+	} {
+		matches, err := blevePdf.SearchBleveIndex(index, test.term, 10)
+		if err != nil {
+			index.Close()
+			t.Fatalf("%q: SearchBleveIndex failed. err=%v", test.term, err)
+		}
+		found := map[string]bool{}
+		for _, m := range matches.Matches {
+			found[m.InPath] = true
+			if m.Parent != parents[m.InPath] {
+				t.Errorf("%q: %q has parent %q. Expected %q", test.term, m.InPath, m.Parent,
+					parents[m.InPath])
+			}
+		}
+		if len(found) != len(test.paths) {
+			t.Errorf("%q: matches=%s", test.term, matches)
+		}
+		for _, inPath := range test.paths {
+			if !found[inPath] {
+				t.Errorf("%q: No match in %q. matches=%s", test.term, inPath, matches)
+			}
+		}
+	}
+
+	// Mark up the match on page 3 of the PDF embedded in the embedded PDF.
+	matches, err := blevePdf.SearchBleveIndex(index, "costs", 10)
+	index.Close()
+	if err != nil || len(matches.Matches) != 1 {
+		t.Fatalf("SearchBleveIndex failed. matches=%s err=%v", matches, err)
+	}
+	m := matches.Matches[0]
+	bbox, ok := m.PagePositions.BBox(m.Spans[0].Start, m.Spans[0].End)
+	if !ok || bbox != fakeWordBBox(0) {
+		t.Fatalf("bbox=%+v ok=%t", bbox, ok)
+	}
+	extractList := CreateExtractList(10, 10)
+	extractList.AddRect(m.InPath, m.PageNum, bbox)
+	markupPath := filepath.Join(dir, "markup.pdf")
+	if err := extractList.SaveOutputPdf(markupPath); err != nil {
+		t.Fatalf("SaveOutputPdf failed. err=%v", err)
+	}
+	if _, err := openDocReader(inPath+"!/schedule-b.pdf", nil); err == nil {
+		t.Errorf("Opened a missing embedded PDF")
+	}
+
+	// Serialized copies of the index keep the parents of the embedded PDFs.
+	data, err := MarshalPdfIndex(persistDir, nil)
+	if err != nil {
+		t.Fatalf("MarshalPdfIndex failed. err=%v", err)
+	}
+	loadedPdf, loadedIndex, err := LoadIndexFromBytes(data)
+	if err != nil {
+		t.Fatalf("LoadIndexFromBytes failed. err=%v", err)
+	}
+	matches, err = loadedPdf.SearchBleveIndex(loadedIndex, "costs", 10)
+	loadedIndex.Close()
+	if err != nil || len(matches.Matches) != 1 || matches.Matches[0].Parent != schedulePath {
+		t.Fatalf("Loaded index: matches=%s err=%v", matches, err)
+	}
+
+	// Moving the PDF on disk moves its embedded PDFs.
+	movedPath := filepath.Join(dir, "moved.pdf")
+	if err := os.Rename(inPath, movedPath); err != nil {
+		t.Fatalf("Rename failed. err=%v", err)
+	}
+	syncResult, err := SyncPdfFiles(persistDir, []string{movedPath}, nil)
+	if err != nil {
+		t.Fatalf("SyncPdfFiles failed. err=%v", err)
+	}
+	if syncResult.NumMoved != 3 || syncResult.NumRemoved != 0 || syncResult.NumAdded != 0 {
+		t.Fatalf("Unexpected sync result %s", syncResult)
+	}
+	blevePdf, err = openBlevePdf(persistDir, nil, false)
+	if err != nil {
+		t.Fatalf("openBlevePdf failed. err=%v", err)
+	}
+	for _, fd := range blevePdf.fdList {
+		if !strings.HasPrefix(fd.InPath, movedPath) ||
+			fd.Parent != "" && fd.Parent != parentPath(fd.InPath) {
+			t.Errorf("Not moved: %s Parent=%q", fd, fd.Parent)
+		}
+	}
+
+	// Removing the PDF on disk removes its embedded PDFs.
+	numRemoved, err := RemovePdfFiles(persistDir, nil, []string{movedPath})
+	if err != nil {
+		t.Fatalf("RemovePdfFiles failed. err=%v", err)
+	}
+	if numRemoved != 3 {
+		t.Fatalf("Removed %d PDFs. Expected 3", numRemoved)
+	}
+}
+
+// TestEmbeddedMemIndex checks that PDFs embedded in PDFs in in-memory indexes are searchable and
+// can be read back for markup.
+func TestEmbeddedMemIndex(t *testing.T) {
+	schedule := makeAttachmentsPdf(t, 2, nil)
+	outer := makeAttachmentsPdf(t, 1, []attachment{{"schedule-a.pdf", schedule}})
+
+	blevePdf, index, err := CreateMemIndex()
+	if err != nil {
+		t.Fatalf("CreateMemIndex failed. err=%v", err)
+	}
+	defer index.Close()
+	result, err := blevePdf.IndexPdfReader(index, "contract.pdf", bytes.NewReader(outer))
+	if err != nil {
+		t.Fatalf("IndexPdfReader failed. err=%v", err)
+	}
+	if result.NumAdded != 2 {
+		t.Fatalf("Unexpected result %s", result)
+	}
+	if fd := blevePdf.fdList[1]; fd.InPath != "contract.pdf!/schedule-a.pdf" ||
+		fd.Parent != "contract.pdf" {
+		t.Fatalf("Unexpected child %s Parent=%q", fd, fd.Parent)
+	}
+	rs := blevePdf.hashReader[blevePdf.fdList[1].Hash]
+	data := make([]byte, len(schedule))
+	if _, err := rs.Seek(0, 0); err != nil {
+		t.Fatalf("Seek failed. err=%v", err)
+	}
+	if _, err := rs.Read(data); err != nil || !bytes.Equal(data, schedule) {
+		t.Fatalf("Child reader doesn't hold the embedded PDF. err=%v", err)
+	}
+}
+
+// TestEmbeddedSizeLimit checks that embedded files over the size limit are skipped and that the
+// sizes in their parameters are used, so that their sizes are known before they are decoded.
+func TestEmbeddedSizeLimit(t *testing.T) {
+	data := makeAttachmentsPdf(t, 1, nil)
+	stream, err := core.MakeStream(data, core.NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("MakeStream failed. err=%v", err)
+	}
+	ef := core.MakeDict()
+	ef.Set("F", stream)
+	spec := core.MakeDict()
+	spec.Set("EF", ef)
+
+	if got, ok := fileSpecData(spec, "small.pdf", 1); !ok || !bytes.Equal(got, data) {
+		t.Fatalf("File under the limit was not read. ok=%t", ok)
+	}
+	params := core.MakeDict()
+	params.Set("Size", core.MakeInteger(2*1024*1024))
+	stream.Set("Params", params)
+	if _, ok := fileSpecData(spec, "big.pdf", 1); ok {
+		t.Fatalf("File over the limit was read")
+	}
+	if got, ok := fileSpecData(spec, "big.pdf", 0); !ok || !bytes.Equal(got, data) {
+		t.Fatalf("File was not read without a limit. ok=%t", ok)
+	}
+}
+
+// attachment is a file to attach to a PDF.
+type attachment struct {
+	name string
+	data []byte
+}
+
+// makeAttachmentsPdf returns the contents of a PDF with `numPages` blank pages and the files in
+// `attachments` in its EmbeddedFiles name tree.
+func makeAttachmentsPdf(t *testing.T, numPages int, attachments []attachment) []byte {
+	return makeTestPdf(t, numPages, func(c *creator.Creator, page *model.PdfPage,
+		pageNum int) error {
+		if pageNum != 1 || len(attachments) == 0 {
+			return nil
+		}
+		var entries []core.PdfObject
+		for _, a := range attachments {
+			stream, err := core.MakeStream(a.data, core.NewFlateEncoder())
+			if err != nil {
+				return err
+			}
+			stream.Set("Type", core.MakeName("EmbeddedFile"))
+			ef := core.MakeDict()
+			ef.Set("F", stream)
+			spec := core.MakeDict()
+			spec.Set("Type", core.MakeName("Filespec"))
+			spec.Set("F", core.MakeString(a.name))
+			spec.Set("EF", ef)
+			entries = append(entries, core.MakeString(a.name), core.MakeIndirectObject(spec))
+		}
+		tree := core.MakeDict()
+		tree.Set("Names", core.MakeArray(entries...))
+		names := core.MakeDict()
+		names.Set("EmbeddedFiles", tree)
+		c.SetPdfWriterAccessFunc(func(w *model.PdfWriter) error {
+			return w.SetNamedDestinations(names)
+		})
+		return nil
+	})
+}
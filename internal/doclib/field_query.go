@@ -0,0 +1,179 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements field-qualified search terms, which search the document metadata
+ * indexed by metadata.go.
+ *  - A search term is a mix of page text and `field:value` qualifiers, e.g.
+ *      budget author:jane created:2017
+ *    The text, "budget", is matched against the page text. The qualifiers filter the results to
+ *    documents whose metadata matches them.
+ *  - Values with spaces are quoted, e.g. author:"Jane Doe".
+ *  - Date fields take a year, year-month or date, e.g. created:2017, modified:2017-06 or
+ *    created:2017-06-30, optionally preceded by one of the comparisons <, <=, > or >=.
+ *  - lang: takes the code of a language detected by lang_detect.go, e.g. lang:de. It filters the
+ *    results to pages in that language.
+ *  - Words with a colon that don't start with a field name are searched for as text.
+ */
+
+package doclib
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// queryFields are the field names that can qualify search terms. {field name: bleve field}
+var queryFields = map[string]string{
+	"title":    fieldTitle,
+	"author":   fieldAuthor,
+	"subject":  fieldSubject,
+	"keyword":  fieldKeywords,
+	"keywords": fieldKeywords,
+	"producer": fieldProducer,
+	"lang":     fieldLang,
+	"created":  fieldCreated,
+	"modified": fieldModified,
+}
+
+// parseFieldQueries splits search term `term` into the text that is searched for in the page text
+// and bleve queries for the field qualifiers in `term`. Qualifiers with no value, such as "title:",
+// are searched for as text.
+func parseFieldQueries(term string) (string, []query.Query, error) {
+	var words []string
+	var queries []query.Query
+	for _, word := range splitQuoted(term) {
+		colon := strings.IndexByte(word, ':')
+		if colon <= 0 {
+			words = append(words, word)
+			continue
+		}
+		field, ok := queryFields[strings.ToLower(word[:colon])]
+		if !ok {
+			words = append(words, word)
+			continue
+		}
+		value := unquote(word[colon+1:])
+		if value == "" {
+			words = append(words, word)
+			continue
+		}
+		q, err := fieldQuery(field, value)
+		if err != nil {
+			return "", nil, fmt.Errorf("bad qualifier %q: %v", word, err)
+		}
+		queries = append(queries, q)
+	}
+	return strings.Join(words, " "), queries, nil
+}
+
+// fieldQuery returns a bleve query that matches `value` in bleve field `field`.
+func fieldQuery(field, value string) (query.Query, error) {
+	switch field {
+	case fieldCreated, fieldModified:
+		return dateQuery(field, value)
+	case fieldLang:
+		if languageCode(value) == nil {
+			return nil, fmt.Errorf("unknown language. Languages are %s", languageCodes())
+		}
+		fallthrough
+	case fieldKeywords:
+		q := bleve.NewTermQuery(strings.ToLower(value))
+		q.SetField(field)
+		return q, nil
+	}
+	q := bleve.NewMatchQuery(value)
+	q.SetField(field)
+	q.SetOperator(query.MatchQueryOperatorAnd)
+	return q, nil
+}
+
+// dateQuery returns a bleve query for the dates in bleve field `field` that match `value`, a period
+// (a year, year-month or date) with an optional comparison prefix.
+func dateQuery(field, value string) (query.Query, error) {
+	op := ""
+	for _, prefix := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(value, prefix) {
+			op = prefix
+			value = value[len(prefix):]
+			break
+		}
+	}
+	start, end, err := datePeriod(value)
+	if err != nil {
+		return nil, err
+	}
+	t, f := true, false
+	var q *query.DateRangeQuery
+	switch op {
+	case "", "=":
+		q = bleve.NewDateRangeInclusiveQuery(start, end, &t, &f)
+	case "<":
+		q = bleve.NewDateRangeInclusiveQuery(time.Time{}, start, nil, &f)
+	case "<=":
+		q = bleve.NewDateRangeInclusiveQuery(time.Time{}, end, nil, &f)
+	case ">":
+		q = bleve.NewDateRangeInclusiveQuery(end, time.Time{}, &t, nil)
+	case ">=":
+		q = bleve.NewDateRangeInclusiveQuery(start, time.Time{}, &t, nil)
+	}
+	q.SetField(field)
+	return q, nil
+}
+
+// datePeriod returns the start and end of the period in `value`, which is a year, year-month or
+// date, e.g. "2017", "2017-06" or "2017-06-30". The period includes its start and excludes its end.
+// Dates are in UTC.
+func datePeriod(value string) (time.Time, time.Time, error) {
+	for _, p := range []struct {
+		layout string
+		years  int
+		months int
+		days   int
+	}{
+		{"2006", 1, 0, 0},
+		{"2006-01", 0, 1, 0},
+		{"2006-01-02", 0, 0, 1},
+	} {
+		if start, err := time.Parse(p.layout, value); err == nil {
+			return start, start.AddDate(p.years, p.months, p.days), nil
+		}
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("%q is not a year, year-month or date", value)
+}
+
+// splitQuoted splits `s` into words separated by white space. Quoted strings are not split.
+func splitQuoted(s string) []string {
+	var words []string
+	var word strings.Builder
+	quoted := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			word.WriteRune(r)
+		case !quoted && (r == ' ' || r == '\t' || r == '\n' || r == '\r'):
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+		default:
+			word.WriteRune(r)
+		}
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// unquote returns `s` without the surrounding quotes, if it has them.
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
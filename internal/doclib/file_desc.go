@@ -5,17 +5,17 @@ package doclib
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"os"
 
 	"github.com/papercutsoftware/pdfsearch/internal/utils"
 )
 
-// loadFileDescList deserializes a file descriptor list `fdList` from json file `jsonPath` if
-// `jsonPath` exists, or creates an empty list if it doesn't.
-func loadFileDescList(jsonPath string) ([]fileDesc, error) {
-	b, err := ioutil.ReadFile(jsonPath)
+// loadFileDescList deserializes a file descriptor list `fdList` from json file `name` in `store`
+// if `name` exists, or creates an empty list if it doesn't.
+func loadFileDescList(store IndexStore, name string) ([]fileDesc, error) {
+	b, err := store.ReadFile(name)
 	if err != nil {
-		if !utils.Exists(jsonPath) {
+		if os.IsNotExist(err) {
 			return nil, nil
 		}
 		return nil, err
@@ -25,32 +25,69 @@ func loadFileDescList(jsonPath string) ([]fileDesc, error) {
 	return fdList, err
 }
 
-// saveFileDescList serializes file descriptor list `fdList` to json file `jsonPath`.
-func saveFileDescList(jsonPath string, fdList []fileDesc) error {
+// saveFileDescList serializes file descriptor list `fdList` to json file `name` in `store`.
+func saveFileDescList(store IndexStore, name string, fdList []fileDesc) error {
 	b, err := json.MarshalIndent(fdList, "", "\t")
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(jsonPath, b, 0666)
+	return store.WriteFile(name, b)
 }
 
-// fileDesc describes a PDF on disk.
+// fileDesc describes a PDF, or a document in another registered format, on disk.
 // The fields are capitalized so that this json.Unmarshal and json.MarshalIndent will work directly
 // on this struct. These fields are not meant to be referenced outside this library.
 type fileDesc struct {
-	InPath string  // Full path to PDF.
-	Hash   string  // SHA-256 hash of file contents.
-	SizeMB float64 // Size of PDF on disk in megabytes.
+	InPath   string         // Full path to PDF.
+	Hash     string         // SHA-256 hash of file contents. See archiveMemberHash() for PDFs in ZIPs.
+	SizeMB   float64        // Size of PDF on disk in megabytes.
+	Deleted  bool           `json:",omitempty"` // The PDF has been removed from the index.
+	Format   string         `json:",omitempty"` // Name of the DocFormat. Empty for PDFs.
+	Lines    bool           `json:",omitempty"` // PagePositions hold source lines. See DocFormat.Lines.
+	Outline  []outlineEntry `json:",omitempty"` // Bookmarks of a PDF. See outline.go.
+	Parent   string         `json:",omitempty"` // Path of the PDF or ZIP archive that holds this PDF. See embedded.go.
+	RootHash string         `json:",omitempty"` // Hash of the file on disk that holds this PDF if Parent is set.
+	Meta     *DocMetadata   `json:",omitempty"` // Metadata of the PDF. See metadata.go.
+}
+
+// rootHash returns the hash of the file on disk that holds the document described by `fd`.
+func (fd fileDesc) rootHash() string {
+	if fd.Parent == "" {
+		return fd.Hash
+	}
+	return fd.RootHash
+}
+
+// format returns the name of the format of the document described by `fd`.
+func (fd fileDesc) format() string {
+	if fd.Format == "" {
+		return FormatPDF
+	}
+	return fd.Format
 }
 
 // String returns a human readable description of `fd`.
 func (fd fileDesc) String() string {
-	return fmt.Sprintf("{fileDesc: %#q %.2f MB %q}", fd.Hash, fd.SizeMB, fd.InPath)
+	deleted := ""
+	if fd.Deleted {
+		deleted = " DELETED"
+	}
+	return fmt.Sprintf("{fileDesc: %#q %.2f MB %q%s}", fd.Hash, fd.SizeMB, fd.InPath, deleted)
+}
+
+// setFormat sets the format of `fd` from the extension of fd.InPath.
+func (fd *fileDesc) setFormat() {
+	if format, ok := formatForPath(fd.InPath); ok {
+		fd.Format = format.Name
+		fd.Lines = format.Lines
+	}
 }
 
-// createFileDesc returns the fileDesc for PDF `inPath`.
+// createFileDesc returns the fileDesc for PDF `inPath`. Files with the extensions of registered
+// DocFormats are described as documents in those formats.
 func createFileDesc(inPath string) (fileDesc, error) {
 	fd := fileDesc{InPath: inPath}
+	fd.setFormat()
 
 	size, err := utils.FileSize(inPath)
 	if err != nil {
@@ -0,0 +1,387 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the indexing of document formats other than PDF.
+ *  - DocSource is implemented by the code that extracts the text of a document format.
+ *  - RegisterFormat() registers a DocFormat, a DocSource for some file name extensions. The
+ *    indexing pipeline extracts files with those extensions with the DocSource and all other
+ *    files as PDFs.
+ *  - TextSource and HTMLSource are the built-in DocSources for plain text, Markdown and HTML.
+ *    XPSSource in xps.go is the built-in DocSource for XPS.
+ *    Text documents have no page geometry so their PagePositions hold the line and column of the
+ *    text in the source file instead of bounding boxes.
+ */
+
+package doclib
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FormatPDF is the name of the PDF format.
+const FormatPDF = "pdf"
+
+// DocSource extracts the text of the documents of a format.
+type DocSource interface {
+	// ExtractDoc returns the pages of text in document `inPath`.
+	ExtractDoc(inPath string) ([]DocPage, error)
+}
+
+// DocPage is a page of text extracted from a document by a DocSource.
+type DocPage struct {
+	PageNum uint32     // 1-offset page number. Documents without pages have a single page 1.
+	Text    string     // Text of the page.
+	Marks   []TextMark // Locations of the text on the page for formats with page geometry.
+	Lines   []LineMark // Locations of the text in the source file for text formats.
+}
+
+// LineMark is the location in a source file of a fragment of the text extracted from a text
+// document. The fragment runs from Offset to the Offset of the next LineMark.
+type LineMark struct {
+	Offset uint32 // Byte offset of the fragment in the extracted text.
+	Line   int    // 1-offset number of the line in the source file where the fragment starts.
+	Column int    // 1-offset byte column in that line where the fragment starts.
+}
+
+// DocFormat describes a document format that can be indexed.
+type DocFormat struct {
+	Name       string    // Name of the format. It is stored in the index and reported in matches.
+	Extensions []string  // File name extensions of the format, e.g. ".txt". Case insensitive.
+	Source     DocSource // Extracts the text of documents in the format.
+	// Lines is true for formats whose pages have line and column locations (DocPage.Lines) rather
+	// than bounding boxes (DocPage.Marks). Matches in these documents report source line numbers.
+	Lines bool
+}
+
+// formatRegistry holds the registered DocFormats.
+var formatRegistry = struct {
+	sync.RWMutex
+	byName map[string]DocFormat // {format name: format}
+	byExt  map[string]string    // {lower case extension: format name}
+}{
+	byName: map[string]DocFormat{},
+	byExt:  map[string]string{},
+}
+
+// RegisterFormat registers `format` so that files with its extensions are indexed with its
+// DocSource. It replaces any format with the same name or extensions. The PDF format can't be
+// replaced.
+func RegisterFormat(format DocFormat) error {
+	if format.Name == "" || format.Source == nil {
+		return errors.New("format needs a name and a source")
+	}
+	if format.Name == FormatPDF {
+		return fmt.Errorf("format %q is built in", FormatPDF)
+	}
+	for _, ext := range format.Extensions {
+		if strings.ToLower(ext) == ".pdf" {
+			return fmt.Errorf("extension %q is built in", ext)
+		}
+	}
+	formatRegistry.Lock()
+	defer formatRegistry.Unlock()
+	formatRegistry.byName[format.Name] = format
+	for _, ext := range format.Extensions {
+		formatRegistry.byExt[strings.ToLower(ext)] = format.Name
+	}
+	return nil
+}
+
+// formatForPath returns the registered DocFormat for the extension of `inPath`. It returns false
+// for PDFs and files with unregistered extensions, which are indexed as PDFs.
+func formatForPath(inPath string) (DocFormat, bool) {
+	formatRegistry.RLock()
+	defer formatRegistry.RUnlock()
+	name, ok := formatRegistry.byExt[strings.ToLower(filepath.Ext(inPath))]
+	if !ok {
+		return DocFormat{}, false
+	}
+	format, ok := formatRegistry.byName[name]
+	return format, ok
+}
+
+// formatNamed returns the registered DocFormat named `name`.
+func formatNamed(name string) (DocFormat, bool) {
+	formatRegistry.RLock()
+	defer formatRegistry.RUnlock()
+	format, ok := formatRegistry.byName[name]
+	return format, ok
+}
+
+// docExtractorFor returns the docExtractor for the format of the document described by `fd`.
+func docExtractorFor(fd fileDesc) (docExtractor, error) {
+	if fd.format() == FormatPDF {
+		return extractDoc, nil
+	}
+	format, ok := formatNamed(fd.Format)
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q", fd.Format)
+	}
+	return format.extractDocContents, nil
+}
+
+// extractDocContents is the docExtractor for documents in `format`. It extracts the pages of the
+// document described by `fd` with format.Source. Documents with more than `opts`.maxPages pages
+// fail if `opts`.maxPages > 0. Pages with no text are skipped.
+func (format DocFormat) extractDocContents(fd fileDesc, opts extractOptions,
+	watch *extractWatch) ([]pageContents, []IndexFailure, error) {
+	pages, err := format.Source.ExtractDoc(fd.InPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.maxPages > 0 && len(pages) > opts.maxPages {
+		return nil, nil, fmt.Errorf("%d pages is over the limit of %d pages", len(pages),
+			opts.maxPages)
+	}
+	var docContents []pageContents
+	for _, page := range pages {
+		if page.PageNum == 0 {
+			return nil, nil, fmt.Errorf("%s source returned page 0", format.Name)
+		}
+		if err := watch.startPage(page.PageNum); err != nil {
+			return nil, nil, err
+		}
+		if strings.TrimSpace(page.Text) == "" {
+			continue
+		}
+		var ppos PagePositions
+		if format.Lines {
+			ppos = PagePositionsFromLines(page.Lines)
+		} else {
+			ppos = PagePositionsFromMarks(page.Marks)
+		}
+		docContents = append(docContents, pageContents{
+			pageNum: page.PageNum,
+			ppos:    ppos,
+			text:    page.Text,
+		})
+	}
+	return docContents, nil, nil
+}
+
+// init registers the built-in formats.
+func init() {
+	for _, format := range []DocFormat{
+		{
+			Name:       "text",
+			Extensions: []string{".txt", ".text", ".md", ".markdown"},
+			Source:     TextSource{},
+			Lines:      true,
+		},
+		{
+			Name:       "html",
+			Extensions: []string{".html", ".htm"},
+			Source:     HTMLSource{},
+			Lines:      true,
+		},
+	} {
+		if err := RegisterFormat(format); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// TextSource is the DocSource for plain text and Markdown. A text file is one page whose text is
+// the contents of the file. Markdown is indexed as it is written.
+type TextSource struct{}
+
+// ExtractDoc returns the text of text file `inPath` as a single page.
+func (TextSource) ExtractDoc(inPath string) ([]DocPage, error) {
+	b, err := ioutil.ReadFile(inPath)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimPrefix(string(b), "\ufeff")
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.ToValidUTF8(text, "\ufffd")
+
+	var lines []LineMark
+	for ofs, lineNum := 0, 1; ofs < len(text); lineNum++ {
+		lines = append(lines, LineMark{Offset: uint32(ofs), Line: lineNum, Column: 1})
+		n := strings.IndexByte(text[ofs:], '\n')
+		if n < 0 {
+			break
+		}
+		ofs += n + 1
+	}
+	return []DocPage{{PageNum: 1, Text: text, Lines: lines}}, nil
+}
+
+// HTMLSource is the DocSource for HTML. An HTML file is one page whose text is the text content
+// of the file with the tags, comments, scripts and styles removed and the character references
+// decoded. Each line of text in the source file starts a new line in the page text and block level
+// elements start new lines.
+type HTMLSource struct{}
+
+// ExtractDoc returns the text of HTML file `inPath` as a single page.
+func (HTMLSource) ExtractDoc(inPath string) ([]DocPage, error) {
+	b, err := ioutil.ReadFile(inPath)
+	if err != nil {
+		return nil, err
+	}
+	src := strings.Replace(string(b), "\r\n", "\n", -1)
+	text, lines := htmlText(strings.ToValidUTF8(src, "\ufffd"))
+	return []DocPage{{PageNum: 1, Text: text, Lines: lines}}, nil
+}
+
+// htmlBreaks are the HTML elements that start a new line of text.
+var htmlBreaks = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "br": true,
+	"dd": true, "div": true, "dl": true, "dt": true, "footer": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "header": true, "hr": true, "li": true,
+	"nav": true, "ol": true, "p": true, "pre": true, "section": true, "table": true,
+	"title": true, "tr": true, "ul": true,
+}
+
+// htmlText returns the text content of HTML `src` and the locations of the text in `src`.
+// It is a simple scanner rather than a full HTML parser. It is meant for indexing, so it only
+// needs to find the text and where it is.
+func htmlText(src string) (string, []LineMark) {
+	// lineStarts are the offsets of the starts of the lines in `src`.
+	lineStarts := []int{0}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	lineCol := func(ofs int) (int, int) {
+		i := sort.Search(len(lineStarts), func(i int) bool { return lineStarts[i] > ofs })
+		return i, ofs - lineStarts[i-1] + 1
+	}
+
+	var sb strings.Builder
+	var lines []LineMark
+	atLineStart := func() bool {
+		s := sb.String()
+		return len(s) == 0 || s[len(s)-1] == '\n'
+	}
+	newLine := func() {
+		if !atLineStart() {
+			sb.WriteString("\n")
+		}
+	}
+	// addText adds the text src[start:end], which contains no tags or newlines.
+	addText := func(start, end int) {
+		if atLineStart() {
+			for start < end && (src[start] == ' ' || src[start] == '\t') {
+				start++
+			}
+		}
+		// Each character reference is a separate fragment so that the columns of the text after it
+		// are not shifted by the difference between its encoded and decoded lengths.
+		for start < end {
+			var n int
+			if src[start] == '&' {
+				n = charRefLen(src[start:end])
+			} else if n = strings.IndexByte(src[start:end], '&'); n < 0 {
+				n = end - start
+			}
+			line, col := lineCol(start)
+			lines = append(lines, LineMark{Offset: uint32(sb.Len()), Line: line, Column: col})
+			sb.WriteString(html.UnescapeString(src[start : start+n]))
+			start += n
+		}
+	}
+
+	for i := 0; i < len(src); {
+		switch {
+		case strings.HasPrefix(src[i:], "<!--"):
+			i = skipPast(src, i+4, "-->")
+		case src[i] == '<' && i+1 < len(src) && isTagStart(src[i+1]):
+			name, end := htmlTag(src, i)
+			i = end
+			if name == "script" || name == "style" {
+				i = skipPastFold(src, i, "</"+name)
+				i = skipPast(src, i, ">")
+			}
+			if htmlBreaks[strings.TrimPrefix(name, "/")] {
+				newLine()
+			}
+		case src[i] == '\n':
+			newLine()
+			i++
+		default:
+			end := i + 1
+			for end < len(src) && src[end] != '\n' &&
+				!(src[end] == '<' && end+1 < len(src) && isTagStart(src[end+1])) {
+				end++
+			}
+			addText(i, end)
+			i = end
+		}
+	}
+	return sb.String(), lines
+}
+
+// charRefLen returns the length of the HTML character reference, e.g. "&amp;", at the start of `s`
+// or 1 if `s` starts with an '&' that doesn't start a character reference.
+func charRefLen(s string) int {
+	for i := 1; i < len(s) && i <= 32; i++ {
+		c := s[i]
+		switch {
+		case c == ';' && i > 1:
+			return i + 1
+		case c == '#' && i == 1, '0' <= c && c <= '9', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		default:
+			return 1
+		}
+	}
+	return 1
+}
+
+// isTagStart returns true if `c` can follow the '<' that starts an HTML tag.
+func isTagStart(c byte) bool {
+	return c == '/' || c == '!' || c == '?' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// htmlTag returns the lower case name of the HTML tag that starts at src[start] and the offset
+// of the end of the tag. Closing tags have names that start with "/".
+func htmlTag(src string, start int) (string, int) {
+	i := start + 1
+	for i < len(src) && !strings.ContainsRune(" \t\n/>", rune(src[i])) || i == start+1 && src[i] == '/' {
+		i++
+	}
+	name := strings.ToLower(src[start+1 : i])
+	var quote byte
+	for ; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return name, i + 1
+		}
+	}
+	return name, len(src)
+}
+
+// skipPast returns the offset in `src` after the first `marker` at or after `start`, or the end of
+// `src` if there is no `marker`.
+func skipPast(src string, start int, marker string) int {
+	i := strings.Index(src[start:], marker)
+	if i < 0 {
+		return len(src)
+	}
+	return start + i + len(marker)
+}
+
+// skipPastFold returns the offset in `src` of the first `marker` at or after `start`, ignoring case,
+// or the end of `src` if there is no `marker`.
+func skipPastFold(src string, start int, marker string) int {
+	i := strings.Index(strings.ToLower(src[start:]), marker)
+	if i < 0 {
+		return len(src)
+	}
+	return start + i
+}
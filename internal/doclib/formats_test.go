@@ -0,0 +1,119 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestHTMLText checks that the text content of HTML is found with its lines and columns in the
+// HTML source.
+func TestHTMLText(t *testing.T) {
+	src := "<html><head><title>Report</title>\n" +
+		"<style>p { color: red; }</style></head>\n" +
+		"<body><!-- draft --><h1>Quarterly &amp; annual &c</h1>\n" +
+		"<p>First <b>bold</b> line\n" +
+		"   second line</p><script>var x = '<p>';</script>\n" +
+		"</body></html>\n"
+	text, lines := htmlText(src)
+	expected := "Report\nQuarterly & annual &c\nFirst bold line\nsecond line\n"
+	if text != expected {
+		t.Fatalf("text=%q\nexpected=%q", text, expected)
+	}
+	ppos := PagePositionsFromLines(lines)
+	for _, test := range []struct {
+		word      string
+		line, col int
+	}{
+		{"Report", 1, 20},
+		{"annual", 3, 41},
+		{"bold", 4, 13},
+		{"line", 4, 22},
+		{"second", 5, 4},
+	} {
+		ofs := strings.Index(text, test.word)
+		line, col, ok := ppos.LineColumn(uint32(ofs))
+		if !ok || line != test.line || col != test.col {
+			t.Errorf("%q: line=%d col=%d ok=%t. Expected line=%d col=%d", test.word, line, col, ok,
+				test.line, test.col)
+		}
+	}
+}
+
+// TestTextFormats checks that text, Markdown and HTML files are indexed with their registered
+// formats and that matches in them report the line numbers in the source files.
+func TestTextFormats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"notes.txt":  "shopping list\r\n\r\napples and pears\r\n",
+		"README.md":  "# Title\n\nSome *pears* here.\n",
+		"page.html":  "<html>\n<body>\n<p>No fruit</p>\n<p>Just <i>pears</i></p>\n</body>\n</html>\n",
+		"empty.html": "<html><body></body></html>", // Files with no text are counted as empty.
+	}
+	expected := map[string]struct {
+		format string
+		line   int
+	}{
+		"notes.txt": {"text", 3},
+		"README.md": {"text", 3},
+		"page.html": {"html", 4},
+	}
+	var pathList []string
+	for name, contents := range files {
+		inPath := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(inPath, []byte(contents), 0644); err != nil {
+			t.Fatalf("WriteFile failed. err=%v", err)
+		}
+		pathList = append(pathList, inPath)
+	}
+
+	persistDir := filepath.Join(dir, "store")
+	blevePdf, index, result, err := IndexPdfFilesContext(context.Background(), pathList,
+		persistDir, true, IndexOptions{})
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	defer index.Close()
+	if result.NumAdded != 3 || result.NumFailed != 0 || result.NumEmpty != 1 ||
+		result.NumPages != 3 {
+		t.Fatalf("Unexpected result %s", result)
+	}
+
+	matches, err := blevePdf.SearchBleveIndex(index, "pears", 10)
+	if err != nil {
+		t.Fatalf("SearchBleveIndex failed. err=%v", err)
+	}
+	if len(matches.Matches) != len(expected) {
+		t.Fatalf("%d matches. Expected %d. matches=%s", len(matches.Matches), len(expected), matches)
+	}
+	for _, m := range matches.Matches {
+		exp := expected[filepath.Base(m.InPath)]
+		if m.Format != exp.format || len(m.LineNums) != 1 || m.LineNums[0] != exp.line {
+			t.Errorf("%q: Format=%q LineNums=%v. Expected %q [%d]", m.InPath, m.Format,
+				m.LineNums, exp.format, exp.line)
+		}
+	}
+}
+
+// TestRegisterFormat checks that the PDF format can't be replaced.
+func TestRegisterFormat(t *testing.T) {
+	for _, format := range []DocFormat{
+		{Name: FormatPDF, Extensions: []string{".pdf"}, Source: TextSource{}},
+		{Name: "fake", Extensions: []string{".PDF"}, Source: TextSource{}},
+		{Name: "fake", Extensions: []string{".fake"}},
+	} {
+		if err := RegisterFormat(format); err == nil {
+			t.Errorf("RegisterFormat(%+v) succeeded", format)
+		}
+	}
+	if _, ok := formatForPath("x.PDF"); ok {
+		t.Errorf("x.PDF has a registered format")
+	}
+	if format, ok := formatForPath("x.HTM"); !ok || format.Name != "html" {
+		t.Errorf("x.HTM has format %+v ok=%t. Expected html", format, ok)
+	}
+}
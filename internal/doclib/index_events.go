@@ -0,0 +1,182 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the progress events that IndexPdfFilesContext() sends to its caller.
+ *  - IndexEvent describes one step in indexing a list of PDFs.
+ *  - ReportEvents() adapts a `report func(string)` progress reporter to receive IndexEvents.
+ */
+
+package doclib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// IndexEventKind is the kind of step in indexing a list of PDFs that an IndexEvent describes.
+type IndexEventKind int
+
+const (
+	// IndexFileStarted is sent when a text extraction worker starts processing a PDF.
+	IndexFileStarted IndexEventKind = iota
+	// IndexFileExtracted is sent when a text extraction worker has extracted the text of a PDF.
+	IndexFileExtracted
+	// IndexFileSkipped is sent when a PDF is skipped because its contents are already indexed.
+	IndexFileSkipped
+	// IndexFileIndexed is sent when the pages of a PDF have been added to the index.
+	IndexFileIndexed
+	// IndexFileFailed is sent when a PDF could not be indexed.
+	IndexFileFailed
+	// IndexFileEmpty is sent when a PDF is not indexed because it has no text.
+	IndexFileEmpty
+	// IndexRunFinished is sent once at the end of the run, after all the other events.
+	IndexRunFinished
+)
+
+// String returns a human readable name for `k`.
+func (k IndexEventKind) String() string {
+	switch k {
+	case IndexFileStarted:
+		return "started"
+	case IndexFileExtracted:
+		return "extracted"
+	case IndexFileSkipped:
+		return "skipped"
+	case IndexFileIndexed:
+		return "indexed"
+	case IndexFileFailed:
+		return "failed"
+	case IndexFileEmpty:
+		return "empty"
+	case IndexRunFinished:
+		return "finished"
+	}
+	return fmt.Sprintf("IndexEventKind(%d)", int(k))
+}
+
+// IndexEvent describes one step in indexing a list of PDFs. Fields that don't apply to an
+// event's Kind are zero.
+// PDFs embedded in the PDFs in the list and PDFs in the ZIP archives in the list have events of
+// their own with the PathIdx of the file in the list that holds them.
+type IndexEvent struct {
+	Kind       IndexEventKind
+	InPath     string             // Path of the PDF. Empty for IndexRunFinished.
+	Parent     string             // Path of the PDF or ZIP archive that holds the PDF, if any.
+	PathIdx    int                // 0-offset index of the PDF in the list of PDFs being indexed.
+	NumFiles   int                // Number of PDFs in the list of PDFs being indexed.
+	FileNum    int                // Number of PDFs received from the workers so far, including this one.
+	Worker     int                // Text extraction worker. IndexFileStarted and IndexFileExtracted only.
+	SizeMB     float64            // Size of the PDF in megabytes.
+	NumPages   int                // Pages extracted (IndexFileExtracted) or indexed (IndexFileIndexed).
+	DtExtract  time.Duration      // Time taken to extract the PDF's text.
+	DtIndex    time.Duration      // Time taken to add the PDF's pages to the index.
+	TotalPages int                // Number of pages in the index after the PDF was added.
+	DtTotal    time.Duration      // Time since the start of the run.
+	Err        error              // Why the PDF failed or, for IndexRunFinished, why the run failed.
+	Result     IndexResult        // Totals for the run. IndexRunFinished only.
+	Workers    []ExtractorProfile // Loads of the text extraction workers when the event was sent.
+}
+
+// String returns a human readable description of `e`.
+func (e IndexEvent) String() string {
+	switch e.Kind {
+	case IndexRunFinished:
+		return fmt.Sprintf("{IndexEvent: %s %s err=%v}", e.Kind, e.Result, e.Err)
+	case IndexFileFailed:
+		return fmt.Sprintf("{IndexEvent: %s %d of %d %q err=%v}", e.Kind, e.PathIdx+1, e.NumFiles,
+			e.InPath, e.Err)
+	}
+	return fmt.Sprintf("{IndexEvent: %s %d of %d %q pages=%d}", e.Kind, e.PathIdx+1, e.NumFiles,
+		e.InPath, e.NumPages)
+}
+
+// ExtractorProfile describes the load of a text extraction worker.
+type ExtractorProfile struct {
+	NumDocs   int           // Number of PDFs whose text the worker has extracted.
+	NumPages  int           // Number of pages in those PDFs.
+	DtProcess time.Duration // Time the worker has spent extracting text.
+	DtIdle    time.Duration // Time the worker has spent waiting for PDFs.
+}
+
+// ReportEvents returns an IndexEvent handler that calls `report` with the progress lines that
+// IndexPdfFiles() has always reported. It lets callers that take a `report func(string)` use
+// the functions that send IndexEvents. It returns nil if `report` is nil.
+func ReportEvents(report func(string)) func(IndexEvent) {
+	if report == nil {
+		return nil
+	}
+	return func(e IndexEvent) {
+		switch e.Kind {
+		case IndexFileSkipped:
+			report(fmt.Sprintf("%3d (%3d) of %d: already indexed %q",
+				e.FileNum, e.PathIdx+1, e.NumFiles, e.InPath))
+		case IndexFileEmpty:
+			report(fmt.Sprintf("%3d (%3d) of %d: no text in %q",
+				e.FileNum, e.PathIdx+1, e.NumFiles, e.InPath))
+		case IndexFileIndexed:
+			totalSec := e.DtTotal.Seconds()
+			rate := 0.0
+			if totalSec > 0.0 {
+				rate = float64(e.TotalPages) / totalSec
+			}
+			report(fmt.Sprintf("%3d (%3d) of %d: %5.1f MB %3d pages %3.1f sec (total: %3d pages %4.1f sec %5.1f pages/sec) %q",
+				e.FileNum, e.PathIdx+1, e.NumFiles, e.SizeMB,
+				e.NumPages, e.DtIndex.Seconds(),
+				e.TotalPages, totalSec, rate,
+				e.InPath))
+		}
+	}
+}
+
+// indexEvents sends the IndexEvents of an indexing run to a handler. It is called from the text
+// extraction workers as well as the indexing loop so it serializes the calls to the handler and
+// keeps the worker loads that are attached to each event.
+// The handler is not called with `mu` held so that a slow handler doesn't stop the workers from
+// updating their loads.
+type indexEvents struct {
+	mu       sync.Mutex       // Guards `profiles`.
+	sendMu   sync.Mutex       // Serializes the calls to `onEvent`.
+	onEvent  func(IndexEvent) // The handler. nil if the caller doesn't want events.
+	numFiles int
+	profiles []ExtractorProfile
+}
+
+// newIndexEvents returns an indexEvents that sends the events for indexing `numFiles` PDFs to
+// `onEvent`.
+func newIndexEvents(onEvent func(IndexEvent), numFiles int) *indexEvents {
+	return &indexEvents{onEvent: onEvent, numFiles: numFiles}
+}
+
+// setNumWorkers sets the number of text extraction workers to `numWorkers`.
+func (ev *indexEvents) setNumWorkers(numWorkers int) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.profiles = make([]ExtractorProfile, numWorkers)
+}
+
+// setProfile updates the load of worker `workerNum` to `profile`.
+func (ev *indexEvents) setProfile(workerNum int, profile ExtractorProfile) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.profiles[workerNum] = profile
+}
+
+// workerProfiles returns a copy of the loads of the workers.
+func (ev *indexEvents) workerProfiles() []ExtractorProfile {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	return append([]ExtractorProfile(nil), ev.profiles...)
+}
+
+// send sends `e` to the handler.
+func (ev *indexEvents) send(e IndexEvent) {
+	if ev.onEvent == nil {
+		return
+	}
+	e.NumFiles = ev.numFiles
+	e.Workers = ev.workerProfiles()
+	ev.sendMu.Lock()
+	defer ev.sendMu.Unlock()
+	ev.onEvent(e)
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements in-memory indexes over PDFs that are supplied as io.ReadSeekers.
+ *  - CreateMemIndex()
+ *  - BlevePdf.IndexPdfReader()
+ */
+
+package doclib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/papercutsoftware/pdfsearch/internal/utils"
+	"github.com/unidoc/unipdf/v3/common"
+)
+
+// CreateMemIndex returns an empty in-memory BlevePdf and bleve index. PDFs are added to them with
+// BlevePdf.IndexPdfReader() and they are searched with BlevePdf.SearchBleveIndex().
+// Nothing is written to disk.
+func CreateMemIndex() (*BlevePdf, bleve.Index, error) {
+	return createMemIndex(AnalysisConfig{})
+}
+
+// createMemIndex returns an empty in-memory BlevePdf and bleve index whose text is analyzed as
+// configured by `config`.
+func createMemIndex(config AnalysisConfig) (*BlevePdf, bleve.Index, error) {
+	blevePdf, err := openBlevePdf("", nil, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	blevePdf.analysis = config
+	index, err := createBleveMemIndex(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not create Bleve memory index. err=%v", err)
+	}
+	return blevePdf, index, nil
+}
+
+// IndexPdfReader adds the PDF with contents `rs` to in-memory BlevePdf `blevePdf` and its bleve
+// index `index`. `inPath` is the name of the PDF in search results.
+// `rs` is kept by `blevePdf` so that search results can be marked up, so the caller must not close
+// or modify it while `blevePdf` is in use.
+// A PDF whose contents are already in `blevePdf` is skipped.
+// The PDFs embedded in the PDF are added as child documents named like "`inPath`!/attachment.pdf".
+// Embedded PDFs are added even if the PDF itself has no text. Embedded PDFs that can't be indexed
+// are counted in the returned IndexResult but don't cause an error.
+func (blevePdf *BlevePdf) IndexPdfReader(index bleve.Index, inPath string, rs io.ReadSeeker) (
+	IndexResult, error) {
+	var result IndexResult
+	if !blevePdf.inMemory() {
+		return result, errors.New("not an in-memory index")
+	}
+
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return result, err
+	}
+	hash, size, err := utils.ReaderHash(rs)
+	if err != nil {
+		return result, fmt.Errorf("Could not read %q. err=%v", inPath, err)
+	}
+	fd := fileDesc{
+		InPath: inPath,
+		Hash:   hash,
+		SizeMB: float64(size) / 1024.0 / 1024.0,
+	}
+	if blevePdf.hasHash(hash) {
+		common.Log.Debug("IndexPdfReader: %q is already indexed. Skipping.", inPath)
+		result.NumSkipped++
+		return result, nil
+	}
+	err = blevePdf.indexReader(index, fd, rs, &result)
+
+	// PDFs with no text, such as portfolio cover sheets, may have attachments with text.
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return result, err
+	}
+	for _, doc := range embeddedDocs(fd, rs, nil) {
+		if blevePdf.hasHash(doc.fd.Hash) {
+			result.NumSkipped++
+			continue
+		}
+		if err := blevePdf.indexReader(index, doc.fd, bytes.NewReader(doc.data), &result); err != nil {
+			common.Log.Info("IndexPdfReader: %v", err)
+		}
+	}
+	common.Log.Debug("IndexPdfReader: %q %s", inPath, result)
+	return result, err
+}
+
+// indexReader adds the PDF described by `fd` with contents `rs` to in-memory BlevePdf `blevePdf`
+// and its bleve index `index` and adds the outcome to `result`.
+func (blevePdf *BlevePdf) indexReader(index bleve.Index, fd fileDesc, rs io.ReadSeeker,
+	result *IndexResult) error {
+	inPath := fd.InPath
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	t0 := time.Now()
+	docContents, pageFailures, err := extractReaderContents(fd, rs, extractOptions{})
+	result.DtPdf += time.Since(t0)
+	result.Failures = append(result.Failures, pageFailures...)
+	if err != nil {
+		result.NumFailed++
+		result.Failures = append(result.Failures, IndexFailure{InPath: inPath, Err: err})
+		return fmt.Errorf("Could not extract text from %q. err=%v", inPath, err)
+	}
+	if len(docContents) == 0 {
+		common.Log.Info("IndexPdfReader: No text in %q.", inPath)
+		result.NumEmpty++
+		return nil
+	}
+
+	_, dtBleve, err := blevePdf.indexDocPagesLoc(index, fd, docContents)
+	result.DtBleve += dtBleve
+	if err != nil {
+		result.NumFailed++
+		result.Failures = append(result.Failures, IndexFailure{InPath: inPath, Err: err})
+		return fmt.Errorf("Could not index %q. err=%v", inPath, err)
+	}
+	blevePdf.hashReader[fd.Hash] = rs
+	result.NumAdded++
+	result.NumPages += len(docContents)
+	return nil
+}
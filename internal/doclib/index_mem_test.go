@@ -0,0 +1,79 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// TestMarkupMemPdf checks that matches in a PDF that was indexed from memory, and is not on disk,
+// can be marked up from the reader it was indexed from, and that the reader can be reused.
+func TestMarkupMemPdf(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "missing.pdf")
+	blevePdf, index, err := CreateMemIndex()
+	if err != nil {
+		t.Fatalf("CreateMemIndex failed. err=%v", err)
+	}
+	defer index.Close()
+	data := makeTestPdf(t, 2, drawTexts("an overdue invoice", "a paid invoice"))
+	if _, err := blevePdf.IndexPdfReader(index, inPath, bytes.NewReader(data)); err != nil {
+		t.Fatalf("IndexPdfReader failed. err=%v", err)
+	}
+
+	matches, err := blevePdf.SearchBleveIndex(index, "invoice", 10)
+	if err != nil {
+		t.Fatalf("SearchBleveIndex failed. err=%v", err)
+	}
+	if len(matches.Matches) != 2 {
+		t.Fatalf("Unexpected matches %s", matches)
+	}
+
+	// Mark up the matches twice so that the second markup reads the PDF from the reader that the
+	// first markup left at its end.
+	for i := 0; i < 2; i++ {
+		extractList := CreateExtractList(10, 10)
+		for _, m := range matches.Matches {
+			if m.InPath != inPath || m.Reader() == nil {
+				t.Fatalf("Unexpected match %s", m)
+			}
+			extractList.AddReader(m.InPath, m.Reader())
+			bbox, ok := m.PagePositions.BBox(m.Spans[0].Start, m.Spans[0].End)
+			if !ok {
+				t.Fatalf("No bbox for %s", m)
+			}
+			extractList.AddRect(m.InPath, m.PageNum, bbox)
+		}
+		markupPath := filepath.Join(dir, "markup.pdf")
+		if err := extractList.SaveOutputPdf(markupPath); err != nil {
+			t.Fatalf("%d: SaveOutputPdf failed. err=%v", i, err)
+		}
+		if numPages := countPdfPages(t, markupPath); numPages != 2 {
+			t.Fatalf("%d: Marked up PDF has %d pages. Expected 2", i, numPages)
+		}
+	}
+}
+
+// countPdfPages returns the number of pages in PDF `inPath`.
+func countPdfPages(t *testing.T, inPath string) int {
+	t.Helper()
+	f, err := os.Open(inPath)
+	if err != nil {
+		t.Fatalf("Open failed. err=%v", err)
+	}
+	defer f.Close()
+	pdfReader, err := model.NewPdfReader(f)
+	if err != nil {
+		t.Fatalf("NewPdfReader failed. err=%v", err)
+	}
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		t.Fatalf("GetNumPages failed. err=%v", err)
+	}
+	return numPages
+}
@@ -6,6 +6,7 @@
 package doclib
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"path/filepath"
@@ -18,52 +19,189 @@ import (
 	"github.com/unidoc/unipdf/v3/common"
 )
 
-// continueOnFailure tells us whether to continue indexing PDFs after errors have occurred.
-const continueOnFailure = true
+// FailurePolicy tells IndexPdfFilesContext() what to do when a PDF or a page can't be indexed.
+type FailurePolicy int
+
+const (
+	// SkipFailedPages indexes the pages of a PDF that text can be extracted from and skips the
+	// others. PDFs that can't be read at all are skipped. This is the default.
+	SkipFailedPages FailurePolicy = iota
+	// SkipFailedFiles skips PDFs that have any pages that text can't be extracted from.
+	SkipFailedFiles
+	// StopOnFailure stops indexing at the first PDF or page that can't be indexed. The PDFs that
+	// were indexed before it are kept in the index.
+	StopOnFailure
+)
+
+// String returns a human readable name for `p`.
+func (p FailurePolicy) String() string {
+	switch p {
+	case SkipFailedPages:
+		return "SkipFailedPages"
+	case SkipFailedFiles:
+		return "SkipFailedFiles"
+	case StopOnFailure:
+		return "StopOnFailure"
+	}
+	return fmt.Sprintf("FailurePolicy(%d)", int(p))
+}
+
+// IndexOptions controls how IndexPdfFilesContext() indexes PDFs. The zero value gives the default
+// behavior.
+type IndexOptions struct {
+	FailurePolicy FailurePolicy     // What to do when a PDF or a page can't be indexed.
+	Limits        ExtractLimits     // Limits on the resources used to extract the text of each PDF.
+	Passwords     PasswordProvider  // Passwords for encrypted PDFs. May be nil.
+	OCR           OCREngine         // Recognizes the text on pages with no extractable text. May be nil.
+	Extractor     PageTextExtractor // Extracts the text of PDF pages. nil for UniDocExtractor.
+	OnEvent       func(IndexEvent)  // Called with progress events. See IndexPdfFilesContext().
+	Analysis      *AnalysisConfig   // How text is analyzed. nil for the index's AnalysisConfig.
+	// Store keeps the files that link the bleve index to the PDFs. If it is nil, they are kept in
+	// persistDir. The bleve index is always kept on the local disk in persistDir.
+	Store IndexStore
+	// abandoned holds a slot for each abandoned extraction of an indexing run that is still
+	// running. indexPdfFiles() makes it so that each run has its own limit. See watchdog.go.
+	abandoned chan struct{}
+}
+
+// extractOptions returns the options in `opts` that control the extraction of the text of a PDF.
+func (opts IndexOptions) extractOptions() extractOptions {
+	return extractOptions{
+		policy:    opts.FailurePolicy,
+		maxPages:  opts.Limits.MaxPages,
+		passwords: opts.Passwords,
+		ocr:       opts.OCR,
+		extractor: opts.Extractor,
+		maxSizeMB: opts.Limits.MaxFileSizeMB,
+	}
+}
+
+// IndexFailure describes a PDF or a page of a PDF that could not be indexed.
+type IndexFailure struct {
+	InPath  string // Path of the PDF.
+	PageNum uint32 // 1-offset page number of the page that failed. 0 if the whole PDF failed.
+	Err     error  // Why it failed.
+}
+
+// String returns a human readable description of `f`.
+func (f IndexFailure) String() string {
+	if f.PageNum == 0 {
+		return fmt.Sprintf("%q: %v", f.InPath, f.Err)
+	}
+	return fmt.Sprintf("%q page %d: %v", f.InPath, f.PageNum, f.Err)
+}
+
+// IndexResult summarizes the outcome of an IndexPdfFiles run.
+type IndexResult struct {
+	NumAdded   int            // Number of PDFs added to the index.
+	NumSkipped int            // Number of PDFs skipped because their contents were already indexed.
+	NumFailed  int            // Number of PDFs that could not be indexed.
+	NumEmpty   int            // Number of PDFs that were not indexed because they have no text.
+	NumPages   int            // Number of PDF pages added to the index.
+	DtPdf      time.Duration  // Time spent extracting text from PDFs.
+	DtBleve    time.Duration  // Time spent updating the bleve index.
+	Failures   []IndexFailure // Every PDF and page that could not be indexed, with its error.
+}
+
+// String returns a human readable description of `r`.
+func (r IndexResult) String() string {
+	return fmt.Sprintf("{IndexResult: added=%d skipped=%d failed=%d empty=%d pages=%d}",
+		r.NumAdded, r.NumSkipped, r.NumFailed, r.NumEmpty, r.NumPages)
+}
 
 // IndexPdfFiles returns a BlevePdf and a bleve.Index over the PDFs in `pathList`.
 // The index is stored on disk in `persistDir`.
-// `report` is a supplied function that is called to report progress.
-// Returns: (blevePdf, index, numFiles, totalPages, dtPdf, dtBleve, err) where
+// If `forceCreate` is true, any existing index in `persistDir` is replaced. Otherwise the existing
+// index is opened and PDFs whose contents hash is already in the index are skipped.
+// `report` is a supplied function that is called to report progress. IndexPdfFilesContext()
+// reports progress as IndexEvents.
+// Returns: (blevePdf, index, result, err) where
 //   blevePdf: mapping of a bleve index to PDF pages and text coordinates
 //   index: a bleve index
-//   numFiles: number of PDFs succesfully indexed
-//   totalPages: number of PDF pages succesfully indexed
-//   dtPdf: number of seconds spent building blevePdf
-//   dtBleve: number of seconds spent building index
+//   result: numbers of PDFs added, skipped and failed, and where the time was spent
 //   err: error, if one occurred
 func IndexPdfFiles(pathList []string, persistDir string, forceCreate bool, report func(string)) (
-	*BlevePdf, bleve.Index, int, int, time.Duration, time.Duration, error) {
-	common.Log.Debug("Indexing %d PDFs. forceCreate=%t", len(pathList), forceCreate)
-	var dtPdf, dtBleve, dtB time.Duration
+	*BlevePdf, bleve.Index, IndexResult, error) {
+	return IndexPdfFilesContext(context.Background(), pathList, persistDir, forceCreate,
+		IndexOptions{OnEvent: ReportEvents(report)})
+}
+
+// IndexPdfFilesContext is IndexPdfFiles() with a context `ctx` that can cancel the indexing.
+// When `ctx` is cancelled or its deadline passes, no more PDFs are dispatched to the text
+// extraction workers, the PDFs that are being extracted are discarded, and the PDFs that have
+// already been added to the index are saved. The returned error is then ctx.Err() and the returned
+// BlevePdf and index contain the PDFs that were added before the cancellation. The caller must
+// close the returned index.
+// `opts`.FailurePolicy controls what happens when PDFs or pages can't be indexed. With
+// StopOnFailure, the first failure stops indexing in the same way as a cancellation and its error
+// is returned. The returned IndexResult lists all the failures.
+// `opts`.Limits limits the time and the sizes of PDFs that text is extracted from. A PDF that
+// exceeds a limit is abandoned and reported as failed while the other PDFs are indexed.
+// `opts`.Passwords supplies the passwords for encrypted PDFs. Encrypted PDFs that can't be
+// decrypted fail with ErrEncrypted.
+// `opts`.OCR recognizes the text on pages with no extractable text, such as scanned pages. If it
+// is nil, these pages are not indexed.
+// `opts`.Extractor extracts the text of the PDF pages. If it is nil, UniDocExtractor is used.
+// `opts`.OnEvent is a supplied function that is called with an IndexEvent for each step in
+// indexing each PDF and with a final IndexRunFinished event. The calls are made one at a time, but
+// from several goroutines. It may be nil.
+// `opts`.Analysis configures how the text is analyzed when a new index is created. It is saved with
+// the index. If it is nil, a new index gets the zero AnalysisConfig and an existing index keeps the
+// one it was created with. An existing index can't be given another AnalysisConfig.
+func IndexPdfFilesContext(ctx context.Context, pathList []string, persistDir string, forceCreate bool,
+	opts IndexOptions) (*BlevePdf, bleve.Index, IndexResult, error) {
+	ev := newIndexEvents(opts.OnEvent, len(pathList))
+	blevePdf, index, result, err := indexPdfFiles(ctx, pathList, persistDir, forceCreate, opts, ev)
+	ev.send(IndexEvent{Kind: IndexRunFinished, Result: result, Err: err})
+	return blevePdf, index, result, err
+}
+
+// indexPdfFiles does the work of IndexPdfFilesContext(). It sends the events for each PDF to `ev`.
+func indexPdfFiles(ctx context.Context, pathList []string, persistDir string, forceCreate bool,
+	opts IndexOptions, ev *indexEvents) (*BlevePdf, bleve.Index, IndexResult, error) {
+	common.Log.Debug("Indexing %d PDFs. forceCreate=%t policy=%s limits=%s", len(pathList),
+		forceCreate, opts.FailurePolicy, opts.Limits)
+	opts.abandoned = newAbandonedSlots()
+	var result IndexResult
+	var dtB time.Duration
 
 	// !@#$
-	blevePdf, err := openBlevePdf(persistDir, forceCreate)
+	blevePdf, err := openBlevePdf(persistDir, opts.Store, forceCreate)
 	if err != nil {
-		return nil, nil, 0, 0, dtPdf, dtBleve, fmt.Errorf("Could not create positions store %q. "+
+		return nil, nil, result, fmt.Errorf("Could not create positions store %q. "+
 			"err=%v", persistDir, err)
 	}
 	defer blevePdf.flush()
 	defer blevePdf.check()
 
+	indexPath := filepath.Join(persistDir, "bleve")
+	create := len(persistDir) == 0 || forceCreate || !bleveIndexExists(indexPath)
+	if err := blevePdf.setAnalysis(opts.Analysis, create); err != nil {
+		return nil, nil, result, err
+	}
+
 	var index bleve.Index
 	if len(persistDir) == 0 {
-		index, err = createBleveMemIndex()
+		index, err = createBleveMemIndex(blevePdf.analysis)
 		if err != nil {
-			return nil, nil, 0, 0, dtPdf, dtBleve, fmt.Errorf("Could not create Bleve memoryindex. "+
+			return nil, nil, result, fmt.Errorf("Could not create Bleve memoryindex. "+
 				"err=%v", err)
 		}
 	} else {
-		indexPath := filepath.Join(persistDir, "bleve")
 		common.Log.Debug("indexPath=%q", indexPath)
-		// Create a new Bleve index.
-		index, err = createBleveDiskIndex(indexPath, forceCreate)
+		// Create a new Bleve index or open the existing one.
+		index, err = createBleveDiskIndex(indexPath, forceCreate, blevePdf.analysis)
 		if err != nil {
-			return nil, nil, 0, 0, dtPdf, dtBleve, fmt.Errorf("Could not create Bleve index in %q",
+			return nil, nil, result, fmt.Errorf("Could not create Bleve index in %q",
 				indexPath)
 		}
 	}
 
+	// The hashes of the PDFs that are already indexed. The workers skip PDFs with these hashes
+	// without extracting their text. This map is not modified while the workers are running.
+	knownHashes := blevePdf.hashSet()
+	common.Log.Info("%d PDFs already indexed.", len(knownHashes))
+
 	t00 := time.Now()
 
 	numWorkers := (runtime.NumCPU() * 3) / 4
@@ -78,16 +216,20 @@ func IndexPdfFiles(pathList []string, persistDir string, forceCreate bool, repor
 	wg.Add(numWorkers)
 	pathChan := make(chan orderedPath, 100)
 	extractedChan := make(chan extractedDoc, 2*numWorkers)
-	profiles := make([]extractorProfile, numWorkers)
+	ev.setNumWorkers(numWorkers)
+	// The pipeline is stopped by cancelling `pipeCtx`, which happens when `ctx` is cancelled or
+	// when a failure stops indexing.
+	pipeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for i := 0; i < numWorkers; i++ {
-		go func(i int, profile *extractorProfile) {
-			extractPDFText(i, pathChan, extractedChan, profile)
+		go func(i int) {
+			extractPDFText(pipeCtx, i, pathChan, extractedChan, knownHashes, opts, ev)
 			wg.Done()
-		}(i, &profiles[i])
+		}(i)
 	}
 	go func() {
 		// Dispatch all the PDFs
-		dispatchPDFs(pathList, pathChan)
+		dispatchPDFs(pipeCtx, pathList, pathChan)
 		close(pathChan)
 		// Wait for all the workers to finish processing the PDFs
 		wg.Wait()
@@ -95,23 +237,66 @@ func IndexPdfFiles(pathList []string, persistDir string, forceCreate bool, repor
 	}()
 
 	fileNum := 0
-	totalFiles := 0
 	docCount00, err := index.DocCount()
 	if err != nil {
-		return nil, nil, 0, 0, dtPdf, dtBleve, err
+		return nil, nil, result, err
 	}
 
+	// stopErr is the error that stopped indexing under the StopOnFailure policy.
+	var stopErr error
+
 	// Add the pages of all the PDFs in the text extraction results channel `extractedChan` to
 	// `blevePdf` and `index`.
 	for e := range extractedChan {
+		if pipeCtx.Err() != nil {
+			break
+		}
 		fileNum++
-		fd, docContents, dtPdf, err := e.fd, e.docContents, e.dt, e.err
+		fd, docContents, err := e.fd, e.docContents, e.err
+		event := IndexEvent{
+			InPath:    e.inPath,
+			Parent:    fd.Parent,
+			PathIdx:   e.i,
+			FileNum:   fileNum,
+			SizeMB:    fd.SizeMB,
+			DtExtract: e.dt,
+		}
+		// fail records that the PDF could not be indexed because of `err`. It returns true if
+		// indexing should stop.
+		fail := func(err error) bool {
+			result.NumFailed++
+			result.Failures = append(result.Failures, IndexFailure{InPath: e.inPath, Err: err})
+			event.Kind, event.Err = IndexFileFailed, err
+			ev.send(event)
+			if opts.FailurePolicy == StopOnFailure {
+				stopErr = fmt.Errorf("Could not index %q. err=%v", e.inPath, err)
+				cancel()
+				return true
+			}
+			return false
+		}
 		if err != nil {
-			common.Log.Error("IndexPdfFiles: Couldn't extract pages from %q err=%v", fd.InPath, err)
-			continue //!@#$ should be configurable
-			// return nil, nil, 0, 0, dtPdf, dtBleve, err
+			common.Log.Error("IndexPdfFiles: Couldn't extract pages from %q err=%v", e.inPath, err)
+			if fail(err) {
+				break
+			}
+			continue
+		}
+		if e.skipped || blevePdf.hasHash(fd.Hash) {
+			common.Log.Debug("IndexPdfFiles: %q is already indexed. Skipping.", fd.InPath)
+			result.NumSkipped++
+			event.Kind = IndexFileSkipped
+			ev.send(event)
+			continue
 		}
 		if len(docContents) == 0 {
+			// PDFs with no text, such as scans when there is no OCREngine, aren't failures. They
+			// are counted separately so that they aren't mistaken for PDFs that couldn't be read.
+			common.Log.Info("IndexPdfFiles: No text in %q.", fd.InPath)
+			result.NumEmpty++
+			result.Failures = append(result.Failures, e.pageFailures...)
+			event.Kind = IndexFileEmpty
+			ev.send(event)
 			continue
 		}
 
@@ -119,25 +304,25 @@ func IndexPdfFiles(pathList []string, persistDir string, forceCreate bool, repor
 		t0 := time.Now()
 		docCount0, err := index.DocCount()
 		if err != nil {
-			return nil, nil, 0, 0, dtPdf, dtBleve, err
+			return nil, nil, result, err
 		}
 
 		_, dtB, err = blevePdf.indexDocPagesLoc(index, fd, docContents)
-		dtBleve += dtB
+		result.DtBleve += dtB
 
 		dt := time.Since(t0)
 		dtTotal := time.Since(t00)
 		blevePdf.check()
 		if err != nil {
-			if continueOnFailure {
-				continue
+			if fail(err) {
+				break
 			}
-			return nil, nil, 0, 0, dtPdf, dtBleve, fmt.Errorf("could not index file %q", fd.InPath)
+			continue
 		}
 		blevePdf.check()
 		docCount, err := index.DocCount()
 		if err != nil {
-			return nil, nil, 0, 0, dtPdf, dtBleve, err
+			return nil, nil, result, err
 		}
 		common.Log.Debug("Indexed %q. Total %d pages indexed.", fd.InPath, docCount)
 		docPages := int(docCount - docCount0)
@@ -150,34 +335,43 @@ func IndexPdfFiles(pathList []string, persistDir string, forceCreate bool, repor
 				docCount0, docCount, docPages, len(docContents))
 			panic(err)
 		}
-		totalPages := int(docCount)
-		totalFiles++
-		totalSec := dtTotal.Seconds()
-		rate := 0.0
-		if totalSec > 0.0 {
-			rate = float64(totalPages) / totalSec
+		result.NumAdded++
+		result.Failures = append(result.Failures, e.pageFailures...)
+		event.Kind = IndexFileIndexed
+		event.NumPages = docPages
+		event.DtIndex = dt
+		event.TotalPages = int(docCount)
+		event.DtTotal = dtTotal
+		ev.send(event)
+	}
+
+	if pipeCtx.Err() != nil {
+		// Drain the pipeline so that the dispatcher and workers can finish. They stop sending
+		// once `pipeCtx` is done, so this doesn't take long.
+		for range extractedChan {
 		}
-		if report != nil {
-			report(fmt.Sprintf("%3d (%3d) of %d: %5.1f MB %3d pages %3.1f sec (total: %3d pages %4.1f sec %5.1f pages/sec) %q",
-				fileNum, e.i+1, len(pathList), fd.SizeMB,
-				docPages, dt.Seconds(),
-				totalPages, totalSec, rate,
-				fd.InPath))
+		err := ctx.Err()
+		if stopErr != nil {
+			err = stopErr
 		}
+		common.Log.Info("IndexPdfFiles: Stopped. %s err=%v", result, err)
+		return blevePdf, index, result, err
 	}
 
 	// Write out the worker loads to see how evenly they are spread.
+	profiles := ev.workerProfiles()
 	for i, profile := range sortedProfiles(profiles) {
 		common.Log.Info("extractPDFText %d: %s", i, profile)
 	}
-	dtPdf = extractionDuration(profiles)
+	result.DtPdf = extractionDuration(profiles)
 
 	docCount, err := index.DocCount()
 	if err != nil {
-		return nil, nil, 0, 0, dtPdf, dtBleve, err
+		return nil, nil, result, err
 	}
-	totalPages := int(docCount - docCount00)
-	return blevePdf, index, totalFiles, totalPages, dtPdf, dtBleve, err
+	result.NumPages = int(docCount - docCount00)
+	common.Log.Info("IndexPdfFiles: %s", result)
+	return blevePdf, index, result, err
 }
 
 type orderedPath struct {
@@ -187,104 +381,210 @@ type orderedPath struct {
 
 // extractedDoc is the result of PDF text extraction.
 type extractedDoc struct {
-	i           int
-	fd          fileDesc
-	docContents []pageContents
-	dt          time.Duration
-	err         error
-}
-
-type extractorProfile struct {
-	numDocs   int
-	numPages  int
-	dtProcess time.Duration
-	dtIdle    time.Duration
+	i            int
+	inPath       string
+	fd           fileDesc
+	docContents  []pageContents
+	pageFailures []IndexFailure // Pages that were skipped under the SkipFailedPages policy.
+	dt           time.Duration
+	skipped      bool // The PDF was already in the index so its text was not extracted.
+	err          error
 }
 
-// dispatchPDFs dispatches the PDFs in `pathList` to `pathChan`.
-func dispatchPDFs(pathList []string, pathChan chan<- orderedPath) {
+// dispatchPDFs dispatches the PDFs in `pathList` to `pathChan`. It stops when `ctx` is done.
+func dispatchPDFs(ctx context.Context, pathList []string, pathChan chan<- orderedPath) {
 	for i, inPath := range pathList {
-		pathChan <- orderedPath{i: i, inPath: inPath}
+		select {
+		case pathChan <- orderedPath{i: i, inPath: inPath}:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
 // extractPDFText takes PDF paths from `pathChan`, extracts text from them and writes the text
-// extraction results to `extractedChan`. When extractPDFText is done it returns a summary in
-// `summary`.
-func extractPDFText(workerNum int, pathChan <-chan orderedPath, extractedChan chan<- extractedDoc,
-	profile *extractorProfile) {
-	numDocs := 0
-	numPages := 0
-	var processTime time.Duration
-	var idleTime time.Duration
+// extraction results to `extractedChan`. PDFs whose hashes are in `knownHashes` are passed on
+// without having their text extracted. extractPDFText sends events for the PDFs it processes and
+// its load to `ev`. Pages that text can't be extracted from are handled according to
+// `opts`.FailurePolicy and PDFs that exceed `opts`.Limits are abandoned.
+// It stops when `ctx` is done.
+func extractPDFText(ctx context.Context, workerNum int, pathChan <-chan orderedPath,
+	extractedChan chan<- extractedDoc, knownHashes map[string]bool, opts IndexOptions,
+	ev *indexEvents) {
+	var profile ExtractorProfile
 
 	tIdle := time.Now()
 	for op := range pathChan {
+		if ctx.Err() != nil {
+			break
+		}
 		// dtIdle := time.Since(tIdle)
 		t0 := time.Now()
-		fd, docContents, err := extractDocPagePositions(op.inPath)
+		ev.send(IndexEvent{Kind: IndexFileStarted, InPath: op.inPath, PathIdx: op.i, Worker: workerNum})
+		fd, err := createFileDesc(op.inPath)
+		if err == nil && isArchivePath(op.inPath) {
+			if !extractArchiveText(ctx, workerNum, op, fd, extractedChan, knownHashes, opts, ev,
+				&profile) {
+				break
+			}
+			tIdle = time.Now()
+			continue
+		}
+		if err == nil && knownHashes[fd.Hash] {
+			e := extractedDoc{i: op.i, inPath: op.inPath, fd: fd, skipped: true}
+			if !sendExtracted(ctx, extractedChan, e) {
+				break
+			}
+			tIdle = time.Now()
+			continue
+		}
+		var docContents []pageContents
+		var pageFailures []IndexFailure
+		var embedded []embeddedDoc
+		if err == nil {
+			docContents, pageFailures, embedded, err = extractWithLimits(ctx, fd, opts)
+		}
 		t1 := time.Now()
 		// dt := time.Since(t0)
 		dtIdle := t0.Sub(tIdle)
 		dt := t1.Sub(t0)
+		profile.NumDocs++
+		profile.NumPages += len(docContents)
+		profile.DtProcess += dt
+		profile.DtIdle += dtIdle
+		ev.setProfile(workerNum, profile)
+		if err == nil {
+			ev.send(IndexEvent{
+				Kind:      IndexFileExtracted,
+				InPath:    op.inPath,
+				PathIdx:   op.i,
+				Worker:    workerNum,
+				SizeMB:    fd.SizeMB,
+				NumPages:  len(docContents),
+				DtExtract: dt,
+			})
+		}
 		e := extractedDoc{
-			i:           op.i,
-			fd:          fd,
-			docContents: docContents,
-			dt:          dt,
-			err:         err,
-		}
-		extractedChan <- e
-		numDocs++
-		numPages += len(docContents)
-		processTime += dt
-		idleTime += dtIdle
+			i:            op.i,
+			inPath:       op.inPath,
+			fd:           fd,
+			docContents:  docContents,
+			pageFailures: pageFailures,
+			dt:           dt,
+			err:          err,
+		}
+		if !sendExtracted(ctx, extractedChan, e) {
+			break
+		}
+		// PDFs with no text, such as portfolio cover sheets, may have attachments with text.
+		if !extractEmbeddedText(ctx, workerNum, op, embedded, extractedChan, knownHashes, opts, ev,
+			&profile) {
+			break
+		}
 		tIdle = time.Now()
 	}
+}
+
+// extractEmbeddedText extracts the text of the embedded PDFs `docs`, and of the PDFs embedded in
+// them, and writes them to `extractedChan` as child documents in the same way as extractPDFText().
+// `docs` were found by the extraction of `op`.inPath or of a document held in it.
+// It updates worker `workerNum`'s `profile`. It returns false if `ctx` was done.
+func extractEmbeddedText(ctx context.Context, workerNum int, op orderedPath, docs []embeddedDoc,
+	extractedChan chan<- extractedDoc, knownHashes map[string]bool, opts IndexOptions,
+	ev *indexEvents, profile *ExtractorProfile) bool {
+	for _, doc := range docs {
+		if ctx.Err() != nil {
+			return false
+		}
+		e := extractedDoc{i: op.i, inPath: doc.fd.InPath, fd: doc.fd}
+		if knownHashes[doc.fd.Hash] {
+			e.skipped = true
+			if !sendExtracted(ctx, extractedChan, e) {
+				return false
+			}
+			continue
+		}
+		ev.send(IndexEvent{Kind: IndexFileStarted, InPath: e.inPath, Parent: doc.fd.Parent,
+			PathIdx: op.i, Worker: workerNum})
+		t0 := time.Now()
+		var nested []embeddedDoc
+		e.docContents, e.pageFailures, nested, e.err = extractLimited(ctx, doc.fd, opts,
+			dataExtractor(doc.data))
+		e.dt = time.Since(t0)
+		profile.NumDocs++
+		profile.NumPages += len(e.docContents)
+		profile.DtProcess += e.dt
+		ev.setProfile(workerNum, *profile)
+		if e.err == nil {
+			ev.send(IndexEvent{
+				Kind:      IndexFileExtracted,
+				InPath:    e.inPath,
+				Parent:    doc.fd.Parent,
+				PathIdx:   op.i,
+				Worker:    workerNum,
+				SizeMB:    doc.fd.SizeMB,
+				NumPages:  len(e.docContents),
+				DtExtract: e.dt,
+			})
+		}
+		if !sendExtracted(ctx, extractedChan, e) {
+			return false
+		}
+		if !extractEmbeddedText(ctx, workerNum, op, nested, extractedChan, knownHashes, opts, ev,
+			profile) {
+			return false
+		}
+	}
+	return true
+}
 
-	*profile = extractorProfile{
-		numDocs:   numDocs,
-		numPages:  numPages,
-		dtProcess: processTime,
-		dtIdle:    idleTime,
+// sendExtracted sends `e` to `extractedChan`. It returns false if `ctx` was done before `e` could
+// be sent.
+func sendExtracted(ctx context.Context, extractedChan chan<- extractedDoc, e extractedDoc) bool {
+	select {
+	case extractedChan <- e:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
-func (p extractorProfile) String() string {
+// String returns a human readable description of `p`.
+func (p ExtractorProfile) String() string {
 	docsSec := 0.0
 	pagesSec := 0.0
-	processSec := p.dtProcess.Seconds()
+	processSec := p.DtProcess.Seconds()
 	if processSec > 0.0 {
-		docsSec = float64(p.numDocs) / processSec
-		pagesSec = float64(p.numPages) / processSec
+		docsSec = float64(p.NumDocs) / processSec
+		pagesSec = float64(p.NumPages) / processSec
 	}
 	return fmt.Sprintf("processed %3d PDFs %4d pages in %5.1f sec [%5.1f sec idle] (%3.1f PDFs/sec %4.1f pages/sec)",
-		p.numDocs, p.numPages, processSec, p.dtIdle.Seconds(), docsSec, pagesSec)
+		p.NumDocs, p.NumPages, processSec, p.DtIdle.Seconds(), docsSec, pagesSec)
 }
 
-func sortedProfiles(profiles []extractorProfile) []extractorProfile {
+func sortedProfiles(profiles []ExtractorProfile) []ExtractorProfile {
 	sort.Slice(profiles, func(i, j int) bool {
 		pi, pj := profiles[i], profiles[j]
-		si, sj := pi.dtProcess.Seconds(), pj.dtProcess.Seconds()
+		si, sj := pi.DtProcess.Seconds(), pj.DtProcess.Seconds()
 		if math.Abs(si-sj) >= 0.1 {
 			return si > sj
 		}
-		if pi.numPages != pj.numPages {
-			return pi.numPages < pj.numPages
+		if pi.NumPages != pj.NumPages {
+			return pi.NumPages < pj.NumPages
 		}
-		if pi.numDocs != pj.numDocs {
-			return pi.numDocs < pj.numDocs
+		if pi.NumDocs != pj.NumDocs {
+			return pi.NumDocs < pj.NumDocs
 		}
 		return i < j
 	})
 	return profiles
 }
 
-func extractionDuration(profiles []extractorProfile) time.Duration {
+func extractionDuration(profiles []ExtractorProfile) time.Duration {
 	var dtProcess time.Duration
 	for _, p := range profiles {
-		if p.dtProcess > dtProcess {
-			dtProcess = p.dtProcess
+		if p.DtProcess > dtProcess {
+			dtProcess = p.DtProcess
 		}
 	}
 	return dtProcess
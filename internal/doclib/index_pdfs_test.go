@@ -0,0 +1,260 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/papercutsoftware/pdfsearch/internal/serial"
+)
+
+// TestUpdateSkipsIndexed checks that updating an index skips the PDFs that are already in it and
+// that PDFs with no text are counted as empty, not failed.
+func TestUpdateSkipsIndexed(t *testing.T) {
+	dir := t.TempDir()
+	var pathList []string
+	for _, test := range []struct {
+		name  string
+		texts []string
+	}{
+		{"one.pdf", []string{"invoice"}},
+		{"two.pdf", []string{"receipt", "refund"}},
+		{"blank.pdf", nil}, // A PDF with no pages has no text.
+	} {
+		inPath := filepath.Join(dir, test.name)
+		writeTestPdf(t, inPath, len(test.texts), drawTexts(test.texts...))
+		pathList = append(pathList, inPath)
+	}
+
+	persistDir := filepath.Join(dir, "store")
+	_, index, result, err := IndexPdfFiles(pathList, persistDir, true, nil)
+	if err != nil {
+		t.Fatalf("IndexPdfFiles failed. err=%v", err)
+	}
+	index.Close()
+	if result.NumAdded != 2 || result.NumEmpty != 1 || result.NumFailed != 0 {
+		t.Fatalf("First run: %s", result)
+	}
+
+	var skipped []string
+	report := func(msg string) {
+		if strings.Contains(msg, "already indexed") {
+			skipped = append(skipped, msg)
+		}
+	}
+	blevePdf, index, result, err := IndexPdfFiles(pathList, persistDir, false, report)
+	if err != nil {
+		t.Fatalf("IndexPdfFiles failed. err=%v", err)
+	}
+	defer index.Close()
+	if result.NumAdded != 0 || result.NumSkipped != 2 || result.NumEmpty != 1 ||
+		result.NumFailed != 0 || len(skipped) != 2 {
+		t.Fatalf("Second run: %s skipped=%q", result, skipped)
+	}
+	matches, err := blevePdf.SearchBleveIndex(index, "refund", 10)
+	if err != nil {
+		t.Fatalf("SearchBleveIndex failed. err=%v", err)
+	}
+	if len(matches.Matches) != 1 {
+		t.Fatalf("%d matches. Expected 1. matches=%s", len(matches.Matches), matches)
+	}
+}
+
+// TestIndexPdfFilesContext checks that cancelling IndexPdfFilesContext() stops the indexing
+// pipeline, returns the context's error and leaves a readable index.
+func TestIndexPdfFilesContext(t *testing.T) {
+	var pathList []string
+	for i := 0; i < 500; i++ {
+		pathList = append(pathList, fmt.Sprintf("missing%03d.pdf", i))
+	}
+
+	persistDir := filepath.Join(t.TempDir(), "store")
+	_, index, result, err := IndexPdfFilesContext(context.Background(), pathList, persistDir, true,
+		IndexOptions{})
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	index.Close()
+	if result.NumFailed != len(pathList) || len(result.Failures) != len(pathList) {
+		t.Fatalf("NumFailed=%d Failures=%d expected %d", result.NumFailed, len(result.Failures),
+			len(pathList))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, index, result, err = IndexPdfFilesContext(ctx, pathList, persistDir, false, IndexOptions{})
+	if err != context.Canceled {
+		t.Fatalf("IndexPdfFilesContext returned err=%v. Expected %v", err, context.Canceled)
+	}
+	if index == nil {
+		t.Fatalf("IndexPdfFilesContext returned no index")
+	}
+	index.Close()
+	if result.NumFailed >= len(pathList) {
+		t.Fatalf("NumFailed=%d. Indexing was not cancelled", result.NumFailed)
+	}
+
+	if _, err := openBlevePdf(persistDir, nil, false); err != nil {
+		t.Fatalf("openBlevePdf failed after cancellation. err=%v", err)
+	}
+}
+
+// TestStopOnFailure checks that the StopOnFailure policy stops indexing at the first failure.
+func TestStopOnFailure(t *testing.T) {
+	var pathList []string
+	for i := 0; i < 100; i++ {
+		pathList = append(pathList, fmt.Sprintf("missing%03d.pdf", i))
+	}
+	persistDir := filepath.Join(t.TempDir(), "store")
+	opts := IndexOptions{FailurePolicy: StopOnFailure}
+	_, index, result, err := IndexPdfFilesContext(context.Background(), pathList, persistDir, true,
+		opts)
+	if err == nil {
+		t.Fatalf("IndexPdfFilesContext succeeded with StopOnFailure")
+	}
+	if index == nil {
+		t.Fatalf("IndexPdfFilesContext returned no index")
+	}
+	index.Close()
+	if result.NumFailed != 1 || len(result.Failures) != 1 {
+		t.Fatalf("NumFailed=%d Failures=%v. Expected 1 failure", result.NumFailed, result.Failures)
+	}
+	f := result.Failures[0]
+	if f.PageNum != 0 || f.Err == nil {
+		t.Fatalf("Bad failure %s", f)
+	}
+}
+
+// TestIndexEvents checks that IndexPdfFilesContext() sends the expected IndexEvents.
+func TestIndexEvents(t *testing.T) {
+	pathList := []string{"missing1.pdf", "missing2.pdf", "missing3.pdf"}
+	var mu sync.Mutex
+	var events []IndexEvent
+	onEvent := func(e IndexEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+	persistDir := filepath.Join(t.TempDir(), "store")
+	_, index, _, err := IndexPdfFilesContext(context.Background(), pathList, persistDir, true,
+		IndexOptions{OnEvent: onEvent})
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	index.Close()
+
+	counts := map[IndexEventKind]int{}
+	for _, e := range events {
+		counts[e.Kind]++
+		if e.NumFiles != len(pathList) {
+			t.Fatalf("NumFiles=%d expected %d. %s", e.NumFiles, len(pathList), e)
+		}
+		if len(e.Workers) == 0 {
+			t.Fatalf("No worker profiles. %s", e)
+		}
+		if e.Kind == IndexFileFailed && (e.Err == nil || e.InPath != pathList[e.PathIdx]) {
+			t.Fatalf("Bad failure event %s", e)
+		}
+	}
+	if counts[IndexFileStarted] != len(pathList) || counts[IndexFileFailed] != len(pathList) {
+		t.Fatalf("Unexpected events: %v", counts)
+	}
+	last := events[len(events)-1]
+	if last.Kind != IndexRunFinished || counts[IndexRunFinished] != 1 {
+		t.Fatalf("Last event is %s. Expected one %s event at the end", last, IndexRunFinished)
+	}
+	if last.Result.NumFailed != len(pathList) {
+		t.Fatalf("Bad result in %s", last)
+	}
+}
+
+// TestReportEvents checks that ReportEvents() reports the same progress lines as IndexPdfFiles()
+// always has.
+func TestReportEvents(t *testing.T) {
+	var lines []string
+	onEvent := ReportEvents(func(line string) { lines = append(lines, line) })
+	onEvent(IndexEvent{Kind: IndexFileStarted, InPath: "a.pdf", NumFiles: 20})
+	onEvent(IndexEvent{Kind: IndexFileSkipped, InPath: "a.pdf", PathIdx: 4, NumFiles: 20, FileNum: 3})
+	onEvent(IndexEvent{Kind: IndexFileIndexed, InPath: "b.pdf", PathIdx: 6, NumFiles: 20, FileNum: 4,
+		SizeMB: 1.25, NumPages: 12, DtIndex: 1500 * time.Millisecond, TotalPages: 40,
+		DtTotal: 10 * time.Second})
+	expected := []string{
+		`  3 (  5) of 20: already indexed "a.pdf"`,
+		`  4 (  7) of 20:   1.2 MB  12 pages 1.5 sec (total:  40 pages 10.0 sec   4.0 pages/sec) "b.pdf"`,
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("lines=%q expected %q", lines, expected)
+	}
+	for i, line := range lines {
+		if line != expected[i] {
+			t.Fatalf("line %d=%q expected %q", i, line, expected[i])
+		}
+	}
+	if ReportEvents(nil) != nil {
+		t.Fatalf("ReportEvents(nil) is not nil")
+	}
+}
+
+// TestSlowEventHandler checks that the workers can update their loads while the event handler is
+// running.
+func TestSlowEventHandler(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ev := newIndexEvents(func(IndexEvent) {
+		close(started)
+		<-release
+	}, 1)
+	ev.setNumWorkers(1)
+	go ev.send(IndexEvent{Kind: IndexFileStarted, InPath: "a.pdf"})
+	<-started
+	defer close(release)
+
+	done := make(chan struct{})
+	go func() {
+		ev.setProfile(0, ExtractorProfile{NumDocs: 1})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("setProfile was blocked by the event handler")
+	}
+}
+
+// TestSearchBleveIndexContext checks that SearchBleveIndexContext() returns the context's error
+// when its context is cancelled.
+func TestSearchBleveIndexContext(t *testing.T) {
+	blevePdf, index, err := CreateMemIndex()
+	if err != nil {
+		t.Fatalf("CreateMemIndex failed. err=%v", err)
+	}
+	defer index.Close()
+
+	text := "The quick brown fox jumps over the lazy dog"
+	ppos := PagePositions{[]serial.OffsetBBox{{Offset: 0, Llx: 10, Lly: 20, Urx: 300, Ury: 40}}}
+	docContents := []pageContents{{pageNum: 1, ppos: ppos, text: text}}
+	fd := fileDesc{InPath: "fox.pdf", Hash: "fedcba9876543210"}
+	if _, _, err := blevePdf.indexDocPagesLoc(index, fd, docContents); err != nil {
+		t.Fatalf("indexDocPagesLoc failed. err=%v", err)
+	}
+
+	results, err := blevePdf.SearchBleveIndexContext(context.Background(), index, "lazy dog", 10)
+	if err != nil {
+		t.Fatalf("SearchBleveIndexContext failed. err=%v", err)
+	}
+	if len(results.Matches) != 1 {
+		t.Fatalf("%d matches. Expected 1. results=%s", len(results.Matches), results)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := blevePdf.SearchBleveIndexContext(ctx, index, "lazy dog", 10); err != context.Canceled {
+		t.Fatalf("SearchBleveIndexContext returned err=%v. Expected %v", err, context.Canceled)
+	}
+}
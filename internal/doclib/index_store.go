@@ -0,0 +1,114 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the storage of the files that link a bleve index to PDFs.
+ *  - IndexStore is the interface to the storage.
+ *  - DirStore keeps the files in a directory on the local disk. This is the default.
+ *  - ObjectStore (see object_store.go) keeps the files in an object store or in memory.
+ *  - IndexOptions.Store selects the IndexStore for an index.
+ *
+ * The files are
+ *    file_list.json                  The list of indexed PDFs.
+ *    pdf.xref/<hash>.dat             Text positions of all the pages of the PDF with hash <hash>.
+ *    pdf.xref/<hash>.idx.json        Offsets of the pages' text positions in <hash>.dat.
+ *    pdf.xref/<hash>.page.contents/  Extracted text of the pages. 000.txt, 001.txt, ...
+ */
+
+package doclib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/papercutsoftware/pdfsearch/internal/utils"
+)
+
+// IndexStore stores the files that link a bleve index to the PDFs it was built from: the file
+// list and, for each PDF, the text positions data, the page partitions and the page texts.
+// Files are named by slash-separated relative paths like "pdf.xref/<hash>.dat". A directory is
+// the set of files whose names start with the directory name and a slash.
+// The bleve index itself is not kept in the IndexStore. It is always kept on the local disk in the
+// index directory, so an index whose IndexStore is an object store still needs a local directory.
+type IndexStore interface {
+	// ReadFile returns the contents of file `name`. If there is no such file, the returned error
+	// satisfies os.IsNotExist().
+	ReadFile(name string) ([]byte, error)
+	// WriteFile replaces the contents of file `name` with `data`.
+	WriteFile(name string, data []byte) error
+	// Exists returns true if there is a file or a directory called `name`.
+	Exists(name string) bool
+	// Rename renames file or directory `oldName` to `newName`.
+	Rename(oldName, newName string) error
+	// RemoveAll removes file or directory `name`. It is not an error if `name` doesn't exist.
+	RemoveAll(name string) error
+	// List returns the sorted names, without the `dir` prefix, of the files and directories in
+	// directory `dir`.
+	List(dir string) ([]string, error)
+}
+
+// DirStore is an IndexStore that keeps its files in a directory on the local disk.
+type DirStore struct {
+	root string // The files are kept in the directory tree under `root`.
+}
+
+// NewDirStore returns a DirStore that keeps its files in the directory tree under `root`.
+func NewDirStore(root string) *DirStore {
+	return &DirStore{root: root}
+}
+
+// path returns the path on disk of the file called `name`.
+func (s *DirStore) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+// ReadFile returns the contents of file `name`.
+func (s *DirStore) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(name))
+}
+
+// WriteFile replaces the contents of file `name` with `data`. Necessary directories are created.
+func (s *DirStore) WriteFile(name string, data []byte) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0666)
+}
+
+// Exists returns true if there is a file or a directory called `name`.
+func (s *DirStore) Exists(name string) bool {
+	return utils.Exists(s.path(name))
+}
+
+// Rename renames file or directory `oldName` to `newName`.
+func (s *DirStore) Rename(oldName, newName string) error {
+	newPath := s.path(newName)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0777); err != nil {
+		return err
+	}
+	return os.Rename(s.path(oldName), newPath)
+}
+
+// RemoveAll removes file or directory `name`.
+func (s *DirStore) RemoveAll(name string) error {
+	return os.RemoveAll(s.path(name))
+}
+
+// List returns the sorted names of the files and directories in directory `dir`.
+func (s *DirStore) List(dir string) ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(s.path(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fileInfos {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
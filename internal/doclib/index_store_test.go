@@ -0,0 +1,229 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/papercutsoftware/pdfsearch/internal/serial"
+)
+
+// TestIndexStores checks that the IndexStore implementations store, list, rename and remove files
+// correctly.
+func TestIndexStores(t *testing.T) {
+	for name, store := range makeTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testIndexStore(t, store)
+		})
+	}
+}
+
+// TestBlevePdfStores checks that BlevePdfs can be saved to and loaded from the IndexStore
+// implementations.
+func TestBlevePdfStores(t *testing.T) {
+	for name, store := range makeTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testBlevePdfStore(t, name, store)
+		})
+	}
+}
+
+// makeTestStores returns a DirStore, a memory store and an ObjectStore over a fake bucket.
+func makeTestStores(t *testing.T) map[string]IndexStore {
+	return map[string]IndexStore{
+		"dir":    NewDirStore(t.TempDir()),
+		"mem":    NewMemStore(),
+		"object": NewObjectStore(newFakeBucket(), "indexes/my.computer"),
+	}
+}
+
+// testIndexStore checks the basic operations of `store`.
+func testIndexStore(t *testing.T, store IndexStore) {
+	files := map[string]string{
+		"file_list.json":                     "[]",
+		"pdf.xref/abc.dat":                   "positions",
+		"pdf.xref/abc.idx.json":              "partitions",
+		"pdf.xref/abc.page.contents/000.txt": "page 1",
+		"pdf.xref/abc.page.contents/001.txt": "page 2",
+	}
+	for name, contents := range files {
+		if err := store.WriteFile(name, []byte(contents)); err != nil {
+			t.Fatalf("WriteFile(%q) failed. err=%v", name, err)
+		}
+	}
+	for name, contents := range files {
+		checkFile(t, store, name, contents)
+	}
+	if _, err := store.ReadFile("pdf.xref/missing.dat"); !os.IsNotExist(err) {
+		t.Fatalf("ReadFile of missing file returned err=%v. Expected os.IsNotExist", err)
+	}
+	for _, name := range []string{"file_list.json", "pdf.xref", "pdf.xref/abc.page.contents"} {
+		if !store.Exists(name) {
+			t.Fatalf("Exists(%q)=false", name)
+		}
+	}
+	if store.Exists("pdf.xref/abc") {
+		t.Fatalf("Exists(%q)=true for a file name prefix", "pdf.xref/abc")
+	}
+
+	checkList(t, store, "pdf.xref", []string{"abc.dat", "abc.idx.json", "abc.page.contents"})
+	checkList(t, store, "pdf.xref/abc.page.contents", []string{"000.txt", "001.txt"})
+	checkList(t, store, "missing", nil)
+
+	if err := store.Rename("pdf.xref/abc.page.contents", "pdf.xref/def.page.contents"); err != nil {
+		t.Fatalf("Rename failed. err=%v", err)
+	}
+	if store.Exists("pdf.xref/abc.page.contents") {
+		t.Fatalf("Renamed directory still exists")
+	}
+	checkFile(t, store, "pdf.xref/def.page.contents/001.txt", "page 2")
+
+	if err := store.RemoveAll("pdf.xref"); err != nil {
+		t.Fatalf("RemoveAll failed. err=%v", err)
+	}
+	if store.Exists("pdf.xref") || store.Exists("pdf.xref/abc.dat") {
+		t.Fatalf("Removed directory still exists")
+	}
+	if err := store.RemoveAll("pdf.xref"); err != nil {
+		t.Fatalf("RemoveAll of missing directory failed. err=%v", err)
+	}
+	checkFile(t, store, "file_list.json", "[]")
+}
+
+// checkFile checks that file `name` in `store` contains `contents`.
+func checkFile(t *testing.T, store IndexStore, name, contents string) {
+	data, err := store.ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile(%q) failed. err=%v", name, err)
+	}
+	if string(data) != contents {
+		t.Fatalf("ReadFile(%q)=%q expected %q", name, data, contents)
+	}
+}
+
+// checkList checks that the files and directories in directory `dir` of `store` are `expected`.
+func checkList(t *testing.T, store IndexStore, dir string, expected []string) {
+	names, err := store.List(dir)
+	if err != nil {
+		t.Fatalf("List(%q) failed. err=%v", dir, err)
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("List(%q)=%q expected %q", dir, names, expected)
+	}
+}
+
+// testBlevePdfStore indexes some pages in a BlevePdf that is saved in `store` then checks that the
+// pages can be read back from a BlevePdf loaded from `store`.
+func testBlevePdfStore(t *testing.T, name string, store IndexStore) {
+	root := "test.index." + name
+	blevePdf, err := openBlevePdf(root, store, false)
+	if err != nil {
+		t.Fatalf("openBlevePdf failed. err=%v", err)
+	}
+	index, err := createBleveMemIndex(AnalysisConfig{})
+	if err != nil {
+		t.Fatalf("createBleveMemIndex failed. err=%v", err)
+	}
+	defer index.Close()
+
+	var docContents []pageContents
+	for pageNum := uint32(1); pageNum <= 3; pageNum++ {
+		ppos := PagePositions{[]serial.OffsetBBox{
+			{Offset: 0, Llx: 10, Lly: 20, Urx: 30, Ury: 40},
+			{Offset: 5, Llx: 30, Lly: 20, Urx: 50, Ury: float32(40 + pageNum)},
+		}}
+		text := fmt.Sprintf("Page %d of the test document", pageNum)
+		docContents = append(docContents, pageContents{pageNum: pageNum, ppos: ppos, text: text})
+	}
+	fd := fileDesc{InPath: "test.pdf", Hash: "0123456789abcdef"}
+	if _, _, err := blevePdf.indexDocPagesLoc(index, fd, docContents); err != nil {
+		t.Fatalf("indexDocPagesLoc failed. err=%v", err)
+	}
+	if err := blevePdf.flush(); err != nil {
+		t.Fatalf("flush failed. err=%v", err)
+	}
+
+	blevePdf2, err := openBlevePdf(root, store, false)
+	if err != nil {
+		t.Fatalf("openBlevePdf failed. err=%v", err)
+	}
+	for pageIdx, contents := range docContents {
+		inPath, pageNum, ppos, err := blevePdf2.docPagePositions(0, uint32(pageIdx))
+		if err != nil {
+			t.Fatalf("docPagePositions failed. pageIdx=%d err=%v", pageIdx, err)
+		}
+		if inPath != fd.InPath || pageNum != contents.pageNum ||
+			!reflect.DeepEqual(ppos, contents.ppos) {
+			t.Fatalf("pageIdx=%d: got %q:%d %v expected %q:%d %v", pageIdx, inPath, pageNum,
+				ppos.offsetBBoxes, fd.InPath, contents.pageNum, contents.ppos.offsetBBoxes)
+		}
+		text, err := blevePdf2.docPageText(0, uint32(pageIdx))
+		if err != nil {
+			t.Fatalf("docPageText failed. pageIdx=%d err=%v", pageIdx, err)
+		}
+		if text != contents.text {
+			t.Fatalf("pageIdx=%d: text=%q expected %q", pageIdx, text, contents.text)
+		}
+	}
+
+	check, err := blevePdf2.checkIndex(index)
+	if err != nil {
+		t.Fatalf("checkIndex failed. err=%v", err)
+	}
+	if !check.OK() {
+		t.Fatalf("checkIndex found problems. %s", check)
+	}
+}
+
+// fakeBucket is a local fake of a cloud storage bucket. It implements ObjectClient.
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{objects: map[string]string{}}
+}
+
+func (b *fakeBucket) Get(key string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return []byte(data), nil
+}
+
+func (b *fakeBucket) Put(key string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = string(data)
+	return nil
+}
+
+func (b *fakeBucket) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, key)
+	return nil
+}
+
+func (b *fakeBucket) List(prefix string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var keys []string
+	for k := range b.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
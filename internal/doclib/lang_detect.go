@@ -0,0 +1,339 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the detection of the languages of pages so that each page can be
+ * indexed with the bleve analyzer for its language.
+ *  - The language of a page is detected by comparing the frequencies of the character trigrams in
+ *    its text with a profile of the most frequent trigrams of each language. This is the n-gram
+ *    method of Cavnar & Trenkle, "N-Gram-Based Text Categorization", 1994.
+ *  - The profiles are built at start-up from the sample text of each language in `languages`.
+ *  - Chinese, Japanese and Korean (CJK) pages are detected by their scripts. They are indexed with
+ *    bleve's CJK analyzer, which indexes overlapping pairs of ideographs (bigrams) as CJK text has
+ *    no spaces between words. The bigrams keep the byte offsets of their characters in the page
+ *    text so that matches in CJK text are located in the same way as matches in other text.
+ *  - English pages, and pages with too little text to detect their language, are indexed in the
+ *    Text field. Pages in the other languages are indexed in fields like LangText.de.
+ *  - The detected language of each page is indexed in the Lang field so that searches can be
+ *    filtered by language with lang: qualifiers. See field_query.go.
+ */
+
+package doclib
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/blevesearch/bleve/analysis/lang/cjk"
+	"github.com/blevesearch/bleve/analysis/lang/de"
+	"github.com/blevesearch/bleve/analysis/lang/en"
+	"github.com/blevesearch/bleve/analysis/lang/es"
+	"github.com/blevesearch/bleve/analysis/lang/fr"
+	"github.com/blevesearch/bleve/analysis/lang/it"
+	"github.com/blevesearch/bleve/analysis/lang/pt"
+	"github.com/blevesearch/bleve/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/analysis/token/porter"
+)
+
+const (
+	// langProfileSize is the number of trigrams in a language profile.
+	langProfileSize = 300
+	// minLangLetters is the minimum number of letters in text whose language is detected. Shorter
+	// texts are treated as English.
+	minLangLetters = 40
+	// maxLangLetters is the number of letters at the start of a text that its language is detected
+	// from.
+	maxLangLetters = 4000
+	// minCJKLetters is the minimum number of CJK characters in text that is detected as CJK. Their
+	// scripts identify CJK languages so a few characters are enough.
+	minCJKLetters = 2
+)
+
+// language is a language whose pages are indexed with the bleve analyzer for the language.
+// The token filters of the analyzer are listed so that an AnalysisConfig can build a custom
+// analyzer from them. See analysis_config.go.
+type language struct {
+	code     string         // ISO 639-1 code, e.g. "de". It is the value of lang: qualifiers.
+	analyzer string         // Name of the bleve analyzer for the language.
+	prepare  []string       // Names of the analyzer's token filters that come before `stop`.
+	stop     string         // Name of the analyzer's stop filter and stop word list, or "".
+	stem     []string       // Names of the analyzer's token filters that stem words.
+	sample   string         // Text that the language's trigram profile is built from. Empty for CJK.
+	profile  map[string]int // {trigram: rank} for the most frequent trigrams in `sample`.
+}
+
+// languages are the languages that are detected. English is first. It is the language of pages
+// whose languages aren't detected.
+var languages = []*language{
+	{code: "en", analyzer: en.AnalyzerName, sample: sampleEn,
+		prepare: []string{en.PossessiveName, lowercase.Name}, stop: en.StopName,
+		stem: []string{porter.Name}},
+	{code: "de", analyzer: de.AnalyzerName, sample: sampleDe,
+		prepare: []string{lowercase.Name}, stop: de.StopName,
+		stem: []string{de.NormalizeName, de.LightStemmerName}},
+	{code: "fr", analyzer: fr.AnalyzerName, sample: sampleFr,
+		prepare: []string{fr.ElisionName, lowercase.Name}, stop: fr.StopName,
+		stem: []string{fr.LightStemmerName}},
+	{code: "es", analyzer: es.AnalyzerName, sample: sampleEs,
+		prepare: []string{lowercase.Name}, stop: es.StopName,
+		stem: []string{es.LightStemmerName}},
+	{code: "it", analyzer: it.AnalyzerName, sample: sampleIt,
+		prepare: []string{it.ElisionName, lowercase.Name}, stop: it.StopName,
+		stem: []string{it.LightStemmerName}},
+	{code: "pt", analyzer: pt.AnalyzerName, sample: samplePt,
+		prepare: []string{lowercase.Name}, stop: pt.StopName,
+		stem: []string{pt.LightStemmerName}},
+	{code: "zh", analyzer: cjk.AnalyzerName, prepare: cjkFilters},
+	{code: "ja", analyzer: cjk.AnalyzerName, prepare: cjkFilters},
+	{code: "ko", analyzer: cjk.AnalyzerName, prepare: cjkFilters},
+}
+
+// cjkFilters are the token filters of bleve's CJK analyzer. It has no stop words or stemming.
+var cjkFilters = []string{cjk.WidthName, lowercase.Name, cjk.BigramName}
+
+// init builds the trigram profiles of `languages`.
+func init() {
+	for _, l := range languages {
+		if l.sample != "" {
+			l.profile = trigramProfile(l.sample)
+		}
+	}
+}
+
+// field returns the name of the bleve field that holds the text of pages in language `l`.
+func (l *language) field() string {
+	if l == languages[0] {
+		return fieldText
+	}
+	return fieldLangText + "." + l.code
+}
+
+// textFields returns the names of the bleve fields that hold page text, one for each language.
+func textFields() []string {
+	fields := make([]string, len(languages))
+	for i, l := range languages {
+		fields[i] = l.field()
+	}
+	return fields
+}
+
+// languageCode returns the language in `languages` with ISO 639-1 code `code`, or nil if there
+// isn't one.
+func languageCode(code string) *language {
+	for _, l := range languages {
+		if l.code == strings.ToLower(code) {
+			return l
+		}
+	}
+	return nil
+}
+
+// languageCodes returns the codes of `languages` separated by commas.
+func languageCodes() string {
+	codes := make([]string, len(languages))
+	for i, l := range languages {
+		codes[i] = l.code
+	}
+	return strings.Join(codes, ", ")
+}
+
+// detectLanguage returns the language of `text`. It returns English if `text` is too short for its
+// language to be detected.
+func detectLanguage(text string) *language {
+	if code := cjkLanguage(text); code != "" {
+		return languageCode(code)
+	}
+	profile := trigramProfile(text)
+	if profile == nil {
+		return languages[0]
+	}
+	best, bestDist := languages[0], -1
+	for _, l := range languages {
+		if l.profile == nil {
+			continue
+		}
+		if dist := l.distance(profile); bestDist < 0 || dist < bestDist {
+			best, bestDist = l, dist
+		}
+	}
+	return best
+}
+
+// cjkLanguage returns the code of the CJK language of `text` if most of its letters are CJK
+// characters, or "" if they aren't. Text with kana (the Japanese syllabaries) is Japanese, text
+// that is mostly Hangul is Korean and other text in Han ideographs is Chinese.
+func cjkLanguage(text string) string {
+	numLetters, numHan, numKana, numHangul := 0, 0, 0, 0
+	for _, r := range text {
+		if numLetters >= maxLangLetters {
+			break
+		}
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		numLetters++
+		switch {
+		case unicode.Is(unicode.Han, r):
+			numHan++
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			numKana++
+		case unicode.Is(unicode.Hangul, r):
+			numHangul++
+		}
+	}
+	numCJK := numHan + numKana + numHangul
+	if numCJK < minCJKLetters || 2*numCJK < numLetters {
+		return ""
+	}
+	switch {
+	case 2*numHangul > numCJK:
+		return "ko"
+	case 20*numKana > numCJK:
+		return "ja"
+	}
+	return "zh"
+}
+
+// distance returns the "out-of-place" distance between the trigram profile of language `l` and
+// `profile`, the trigram profile of a text. Each trigram in `profile` adds the difference between
+// its ranks in the two profiles, or langProfileSize if it isn't in the profile of `l`.
+func (l *language) distance(profile map[string]int) int {
+	dist := 0
+	for tri, rank := range profile {
+		lRank, ok := l.profile[tri]
+		switch {
+		case !ok:
+			dist += langProfileSize
+		case lRank > rank:
+			dist += lRank - rank
+		default:
+			dist += rank - lRank
+		}
+	}
+	return dist
+}
+
+// trigramProfile returns the ranks of the langProfileSize most frequent character trigrams in
+// `text` as a {trigram: rank} map. It returns nil if `text` has fewer than minLangLetters letters.
+// The trigrams are those of the lower case words in `text` with a space before and after each word.
+func trigramProfile(text string) map[string]int {
+	counts := map[string]int{}
+	numLetters := 0
+	word := []rune{' '}
+	addWord := func() {
+		if len(word) == 1 {
+			return
+		}
+		word = append(word, ' ')
+		for i := 0; i+3 <= len(word); i++ {
+			counts[string(word[i:i+3])]++
+		}
+		word = word[:1]
+	}
+	for _, r := range text {
+		if numLetters >= maxLangLetters {
+			break
+		}
+		if unicode.IsLetter(r) {
+			word = append(word, unicode.ToLower(r))
+			numLetters++
+		} else {
+			addWord()
+		}
+	}
+	addWord()
+	if numLetters < minLangLetters {
+		return nil
+	}
+
+	trigrams := make([]string, 0, len(counts))
+	for tri := range counts {
+		trigrams = append(trigrams, tri)
+	}
+	sort.Slice(trigrams, func(i, j int) bool {
+		ti, tj := trigrams[i], trigrams[j]
+		if counts[ti] != counts[tj] {
+			return counts[ti] > counts[tj]
+		}
+		return ti < tj
+	})
+	if len(trigrams) > langProfileSize {
+		trigrams = trigrams[:langProfileSize]
+	}
+	profile := make(map[string]int, len(trigrams))
+	for i, tri := range trigrams {
+		profile[tri] = i
+	}
+	return profile
+}
+
+// The sample texts that the language profiles are built from. They are the same text, which has
+// the vocabulary of the contracts and reports that are typically indexed, in each language.
+const (
+	sampleEn = `This agreement sets out the terms and conditions under which the supplier will
+provide services to the customer. The customer agrees to pay all invoices within thirty days of the
+date of the invoice. If the customer does not pay on time, the supplier may charge interest on the
+amount that is overdue. Either party may end this agreement by giving the other party written
+notice. The supplier will keep all information about the customer confidential and will not share
+it with any other person without the consent of the customer. This report describes the results of
+the company for the year and the plans of the board for the next year. Sales were higher than in
+the previous year and costs were lower, so the profit of the business grew. We would like to thank
+our staff, who have worked hard through a difficult time, and our shareholders for their support.`
+
+	sampleDe = `Dieser Vertrag regelt die Bedingungen, unter denen der Lieferant dem Kunden seine
+Leistungen erbringt. Der Kunde verpflichtet sich, alle Rechnungen innerhalb von dreißig Tagen nach
+dem Rechnungsdatum zu bezahlen. Zahlt der Kunde nicht rechtzeitig, kann der Lieferant Zinsen auf den
+überfälligen Betrag verlangen. Jede Partei kann diesen Vertrag durch schriftliche Mitteilung an die
+andere Partei kündigen. Der Lieferant wird alle Informationen über den Kunden vertraulich behandeln
+und sie ohne die Zustimmung des Kunden nicht an Dritte weitergeben. Dieser Bericht beschreibt die
+Ergebnisse des Unternehmens für das Jahr und die Pläne des Vorstands für das nächste Jahr. Der
+Umsatz war höher als im Vorjahr und die Kosten waren niedriger, sodass der Gewinn des Unternehmens
+gestiegen ist. Wir möchten unseren Mitarbeitern danken, die in einer schwierigen Zeit hart
+gearbeitet haben, und unseren Aktionären für ihre Unterstützung.`
+
+	sampleFr = `Le présent contrat fixe les conditions dans lesquelles le fournisseur fournira ses
+services au client. Le client s'engage à payer toutes les factures dans un délai de trente jours à
+compter de la date de la facture. Si le client ne paie pas à temps, le fournisseur peut facturer des
+intérêts sur le montant qui est en retard. Chaque partie peut mettre fin au présent contrat en
+adressant une notification écrite à l'autre partie. Le fournisseur gardera confidentielles toutes
+les informations concernant le client et ne les communiquera à aucune autre personne sans le
+consentement du client. Ce rapport décrit les résultats de la société pour l'année et les projets du
+conseil d'administration pour l'année prochaine. Les ventes ont été plus élevées que l'année
+précédente et les coûts ont été plus faibles, de sorte que le bénéfice de l'entreprise a augmenté.
+Nous tenons à remercier notre personnel, qui a travaillé dur pendant une période difficile, ainsi
+que nos actionnaires pour leur soutien.`
+
+	sampleEs = `Este contrato establece los términos y condiciones en los que el proveedor prestará
+sus servicios al cliente. El cliente se compromete a pagar todas las facturas en un plazo de treinta
+días a partir de la fecha de la factura. Si el cliente no paga a tiempo, el proveedor podrá cobrar
+intereses sobre el importe vencido. Cualquiera de las partes puede poner fin a este contrato
+mediante una notificación por escrito a la otra parte. El proveedor mantendrá la confidencialidad
+de toda la información sobre el cliente y no la compartirá con ninguna otra persona sin el
+consentimiento del cliente. Este informe describe los resultados de la empresa durante el año y los
+planes del consejo para el próximo año. Las ventas fueron más altas que en el año anterior y los
+costes fueron más bajos, por lo que el beneficio de la empresa creció. Queremos dar las gracias a
+nuestro personal, que ha trabajado mucho durante una época difícil, y a nuestros accionistas por su
+apoyo.`
+
+	sampleIt = `Il presente contratto stabilisce i termini e le condizioni alle quali il fornitore
+presterà i suoi servizi al cliente. Il cliente si impegna a pagare tutte le fatture entro trenta
+giorni dalla data della fattura. Se il cliente non paga in tempo, il fornitore può addebitare gli
+interessi sull'importo scaduto. Ciascuna delle parti può porre fine al presente contratto dandone
+comunicazione scritta all'altra parte. Il fornitore manterrà riservate tutte le informazioni
+relative al cliente e non le comunicherà ad altre persone senza il consenso del cliente. Questa
+relazione descrive i risultati della società per l'anno e i piani del consiglio per l'anno
+prossimo. Le vendite sono state più alte rispetto all'anno precedente e i costi sono stati più
+bassi, quindi l'utile dell'azienda è cresciuto. Desideriamo ringraziare il nostro personale, che ha
+lavorato duramente in un periodo difficile, e i nostri azionisti per il loro sostegno.`
+
+	samplePt = `O presente contrato estabelece os termos e as condições em que o fornecedor prestará
+os seus serviços ao cliente. O cliente compromete-se a pagar todas as faturas no prazo de trinta
+dias a contar da data da fatura. Se o cliente não pagar a tempo, o fornecedor poderá cobrar juros
+sobre o montante em atraso. Qualquer uma das partes pode pôr termo ao presente contrato mediante
+notificação por escrito à outra parte. O fornecedor manterá confidenciais todas as informações
+sobre o cliente e não as partilhará com nenhuma outra pessoa sem o consentimento do cliente. Este
+relatório descreve os resultados da empresa durante o ano e os planos do conselho para o próximo
+ano. As vendas foram mais altas do que no ano anterior e os custos foram mais baixos, pelo que o
+lucro da empresa cresceu. Queremos agradecer ao nosso pessoal, que trabalhou muito durante um
+período difícil, e aos nossos acionistas pelo seu apoio.`
+)
@@ -0,0 +1,102 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestDetectLanguage checks the detection of the languages of texts that aren't the sample texts.
+func TestDetectLanguage(t *testing.T) {
+	for _, test := range []struct {
+		text     string
+		expected string
+	}{
+		{"The meeting of the committee was held on Monday and the members discussed the budget " +
+			"for the new building.", "en"},
+		{"Die Sitzung des Ausschusses fand am Montag statt und die Mitglieder besprachen das " +
+			"Budget für das neue Gebäude.", "de"},
+		{"La réunion du comité a eu lieu lundi et les membres ont discuté du budget pour le " +
+			"nouveau bâtiment.", "fr"},
+		{"La reunión del comité se celebró el lunes y los miembros discutieron el presupuesto " +
+			"para el nuevo edificio.", "es"},
+		{"La riunione del comitato si è tenuta lunedì e i membri hanno discusso il bilancio per " +
+			"il nuovo edificio.", "it"},
+		{"A reunião do comité realizou-se na segunda-feira e os membros discutiram o orçamento " +
+			"para o novo edifício.", "pt"},
+		{"委员会于星期一举行会议，成员们讨论了新大楼的预算。", "zh"},
+		{"委員会は月曜日に開かれ、委員は新しい建物の予算について話し合った。", "ja"},
+		{"위원회는 월요일에 열렸고 위원들은 새 건물의 예산을 논의했다.", "ko"},
+		{"Die Sitzung fand statt.", "en"}, // Too short to detect.
+		{"", "en"},
+	} {
+		if lang := detectLanguage(test.text); lang.code != test.expected {
+			t.Errorf("%q: detected %q. Expected %q", test.text, lang.code, test.expected)
+		}
+	}
+}
+
+// TestLanguageSearch checks that pages are searched with the analyzers for their languages and
+// that lang: qualifiers filter matches by language.
+func TestLanguageSearch(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "contracts.pdf")
+	if err := ioutil.WriteFile(inPath, makeAttachmentsPdf(t, 2, nil), 0644); err != nil {
+		t.Fatalf("WriteFile failed. err=%v", err)
+	}
+	opts := IndexOptions{Extractor: fakePageExtractor{
+		1: "Die Verträge mit den Lieferanten werden jedes Jahr von der Rechtsabteilung geprüft " +
+			"und bei Bedarf angepasst.",
+		2: "The contracts with the suppliers are reviewed every year by the legal department and " +
+			"changed when they need to be.",
+	}}
+	blevePdf, index, _, err := IndexPdfFilesContext(context.Background(), []string{inPath},
+		filepath.Join(dir, "store"), true, opts)
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	defer index.Close()
+
+	for _, test := range []struct {
+		term     string
+		pageNums []uint32
+	}{
+		{"Vertrag", []uint32{1}},  // German stemming.
+		{"vertrage", []uint32{1}}, // German normalization.
+		{"contract", []uint32{2}}, // English stemming.
+		{"Vertrag lang:de", []uint32{1}},
+		{"Vertrag lang:en", nil},
+		{"contract lang:EN", []uint32{2}},
+		{"lang:de", []uint32{1}},
+		{"lang:fr", nil},
+	} {
+		matches, err := blevePdf.SearchBleveIndex(index, test.term, 10)
+		if err != nil {
+			t.Fatalf("%q: SearchBleveIndex failed. err=%v", test.term, err)
+		}
+		if len(matches.Matches) != len(test.pageNums) {
+			t.Errorf("%q: %d matches. Expected %d. matches=%s", test.term, len(matches.Matches),
+				len(test.pageNums), matches)
+			continue
+		}
+		for i, m := range matches.Matches {
+			if m.PageNum != test.pageNums[i] {
+				t.Errorf("%q: match on page %d. Expected %d", test.term, m.PageNum, test.pageNums[i])
+			}
+			if len(m.Spans) == 0 {
+				continue
+			}
+			bbox, ok := m.PagePositions.BBox(m.Spans[0].Start, m.Spans[0].End)
+			if !ok || bbox != fakeWordBBox(1) {
+				t.Errorf("%q: bbox=%+v ok=%t", test.term, bbox, ok)
+			}
+		}
+	}
+
+	if _, err := blevePdf.SearchBleveIndex(index, "Vertrag lang:xx", 10); err == nil {
+		t.Errorf("No error for an unknown language")
+	}
+}
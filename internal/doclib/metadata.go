@@ -0,0 +1,313 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the indexing of PDF document metadata.
+ *  - pdfMetadata() reads the Title, Author, Subject, Keywords, Producer and creation and
+ *    modification dates from the Info dictionary of a PDF and fills any gaps from its XMP metadata.
+ *  - The metadata of a document is indexed with each of its pages in bleve fields next to the
+ *    page text. The fields are not in bleve's _all field so they don't affect plain text searches.
+ *    They are searched with field-qualified queries. See field_query.go.
+ */
+
+package doclib
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// DocMetadata is the metadata of a document.
+type DocMetadata struct {
+	Title    string
+	Author   string
+	Subject  string
+	Keywords []string
+	Producer string
+	Created  time.Time // Creation date. Zero if unknown.
+	Modified time.Time // Modification date. Zero if unknown.
+}
+
+// Empty returns true if `meta` has no metadata.
+func (meta DocMetadata) Empty() bool {
+	return meta.Title == "" && meta.Author == "" && meta.Subject == "" &&
+		len(meta.Keywords) == 0 && meta.Producer == "" && meta.Created.IsZero() &&
+		meta.Modified.IsZero()
+}
+
+// The names of the bleve fields that hold the page text and the document metadata.
+const (
+	fieldText      = "Text"
+	fieldLangText  = "LangText"
+	fieldLang      = "Lang"
+	fieldTitle     = "Title"
+	fieldAuthor    = "Author"
+	fieldSubject   = "Subject"
+	fieldKeywords  = "Keywords"
+	fieldProducer  = "Producer"
+	fieldCreated   = "Created"
+	fieldModified  = "Modified"
+	fieldFirstPage = "FirstPage"
+)
+
+// newIDText returns the IDText that is indexed for page text `text` with bleve document ID `id`.
+// `text` is indexed in the text field for its language. See lang_detect.go.
+// `meta` is the metadata of the page's document. It may be nil. `firstPage` is true for the first
+// indexed page of the document.
+func newIDText(id, text string, meta *DocMetadata, firstPage bool) IDText {
+	idText := IDText{ID: id, FirstPage: firstPage}
+	lang := detectLanguage(text)
+	idText.Lang = lang.code
+	if lang.field() == fieldText {
+		idText.Text = text
+	} else {
+		idText.LangText = map[string]string{lang.code: text}
+	}
+	if meta == nil {
+		return idText
+	}
+	idText.Title = meta.Title
+	idText.Author = meta.Author
+	idText.Subject = meta.Subject
+	idText.Producer = meta.Producer
+	for _, kw := range meta.Keywords {
+		idText.Keywords = append(idText.Keywords, strings.ToLower(kw))
+	}
+	if !meta.Created.IsZero() {
+		created := meta.Created
+		idText.Created = &created
+	}
+	if !meta.Modified.IsZero() {
+		modified := meta.Modified
+		idText.Modified = &modified
+	}
+	return idText
+}
+
+// pdfMetadata returns the metadata of the PDF opened in `pdfReader`. It returns nil if the PDF has
+// no metadata. The Info dictionary takes precedence over the XMP metadata.
+func pdfMetadata(pdfReader *model.PdfReader) *DocMetadata {
+	trailer, err := pdfReader.GetTrailer()
+	if err != nil {
+		common.Log.Debug("pdfMetadata: No trailer. err=%v", err)
+		return nil
+	}
+	var meta DocMetadata
+	if info, ok := core.GetDict(trailer.Get("Info")); ok {
+		meta = infoMetadata(info)
+	}
+	if catalog, ok := core.GetDict(trailer.Get("Root")); ok {
+		if stream, ok := core.GetStream(catalog.Get("Metadata")); ok {
+			data, err := core.DecodeStream(stream)
+			if err != nil {
+				common.Log.Debug("pdfMetadata: Bad XMP stream. err=%v", err)
+			} else {
+				meta.fillFrom(xmpMetadata(data))
+			}
+		}
+	}
+	if meta.Empty() {
+		return nil
+	}
+	return &meta
+}
+
+// infoMetadata returns the metadata in PDF Info dictionary `info`.
+func infoMetadata(info *core.PdfObjectDictionary) DocMetadata {
+	str := func(key core.PdfObjectName) string {
+		s, ok := core.GetString(info.Get(key))
+		if !ok {
+			return ""
+		}
+		return strings.TrimSpace(s.Decoded())
+	}
+	date := func(key core.PdfObjectName) time.Time {
+		s := str(key)
+		if s == "" {
+			return time.Time{}
+		}
+		d, err := model.NewPdfDate(s)
+		if err != nil {
+			common.Log.Debug("infoMetadata: Bad %s date %q. err=%v", key, s, err)
+			return time.Time{}
+		}
+		return d.ToGoTime()
+	}
+	return DocMetadata{
+		Title:    str("Title"),
+		Author:   str("Author"),
+		Subject:  str("Subject"),
+		Keywords: splitKeywords(str("Keywords")),
+		Producer: str("Producer"),
+		Created:  date("CreationDate"),
+		Modified: date("ModDate"),
+	}
+}
+
+// fillFrom sets the fields of `meta` that are empty to the values in `other`.
+func (meta *DocMetadata) fillFrom(other DocMetadata) {
+	if meta.Title == "" {
+		meta.Title = other.Title
+	}
+	if meta.Author == "" {
+		meta.Author = other.Author
+	}
+	if meta.Subject == "" {
+		meta.Subject = other.Subject
+	}
+	if len(meta.Keywords) == 0 {
+		meta.Keywords = other.Keywords
+	}
+	if meta.Producer == "" {
+		meta.Producer = other.Producer
+	}
+	if meta.Created.IsZero() {
+		meta.Created = other.Created
+	}
+	if meta.Modified.IsZero() {
+		meta.Modified = other.Modified
+	}
+}
+
+// splitKeywords returns the keywords in PDF Keywords string `s`. Keywords are separated by commas
+// or semicolons.
+func splitKeywords(s string) []string {
+	var keywords []string
+	for _, kw := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' }) {
+		if kw = strings.TrimSpace(kw); kw != "" {
+			keywords = append(keywords, kw)
+		}
+	}
+	return keywords
+}
+
+// The XMP namespaces of the metadata we index.
+const (
+	xmpNsDC  = "http://purl.org/dc/elements/1.1/"
+	xmpNsPDF = "http://ns.adobe.com/pdf/1.3/"
+	xmpNsXMP = "http://ns.adobe.com/xap/1.0/"
+	xmpNsRDF = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+)
+
+// xmpProperties are the XMP properties we index. {XMP property: DocMetadata field}
+var xmpProperties = map[xml.Name]string{
+	{Space: xmpNsDC, Local: "title"}:       fieldTitle,
+	{Space: xmpNsDC, Local: "creator"}:     fieldAuthor,
+	{Space: xmpNsDC, Local: "description"}: fieldSubject,
+	{Space: xmpNsDC, Local: "subject"}:     fieldKeywords,
+	{Space: xmpNsPDF, Local: "Keywords"}:   fieldKeywords,
+	{Space: xmpNsPDF, Local: "Producer"}:   fieldProducer,
+	{Space: xmpNsXMP, Local: "CreateDate"}: fieldCreated,
+	{Space: xmpNsXMP, Local: "ModifyDate"}: fieldModified,
+}
+
+// xmpMetadata returns the metadata in XMP packet `data`. Properties may be elements, with their
+// values in rdf:li items for arrays, or attributes of rdf:Description elements.
+func xmpMetadata(data []byte) DocMetadata {
+	values := map[string][]string{} // {DocMetadata field: values}
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var field string         // Field of the property element being read.
+	var text strings.Builder // Text of the current value.
+	addValue := func() {
+		if v := strings.TrimSpace(text.String()); v != "" {
+			values[field] = append(values[field], v)
+		}
+		text.Reset()
+	}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			common.Log.Debug("xmpMetadata: Bad XMP. err=%v", err)
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if field != "" {
+				if t.Name == (xml.Name{Space: xmpNsRDF, Local: "li"}) {
+					text.Reset()
+				}
+				break
+			}
+			if f, ok := xmpProperties[t.Name]; ok {
+				field = f
+				text.Reset()
+				break
+			}
+			if t.Name == (xml.Name{Space: xmpNsRDF, Local: "Description"}) {
+				for _, a := range t.Attr {
+					if f, ok := xmpProperties[a.Name]; ok {
+						values[f] = append(values[f], strings.TrimSpace(a.Value))
+					}
+				}
+			}
+		case xml.CharData:
+			if field != "" {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if field == "" {
+				break
+			}
+			if t.Name == (xml.Name{Space: xmpNsRDF, Local: "li"}) {
+				addValue()
+			} else if f, ok := xmpProperties[t.Name]; ok && f == field {
+				addValue()
+				field = ""
+			}
+		}
+	}
+
+	first := func(f string) string {
+		if len(values[f]) == 0 {
+			return ""
+		}
+		return values[f][0]
+	}
+	var keywords []string
+	for _, v := range values[fieldKeywords] {
+		keywords = append(keywords, splitKeywords(v)...)
+	}
+	return DocMetadata{
+		Title:    first(fieldTitle),
+		Author:   strings.Join(values[fieldAuthor], ", "),
+		Subject:  first(fieldSubject),
+		Keywords: keywords,
+		Producer: first(fieldProducer),
+		Created:  parseXMPDate(first(fieldCreated)),
+		Modified: parseXMPDate(first(fieldModified)),
+	}
+}
+
+// xmpDateLayouts are the layouts of XMP dates. XMP dates are ISO 8601 dates with optional parts.
+var xmpDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// parseXMPDate returns the time in XMP date `s` or the zero time if `s` isn't a date.
+func parseXMPDate(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	for _, layout := range xmpDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	common.Log.Debug("parseXMPDate: Bad date %q", s)
+	return time.Time{}
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// TestXMPMetadata checks that metadata is read from XMP properties that are elements and
+// attributes.
+func TestXMPMetadata(t *testing.T) {
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:pdf="http://ns.adobe.com/pdf/1.3/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    pdf:Producer="Acme Writer" xmp:CreateDate="2017-05-01T10:00:00+10:00">
+   <dc:title xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <rdf:Alt><rdf:li xml:lang="x-default">Annual Report</rdf:li></rdf:Alt>
+   </dc:title>
+   <dc:creator xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <rdf:Seq><rdf:li>Jane Smith</rdf:li><rdf:li>John Doe</rdf:li></rdf:Seq>
+   </dc:creator>
+   <dc:subject xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <rdf:Bag><rdf:li>finance</rdf:li><rdf:li>audit; tax</rdf:li></rdf:Bag>
+   </dc:subject>
+   <xmp:ModifyDate>2018-02</xmp:ModifyDate>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+	meta := xmpMetadata([]byte(xmp))
+	if meta.Title != "Annual Report" || meta.Author != "Jane Smith, John Doe" ||
+		meta.Producer != "Acme Writer" {
+		t.Fatalf("meta=%+v", meta)
+	}
+	if len(meta.Keywords) != 3 || meta.Keywords[2] != "tax" {
+		t.Fatalf("Keywords=%q", meta.Keywords)
+	}
+	created := time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)
+	modified := time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC)
+	if !meta.Created.Equal(created) || !meta.Modified.Equal(modified) {
+		t.Fatalf("Created=%s Modified=%s", meta.Created, meta.Modified)
+	}
+}
+
+// TestParseFieldQueries checks the splitting of search terms into text and field qualifiers.
+func TestParseFieldQueries(t *testing.T) {
+	text, queries, err := parseFieldQueries(`budget author:"Jane Doe" created:>=2017-06 note:this`)
+	if err != nil {
+		t.Fatalf("parseFieldQueries failed. err=%v", err)
+	}
+	if text != "budget note:this" || len(queries) != 2 {
+		t.Fatalf("text=%q queries=%d", text, len(queries))
+	}
+	// A qualifier with no value is text, e.g. a heading like "Title:" in a page.
+	text, queries, err = parseFieldQueries("Title: budget")
+	if err != nil || text != "Title: budget" || len(queries) != 0 {
+		t.Fatalf("text=%q queries=%d err=%v", text, len(queries), err)
+	}
+	for _, term := range []string{"created:2017-13", "modified:<yesterday"} {
+		if _, _, err := parseFieldQueries(term); err == nil {
+			t.Errorf("parseFieldQueries(%q) succeeded", term)
+		}
+	}
+}
+
+// TestMetadataSearch checks that field-qualified searches find PDFs by their metadata and that
+// plain text searches don't match the metadata. It checks that serialized indexes keep the
+// metadata.
+func TestMetadataSearch(t *testing.T) {
+	dir := t.TempDir()
+	defer func() {
+		model.SetPdfTitle("")
+		model.SetPdfAuthor("")
+		model.SetPdfKeywords("")
+		model.SetPdfCreationDate(time.Time{})
+	}()
+	makePdf := func(name, title, author, keywords string, created time.Time) string {
+		model.SetPdfTitle(title)
+		model.SetPdfAuthor(author)
+		model.SetPdfKeywords(keywords)
+		model.SetPdfCreationDate(created)
+		inPath := filepath.Join(dir, name)
+		makeBlankPagePdf(t, inPath, "Not indexed")
+		return inPath
+	}
+	report := makePdf("report.pdf", "Annual Reports", "Jane Smith", "finance, audit",
+		time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC))
+	memo := makePdf("memo.pdf", "Staff Memo", "John Doe", "staff",
+		time.Date(2019, 1, 15, 12, 0, 0, 0, time.UTC))
+
+	persistDir := filepath.Join(dir, "store")
+	opts := IndexOptions{Extractor: fakePageExtractor{1: "budget figures", 2: "budget totals"}}
+	blevePdf, index, result, err := IndexPdfFilesContext(context.Background(),
+		[]string{report, memo}, persistDir, true, opts)
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	defer index.Close()
+	if result.NumAdded != 2 {
+		t.Fatalf("Unexpected result %s", result)
+	}
+
+	tests := []struct {
+		term     string
+		inPath   string // The PDF of all the matches. "" if they may be in either PDF.
+		expected int    // Number of matches.
+	}{
+		{"budget", "", 4},
+		{"jane", "", 0},
+		{"budget author:jane", report, 2},
+		{"author:jane", report, 1},
+		{`author:"john doe"`, memo, 1},
+		{"title:report", report, 1},
+		{"keywords:FINANCE", report, 1},
+		{"created:2017", report, 1},
+		{"created:>2017", memo, 1},
+		{"created:<2019-01-15 budget", report, 2},
+		{"created:2018", "", 0},
+	}
+	check := func(name string, blevePdf *BlevePdf, index bleve.Index) {
+		for _, test := range tests {
+			matches, err := blevePdf.SearchBleveIndex(index, test.term, 10)
+			if err != nil {
+				t.Fatalf("%s %q: SearchBleveIndex failed. err=%v", name, test.term, err)
+			}
+			if len(matches.Matches) != test.expected {
+				t.Errorf("%s %q: %d matches. Expected %d. matches=%s", name, test.term,
+					len(matches.Matches), test.expected, matches)
+				continue
+			}
+			for _, m := range matches.Matches {
+				if test.inPath != "" && m.InPath != test.inPath {
+					t.Errorf("%s %q: Matched %q. Expected %q", name, test.term, m.InPath,
+						test.inPath)
+				}
+			}
+		}
+	}
+	check("on-disk", blevePdf, index)
+
+	// The metadata isn't in the stored page contents that serialized indexes are built from.
+	data, err := MarshalPdfIndex(persistDir, nil)
+	if err != nil {
+		t.Fatalf("MarshalPdfIndex failed. err=%v", err)
+	}
+	loadedPdf, loadedIndex, err := LoadIndexFromBytes(data)
+	if err != nil {
+		t.Fatalf("LoadIndexFromBytes failed. err=%v", err)
+	}
+	defer loadedIndex.Close()
+	check("loaded", loadedPdf, loadedIndex)
+}
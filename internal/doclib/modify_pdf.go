@@ -5,10 +5,13 @@ package doclib
 import (
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 
+	"github.com/papercutsoftware/pdfsearch/internal/utils"
 	"github.com/unidoc/unipdf/v3/common"
 	"github.com/unidoc/unipdf/v3/creator"
 	"github.com/unidoc/unipdf/v3/model"
@@ -25,6 +28,8 @@ type ExtractList struct {
 	sources    []pdfPage                         // Source pages in order they will be combined.
 	sourceSet  map[string]bool                   // Used to ensure PDF pages are only added once.
 	contents   map[string]map[uint32]pageContent // contents[inPath][pageNum] is the contents to be added to inPath:pageNum.
+	readers    map[string]io.ReadSeeker          // readers[inPath] is the contents of PDF inPath if it is not on disk.
+	passwords  PasswordProvider                  // Passwords for encrypted PDFs. May be nil.
 }
 
 var errMissing = errors.New("missing value")
@@ -59,9 +64,21 @@ func CreateExtractList(maxPages, maxPerPage int) *ExtractList {
 		maxPerPage: maxPerPage,
 		contents:   map[string]map[uint32]pageContent{},
 		sourceSet:  map[string]bool{},
+		readers:    map[string]io.ReadSeeker{},
 	}
 }
 
+// AddReader tells `l` to read the PDF `inPath` from `rs` rather than from disk. It is used for
+// PDFs from in-memory indexes.
+func (l *ExtractList) AddReader(inPath string, rs io.ReadSeeker) {
+	l.readers[inPath] = rs
+}
+
+// SetPasswords tells `l` to open encrypted PDFs with the passwords supplied by `passwords`.
+func (l *ExtractList) SetPasswords(passwords PasswordProvider) {
+	l.passwords = passwords
+}
+
 // AddRect adds to `l`, instructions to draw rectangle `r` on (1-offset) page number `pageNum` of
 // PDF `inPath`
 func (l *ExtractList) AddRect(inPath string, pageNum uint32, r model.PdfRectangle) {
@@ -103,17 +120,37 @@ const (
 )
 
 // SaveOutputPdf is called to markup a PDF with the locations in `l`.
-// `l` contains the input PDF names and the pages and coordinates to mark.
+// `l` contains the input PDF names and the pages and coordinates to mark. PDFs embedded in other
+// PDFs, whose names are like "outer.pdf!/inner.pdf", are extracted from the PDFs that hold them.
+// Encrypted PDFs are opened with the passwords set by SetPasswords().
 // The resulting PDF is written to `outPath`.
 func (l *ExtractList) SaveOutputPdf(outPath string) error {
 	common.Log.Debug("l=%s", *l)
 	for inPath, docContents := range l.contents {
-		f, pdfReader, err := PdfOpenFileLazy(inPath)
+		var pdfReader *model.PdfReader
+		var err error
+		if rs, ok := l.readers[inPath]; ok {
+			if _, err = rs.Seek(0, io.SeekStart); err == nil {
+				pdfReader, err = PdfOpenReaderPasswords(rs, true, inPath, l.passwords)
+			}
+		} else if parentPath(inPath) != "" && !utils.Exists(inPath) {
+			// A PDF embedded in another PDF. See embedded.go.
+			var rs readSeekCloser
+			if rs, err = openDocReader(inPath, l.passwords); err == nil {
+				defer rs.Close()
+				pdfReader, err = PdfOpenReaderPasswords(rs, true, inPath, l.passwords)
+			}
+		} else {
+			var f *os.File
+			if f, err = os.Open(inPath); err == nil {
+				defer f.Close()
+				pdfReader, err = PdfOpenReaderPasswords(f, true, inPath, l.passwords)
+			}
+		}
 		if err != nil {
 			common.Log.Error("SaveOutputPdf: Could not open inPath=%q. err=%v", inPath, err)
 			return err
 		}
-		defer f.Close()
 
 		for pageNum := range docContents {
 			common.Log.Debug("SaveOutputPdf: %q %d", inPath, pageNum)
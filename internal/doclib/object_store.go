@@ -0,0 +1,208 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements IndexStores that keep their files in an object store.
+ *  - ObjectClient is the interface to an object store such as a cloud storage bucket.
+ *  - ObjectStore is an IndexStore over an ObjectClient.
+ *  - NewMemStore() returns an ObjectStore over an in-memory object store.
+ */
+
+package doclib
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrObjectNotFound is returned by ObjectClient.Get() when there is no object with the requested
+// key.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectClient is the interface to an object store such as a cloud storage bucket. Objects are
+// identified by keys. Object stores have no directories, so a key like "a/b/c" is just a name.
+// Implementations must be safe for concurrent use.
+type ObjectClient interface {
+	// Get returns the contents of the object with key `key` or ErrObjectNotFound if there is no
+	// such object.
+	Get(key string) ([]byte, error)
+	// Put creates or replaces the object with key `key` with contents `data`.
+	Put(key string, data []byte) error
+	// Delete removes the object with key `key`. It is not an error if there is no such object.
+	Delete(key string) error
+	// List returns the keys of the objects whose keys start with `prefix`.
+	List(prefix string) ([]string, error)
+}
+
+// ObjectStore is an IndexStore that keeps its files as the objects of an ObjectClient.
+// The file called `name` is kept in the object with key `prefix`/`name`. Directories are emulated
+// with key prefixes, so renaming and removing directories takes one object operation per file.
+type ObjectStore struct {
+	client ObjectClient
+	prefix string // Key prefix of all the files in the store.
+}
+
+// NewObjectStore returns an ObjectStore that keeps its files in `client` under key prefix
+// `prefix`. Several indexes can be kept in one object store by giving them different prefixes.
+func NewObjectStore(client ObjectClient, prefix string) *ObjectStore {
+	return &ObjectStore{client: client, prefix: prefix}
+}
+
+// NewMemStore returns an IndexStore that keeps its files in memory. The files only last as long
+// as the returned IndexStore.
+func NewMemStore() *ObjectStore {
+	return NewObjectStore(&memObjects{objects: map[string][]byte{}}, "")
+}
+
+// key returns the object key of the file called `name`.
+func (s *ObjectStore) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return path.Join(s.prefix, name)
+}
+
+// ReadFile returns the contents of file `name`.
+func (s *ObjectStore) ReadFile(name string) ([]byte, error) {
+	data, err := s.client.Get(s.key(name))
+	if err == ErrObjectNotFound {
+		return nil, &os.PathError{Op: "read", Path: name, Err: os.ErrNotExist}
+	}
+	return data, err
+}
+
+// WriteFile replaces the contents of file `name` with `data`.
+func (s *ObjectStore) WriteFile(name string, data []byte) error {
+	return s.client.Put(s.key(name), data)
+}
+
+// Exists returns true if there is a file or a directory called `name`.
+func (s *ObjectStore) Exists(name string) bool {
+	keys, err := s.treeKeys(name)
+	return err == nil && len(keys) > 0
+}
+
+// Rename renames file or directory `oldName` to `newName`. Each file is copied then deleted.
+func (s *ObjectStore) Rename(oldName, newName string) error {
+	oldKey, newKey := s.key(oldName), s.key(newName)
+	keys, err := s.treeKeys(oldName)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrNotExist}
+	}
+	for _, k := range keys {
+		data, err := s.client.Get(k)
+		if err != nil {
+			return err
+		}
+		if err := s.client.Put(newKey+strings.TrimPrefix(k, oldKey), data); err != nil {
+			return err
+		}
+		if err := s.client.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveAll removes file or directory `name`.
+func (s *ObjectStore) RemoveAll(name string) error {
+	keys, err := s.treeKeys(name)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := s.client.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the sorted names of the files and directories in directory `dir`.
+func (s *ObjectStore) List(dir string) ([]string, error) {
+	dirKey := s.key(dir) + "/"
+	keys, err := s.client.List(dirKey)
+	if err != nil {
+		return nil, err
+	}
+	nameSet := map[string]bool{}
+	for _, k := range keys {
+		name := strings.TrimPrefix(k, dirKey)
+		nameSet[strings.Split(name, "/")[0]] = true
+	}
+	var names []string
+	for name := range nameSet {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// treeKeys returns the keys of file `name` or of the files in directory `name`.
+func (s *ObjectStore) treeKeys(name string) ([]string, error) {
+	key := s.key(name)
+	keys, err := s.client.List(key)
+	if err != nil {
+		return nil, err
+	}
+	var tree []string
+	for _, k := range keys {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			tree = append(tree, k)
+		}
+	}
+	return tree, nil
+}
+
+// memObjects is an in-memory ObjectClient.
+type memObjects struct {
+	mu      sync.Mutex
+	objects map[string][]byte // {key: contents}
+}
+
+// Get returns the contents of the object with key `key`.
+func (m *memObjects) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// Put creates or replaces the object with key `key` with contents `data`.
+func (m *memObjects) Put(key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = append([]byte(nil), data...)
+	return nil
+}
+
+// Delete removes the object with key `key`.
+func (m *memObjects) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+// List returns the keys of the objects whose keys start with `prefix`.
+func (m *memObjects) List(prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for k := range m.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the OCR of PDF pages that have no extractable text, such as scanned
+ * pages.
+ *  - OCREngine is implemented by callers that have an OCR engine. None is bundled.
+ *  - pagePositionsFromOCR() converts the words an OCREngine recognizes to the same text and
+ *    TextMarks that a PageTextExtractor returns, so that searching, highlighting and markup work
+ *    in the same way on OCR'd pages.
+ */
+
+package doclib
+
+import (
+	"image"
+	"strings"
+
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// OCREngine recognizes the words on PDF pages that have no extractable text.
+type OCREngine interface {
+	// RecognizePage returns the words on `page` in reading order. Engines that work on images can
+	// render page.Page, or page page.PageNum of page.InPath, and convert the image coordinates of
+	// the words to PDF coordinates with page.ImageToPage().
+	RecognizePage(page OCRPage) ([]OCRWord, error)
+}
+
+// OCRPage is a PDF page with no extractable text that is passed to an OCREngine.
+type OCRPage struct {
+	InPath   string             // Path of the PDF.
+	PageNum  uint32             // 1-offset page number.
+	Page     *model.PdfPage     // The page.
+	MediaBox model.PdfRectangle // Bounds of the page in PDF coordinates.
+}
+
+// OCRWord is a word recognized by an OCREngine.
+type OCRWord struct {
+	Text string
+	BBox model.PdfRectangle // Bounding box of the word in PDF coordinates.
+}
+
+// ImageToPage converts rectangle `r` on a `size` pixel image of `page` to PDF coordinates on the
+// page. Image coordinates have their origin at the top left of the image and y increasing downwards.
+// PDF coordinates have their origin at the bottom left of the page and y increasing upwards.
+// Page rotation is not handled, so `size` must be the size of the unrotated page image.
+func (page OCRPage) ImageToPage(r image.Rectangle, size image.Point) model.PdfRectangle {
+	box := page.MediaBox
+	sx := box.Width() / float64(size.X)
+	sy := box.Height() / float64(size.Y)
+	return model.PdfRectangle{
+		Llx: box.Llx + float64(r.Min.X)*sx,
+		Lly: box.Ury - float64(r.Max.Y)*sy,
+		Urx: box.Llx + float64(r.Max.X)*sx,
+		Ury: box.Ury - float64(r.Min.Y)*sy,
+	}
+}
+
+// ocrPage returns the text and text positions of page `page`, which is page `pageNum` of PDF
+// `inPath`, as recognized by `engine`.
+func ocrPage(engine OCREngine, inPath string, pageNum uint32, page *model.PdfPage) (string,
+	PagePositions, error) {
+	mediaBox, err := page.GetMediaBox()
+	if err != nil {
+		return "", PagePositions{}, err
+	}
+	words, err := engine.RecognizePage(OCRPage{
+		InPath:   inPath,
+		PageNum:  pageNum,
+		Page:     page,
+		MediaBox: *mediaBox,
+	})
+	if err != nil {
+		return "", PagePositions{}, err
+	}
+	text, ppos := pagePositionsFromOCR(words)
+	return text, ppos, nil
+}
+
+// pagePositionsFromOCR returns the page text and PagePositions for OCR'd words `words`.
+// The words are separated by spaces and the text ends with a newline. Each word has a TextMark at
+// its offset and each separator has a TextMark with an empty bounding box, so that
+// PagePositions.BBox() returns the bounding box of the words in a match.
+func pagePositionsFromOCR(words []OCRWord) (string, PagePositions) {
+	var texts []string
+	var bboxes []model.PdfRectangle
+	for _, w := range words {
+		text := strings.Join(strings.Fields(w.Text), " ")
+		if text == "" {
+			continue
+		}
+		texts = append(texts, text)
+		bboxes = append(bboxes, w.BBox)
+	}
+
+	var sb strings.Builder
+	var marks []TextMark
+	for i, text := range texts {
+		marks = append(marks, TextMark{Offset: uint32(sb.Len()), BBox: bboxes[i]})
+		sb.WriteString(text)
+		marks = append(marks, TextMark{Offset: uint32(sb.Len())})
+		if i < len(texts)-1 {
+			sb.WriteString(" ")
+		} else {
+			sb.WriteString("\n")
+		}
+	}
+	if len(texts) > 0 {
+		marks = append(marks, TextMark{Offset: uint32(sb.Len())})
+	}
+	return sb.String(), PagePositionsFromMarks(marks)
+}
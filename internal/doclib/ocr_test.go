@@ -0,0 +1,117 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"errors"
+	"image"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// stubOCR is an OCREngine that returns `words` for every page and records the pages it was called
+// on.
+type stubOCR struct {
+	words    []OCRWord
+	err      error
+	pageNums []uint32
+}
+
+func (e *stubOCR) RecognizePage(page OCRPage) ([]OCRWord, error) {
+	e.pageNums = append(e.pageNums, page.PageNum)
+	return e.words, e.err
+}
+
+// ocrWords are the words returned by the stub OCR engine in the tests.
+var ocrWords = []OCRWord{
+	{Text: "Scanned", BBox: model.PdfRectangle{Llx: 100, Lly: 700, Urx: 180, Ury: 712}},
+	{Text: " ", BBox: model.PdfRectangle{Llx: 180, Lly: 700, Urx: 190, Ury: 712}},
+	{Text: "invoice", BBox: model.PdfRectangle{Llx: 200, Lly: 700, Urx: 260, Ury: 712}},
+	{Text: "1234", BBox: model.PdfRectangle{Llx: 270, Lly: 700, Urx: 310, Ury: 712}},
+}
+
+// TestPagePositionsFromOCR checks that the bounding boxes of OCR'd words are found from their
+// offsets in the page text in the same way as for extracted text.
+func TestPagePositionsFromOCR(t *testing.T) {
+	text, ppos := pagePositionsFromOCR(ocrWords)
+	if text != "Scanned invoice 1234\n" {
+		t.Fatalf("text=%q", text)
+	}
+	for _, w := range []OCRWord{ocrWords[0], ocrWords[2], ocrWords[3]} {
+		start := strings.Index(text, w.Text)
+		bbox, ok := ppos.BBox(uint32(start), uint32(start+len(w.Text)))
+		if !ok || bbox != w.BBox {
+			t.Fatalf("%q: bbox=%+v ok=%t. Expected %+v", w.Text, bbox, ok, w.BBox)
+		}
+	}
+	start := strings.Index(text, "invoice")
+	bbox, ok := ppos.BBox(uint32(start), uint32(len(text)-1))
+	expected := rectUnion(ocrWords[2].BBox, ocrWords[3].BBox)
+	if !ok || bbox != expected {
+		t.Fatalf("%q: bbox=%+v ok=%t. Expected %+v", text[start:], bbox, ok, expected)
+	}
+	if text, ppos := pagePositionsFromOCR(nil); text != "" || !ppos.Empty() {
+		t.Fatalf("No words gave text=%q ppos=%s", text, ppos)
+	}
+}
+
+// TestOCR checks that an OCREngine is only called for pages with no extractable text and how its
+// failures are handled. It uses fakePageExtractor because unlicensed UniDoc adds a watermark to the
+// text of every page so that no page is empty.
+func TestOCR(t *testing.T) {
+	inPath := filepath.Join(t.TempDir(), "scanned.pdf")
+	makeBlankPagePdf(t, inPath, "The quick brown fox")
+	fd := fileDesc{InPath: inPath, Hash: "0123456789abcdef"}
+	extractor := fakePageExtractor{1: "The quick brown fox"}
+
+	engine := &stubOCR{words: ocrWords}
+	opts := extractOptions{ocr: engine, extractor: extractor}
+	docContents, failures, err := extractDocContents(fd, opts, nil)
+	if err != nil {
+		t.Fatalf("extractDocContents failed. err=%v", err)
+	}
+	if len(engine.pageNums) != 1 || engine.pageNums[0] != 2 {
+		t.Fatalf("OCR called on pages %v. Expected [2]", engine.pageNums)
+	}
+	if len(docContents) != 2 || len(failures) != 0 {
+		t.Fatalf("%d pages and %d failures. Expected 2 pages", len(docContents), len(failures))
+	}
+	if page := docContents[1]; page.pageNum != 2 || page.text != "Scanned invoice 1234\n" {
+		t.Fatalf("OCR'd page %d text=%q", page.pageNum, page.text)
+	}
+
+	opts.ocr = &stubOCR{err: errors.New("engine failed")}
+	docContents, failures, err = extractDocContents(fd, opts, nil)
+	if err != nil {
+		t.Fatalf("extractDocContents failed. err=%v", err)
+	}
+	if len(docContents) != 1 || len(failures) != 1 || failures[0].PageNum != 2 {
+		t.Fatalf("%d pages and failures=%v. Expected 1 page and a failure on page 2",
+			len(docContents), failures)
+	}
+	opts.policy = SkipFailedFiles
+	_, _, err = extractDocContents(fd, opts, nil)
+	if err == nil {
+		t.Fatalf("extractDocContents succeeded with SkipFailedFiles and a failed OCR")
+	}
+}
+
+// TestImageToPage checks the conversion of image coordinates to PDF coordinates.
+func TestImageToPage(t *testing.T) {
+	page := OCRPage{MediaBox: model.PdfRectangle{Llx: 0, Lly: 0, Urx: 600, Ury: 800}}
+	r := image.Rect(100, 200, 300, 250)
+	bbox := page.ImageToPage(r, image.Pt(1200, 1600))
+	expected := model.PdfRectangle{Llx: 50, Lly: 675, Urx: 150, Ury: 700}
+	if bbox != expected {
+		t.Fatalf("bbox=%+v expected %+v", bbox, expected)
+	}
+}
+
+// makeBlankPagePdf writes a two page PDF to `outPath`. The first page contains `text` and the second
+// page is blank.
+func makeBlankPagePdf(t *testing.T, outPath, text string) {
+	writeTestPdf(t, outPath, 2, drawTexts(text))
+}
@@ -0,0 +1,260 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the indexing of PDF outlines (bookmarks).
+ *  - pdfOutline() reads the outline tree of a PDF into a list of outlineEntrys in document order.
+ *    The list is stored in the PDF's fileDesc.
+ *  - sectionPath() finds the titles of the bookmarks enclosing a search match, e.g.
+ *      ["12 Interactive Features", "12.5 Annotations", "12.5.6.4 Text Annotations"]
+ *  - The titles of the bookmarks that point to a page are indexed with the page in a field that
+ *    is boosted in searches so that matches in section headings rank higher.
+ *  - Serialized indexes (see serialize_index.go) don't hold outlines, so matches in indexes loaded
+ *    with LoadIndexFromBytes() have no section paths.
+ */
+
+package doclib
+
+import (
+	"math"
+	"strings"
+
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// outlineEntry is a bookmark in the outline of a PDF.
+type outlineEntry struct {
+	Title string
+	Level int     `json:",omitempty"` // Depth in the outline tree. 0 for top level bookmarks.
+	Page  uint32  `json:",omitempty"` // 1-offset page number of the destination. 0 if unknown.
+	Top   float64 `json:",omitempty"` // Top of the destination on the page in PDF coordinates.
+}
+
+// fieldHeadings is the name of the bleve field that holds the titles of the bookmarks that point to
+// a page.
+const fieldHeadings = "Headings"
+
+const (
+	// maxOutlineEntries is the maximum number of bookmarks read from a PDF. It guards against
+	// loops in corrupt outlines.
+	maxOutlineEntries = 100000
+	// sectionTolerance is how far, in points, a bookmark destination may be below the top of a
+	// match and still be before the match. Destinations are often a little below the tops of the
+	// headings they point to.
+	sectionTolerance = 6.0
+	// headingsBoost is the boost of matches in bookmark titles relative to matches in page text.
+	headingsBoost = 3.0
+)
+
+// pdfOutline returns the outline of the PDF opened in `pdfReader` in document order.
+func pdfOutline(pdfReader *model.PdfReader) []outlineEntry {
+	trailer, err := pdfReader.GetTrailer()
+	if err != nil {
+		return nil
+	}
+	catalog, ok := core.GetDict(trailer.Get("Root"))
+	if !ok {
+		return nil
+	}
+	outlines, ok := core.GetDict(catalog.Get("Outlines"))
+	if !ok {
+		return nil
+	}
+	r := outlineReader{
+		catalog:  catalog,
+		numPages: len(pdfReader.PageList),
+		pages:    map[int64]uint32{},
+		tops:     map[uint32]float64{},
+		visited:  map[*core.PdfObjectDictionary]bool{},
+	}
+	for i, page := range pdfReader.PageList {
+		pageNum := uint32(i + 1)
+		if ind := page.GetPageAsIndirectObject(); ind != nil {
+			r.pages[ind.ObjectNumber] = pageNum
+		}
+		if mediaBox, err := page.GetMediaBox(); err == nil {
+			r.tops[pageNum] = mediaBox.Ury
+		}
+	}
+	r.readItems(outlines.Get("First"), 0)
+	return r.entries
+}
+
+// outlineReader reads the items in a PDF outline tree.
+type outlineReader struct {
+	catalog  *core.PdfObjectDictionary
+	numPages int
+	pages    map[int64]uint32   // {page object number: page number}
+	tops     map[uint32]float64 // {page number: top of page}
+	visited  map[*core.PdfObjectDictionary]bool
+	entries  []outlineEntry
+}
+
+// readItems reads the outline item `first` and its siblings and their descendants at depth `level`.
+func (r *outlineReader) readItems(first core.PdfObject, level int) {
+	for obj := first; obj != nil; {
+		item, ok := core.GetDict(obj)
+		if !ok || r.visited[item] || len(r.entries) >= maxOutlineEntries {
+			return
+		}
+		r.visited[item] = true
+		entry := outlineEntry{Level: level}
+		if s, ok := core.GetString(item.Get("Title")); ok {
+			entry.Title = strings.Join(strings.Fields(s.Decoded()), " ")
+		}
+		dest := item.Get("Dest")
+		if dest == nil {
+			if action, ok := core.GetDict(item.Get("A")); ok {
+				if s, ok := core.GetNameVal(action.Get("S")); ok && s == "GoTo" {
+					dest = action.Get("D")
+				}
+			}
+		}
+		entry.Page, entry.Top = r.destination(dest)
+		r.entries = append(r.entries, entry)
+		r.readItems(item.Get("First"), level+1)
+		obj = item.Get("Next")
+	}
+}
+
+// destination returns the page number and top of explicit or named destination `dest`.
+// See 12.3.2 "Destinations" (p. 366 PDF32000_2008). It returns a page number of 0 if `dest` can't
+// be resolved. The top is the top of the page if `dest` doesn't give one.
+func (r *outlineReader) destination(dest core.PdfObject) (uint32, float64) {
+	arr, ok := core.GetArray(r.resolveNamed(dest))
+	if !ok || arr.Len() == 0 {
+		return 0, 0
+	}
+	var pageNum uint32
+	switch page := arr.Get(0).(type) {
+	case *core.PdfObjectReference:
+		pageNum = r.pages[page.ObjectNumber]
+	case *core.PdfIndirectObject:
+		pageNum = r.pages[page.ObjectNumber]
+	case *core.PdfObjectInteger:
+		// 0-offset page numbers are meant for remote destinations but some writers use them in
+		// local destinations.
+		if n := int64(*page); n >= 0 && n < int64(r.numPages) {
+			pageNum = uint32(n + 1)
+		}
+	}
+	if pageNum == 0 {
+		return 0, 0
+	}
+	top := r.tops[pageNum]
+	// The index of the top in each type of destination that has one.
+	topIndex := map[string]int{"XYZ": 3, "FitH": 2, "FitBH": 2, "FitR": 5}
+	if kind, ok := core.GetNameVal(arr.Get(1)); ok {
+		if i, ok := topIndex[kind]; ok && i < arr.Len() {
+			if v, err := core.GetNumberAsFloat(core.TraceToDirectObject(arr.Get(i))); err == nil {
+				top = v
+			}
+		}
+	}
+	return pageNum, top
+}
+
+// resolveNamed returns the explicit destination for `dest`. Named destinations are looked up in
+// the catalog's Dests dictionary and Names tree. Destination dictionaries are resolved to their D
+// entries.
+func (r *outlineReader) resolveNamed(dest core.PdfObject) core.PdfObject {
+	var key string
+	if name, ok := core.GetNameVal(dest); ok {
+		key = name
+		if dests, ok := core.GetDict(r.catalog.Get("Dests")); ok {
+			dest = dests.Get(core.PdfObjectName(key))
+		}
+	} else if s, ok := core.GetString(dest); ok {
+		key = s.Str()
+		dest = nil
+		if names, ok := core.GetDict(r.catalog.Get("Names")); ok {
+			dest = nameTreeLookup(names.Get("Dests"), key, 0)
+		}
+	}
+	if d, ok := core.GetDict(dest); ok {
+		return d.Get("D")
+	}
+	return dest
+}
+
+// nameTreeLookup returns the value for `key` in name tree `node`. See 7.9.6 "Name Trees".
+func nameTreeLookup(node core.PdfObject, key string, depth int) core.PdfObject {
+	dict, ok := core.GetDict(node)
+	if !ok || depth > 32 {
+		return nil
+	}
+	if names, ok := core.GetArray(dict.Get("Names")); ok {
+		for i := 0; i+1 < names.Len(); i += 2 {
+			if s, ok := core.GetString(names.Get(i)); ok && s.Str() == key {
+				return names.Get(i + 1)
+			}
+		}
+	}
+	if kids, ok := core.GetArray(dict.Get("Kids")); ok {
+		for _, kid := range kids.Elements() {
+			if v := nameTreeLookup(kid, key, depth+1); v != nil {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// sectionPath returns the titles of the bookmarks in `outline` from the top level down to the
+// closest bookmark before a match on page `pageNum` whose top is at `top`. A `top` of -Inf means
+// that the position of the match on the page is unknown, in which case any bookmark on the page
+// is before the match.
+func sectionPath(outline []outlineEntry, pageNum uint32, top float64) []string {
+	best := -1
+	for i, e := range outline {
+		if e.Page == 0 || e.Page > pageNum {
+			continue
+		}
+		if e.Page == pageNum && e.Top < top-sectionTolerance {
+			continue
+		}
+		// Later bookmarks at the same position are deeper or follow in the outline so they win ties.
+		if best < 0 || e.Page > outline[best].Page ||
+			e.Page == outline[best].Page && e.Top <= outline[best].Top {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	path := []string{outline[best].Title}
+	level := outline[best].Level
+	for i := best - 1; i >= 0 && level > 0; i-- {
+		if outline[i].Level < level {
+			path = append([]string{outline[i].Title}, path...)
+			level = outline[i].Level
+		}
+	}
+	return path
+}
+
+// matchTop returns the top of the first span of `m` on its page or -Inf if it is not known.
+func matchTop(m bleveMatch, ppos PagePositions, lines bool) float64 {
+	if lines || len(m.Spans) == 0 || ppos.Empty() {
+		return math.Inf(-1)
+	}
+	bbox, ok := ppos.BBox(m.Spans[0].Start, m.Spans[0].End)
+	if !ok {
+		common.Log.Debug("matchTop: No bbox for m=%s", m)
+		return math.Inf(-1)
+	}
+	return bbox.Ury
+}
+
+// pageHeadings returns the titles of the bookmarks in `outline` that point to page `pageNum`
+// separated by newlines.
+func pageHeadings(outline []outlineEntry, pageNum uint32) string {
+	var titles []string
+	for _, e := range outline {
+		if e.Page == pageNum && e.Title != "" {
+			titles = append(titles, e.Title)
+		}
+	}
+	return strings.Join(titles, "\n")
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/creator"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// TestSectionPath checks that matches are given the title path of the closest bookmark before them.
+func TestSectionPath(t *testing.T) {
+	outline := []outlineEntry{
+		{Title: "Cover"},
+		{Title: "1 Intro", Page: 1, Top: 792},
+		{Title: "1.1 Scope", Level: 1, Page: 1, Top: 400},
+		{Title: "1.1.1 Limits", Level: 2, Page: 3, Top: 500},
+		{Title: "2 Design", Page: 3, Top: 500},
+		{Title: "2.1 Parts", Level: 1, Page: 5, Top: 600},
+	}
+	noTop := math.Inf(-1)
+	for _, test := range []struct {
+		pageNum  uint32
+		top      float64
+		expected []string
+	}{
+		{1, 700, []string{"1 Intro"}},
+		{1, 404, []string{"1 Intro", "1.1 Scope"}},
+		{1, noTop, []string{"1 Intro", "1.1 Scope"}},
+		{2, 792, []string{"1 Intro", "1.1 Scope"}},
+		{3, 600, []string{"1 Intro", "1.1 Scope"}},
+		{3, 300, []string{"2 Design"}},
+		{6, 100, []string{"2 Design", "2.1 Parts"}},
+	} {
+		path := sectionPath(outline, test.pageNum, test.top)
+		if !reflect.DeepEqual(path, test.expected) {
+			t.Errorf("page %d top %g: path=%q expected=%q", test.pageNum, test.top, path,
+				test.expected)
+		}
+	}
+	if path := sectionPath(outline[3:], 1, 100); path != nil {
+		t.Errorf("path=%q. Expected none", path)
+	}
+}
+
+// TestOutlineSearch checks that PDF outlines are indexed, that matches are given their section
+// paths and that matches in section headings rank higher.
+func TestOutlineSearch(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "outline.pdf")
+	makeOutlinePdf(t, inPath)
+
+	persistDir := filepath.Join(dir, "store")
+	opts := IndexOptions{Extractor: fakePageExtractor{
+		1: "overview scope details",
+		2: "budget",
+		3: "summary of the figures and budget totals for the whole year",
+	}}
+	blevePdf, index, result, err := IndexPdfFilesContext(context.Background(),
+		[]string{inPath}, persistDir, true, opts)
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	defer index.Close()
+	if result.NumAdded != 1 {
+		t.Fatalf("Unexpected result %s", result)
+	}
+
+	expected := []outlineEntry{
+		{Title: "1 Introduction", Page: 1, Top: 800},
+		{Title: "1.1 Scope", Level: 1, Page: 1, Top: 695},
+		{Title: "2 Budget", Page: 3, Top: 792},
+	}
+	if outline := blevePdf.fdList[0].Outline; !reflect.DeepEqual(outline, expected) {
+		t.Fatalf("outline=%+v\nexpected=%+v", outline, expected)
+	}
+
+	// checkSections checks the section paths of matches in `blevePdf` and `index`.
+	checkSections := func(desc string, blevePdf *BlevePdf, index bleve.Index) {
+		t.Helper()
+		for _, test := range []struct {
+			term    string
+			section []string
+		}{
+			{"overview", []string{"1 Introduction"}},
+			{"details", []string{"1 Introduction", "1.1 Scope"}},
+			{"totals", []string{"2 Budget"}},
+		} {
+			matches, err := blevePdf.SearchBleveIndex(index, test.term, 10)
+			if err != nil {
+				t.Fatalf("%s %q: SearchBleveIndex failed. err=%v", desc, test.term, err)
+			}
+			if len(matches.Matches) != 1 {
+				t.Fatalf("%s %q: matches=%s", desc, test.term, matches)
+			}
+			if section := matches.Matches[0].Section; !reflect.DeepEqual(section, test.section) {
+				t.Errorf("%s %q: section=%q expected=%q", desc, test.term, section, test.section)
+			}
+		}
+	}
+	checkSections("on-disk", blevePdf, index)
+
+	// Serialized copies of the index keep the outline.
+	data, err := MarshalPdfIndex(persistDir, nil)
+	if err != nil {
+		t.Fatalf("MarshalPdfIndex failed. err=%v", err)
+	}
+	loadedPdf, loadedIndex, err := LoadIndexFromBytes(data)
+	if err != nil {
+		t.Fatalf("LoadIndexFromBytes failed. err=%v", err)
+	}
+	defer loadedIndex.Close()
+	if outline := loadedPdf.fdList[0].Outline; !reflect.DeepEqual(outline, expected) {
+		t.Fatalf("loaded outline=%+v\nexpected=%+v", outline, expected)
+	}
+	checkSections("loaded", loadedPdf, loadedIndex)
+
+	// Page 2 is a better text match for "budget" but page 3 has a "Budget" heading.
+	matches, err := blevePdf.SearchBleveIndex(index, "budget", 10)
+	if err != nil {
+		t.Fatalf("SearchBleveIndex failed. err=%v", err)
+	}
+	if len(matches.Matches) != 2 || matches.Matches[0].PageNum != 3 {
+		t.Fatalf("Heading match didn't rank first. matches=%s", matches)
+	}
+	if section := matches.Matches[1].Section; !reflect.DeepEqual(section,
+		[]string{"1 Introduction", "1.1 Scope"}) {
+		t.Errorf("section=%q", section)
+	}
+}
+
+// makeOutlinePdf writes a 3 page PDF with this outline to `outPath`.
+//
+//	1 Introduction  page 1 at 800 points
+//	  1.1 Scope     page 1 at 695 points. The destination page is a 0-offset page number.
+//	2 Budget        page 3. The destination is the whole page.
+func makeOutlinePdf(t *testing.T, outPath string) {
+	var pages []*model.PdfPage
+	writeTestPdf(t, outPath, 3, func(c *creator.Creator, page *model.PdfPage, pageNum int) error {
+		pages = append(pages, page)
+		if pageNum == 3 {
+			c.SetOutlineTree(makeTestOutline(pages))
+		}
+		return nil
+	})
+}
+
+// makeTestOutline returns the outline described in makeOutlinePdf() for the 3 pages `pages`.
+func makeTestOutline(pages []*model.PdfPage) *model.PdfOutlineTreeNode {
+	item := func(title string, dest ...core.PdfObject) *model.PdfOutlineItem {
+		it := model.NewPdfOutlineItem()
+		it.Title = core.MakeString(title)
+		it.Dest = core.MakeArray(dest...)
+		return it
+	}
+	intro := item("1 Introduction", pages[0].GetPageAsIndirectObject(), core.MakeName("XYZ"),
+		core.MakeNull(), core.MakeFloat(800), core.MakeNull())
+	scope := item("1.1 Scope", core.MakeInteger(0), core.MakeName("XYZ"),
+		core.MakeNull(), core.MakeFloat(695), core.MakeNull())
+	budget := item("2 Budget", pages[2].GetPageAsIndirectObject(), core.MakeName("Fit"))
+
+	outline := model.NewPdfOutline()
+	outline.First = &intro.PdfOutlineTreeNode
+	outline.Last = &budget.PdfOutlineTreeNode
+	intro.Parent = &outline.PdfOutlineTreeNode
+	intro.Next = &budget.PdfOutlineTreeNode
+	intro.First = &scope.PdfOutlineTreeNode
+	intro.Last = &scope.PdfOutlineTreeNode
+	scope.Parent = &intro.PdfOutlineTreeNode
+	budget.Parent = &outline.PdfOutlineTreeNode
+	budget.Prev = &intro.PdfOutlineTreeNode
+	return &outline.PdfOutlineTreeNode
+}
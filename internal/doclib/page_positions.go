@@ -9,7 +9,6 @@ import (
 
 	"github.com/papercutsoftware/pdfsearch/internal/serial"
 	"github.com/unidoc/unipdf/v3/common"
-	"github.com/unidoc/unipdf/v3/extractor"
 	"github.com/unidoc/unipdf/v3/model"
 )
 
@@ -32,29 +31,6 @@ func (ppos PagePositions) Empty() bool {
 	return len(ppos.offsetBBoxes) == 0
 }
 
-// PagePositionsFromTextMarks converts extractor.TextMarkArray `textMarks` to a more compact
-// PagePositions. We do this because PagePositions is stored in our index which we want to be small.
-func PagePositionsFromTextMarks(textMarks *extractor.TextMarkArray) PagePositions {
-	var ppos PagePositions
-	for _, uloc := range textMarks.Elements() {
-		loc := fromExtractorLocation(uloc)
-		ppos.offsetBBoxes = append(ppos.offsetBBoxes, loc)
-	}
-	return ppos
-}
-
-// fromExtractorLocation converts extractor.TextMark `uloc` to a more compact serial.OffsetBBox.
-func fromExtractorLocation(uloc extractor.TextMark) serial.OffsetBBox {
-	b := uloc.BBox
-	return serial.OffsetBBox{
-		Offset: uint32(uloc.Offset),
-		Llx:    float32(b.Llx),
-		Lly:    float32(b.Lly),
-		Urx:    float32(b.Urx),
-		Ury:    float32(b.Ury),
-	}
-}
-
 // BBox returns a rectangle that bounds the text with offsets `start` and `end`.
 // ofs: `start` <= ofs < `end` on the PDF page indexed by `ppos`.
 // Caller must check that ppos.offsetBBoxes is not empty.
@@ -66,6 +42,11 @@ func (ppos PagePositions) BBox(start, end uint32) (model.PdfRectangle, bool) {
 			start, i0, ok0, end, i1, ok1)
 		return model.PdfRectangle{}, false
 	}
+	// `start` may be inside the text of an entry, e.g. in a CJK word recognized by OCR, which has
+	// one entry for the whole word, or in a multi-byte character. The entry is included.
+	if i0 > 0 && ppos.offsetBBoxes[i0].Offset > start {
+		i0--
+	}
 	if i1 <= i0 {
 		return model.PdfRectangle{}, false
 	}
@@ -79,13 +60,12 @@ func (ppos PagePositions) BBox(start, end uint32) (model.PdfRectangle, bool) {
 		bbox = rectUnion(bbox, b)
 	}
 	if bbox.Height() > 200 || bbox.Width() > 200 {
-		// TODO Remove panic
+		// Large boxes are usually annotations or form fields, whose text has the bounding box of the
+		// whole annotation.
+		common.Log.Debug("BBox: Large bbox=%+v start=%d end=%d", bbox, start, end)
 		for i := i0 + 1; i < i1; i++ {
 			common.Log.Debug("i=%d bbox=%v", i, ppos.offsetBBoxes[i].BBox())
 		}
-		if bbox.Height() > 200 {
-			panic(fmt.Errorf("bbox=%+v start=%d end=%d", bbox, start, end))
-		}
 	}
 	return bbox, true
 }
@@ -123,3 +103,31 @@ func rectUnion(b1, b2 model.PdfRectangle) model.PdfRectangle {
 		Ury: math.Max(b1.Ury, b2.Ury),
 	}
 }
+
+// PagePositionsFromLines converts the LineMarks of a text document to a PagePositions. Text
+// documents have no page geometry so each entry holds a line and column in the source file in place
+// of a bounding box: Llx is the column and Lly is the line. Urx and Ury are zero so that BBox()
+// treats the entries as fillers.
+func PagePositionsFromLines(lines []LineMark) PagePositions {
+	var ppos PagePositions
+	for _, m := range lines {
+		ppos.offsetBBoxes = append(ppos.offsetBBoxes, serial.OffsetBBox{
+			Offset: m.Offset,
+			Llx:    float32(m.Column),
+			Lly:    float32(m.Line),
+		})
+	}
+	return ppos
+}
+
+// LineColumn returns the source file line and column of the text at offset `offset` in a text
+// document whose PagePositions `ppos` were created by PagePositionsFromLines().
+func (ppos PagePositions) LineColumn(offset uint32) (line, col int, ok bool) {
+	locations := ppos.offsetBBoxes
+	i := sort.Search(len(locations), func(i int) bool { return locations[i].Offset > offset })
+	if i == 0 {
+		return 0, 0, false
+	}
+	loc := locations[i-1]
+	return int(loc.Lly), int(loc.Llx) + int(offset-loc.Offset), true
+}
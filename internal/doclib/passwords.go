@@ -0,0 +1,86 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the opening of encrypted PDFs.
+ *  - PasswordProvider supplies candidate passwords for encrypted PDFs.
+ *  - StaticPasswords, PathPasswords and PasswordFunc are PasswordProviders.
+ *  - ErrEncrypted is returned for encrypted PDFs that none of the passwords open.
+ */
+
+package doclib
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// ErrEncrypted is returned for encrypted PDFs that can't be decrypted with the empty password or
+// any of the passwords supplied by a PasswordProvider.
+var ErrEncrypted = errors.New("PDF is encrypted and none of the passwords opened it")
+
+// PasswordProvider supplies candidate passwords for encrypted PDFs.
+type PasswordProvider interface {
+	// Passwords returns the passwords to try on encrypted PDF `inPath`. It is only called for
+	// PDFs that can't be decrypted with the empty password.
+	Passwords(inPath string) []string
+}
+
+// StaticPasswords is a PasswordProvider that supplies the same passwords for every PDF.
+type StaticPasswords []string
+
+// Passwords returns the passwords in `p`.
+func (p StaticPasswords) Passwords(inPath string) []string {
+	return p
+}
+
+// PathPasswords is a PasswordProvider that supplies passwords for individual PDFs. It is a
+// {path: passwords} map. Paths are looked up as given and then by their file names, so the keys
+// can be full paths or file names.
+type PathPasswords map[string][]string
+
+// Passwords returns the passwords in `p` for PDF `inPath`.
+func (p PathPasswords) Passwords(inPath string) []string {
+	if passwords, ok := p[inPath]; ok {
+		return passwords
+	}
+	return p[filepath.Base(inPath)]
+}
+
+// PasswordFunc is a PasswordProvider that calls a supplied function. It can be used to look up
+// passwords in a key store or to ask a user for them.
+type PasswordFunc func(inPath string) []string
+
+// Passwords returns the passwords that `f` returns for PDF `inPath`.
+func (f PasswordFunc) Passwords(inPath string) []string {
+	return f(inPath)
+}
+
+// decryptPdf decrypts encrypted PDF `pdfReader` which was read from `inPath`. It tries the empty
+// password then each of the passwords supplied by `passwords`, which may be nil.
+// Returns ErrEncrypted if none of the passwords decrypt the PDF.
+func decryptPdf(pdfReader *model.PdfReader, inPath string, passwords PasswordProvider) error {
+	ok, err := pdfReader.Decrypt([]byte(""))
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	if passwords != nil {
+		for _, password := range passwords.Passwords(inPath) {
+			ok, err := pdfReader.Decrypt([]byte(password))
+			if err != nil {
+				return err
+			}
+			if ok {
+				common.Log.Debug("decryptPdf: Decrypted %q", inPath)
+				return nil
+			}
+		}
+	}
+	common.Log.Debug("decryptPdf: Could not decrypt %q", inPath)
+	return ErrEncrypted
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/unidoc/unipdf/v3/creator"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// TestEncryptedPdf checks that the text of an encrypted PDF is extracted, and the PDF is marked
+// up, with a password from a PasswordProvider and that ErrEncrypted is returned when there is no
+// password that opens it.
+func TestEncryptedPdf(t *testing.T) {
+	const text = "The quick brown fox jumps over the lazy dog"
+	inPath := filepath.Join(t.TempDir(), "secret.pdf")
+	makeEncryptedPdf(t, inPath, text, "user", "owner")
+	fd := fileDesc{InPath: inPath, Hash: "0123456789abcdef"}
+
+	for _, passwords := range []PasswordProvider{nil, StaticPasswords{"wrong"},
+		PathPasswords{"other.pdf": {"user"}}} {
+		_, _, err := extractDocContents(fd, extractOptions{passwords: passwords}, nil)
+		if err != ErrEncrypted {
+			t.Fatalf("passwords=%v: err=%v. Expected %v", passwords, err, ErrEncrypted)
+		}
+	}
+
+	for _, passwords := range []PasswordProvider{
+		StaticPasswords{"wrong", "user"},
+		StaticPasswords{"owner"},
+		PathPasswords{"secret.pdf": {"user"}},
+		PathPasswords{inPath: {"user"}},
+		PasswordFunc(func(string) []string { return []string{"user"} }),
+	} {
+		docContents, _, err := extractDocContents(fd, extractOptions{passwords: passwords}, nil)
+		if err != nil {
+			t.Fatalf("passwords=%v: extractDocContents failed. err=%v", passwords, err)
+		}
+		if len(docContents) != 1 || !strings.Contains(docContents[0].text, text) {
+			t.Fatalf("passwords=%v: Unexpected contents %+v", passwords, docContents)
+		}
+	}
+
+	// Marking up the PDF needs the password too.
+	rect := model.PdfRectangle{Llx: 10, Lly: 20, Urx: 30, Ury: 40}
+	markupPath := filepath.Join(filepath.Dir(inPath), "markup.pdf")
+	extractList := CreateExtractList(10, 10)
+	extractList.AddRect(inPath, 1, rect)
+	if err := extractList.SaveOutputPdf(markupPath); err != ErrEncrypted {
+		t.Fatalf("SaveOutputPdf without password: err=%v. Expected %v", err, ErrEncrypted)
+	}
+	extractList = CreateExtractList(10, 10)
+	extractList.SetPasswords(StaticPasswords{"user"})
+	extractList.AddRect(inPath, 1, rect)
+	if err := extractList.SaveOutputPdf(markupPath); err != nil {
+		t.Fatalf("SaveOutputPdf failed. err=%v", err)
+	}
+}
+
+// makeEncryptedPdf writes a one page PDF containing `text` to `outPath`. The PDF is encrypted with
+// user password `userPass` and owner password `ownerPass`.
+func makeEncryptedPdf(t *testing.T, outPath, text, userPass, ownerPass string) {
+	draw := drawTexts(text)
+	writeTestPdf(t, outPath, 1, func(c *creator.Creator, page *model.PdfPage, pageNum int) error {
+		c.SetPdfWriterAccessFunc(func(w *model.PdfWriter) error {
+			return w.Encrypt([]byte(userPass), []byte(ownerPass), nil)
+		})
+		return draw(c, page, pageNum)
+	})
+}
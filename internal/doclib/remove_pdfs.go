@@ -0,0 +1,195 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the removal of PDFs from an index.
+ *  - RemovePdfFiles()
+ *  - RemovePdfHashes()
+ *  - BlevePdf.RemovePdfFiles()
+ *  - BlevePdf.RemovePdfHashes()
+ */
+
+package doclib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/blevesearch/bleve"
+	"github.com/unidoc/unipdf/v3/common"
+)
+
+// RemovePdfFiles removes the PDFs with paths in `pathList` from the on-disk index in `persistDir`.
+// The PDFs embedded in them are removed too.
+// The files that link the bleve index to the PDFs are kept in `store`, or in `persistDir` if
+// `store` is nil.
+// It returns the number of PDFs removed. Paths that aren't in the index are ignored.
+func RemovePdfFiles(persistDir string, store IndexStore, pathList []string) (int, error) {
+	return removeDocs(persistDir, store, selectPaths(pathList))
+}
+
+// RemovePdfHashes removes the PDFs with contents hashes in `hashes` from the on-disk index in
+// `persistDir`. `store` is as in RemovePdfFiles().
+// It returns the number of PDFs removed. Hashes that aren't in the index are ignored.
+func RemovePdfHashes(persistDir string, store IndexStore, hashes []string) (int, error) {
+	return removeDocs(persistDir, store, selectHashes(hashes))
+}
+
+// RemovePdfFiles removes the PDFs with paths in `pathList`, and the PDFs embedded in them, from
+// in-memory BlevePdf `blevePdf` and its bleve index `index`.
+// It returns the number of PDFs removed. Paths that aren't in the index are ignored.
+func (blevePdf *BlevePdf) RemovePdfFiles(index bleve.Index, pathList []string) (int, error) {
+	return blevePdf.removeSelected(index, selectPaths(pathList))
+}
+
+// RemovePdfHashes removes the PDFs with contents hashes in `hashes` from in-memory BlevePdf
+// `blevePdf` and its bleve index `index`.
+// It returns the number of PDFs removed. Hashes that aren't in the index are ignored.
+func (blevePdf *BlevePdf) RemovePdfHashes(index bleve.Index, hashes []string) (int, error) {
+	return blevePdf.removeSelected(index, selectHashes(hashes))
+}
+
+// selectPaths returns a function that selects the PDFs with paths in `pathList` and the PDFs
+// embedded in them.
+func selectPaths(pathList []string) func(fd fileDesc) bool {
+	pathSet := map[string]bool{}
+	for _, inPath := range pathList {
+		pathSet[inPath] = true
+	}
+	return func(fd fileDesc) bool {
+		for inPath := fd.InPath; inPath != ""; inPath = parentPath(inPath) {
+			if pathSet[inPath] {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// selectHashes returns a function that selects the PDFs with contents hashes in `hashes`.
+func selectHashes(hashes []string) func(fd fileDesc) bool {
+	hashSet := map[string]bool{}
+	for _, hash := range hashes {
+		hashSet[hash] = true
+	}
+	return func(fd fileDesc) bool { return hashSet[fd.Hash] }
+}
+
+// removeDocs removes the PDFs whose fileDescs match `selected` from the on-disk index in
+// `persistDir` whose BlevePdf is kept in `store`. It returns the number of PDFs removed.
+func removeDocs(persistDir string, store IndexStore, selected func(fd fileDesc) bool) (int, error) {
+	blevePdf, index, err := openIndexForUpdate(persistDir, store)
+	if err != nil {
+		return 0, err
+	}
+	defer index.Close()
+
+	numRemoved, err := blevePdf.removeSelected(index, selected)
+	if err != nil {
+		blevePdf.flush()
+		return numRemoved, err
+	}
+	common.Log.Info("removeDocs: Removed %d PDFs from %q.", numRemoved, persistDir)
+	return numRemoved, blevePdf.flush()
+}
+
+// removeSelected removes the PDFs whose fileDescs match `selected` from `blevePdf` and `index`.
+// It returns the number of PDFs removed. The caller must flush on-disk BlevePdfs.
+func (blevePdf *BlevePdf) removeSelected(index bleve.Index, selected func(fd fileDesc) bool) (
+	int, error) {
+	numRemoved := 0
+	for i, fd := range blevePdf.fdList {
+		if fd.Deleted || !selected(fd) {
+			continue
+		}
+		if err := blevePdf.removeDoc(index, uint64(i)); err != nil {
+			return numRemoved, err
+		}
+		numRemoved++
+	}
+	return numRemoved, nil
+}
+
+// openIndexForUpdate opens the existing bleve index in `persistDir` and BlevePdf in `store`, or in
+// `persistDir` if `store` is nil, for updating.
+// Caller must close the returned bleve index and flush the returned BlevePdf.
+func openIndexForUpdate(persistDir string, store IndexStore) (*BlevePdf, bleve.Index, error) {
+	blevePdf, err := openBlevePdf(persistDir, store, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not open positions store %q. err=%v", persistDir, err)
+	}
+	indexPath := filepath.Join(persistDir, "bleve")
+	index, err := bleve.Open(indexPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not open Bleve index %q. err=%v", indexPath, err)
+	}
+	return blevePdf, index, nil
+}
+
+// removeDoc removes the PDF with document index `docIdx` from `blevePdf` and `index`.
+// The pages of the PDF are deleted from `index`, its PDF<-bleve cross-reference files are deleted
+// from disk, or from memory for in-memory BlevePdfs, and its entry in `blevePdf.fdList` is marked as deleted. The entry is kept so that the
+// document indexes of the other PDFs, which are encoded in their bleve IDs, don't change.
+func (blevePdf *BlevePdf) removeDoc(index bleve.Index, docIdx uint64) error {
+	docPos, err := blevePdf.baseFields(docIdx)
+	if err != nil {
+		return err
+	}
+	fd := blevePdf.fdList[docIdx]
+	common.Log.Debug("removeDoc: docIdx=%d %s", docIdx, fd)
+
+	numPages, err := blevePdf.numBlevePages(index, docPos)
+	if err != nil {
+		return err
+	}
+	batch := index.NewBatch()
+	for pageIdx := uint32(0); pageIdx < numPages; pageIdx++ {
+		batch.Delete(encodeID(docIdx, pageIdx))
+	}
+	if err := index.Batch(batch); err != nil {
+		return err
+	}
+
+	if err := blevePdf.deleteDocPositions(docPos); err != nil {
+		return err
+	}
+	blevePdf.fdList[docIdx].Deleted = true
+	blevePdf.remove(fd.Hash)
+	return nil
+}
+
+// numBlevePages returns the number of pages of the document `docPos` in `index`.
+// This is the number of pages in the document's saved partitions, or in its DocPositions in
+// `blevePdf`.hashDoc for in-memory BlevePdfs. If neither can be read then the pages in `index` are
+// counted.
+func (blevePdf *BlevePdf) numBlevePages(index bleve.Index, docPos *DocPositions) (uint32, error) {
+	if blevePdf.inMemory() {
+		// In-memory documents keep their pages in blevePdf.hashDoc.
+		if memPos, ok := blevePdf.hashDoc[blevePdf.fdList[docPos.docIdx].Hash]; ok {
+			return uint32(memPos.numPages()), nil
+		}
+	} else {
+		pagePartitions, err := docPos.loadPartitions()
+		if err == nil {
+			return uint32(len(pagePartitions)), nil
+		}
+		if !os.IsNotExist(err) {
+			common.Log.Error("numBlevePages: Couldn't read partitions %q err=%v",
+				docPos.partitionsPath, err)
+		}
+	}
+	// Page indexes are allocated in order from 0 so the pages of a document in `index` are the
+	// ones before the first missing page index.
+	var numPages uint32
+	for {
+		doc, err := index.Document(encodeID(docPos.docIdx, numPages))
+		if err != nil {
+			return 0, err
+		}
+		if doc == nil {
+			break
+		}
+		numPages++
+	}
+	return numPages, nil
+}
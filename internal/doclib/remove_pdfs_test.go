@@ -0,0 +1,138 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/papercutsoftware/pdfsearch/internal/utils"
+)
+
+// TestRemovePdfs checks that PDFs removed from an on-disk index by path or by hash are no longer
+// returned by searches and that the other PDFs still are.
+func TestRemovePdfs(t *testing.T) {
+	dir := t.TempDir()
+	paths := map[string]string{}
+	var pathList []string
+	for _, name := range []string{"alpha", "beta", "gamma"} {
+		inPath := filepath.Join(dir, name+".pdf")
+		writeTestPdf(t, inPath, 1, drawTexts("invoice "+name))
+		paths[name] = inPath
+		pathList = append(pathList, inPath)
+	}
+	persistDir := filepath.Join(dir, "store")
+	_, index, result, err := IndexPdfFiles(pathList, persistDir, true, nil)
+	if err != nil {
+		t.Fatalf("IndexPdfFiles failed. err=%v", err)
+	}
+	index.Close()
+	if result.NumAdded != 3 {
+		t.Fatalf("%s. Expected 3 PDFs added", result)
+	}
+
+	n, err := RemovePdfFiles(persistDir, nil, []string{paths["alpha"], filepath.Join(dir, "x.pdf")})
+	if err != nil {
+		t.Fatalf("RemovePdfFiles failed. err=%v", err)
+	}
+	if n != 1 {
+		t.Fatalf("RemovePdfFiles removed %d PDFs. Expected 1", n)
+	}
+	checkSearchPaths(t, persistDir, "invoice", []string{paths["beta"], paths["gamma"]})
+	checkSearchPaths(t, persistDir, "alpha", nil)
+
+	hash, err := utils.FileHash(paths["gamma"])
+	if err != nil {
+		t.Fatalf("FileHash failed. err=%v", err)
+	}
+	n, err = RemovePdfHashes(persistDir, nil, []string{hash, "0123456789"})
+	if err != nil {
+		t.Fatalf("RemovePdfHashes failed. err=%v", err)
+	}
+	if n != 1 {
+		t.Fatalf("RemovePdfHashes removed %d PDFs. Expected 1", n)
+	}
+	checkSearchPaths(t, persistDir, "invoice", []string{paths["beta"]})
+	checkSearchPaths(t, persistDir, "gamma", nil)
+
+	// Removing PDFs that have already been removed does nothing.
+	if n, err = RemovePdfFiles(persistDir, nil, []string{paths["alpha"]}); err != nil || n != 0 {
+		t.Fatalf("RemovePdfFiles removed %d PDFs. Expected 0. err=%v", n, err)
+	}
+}
+
+// TestRemoveMemPdfs checks that PDFs removed from an in-memory index by path or by hash are no
+// longer returned by searches and that the other PDFs still are.
+func TestRemoveMemPdfs(t *testing.T) {
+	blevePdf, index, err := CreateMemIndex()
+	if err != nil {
+		t.Fatalf("CreateMemIndex failed. err=%v", err)
+	}
+	defer index.Close()
+	hashes := map[string]string{}
+	for _, name := range []string{"alpha", "beta", "gamma"} {
+		data := makeTestPdf(t, 1, drawTexts("invoice "+name))
+		if _, err := blevePdf.IndexPdfReader(index, name+".pdf", bytes.NewReader(data)); err != nil {
+			t.Fatalf("IndexPdfReader failed. err=%v", err)
+		}
+		hash, _, err := utils.ReaderHash(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("ReaderHash failed. err=%v", err)
+		}
+		hashes[name] = hash
+	}
+
+	n, err := blevePdf.RemovePdfFiles(index, []string{"alpha.pdf", "x.pdf"})
+	if err != nil || n != 1 {
+		t.Fatalf("RemovePdfFiles removed %d PDFs. Expected 1. err=%v", n, err)
+	}
+	checkMatchPaths(t, blevePdf, index, "invoice", []string{"beta.pdf", "gamma.pdf"})
+	checkMatchPaths(t, blevePdf, index, "alpha", nil)
+
+	n, err = blevePdf.RemovePdfHashes(index, []string{hashes["gamma"], "0123456789"})
+	if err != nil || n != 1 {
+		t.Fatalf("RemovePdfHashes removed %d PDFs. Expected 1. err=%v", n, err)
+	}
+	checkMatchPaths(t, blevePdf, index, "invoice", []string{"beta.pdf"})
+	checkMatchPaths(t, blevePdf, index, "gamma", nil)
+}
+
+// checkSearchPaths checks that searching the on-disk index in `persistDir` for `term` returns
+// matches in the PDFs `pathList` and no others.
+func checkSearchPaths(t *testing.T, persistDir, term string, pathList []string) {
+	t.Helper()
+	blevePdf, index, err := openIndexForUpdate(persistDir, nil)
+	if err != nil {
+		t.Fatalf("openIndexForUpdate failed. err=%v", err)
+	}
+	defer index.Close()
+	checkMatchPaths(t, blevePdf, index, term, pathList)
+}
+
+// checkMatchPaths checks that searching `blevePdf` and `index` for `term` returns matches in the
+// PDFs `pathList` and no others.
+func checkMatchPaths(t *testing.T, blevePdf *BlevePdf, index bleve.Index, term string,
+	pathList []string) {
+	t.Helper()
+	matches, err := blevePdf.SearchBleveIndex(index, term, 10)
+	if err != nil {
+		t.Fatalf("SearchBleveIndex failed. err=%v", err)
+	}
+	want := map[string]bool{}
+	for _, inPath := range pathList {
+		want[inPath] = true
+	}
+	got := map[string]bool{}
+	for _, m := range matches.Matches {
+		if !want[m.InPath] {
+			t.Errorf("%q matched removed PDF %q", term, m.InPath)
+		}
+		got[m.InPath] = true
+	}
+	if len(got) != len(want) {
+		t.Errorf("%q matched %d PDFs. Expected %d. matches=%s", term, len(got), len(want),
+			matches)
+	}
+}
@@ -2,26 +2,28 @@
 
 /*
  * Functions for searching a PdfIndex
- *  - BlevePdf.SearchBleveIndex()
- *  - SearchPdfIndex()
+ *  - BlevePdf.SearchBleveIndex(), BlevePdf.SearchBleveIndexContext()
+ *  - SearchPdfIndex(), SearchPdfIndexContext()
  */
 
 package doclib
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/analysis"
-	"github.com/blevesearch/bleve/analysis/lang/en"
-	"github.com/blevesearch/bleve/registry"
 	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
 	"github.com/unidoc/unipdf/v3/common"
 )
 
@@ -35,12 +37,23 @@ type PdfMatchSet struct {
 // PdfPageMatch describes the search results for a PDF page returned from a search over a PDF index.
 // It is the analog of a bleve search.DocumentMatch.
 type PdfPageMatch struct {
-	InPath        string   // Path of the PDF that was matched. (A name stored in the index.)
-	PageNum       uint32   // 1-offset page number of the PDF page containing the matched text.
-	LineNums      []int    // 1-offset line number of the matched text within the extracted page text.
-	Lines         []string // The contents of the line containing the matched text.
-	PagePositions          // This is used to find the bounding box of the match text on the PDF page.
-	bleveMatch             // Internal information on the match returned from the bleve query.
+	InPath        string        // Path of the PDF that was matched. (A name stored in the index.)
+	Parent        string        // Path of the PDF or ZIP archive that holds the matched PDF, if any.
+	Format        string        // Format of the matched document. FormatPDF for PDFs.
+	PageNum       uint32        // 1-offset page number of the PDF page containing the matched text.
+	LineNums      []int         // 1-offset line number of the matched text within the extracted page text, or the source file for text documents.
+	Lines         []string      // The contents of the line containing the matched text.
+	Sources       []MatchSource // Where the matched text came from: page text, an annotation or a form field.
+	Section       []string      // Titles of the bookmarks enclosing the match, outermost first. nil if none.
+	PagePositions               // This is used to find the bounding box of the match text on the PDF page.
+	bleveMatch                  // Internal information on the match returned from the bleve query.
+	rs            io.ReadSeeker // Contents of the PDF for in-memory indexes. nil for on-disk indexes.
+}
+
+// Reader returns the contents of the PDF matched by `p` if it came from an in-memory index, or nil
+// if the PDF should be read from `p.InPath`.
+func (p PdfPageMatch) Reader() io.ReadSeeker {
+	return p.rs
 }
 
 // bleveMatch is the match information returned by a bleve query.
@@ -60,10 +73,17 @@ type Span struct {
 }
 
 // Best return a copy of `s` trimmed to the results with the highest score.
+// Matches with no text spans, from searches on document metadata alone, are all returned.
 func (s PdfMatchSet) Best() PdfMatchSet {
 	best := PdfMatchSet{
 		SearchDuration: s.SearchDuration,
 	}
+	if !s.hasSpans() {
+		// Searches on document metadata alone match documents rather than text.
+		best.Matches = s.Matches
+		best.TotalMatches = len(s.Matches)
+		return best
+	}
 	bestScore := 0.0
 	for _, m := range s.Matches {
 		for _, s := range m.Spans {
@@ -77,12 +97,14 @@ func (s PdfMatchSet) Best() PdfMatchSet {
 	for _, m := range s.Matches {
 		var lineNums []int
 		var lines []string
+		var sources []MatchSource
 		var spans []Span
 		for i, a := range m.Spans {
 			numMatches++
 			if a.Score >= bestScore {
 				lineNums = append(lineNums, m.LineNums[i])
 				lines = append(lines, m.Lines[i])
+				sources = append(sources, m.Sources[i])
 				spans = append(spans, a)
 			}
 		}
@@ -90,6 +112,7 @@ func (s PdfMatchSet) Best() PdfMatchSet {
 			o := m
 			o.LineNums = lineNums
 			o.Lines = lines
+			o.Sources = sources
 			o.Spans = spans
 			best.Matches = append(best.Matches, o)
 			best.TotalMatches += len(spans)
@@ -101,17 +124,38 @@ func (s PdfMatchSet) Best() PdfMatchSet {
 	return best
 }
 
+// hasSpans returns true if any of the matches in `s` have text spans.
+func (s PdfMatchSet) hasSpans() bool {
+	for _, m := range s.Matches {
+		if len(m.Spans) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // ErrNoMatch indicates there was no match for a bleve hit. It is not a real error.
 var ErrNoMatch = errors.New("no match for hit")
 
 // ErrNoMatch indicates there was no match for a bleve hit. It is not a real error.
 var ErrNoPositions = errors.New("no match for hit")
 
+// ErrDeleted indicates that a document has been removed from the index.
+var ErrDeleted = errors.New("document has been removed")
+
 // SearchPdfIndex performs a bleve search on the persistent index in `persistDir/bleve`
 // for `term` and returns up to `maxResults` matches. It maps the results to PDF file names, page
-// numbers, line numbers and page locations using the BlevePdf that was saved in directory
-// `persistDir` by IndexPdfFiles().
-func SearchPdfIndex(persistDir, term string, maxResults int) (PdfMatchSet, error) {
+// numbers, line numbers and page locations using the BlevePdf that was saved in `store` by
+// IndexPdfFiles(), or in directory `persistDir` if `store` is nil.
+func SearchPdfIndex(persistDir string, store IndexStore, term string, maxResults int) (
+	PdfMatchSet, error) {
+	return SearchPdfIndexContext(context.Background(), persistDir, store, term, maxResults)
+}
+
+// SearchPdfIndexContext is SearchPdfIndex() with a context `ctx` that can cancel the search.
+// If `ctx` is cancelled or its deadline passes during the bleve search, ctx.Err() is returned.
+func SearchPdfIndexContext(ctx context.Context, persistDir string, store IndexStore, term string,
+	maxResults int) (PdfMatchSet, error) {
 	p := PdfMatchSet{}
 
 	indexPath := filepath.Join(persistDir, "bleve")
@@ -127,14 +171,17 @@ func SearchPdfIndex(persistDir, term string, maxResults int) (PdfMatchSet, error
 	}
 	common.Log.Debug("index=%v", index)
 
-	blevePdf, err := openBlevePdf(persistDir, false)
+	blevePdf, err := openBlevePdf(persistDir, store, false)
 	if err != nil {
 		return p, fmt.Errorf("Could not open positions store %q. err=%v", persistDir, err)
 	}
 	common.Log.Debug("blevePdf=%s", *blevePdf)
 
-	results, err := blevePdf.SearchBleveIndex(index, term, maxResults)
+	results, err := blevePdf.SearchBleveIndexContext(ctx, index, term, maxResults)
 	if err != nil {
+		if err == ctx.Err() {
+			return p, err
+		}
 		return p, fmt.Errorf("Could not find term=%q %q. err=%v", term, persistDir, err)
 	}
 
@@ -149,6 +196,13 @@ func SearchPdfIndex(persistDir, term string, maxResults int) (PdfMatchSet, error
 // numbers and page locations using `blevePdf`.
 func (blevePdf *BlevePdf) SearchBleveIndex(index bleve.Index, term0 string, maxResults int) (
 	PdfMatchSet, error) {
+	return blevePdf.SearchBleveIndexContext(context.Background(), index, term0, maxResults)
+}
+
+// SearchBleveIndexContext is SearchBleveIndex() with a context `ctx` that is passed to bleve's
+// SearchInContext(). If `ctx` is cancelled or its deadline passes, ctx.Err() is returned.
+func (blevePdf *BlevePdf) SearchBleveIndexContext(ctx context.Context, index bleve.Index,
+	term0 string, maxResults int) (PdfMatchSet, error) {
 	p := PdfMatchSet{}
 	common.Log.Debug("SearchBleveIndex: term0=%q maxResults=%d", term0, maxResults)
 
@@ -160,39 +214,75 @@ func (blevePdf *BlevePdf) SearchBleveIndex(index bleve.Index, term0 string, maxR
 
 	// TODO precompute analyzer?
 	// TODO: Are tokens needed? Is there a better way of computing spans/.
-	cache := registry.NewCache()
-	analyzer, err := cache.AnalyzerNamed(en.AnalyzerName)
+	term, fieldQueries, err := parseFieldQueries(term0)
 	if err != nil {
-		return p, nil
+		return p, err
+	}
+	// The text is matched in the text field of each language with the analyzer for the language.
+	// See lang_detect.go. The analyzers are taken from the index mapping so that the text is
+	// analyzed in the same way as it was indexed. See analysis_config.go.
+	indexMapping := index.Mapping()
+	fieldTokens := map[string]analysis.TokenStream{}
+	var textQueries []query.Query
+	numTokens := 0
+	for _, l := range languages {
+		analyzerName := indexMapping.AnalyzerNameForPath(l.field())
+		analyzer := indexMapping.AnalyzerNamed(analyzerName)
+		if analyzer == nil {
+			return p, fmt.Errorf("no analyzer %q for %q", analyzerName, l.field())
+		}
+		tokens := analyzer.Analyze([]byte(term))
+		fieldTokens[l.field()] = tokens
+		numTokens += len(tokens)
+		q := bleve.NewMatchQuery(term)
+		q.SetField(l.field())
+		textQueries = append(textQueries, q)
 	}
-	tokens := analyzer.Analyze([]byte(term0))
 	common.Log.Debug("term0=%q", term0)
-	common.Log.Debug("tokens=%d", len(tokens))
-	for i, t := range tokens {
+	common.Log.Debug("tokens=%d", numTokens)
+	for i, t := range fieldTokens[fieldText] {
 		common.Log.Debug("%4d: %v", i, t)
 	}
-	term := term0
 
 	// query0 := bleve.NewMatchQuery(term)
 	// query0.SetOperator(query.MatchQueryOperatorAnd)
 	// query0.SetBoost(10.0)
 	// // query0.Fuzziness = 1
 	// query0.Analyzer = "en"
-	query1 := bleve.NewMatchQuery(term)
-	// query1.SetOperator(query.MatchQueryOperatorOr)
-	// query1.Analyzer = "en"
+	query1 := bleve.NewDisjunctionQuery(textQueries...)
 	// query1.Fuzziness = 1
 	// queryX := bleve.NewDisjunctionQuery(query0, query1)
-	queryX := query1
+	var queryX query.Query = query1
+	if numTokens > 0 {
+		// Matches of the text in the headings of the matched page rank higher. The headings are
+		// optional so they don't add matches.
+		headings := bleve.NewMatchQuery(term)
+		headings.SetField(fieldHeadings)
+		headings.SetBoost(headingsBoost)
+		queryX = query.NewBooleanQuery([]query.Query{query1}, []query.Query{headings}, nil)
+	}
+	if len(fieldQueries) > 0 {
+		// The field qualifiers filter the matches of the text. With no text, they match the first
+		// page of each document.
+		if term == "" {
+			firstPage := bleve.NewBoolFieldQuery(true)
+			firstPage.SetField(fieldFirstPage)
+			queryX = firstPage
+		}
+		queryX = bleve.NewConjunctionQuery(append([]query.Query{queryX}, fieldQueries...)...)
+	}
 	search := bleve.NewSearchRequest(queryX)
 	search.Highlight = bleve.NewHighlight()
-	search.Fields = []string{"Text"}
+	search.Fields = textFields()
 	search.Highlight.Fields = search.Fields
 	search.Size = maxResults
 	// search.Explain = true
 
-	searchResults, err := index.Search(search)
+	searchResults, err := index.SearchInContext(ctx, search)
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return p, ctxErr
+		}
 		return p, err
 	}
 
@@ -238,26 +328,31 @@ func (blevePdf *BlevePdf) SearchBleveIndex(index bleve.Index, term0 string, maxR
 	for i, hit := range searchResults.Hits {
 		common.Log.Debug("%3d: %4.2f %3d %q", i, hit.Score, hit.Size(), hit.String())
 	}
-	return blevePdf.srToMatchSet(tokens, searchResults)
+	return blevePdf.srToMatchSet(fieldTokens, searchResults)
 }
 
-// truncate truncates `text` to its first `n` characters.
+// truncate truncates `text` to its first `n` bytes without splitting a multi-byte character.
 func truncate(text string, n int) string {
 	if len(text) <= n {
 		return text
 	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
 	return text[:n]
 }
 
 // srToMatchSet maps bleve search results `sr` to PDF page names, page numbers, line
 // numbers and page locations using the tables in `blevePdf`.
-func (blevePdf *BlevePdf) srToMatchSet(tokens analysis.TokenStream, sr *bleve.SearchResult) (PdfMatchSet, error) {
+// `fieldTokens` are the tokens of the search term in each page text field.
+func (blevePdf *BlevePdf) srToMatchSet(fieldTokens map[string]analysis.TokenStream,
+	sr *bleve.SearchResult) (PdfMatchSet, error) {
 	var matches []PdfPageMatch
 	if sr.Total > 0 && sr.Request.Size > 0 {
 		for _, hit := range sr.Hits {
-			m, err := blevePdf.hitToPdfMatch(tokens, hit)
+			m, err := blevePdf.hitToPdfMatch(fieldTokens, hit)
 			if err != nil {
-				if err == ErrNoMatch {
+				if err == ErrNoMatch || err == ErrDeleted {
 					continue
 				}
 				return PdfMatchSet{}, err
@@ -330,9 +425,9 @@ func (s PdfMatchSet) Files() []string {
 // `blevePdf`.
 // We purposely try to keep `hit` small to improve bleve indexing speed and to reduce the bleve
 // index size.
-func (blevePdf *BlevePdf) hitToPdfMatch(tokens analysis.TokenStream, hit *search.DocumentMatch) (
-	PdfPageMatch, error) {
-	m, err := hitToBleveMatch(tokens, hit)
+func (blevePdf *BlevePdf) hitToPdfMatch(fieldTokens map[string]analysis.TokenStream,
+	hit *search.DocumentMatch) (PdfPageMatch, error) {
+	m, err := hitToBleveMatch(fieldTokens, hit)
 	if err != nil {
 		return PdfPageMatch{}, err
 	}
@@ -344,24 +439,44 @@ func (blevePdf *BlevePdf) hitToPdfMatch(tokens analysis.TokenStream, hit *search
 	if err != nil {
 		return PdfPageMatch{}, err
 	}
+	var fd fileDesc
+	if m.docIdx < uint64(len(blevePdf.fdList)) {
+		fd = blevePdf.fdList[m.docIdx]
+	}
 	var lineNums []int
 	var lines []string
+	var sources []MatchSource
 	for _, span := range m.Spans {
 		lineNum, line, ok := lineNumber(text, span.Start)
 		if !ok {
 			return PdfPageMatch{}, fmt.Errorf("No line number. m=%s span=%v", m, span)
 		}
+		if fd.Lines {
+			if lineNum, _, ok = ppos.LineColumn(span.Start); !ok {
+				return PdfPageMatch{}, fmt.Errorf("No source line number. m=%s span=%v", m, span)
+			}
+		}
 		lineNums = append(lineNums, lineNum)
 		lines = append(lines, line)
+		sources = append(sources, ppos.Source(span.Start))
+	}
+	var section []string
+	if len(fd.Outline) > 0 {
+		section = sectionPath(fd.Outline, pageNum, matchTop(m, ppos, fd.Lines))
 	}
 
 	return PdfPageMatch{
 		InPath:        inPath,
+		Parent:        fd.Parent,
+		Format:        fd.format(),
 		PageNum:       pageNum,
 		LineNums:      lineNums,
 		Lines:         lines,
+		Sources:       sources,
+		Section:       section,
 		PagePositions: ppos,
 		bleveMatch:    m,
+		rs:            blevePdf.hashReader[blevePdf.indexHash[m.docIdx]],
 	}, nil
 }
 
@@ -379,10 +494,16 @@ type Phrase struct {
 	end       int
 }
 
+// bestPhrases returns the phrases in the page text with term locations `termLocMap` that match the
+// most of the search term tokens `tokens`.
+// The tokens are matched at their positions relative to the first token. Stop words leave gaps in
+// the positions and synonyms have the same positions as the words they are synonyms of.
 func bestPhrases(tokens analysis.TokenStream, termLocMap search.TermLocationMap) []Phrase {
 	var terms []string
+	var offsets []int // Position of each token relative to the first token.
 	for _, tok := range tokens {
 		terms = append(terms, string(tok.Term))
+		offsets = append(offsets, tok.Position-tokens[0].Position)
 	}
 	common.Log.Debug("$^$ bestPhrases: terms=%d %q", len(terms), terms)
 
@@ -407,9 +528,10 @@ func bestPhrases(tokens analysis.TokenStream, termLocMap search.TermLocationMap)
 			posLoc[pos] = *loc
 
 			termPositions[term][pos] = struct{}{}
-			startPos := pos - i
+			startPos := pos - offsets[i]
 			if startPos < 0 {
-				panic("not possible")
+				// The term is too near the start of the page to be in a phrase.
+				continue
 			}
 			startMap[startPos] = struct{}{}
 		}
@@ -440,7 +562,7 @@ func bestPhrases(tokens analysis.TokenStream, termLocMap search.TermLocationMap)
 		common.Log.Debug("pos0=%d ---------------", pos0)
 		var phrase Phrase
 		for k, term := range terms {
-			pos := pos0 + k
+			pos := pos0 + offsets[k]
 			loc := posLoc[pos]
 			_, ok := termPositions[term][pos]
 
@@ -484,7 +606,10 @@ func bestPhrases(tokens analysis.TokenStream, termLocMap search.TermLocationMap)
 }
 
 // hitToBleveMatch returns a bleveMatch filled with the information in `hit` that comes from bleve.
-func hitToBleveMatch(tokens analysis.TokenStream, hit *search.DocumentMatch) (bleveMatch, error) {
+// `fieldTokens` are the tokens of the search term in each page text field. The term locations of
+// the page text field that `hit` matched are matched against the tokens for that field.
+func hitToBleveMatch(fieldTokens map[string]analysis.TokenStream, hit *search.DocumentMatch) (
+	bleveMatch, error) {
 	docIdx, pageIdx, err := decodeID(hit.ID)
 	if err != nil {
 		return bleveMatch{}, err
@@ -500,11 +625,14 @@ func hitToBleveMatch(tokens analysis.TokenStream, hit *search.DocumentMatch) (bl
 	var frags strings.Builder
 	var phrases []Phrase
 	common.Log.Debug("----------xxx------------ %d Fragments", len(hit.Fragments))
-	for k, fragments := range hit.Fragments {
-		for _, fragment := range fragments {
+	for k, termLocMap := range hit.Locations {
+		tokens, ok := fieldTokens[k]
+		if !ok {
+			continue
+		}
+		for _, fragment := range hit.Fragments[k] {
 			frags.WriteString(fragment)
 		}
-		termLocMap := hit.Locations[k]
 		common.Log.Debug("%q: %d %q", k, len(termLocMap), frags.String())
 		phrases = bestPhrases(tokens, termLocMap)
 	}
@@ -523,6 +651,12 @@ func hitToBleveMatch(tokens analysis.TokenStream, hit *search.DocumentMatch) (bl
 	}, nil
 }
 
+// encodeID returns the ID string passed to bleve in indexDocPagesLoc() for the page with document
+// and page indexes `docIdx` and `pageIdx`.
+func encodeID(docIdx uint64, pageIdx uint32) string {
+	return fmt.Sprintf("%04X.%d", docIdx, pageIdx)
+}
+
 // decodeID decodes the ID string passed to bleve in indexDocPagesLoc().
 // id := fmt.Sprintf("%04X.%d", l.DocIdx, l.PageIdx)
 func decodeID(id string) (uint64, uint32, error) {
@@ -541,44 +675,21 @@ func decodeID(id string) (uint64, uint32, error) {
 	return uint64(docIdx), uint32(pageIdx), nil
 }
 
-// lineNumber returns the 1-offset line number and the text of the line of the contains the 0-offset
-//  `offset` in `text`.
-// !@#$ precalculate this and stop storing text!
+// lineNumber returns the 1-offset line number and the text of the line that contains the 0-offset
+// byte offset `offset` in `text`. Lines are separated by '\n'. As the line is found from the
+// positions of the '\n' bytes, which are never part of multi-byte UTF-8 sequences, the returned
+// line is valid UTF-8 if `text` is.
 func lineNumber(text string, offset uint32) (int, string, bool) {
-	endings := lineEndings(text)
-	n := len(endings)
-	i := sort.Search(len(endings), func(i int) bool { return endings[i] > offset })
-	ok := 0 <= i && i < n
-	if !ok {
-		common.Log.Error("lineNumber: offset=%d text=%d i=%d endings=%d %+v\n%s",
-			offset, len(text), i, n, endings, text)
+	if int(offset) >= len(text) {
+		common.Log.Error("lineNumber: offset=%d text=%d\n%s", offset, len(text), text)
 		return 0, "", false
 	}
-	common.Log.Debug("offset=%d i=%d endings=%+v", offset, i, endings)
-	ofs0 := endings[i-1]
-	ofs1 := endings[i+0]
-	line := text[ofs0:ofs1]
-	runes := []rune(line)
-	if len(runes) >= 1 && runes[0] == '\n' {
-		line = string(runes[1:])
-	}
-	return i + 1, line, ok
-}
-
-// lineEndings returns the offsets of all the line endings in `text`.
-func lineEndings(text string) []uint32 {
-	if len(text) == 0 || (len(text) > 0 && text[len(text)-1] != '\n') {
-		text += "\n"
-	}
-	endings := []uint32{0}
-	for ofs := 0; ofs < len(text); {
-		o := strings.Index(text[ofs:], "\n")
-		if o < 0 {
-			break
-		}
-		endings = append(endings, uint32(ofs+o))
-		ofs = ofs + o + 1
+	start := strings.LastIndexByte(text[:offset], '\n') + 1
+	end := strings.IndexByte(text[offset:], '\n')
+	if end < 0 {
+		end = len(text)
+	} else {
+		end += int(offset)
 	}
-
-	return endings
+	return strings.Count(text[:start], "\n") + 1, text[start:end], true
 }
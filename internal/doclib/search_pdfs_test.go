@@ -0,0 +1,143 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLineNumber checks the line numbers and lines found for byte offsets in ASCII and multi-byte
+// text. The first line is line 1.
+func TestLineNumber(t *testing.T) {
+	ascii := "first line\nsecond line\nthird"
+	for _, test := range []struct {
+		offset  int
+		lineNum int
+		line    string
+	}{
+		{0, 1, "first line"},
+		{strings.Index(ascii, "line"), 1, "first line"},
+		{strings.Index(ascii, "\n"), 1, "first line"},
+		{strings.Index(ascii, "second"), 2, "second line"},
+		{strings.Index(ascii, "third"), 3, "third"},
+		{len(ascii) - 1, 3, "third"},
+	} {
+		lineNum, line, ok := lineNumber(ascii, uint32(test.offset))
+		if !ok || lineNum != test.lineNum || line != test.line {
+			t.Errorf("ASCII offset=%d: lineNum=%d line=%q ok=%t. Expected %d %q", test.offset,
+				lineNum, line, ok, test.lineNum, test.line)
+		}
+	}
+
+	text := "契約書の条件\n支払期限は三十日です\n\nend"
+	for _, test := range []struct {
+		offset  int
+		lineNum int
+		line    string
+	}{
+		{0, 1, "契約書の条件"},
+		{strings.Index(text, "条件"), 1, "契約書の条件"},
+		{strings.Index(text, "\n"), 1, "契約書の条件"},
+		{strings.Index(text, "支払"), 2, "支払期限は三十日です"},
+		{strings.Index(text, "三十"), 2, "支払期限は三十日です"},
+		{strings.Index(text, "end"), 4, "end"},
+		{len(text) - 1, 4, "end"},
+	} {
+		lineNum, line, ok := lineNumber(text, uint32(test.offset))
+		if !ok || lineNum != test.lineNum || line != test.line {
+			t.Errorf("offset=%d: lineNum=%d line=%q ok=%t. Expected %d %q", test.offset, lineNum,
+				line, ok, test.lineNum, test.line)
+		}
+	}
+	if _, _, ok := lineNumber(text, uint32(len(text))); ok {
+		t.Errorf("Found a line past the end of the text")
+	}
+	if s := truncate("三十日", 4); s != "三" {
+		t.Errorf("truncate split a character: %q", s)
+	}
+}
+
+// TestCJKSearch checks that words in Chinese and Japanese text without spaces are found and that
+// the matches have the byte offsets, bounding boxes and lines of the matched text.
+func TestCJKSearch(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "cjk.pdf")
+	if err := ioutil.WriteFile(inPath, makeAttachmentsPdf(t, 2, nil), 0644); err != nil {
+		t.Fatalf("WriteFile failed. err=%v", err)
+	}
+	// fakePageExtractor puts each word on a line of its own with one bounding box for the word,
+	// like OCR, so matches start inside the words.
+	opts := IndexOptions{Extractor: fakePageExtractor{
+		1: "契約書の条件 支払期限は三十日です 以上",
+		2: "本合同规定了付款条件 供应商应在三十天内付款",
+	}}
+	blevePdf, index, _, err := IndexPdfFilesContext(context.Background(), []string{inPath},
+		filepath.Join(dir, "store"), true, opts)
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	defer index.Close()
+
+	type cjkMatch struct {
+		pageNum uint32
+		word    int
+		line    string
+	}
+	for _, test := range []struct {
+		term    string
+		matches []cjkMatch
+	}{
+		{"支払期限", []cjkMatch{{1, 1, "支払期限は三十日です"}}},
+		{"条件", []cjkMatch{{1, 0, "契約書の条件"}, {2, 0, "本合同规定了付款条件"}}},
+		{"三十", []cjkMatch{{1, 1, "支払期限は三十日です"}, {2, 1, "供应商应在三十天内付款"}}},
+		{"三十 lang:zh", []cjkMatch{{2, 1, "供应商应在三十天内付款"}}},
+		{"三十 lang:ja", []cjkMatch{{1, 1, "支払期限は三十日です"}}},
+		{"供应商", []cjkMatch{{2, 1, "供应商应在三十天内付款"}}},
+		{"会議室", nil},
+	} {
+		matches, err := blevePdf.SearchBleveIndex(index, test.term, 10)
+		if err != nil {
+			t.Fatalf("%q: SearchBleveIndex failed. err=%v", test.term, err)
+		}
+		if len(matches.Matches) != len(test.matches) {
+			t.Errorf("%q: %d matches. Expected %d. matches=%s", test.term, len(matches.Matches),
+				len(test.matches), matches)
+			continue
+		}
+		word := strings.Fields(test.term)[0]
+		for _, exp := range test.matches {
+			var m *PdfPageMatch
+			for i := range matches.Matches {
+				if matches.Matches[i].PageNum == exp.pageNum {
+					m = &matches.Matches[i]
+				}
+			}
+			if m == nil || len(m.Spans) != 1 {
+				t.Errorf("%q: No match on page %d. matches=%s", test.term, exp.pageNum, matches)
+				continue
+			}
+			span := m.Spans[0]
+			text, err := blevePdf.docPageText(m.docIdx, m.pageIdx)
+			if err != nil {
+				t.Fatalf("docPageText failed. err=%v", err)
+			}
+			if text[span.Start:span.End] != word {
+				t.Errorf("%q: span %d-%d is %q", test.term, span.Start, span.End,
+					text[span.Start:span.End])
+			}
+			bbox, ok := m.PagePositions.BBox(span.Start, span.End)
+			if !ok || bbox != fakeWordBBox(exp.word) {
+				t.Errorf("%q: page %d bbox=%+v ok=%t. Expected %+v", test.term, exp.pageNum, bbox,
+					ok, fakeWordBBox(exp.word))
+			}
+			if m.LineNums[0] != exp.word+1 || m.Lines[0] != exp.line {
+				t.Errorf("%q: page %d line %d %q. Expected %d %q", test.term, exp.pageNum,
+					m.LineNums[0], m.Lines[0], exp.word+1, exp.line)
+			}
+		}
+	}
+}
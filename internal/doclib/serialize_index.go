@@ -0,0 +1,217 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements serialization of whole indexes to single flat byte buffers.
+ *  - BlevePdf.MarshalIndex() serializes an in-memory index.
+ *  - MarshalPdfIndex() serializes an on-disk index.
+ *  - LoadIndexFromBytes() returns an in-memory index that is searched directly from a buffer.
+ *
+ * The buffer is a flatbuffers PdfIndex (see internal/serial/schemas/pdf_index.fbs) containing
+ *  - the bleve index serialized by ExportBleveMem(),
+ *  - the list of indexed PDFs and
+ *  - the page numbers, page texts and text positions of each PDF.
+ */
+
+package doclib
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/blevesearch/bleve"
+	"github.com/papercutsoftware/pdfsearch/internal/serial"
+	"github.com/papercutsoftware/pdfsearch/internal/serial/pdf_index"
+	"github.com/unidoc/unipdf/v3/common"
+)
+
+// MarshalIndex returns in-memory BlevePdf `blevePdf` and its bleve index `index` serialized to a
+// byte slice that can be loaded with LoadIndexFromBytes().
+func (blevePdf *BlevePdf) MarshalIndex(index bleve.Index) ([]byte, error) {
+	if !blevePdf.inMemory() {
+		return nil, errors.New("not an in-memory index")
+	}
+	indexData, err := ExportBleveMem(index)
+	if err != nil {
+		return nil, fmt.Errorf("Could not serialize bleve index. err=%v", err)
+	}
+
+	var docs []serial.DocEntry
+	numPages := 0
+	for i, fd := range blevePdf.fdList {
+		if fd.Deleted {
+			continue
+		}
+		docIdx := uint64(i)
+		docPos, err := blevePdf.openDocPosition(docIdx)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open %q. err=%v", fd.InPath, err)
+		}
+		docContents, err := docPos.readPageContents()
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %q. err=%v", fd.InPath, err)
+		}
+		docs = append(docs, makeDocEntry(fd, docIdx, docContents))
+		numPages += len(docContents)
+	}
+	common.Log.Debug("MarshalIndex: fdList=%d docs=%d pages=%d bleve=%d bytes",
+		len(blevePdf.fdList), len(docs), numPages, len(indexData))
+	return serial.MakePdfIndex(uint32(len(blevePdf.fdList)), uint32(numPages), indexData, docs), nil
+}
+
+// MarshalPdfIndex returns the on-disk index in `persistDir` serialized to a byte slice that can be
+// loaded with LoadIndexFromBytes().
+// On-disk bleve indexes can't be serialized directly, so the pages of the indexed PDFs are read
+// from disk and added to an in-memory index which is then serialized. The PDFs are not re-read.
+// The in-memory index analyzes the text with the AnalysisConfig of the on-disk index.
+// The files that link the bleve index to the PDFs are read from `store`, or from `persistDir` if
+// `store` is nil.
+func MarshalPdfIndex(persistDir string, store IndexStore) ([]byte, error) {
+	blevePdf, err := openBlevePdf(persistDir, store, false)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open positions store %q. err=%v", persistDir, err)
+	}
+	memPdf, memIndex, err := createMemIndex(blevePdf.analysis)
+	if err != nil {
+		return nil, err
+	}
+	defer memIndex.Close()
+
+	for i, fd := range blevePdf.fdList {
+		if fd.Deleted {
+			continue
+		}
+		docPos, err := blevePdf.openDocPosition(uint64(i))
+		if err != nil {
+			return nil, fmt.Errorf("Could not open %q. err=%v", fd.InPath, err)
+		}
+		docContents, err := docPos.readPageContents()
+		docPos.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %q. err=%v", fd.InPath, err)
+		}
+		if len(docContents) == 0 {
+			common.Log.Info("MarshalPdfIndex: No pages in %q. Skipping.", fd.InPath)
+			continue
+		}
+		if _, _, err := memPdf.indexDocPagesLoc(memIndex, fd, docContents); err != nil {
+			return nil, fmt.Errorf("Could not index %q. err=%v", fd.InPath, err)
+		}
+	}
+	return memPdf.MarshalIndex(memIndex)
+}
+
+// LoadIndexFromBytes returns the in-memory BlevePdf and bleve index serialized in `data` by
+// MarshalIndex() or MarshalPdfIndex().
+// Nothing is unpacked. Searches read the bleve index, page texts and text positions directly from
+// `data`, so `data` must not be modified while the returned index is in use.
+// The PDFs in the returned index are read from their paths when search results are marked up.
+func LoadIndexFromBytes(data []byte) (*BlevePdf, bleve.Index, error) {
+	pdfIndex, indexData, err := serial.ReadPdfIndex(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	blevePdf, err := openBlevePdf("", nil, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Documents are identified in the bleve index by their index in fdList, so fdList is rebuilt
+	// with the same indexes. Gaps are filled with deleted entries.
+	blevePdf.fdList = make([]fileDesc, pdfIndex.NumFiles())
+	for i := range blevePdf.fdList {
+		blevePdf.fdList[i].Deleted = true
+	}
+	for i := 0; i < pdfIndex.HipdLength(); i++ {
+		var hipd pdf_index.HashIndexPathDoc
+		if !pdfIndex.Hipd(&hipd, i) {
+			return nil, nil, fmt.Errorf("No PDF %d in serialized index", i)
+		}
+		docIdx := hipd.Index()
+		if docIdx >= uint64(len(blevePdf.fdList)) {
+			return nil, nil, fmt.Errorf("Bad docIdx=%d. %d files", docIdx, len(blevePdf.fdList))
+		}
+		flat := hipd.Doc(nil)
+		if flat == nil {
+			return nil, nil, fmt.Errorf("No pages for docIdx=%d in serialized index", docIdx)
+		}
+		outline, err := serial.ReadOutline(&hipd)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Bad outline for docIdx=%d in serialized index. err=%v",
+				docIdx, err)
+		}
+		fd := fileDesc{
+			InPath: string(hipd.Path()),
+			Hash:   string(hipd.Hash()),
+			Parent: string(hipd.Parent()),
+		}
+		for _, e := range outline {
+			fd.Outline = append(fd.Outline, outlineEntry{
+				Title: e.Title,
+				Level: int(e.Level),
+				Page:  e.Page,
+				Top:   e.Top,
+			})
+		}
+		fd.setFormat()
+		blevePdf.fdList[docIdx] = fd
+		blevePdf.hashIndex[fd.Hash] = docIdx
+		blevePdf.indexHash[docIdx] = fd.Hash
+		blevePdf.hashDoc[fd.Hash] = &DocPositions{
+			inPath:        fd.InPath,
+			docIdx:        docIdx,
+			pagePositions: map[uint32]PagePositions{},
+			flat:          flat,
+		}
+	}
+
+	index, err := ImportBleveMem(indexData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not load bleve index. err=%v", err)
+	}
+	common.Log.Debug("LoadIndexFromBytes: %d bytes blevePdf=%s", len(data), blevePdf)
+	return blevePdf, index, nil
+}
+
+// readPageContents returns the page numbers, texts and text positions of all the pages in `docPos`.
+func (docPos *DocPositions) readPageContents() ([]pageContents, error) {
+	n := docPos.numPages()
+	docContents := make([]pageContents, n)
+	for i := 0; i < n; i++ {
+		pageIdx := uint32(i)
+		pageNum, ppos, err := docPos.pageNumPositions(pageIdx)
+		if err != nil {
+			return nil, err
+		}
+		text, err := docPos.pageText(pageIdx)
+		if err != nil {
+			return nil, err
+		}
+		docContents[i] = pageContents{pageNum: pageNum, ppos: ppos, text: text}
+	}
+	return docContents, nil
+}
+
+// makeDocEntry returns the serializable description of the PDF `fd` with document index `docIdx`
+// and pages `docContents`.
+func makeDocEntry(fd fileDesc, docIdx uint64, docContents []pageContents) serial.DocEntry {
+	doc := serial.DocEntry{
+		Hash:   fd.Hash,
+		DocIdx: docIdx,
+		Path:   fd.InPath,
+		Parent: fd.Parent,
+	}
+	for _, e := range fd.Outline {
+		doc.Outline = append(doc.Outline, serial.OutlineEntry{
+			Title: e.Title,
+			Level: int32(e.Level),
+			Page:  e.Page,
+			Top:   e.Top,
+		})
+	}
+	for _, page := range docContents {
+		doc.PageNums = append(doc.PageNums, page.pageNum)
+		doc.PageTexts = append(doc.PageTexts, page.text)
+		doc.PagePositions = append(doc.PagePositions, page.ppos.offsetBBoxes)
+	}
+	return doc
+}
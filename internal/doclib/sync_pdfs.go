@@ -0,0 +1,231 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements SyncPdfFiles() which reconciles an index with a list of files.
+ */
+
+package doclib
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/unidoc/unipdf/v3/common"
+)
+
+// SyncResult summarizes the changes that SyncPdfFiles() made to an index.
+type SyncResult struct {
+	NumAdded     int // Number of PDFs added to the index. This includes re-indexed PDFs.
+	NumRemoved   int // Number of PDFs removed from the index because they are no longer on disk.
+	NumUpdated   int // Number of PDFs whose contents changed and were re-indexed.
+	NumMoved     int // Number of PDFs that were moved or renamed. Only their paths were updated.
+	NumUnchanged int // Number of PDFs that were already in the index.
+	NumFailed    int // Number of PDFs that could not be indexed.
+	NumEmpty     int // Number of PDFs that were not indexed because they have no text.
+}
+
+// String returns a human readable description of `r`.
+func (r SyncResult) String() string {
+	return fmt.Sprintf("{SyncResult: added=%d removed=%d updated=%d moved=%d unchanged=%d "+
+		"failed=%d empty=%d}", r.NumAdded, r.NumRemoved, r.NumUpdated, r.NumMoved, r.NumUnchanged,
+		r.NumFailed, r.NumEmpty)
+}
+
+// SyncPdfFiles updates the on-disk index in `persistDir` so that it contains the PDFs in
+// `pathList` and no others. The index is created if it doesn't exist.
+//  - PDFs in `pathList` that aren't in the index are added.
+//  - PDFs in the index that aren't in `pathList` are removed.
+//  - PDFs whose contents have changed since they were indexed are re-indexed.
+//  - PDFs that have been moved have their paths updated without being re-indexed.
+//  - PDFs embedded in other PDFs and PDFs in ZIP archives are removed, re-indexed or moved with
+//    the files that hold them.
+// PDFs are matched to index entries by their contents hashes.
+// `report` is a supplied function that is called to report progress.
+func SyncPdfFiles(persistDir string, pathList []string, report func(string)) (SyncResult, error) {
+	return SyncPdfFilesContext(context.Background(), persistDir, pathList,
+		IndexOptions{OnEvent: ReportEvents(report)}, report)
+}
+
+// SyncPdfFilesContext is SyncPdfFiles() with a context `ctx` that can cancel the indexing of the
+// new and changed PDFs and options `opts` for indexing them. See IndexPdfFilesContext().
+// `report` is called to report the PDFs that are moved and removed. `opts`.OnEvent is called to
+// report the PDFs that are indexed.
+func SyncPdfFilesContext(ctx context.Context, persistDir string, pathList []string,
+	opts IndexOptions, report func(string)) (SyncResult, error) {
+	var result SyncResult
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	blevePdf, err := openBlevePdf(persistDir, opts.Store, false)
+	if err != nil {
+		return result, fmt.Errorf("Could not open positions store %q. err=%v", persistDir, err)
+	}
+	indexPath := filepath.Join(persistDir, "bleve")
+	index, err := createBleveDiskIndex(indexPath, false, blevePdf.analysis)
+	if err != nil {
+		return result, fmt.Errorf("Could not open Bleve index %q. err=%v", indexPath, err)
+	}
+
+	// Live index entries by path. PDFs held in other files, i.e. PDFs embedded in PDFs and PDFs in
+	// ZIP archives, are kept separately by the paths of the files that hold them.
+	pathIndex := map[string]uint64{}
+	held := map[string][]uint64{} // {root path: index entries of the PDFs held in it}
+	rootHashes := map[string]bool{}
+	for i, fd := range blevePdf.fdList {
+		switch {
+		case fd.Deleted:
+		case fd.Parent != "":
+			root := rootPath(fd.InPath)
+			held[root] = append(held[root], uint64(i))
+			rootHashes[fd.RootHash] = true
+		default:
+			pathIndex[fd.InPath] = uint64(i)
+		}
+	}
+
+	var diskFds []fileDesc
+	onDisk := map[string]bool{}
+	diskHash := map[string]string{} // {path: contents hash}
+	diskPath := map[string]string{} // {contents hash: path}
+	for _, inPath := range pathList {
+		fd, err := createFileDesc(inPath)
+		if err != nil {
+			common.Log.Error("SyncPdfFiles: Couldn't read %q. err=%v", inPath, err)
+			result.NumFailed++
+			continue
+		}
+		diskFds = append(diskFds, fd)
+		onDisk[inPath] = true
+		diskHash[inPath] = fd.Hash
+		if _, ok := diskPath[fd.Hash]; !ok {
+			diskPath[fd.Hash] = inPath
+		}
+	}
+
+	// stale is the set of index entries that no longer describe the file at their path, either
+	// because the file is gone or because its contents have changed. Stale entries are either
+	// moved to the new path of their contents or removed.
+	stale := map[uint64]bool{}
+	for inPath, docIdx := range pathIndex {
+		if !onDisk[inPath] {
+			stale[docIdx] = true
+		}
+	}
+	var newFds []fileDesc
+	for _, fd := range diskFds {
+		docIdx, ok := pathIndex[fd.InPath]
+		if !ok {
+			// ZIP archives and PDFs with no text of their own are only in the index through the
+			// PDFs they hold. These are handled below.
+			if _, indexed := blevePdf.hashIndex[fd.Hash]; !indexed && rootHashes[fd.Hash] {
+				continue
+			}
+			newFds = append(newFds, fd)
+			continue
+		}
+		if blevePdf.fdList[docIdx].Hash == fd.Hash {
+			result.NumUnchanged++
+			continue
+		}
+		stale[docIdx] = true
+		result.NumUpdated++
+		newFds = append(newFds, fd)
+	}
+
+	// Match the new contents to stale entries.
+	moved := map[uint64]string{} // {docIdx: new path}
+	var addList []string
+	for _, fd := range newFds {
+		docIdx, ok := blevePdf.hashIndex[fd.Hash]
+		switch {
+		case !ok:
+			addList = append(addList, fd.InPath)
+		case stale[docIdx] && moved[docIdx] == "":
+			moved[docIdx] = fd.InPath
+		default:
+			// A copy of a PDF that is already indexed. The index only holds one copy.
+			common.Log.Debug("SyncPdfFiles: %q is a copy of %q.", fd.InPath,
+				blevePdf.fdList[docIdx].InPath)
+			if _, ok := pathIndex[fd.InPath]; !ok {
+				result.NumUnchanged++
+			}
+		}
+	}
+
+	// PDFs held in other files follow those files. They are unchanged if the file at their root
+	// path has the contents they were indexed from, moved if those contents are at another path and
+	// removed otherwise. Changed files are re-indexed with the PDFs they hold.
+	for root, docIdxs := range held {
+		for _, docIdx := range docIdxs {
+			fd := blevePdf.fdList[docIdx]
+			if diskHash[root] == fd.RootHash {
+				continue
+			}
+			stale[docIdx] = true
+			if newRoot, ok := diskPath[fd.RootHash]; ok {
+				moved[docIdx] = newRoot + strings.TrimPrefix(fd.InPath, root)
+			}
+		}
+	}
+
+	for docIdx := range stale {
+		fd := &blevePdf.fdList[docIdx]
+		if newPath, ok := moved[docIdx]; ok {
+			common.Log.Debug("SyncPdfFiles: Moved %q to %q.", fd.InPath, newPath)
+			if report != nil {
+				report(fmt.Sprintf("moved %q to %q", fd.InPath, newPath))
+			}
+			if _, ok := pathIndex[newPath]; !ok {
+				result.NumMoved++
+			}
+			fd.InPath = newPath
+			if fd.Parent != "" {
+				fd.Parent = parentPath(newPath)
+			}
+			continue
+		}
+		inPath, root := fd.InPath, fd.InPath
+		if fd.Parent != "" {
+			root = rootPath(inPath)
+		}
+		if err := blevePdf.removeDoc(index, docIdx); err != nil {
+			index.Close()
+			blevePdf.flush()
+			return result, err
+		}
+		if !onDisk[root] {
+			result.NumRemoved++
+			if report != nil {
+				report(fmt.Sprintf("removed %q", inPath))
+			}
+		}
+	}
+
+	if err := blevePdf.flush(); err != nil {
+		index.Close()
+		return result, err
+	}
+	if err := index.Close(); err != nil {
+		return result, err
+	}
+	common.Log.Info("SyncPdfFiles: %d PDFs to add.", len(addList))
+	if len(addList) == 0 {
+		return result, nil
+	}
+
+	_, index, indexResult, err := IndexPdfFilesContext(ctx, addList, persistDir, false, opts)
+	if index != nil {
+		index.Close()
+	}
+	if err != nil {
+		return result, err
+	}
+	result.NumAdded = indexResult.NumAdded
+	result.NumFailed += indexResult.NumFailed
+	result.NumEmpty = indexResult.NumEmpty
+	common.Log.Info("SyncPdfFiles: %s", result)
+	return result, nil
+}
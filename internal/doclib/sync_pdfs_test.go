@@ -0,0 +1,82 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSyncPdfFiles checks that SyncPdfFiles adds new PDFs, removes deleted PDFs, re-indexes changed
+// PDFs and updates the paths of moved PDFs without re-indexing them.
+func TestSyncPdfFiles(t *testing.T) {
+	dir := t.TempDir()
+	// writePdf writes a PDF whose pages contain `texts` to `name` in `dir`.
+	writePdf := func(name string, texts ...string) string {
+		inPath := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(inPath), 0777); err != nil {
+			t.Fatalf("MkdirAll failed. err=%v", err)
+		}
+		writeTestPdf(t, inPath, len(texts), drawTexts(texts...))
+		return inPath
+	}
+	persistDir := filepath.Join(dir, "store")
+	sync := func(pathList []string) SyncResult {
+		t.Helper()
+		result, err := SyncPdfFiles(persistDir, pathList, nil)
+		if err != nil {
+			t.Fatalf("SyncPdfFiles failed. err=%v", err)
+		}
+		return result
+	}
+
+	applePath := writePdf("apple.pdf", "apple")
+	bananaPath := writePdf("banana.pdf", "banana", "yellow")
+	cherryPath := writePdf("cherry.pdf", "cherry", "red", "stone")
+	result := sync([]string{applePath, bananaPath, cherryPath})
+	if result != (SyncResult{NumAdded: 3}) {
+		t.Fatalf("First sync: %s", result)
+	}
+	checkSearchPaths(t, persistDir, "cherry", []string{cherryPath})
+
+	// Delete cherry.pdf, change banana.pdf, move apple.pdf and add date.pdf.
+	if err := os.Remove(cherryPath); err != nil {
+		t.Fatalf("Remove failed. err=%v", err)
+	}
+	writePdf("banana.pdf", "banana", "green", "unripe", "peel")
+	movedPath := filepath.Join(dir, "fruit", "apple.pdf")
+	if err := os.MkdirAll(filepath.Dir(movedPath), 0777); err != nil {
+		t.Fatalf("MkdirAll failed. err=%v", err)
+	}
+	if err := os.Rename(applePath, movedPath); err != nil {
+		t.Fatalf("Rename failed. err=%v", err)
+	}
+	datePath := writePdf("date.pdf", "date")
+	pathList := []string{movedPath, bananaPath, datePath}
+	result = sync(pathList)
+	expected := SyncResult{NumAdded: 2, NumRemoved: 1, NumUpdated: 1, NumMoved: 1}
+	if result != expected {
+		t.Fatalf("Second sync: %s. Expected %s", result, expected)
+	}
+	checkSearchPaths(t, persistDir, "apple", []string{movedPath})
+	checkSearchPaths(t, persistDir, "cherry", nil)
+	checkSearchPaths(t, persistDir, "yellow", nil)
+	checkSearchPaths(t, persistDir, "unripe", []string{bananaPath})
+	checkSearchPaths(t, persistDir, "date", []string{datePath})
+
+	// Nothing changes when the files haven't changed.
+	result = sync(pathList)
+	if result != (SyncResult{NumUnchanged: 3}) {
+		t.Fatalf("Third sync: %s", result)
+	}
+
+	// A cancelled context stops the sync before the index is changed.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := SyncPdfFilesContext(ctx, persistDir, nil, IndexOptions{}, nil); err != context.Canceled {
+		t.Fatalf("SyncPdfFilesContext returned err=%v. Expected %v", err, context.Canceled)
+	}
+	checkSearchPaths(t, persistDir, "apple", []string{movedPath})
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/unidoc/unipdf/v3/creator"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// pageDecorator adds the content of page `pageNum` (1-offset) of a PDF made by makeTestPdf().
+// `page` is the page that `c` is drawing on.
+type pageDecorator func(c *creator.Creator, page *model.PdfPage, pageNum int) error
+
+// makeTestPdf returns the contents of a PDF with `numPages` US Letter pages. `decorate`, if it is
+// not nil, is called for each page after the page is added.
+func makeTestPdf(t *testing.T, numPages int, decorate pageDecorator) []byte {
+	t.Helper()
+	c := creator.New()
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		page := c.NewPage()
+		if decorate == nil {
+			continue
+		}
+		if err := decorate(c, page, pageNum); err != nil {
+			t.Fatalf("Could not decorate page %d. err=%v", pageNum, err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := c.Write(&buf); err != nil {
+		t.Fatalf("Write failed. err=%v", err)
+	}
+	return buf.Bytes()
+}
+
+// writeTestPdf writes the PDF made by makeTestPdf(`t`, `numPages`, `decorate`) to `outPath`.
+func writeTestPdf(t *testing.T, outPath string, numPages int, decorate pageDecorator) {
+	t.Helper()
+	if err := ioutil.WriteFile(outPath, makeTestPdf(t, numPages, decorate), 0644); err != nil {
+		t.Fatalf("WriteFile failed. err=%v", err)
+	}
+}
+
+// drawTexts returns a pageDecorator that draws `texts`[i] on page i+1. Pages without an entry in
+// `texts`, and pages whose entry is "", are left blank.
+func drawTexts(texts ...string) pageDecorator {
+	return func(c *creator.Creator, page *model.PdfPage, pageNum int) error {
+		if pageNum > len(texts) || texts[pageNum-1] == "" {
+			return nil
+		}
+		return c.Draw(c.NewParagraph(texts[pageNum-1]))
+	}
+}
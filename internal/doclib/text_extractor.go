@@ -0,0 +1,63 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the interface between the indexing code and the code that extracts
+ * text from PDF pages.
+ *  - PageTextExtractor is implemented by text extractors. UniDocExtractor is the default.
+ *  - PagePositionsFromMarks() converts the TextMarks that a PageTextExtractor returns to the
+ *    PagePositions that are stored in the index.
+ */
+
+package doclib
+
+import (
+	"io"
+
+	"github.com/papercutsoftware/pdfsearch/internal/serial"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// PageTextExtractor extracts the text of PDF pages and the locations of the text on the pages.
+type PageTextExtractor interface {
+	// ExtractPageText returns the text of (1-offset) page `pageNum` of PDF `inPath`, and the
+	// locations of the fragments of the text on the page. The contents of the PDF are read from
+	// `pdf`, which may be positioned anywhere. `inPath` need not exist on disk. e.g. It may be the
+	// path of a PDF in an archive. The TextMarks must be in offset order.
+	// A page with no text returns an empty string and no error.
+	ExtractPageText(inPath string, pdf io.ReadSeeker, pageNum uint32) (string, []TextMark, error)
+}
+
+// TextMark is the location of a fragment of the text extracted from a PDF page.
+// The fragment runs from Offset to the Offset of the next TextMark. Fragments that have no location
+// on the page, such as the spaces and newlines that separate words, may have an empty BBox.
+type TextMark struct {
+	Offset uint32             // Byte offset of the fragment in the extracted page text.
+	BBox   model.PdfRectangle // Bounding box of the fragment on the page in PDF coordinates.
+}
+
+// isUniDocExtractor returns true if `extractor` is nil or UniDocExtractor, the default
+// PageTextExtractor. Its text is extracted from the UniDoc pages the indexer has already opened
+// rather than by re-reading the PDF for each page.
+func isUniDocExtractor(extractor PageTextExtractor) bool {
+	if extractor == nil {
+		return true
+	}
+	_, ok := extractor.(UniDocExtractor)
+	return ok
+}
+
+// PagePositionsFromMarks converts `marks` to a more compact PagePositions.
+func PagePositionsFromMarks(marks []TextMark) PagePositions {
+	var ppos PagePositions
+	for _, m := range marks {
+		b := m.BBox
+		ppos.offsetBBoxes = append(ppos.offsetBBoxes, serial.OffsetBBox{
+			Offset: m.Offset,
+			Llx:    float32(b.Llx),
+			Lly:    float32(b.Lly),
+			Urx:    float32(b.Urx),
+			Ury:    float32(b.Ury),
+		})
+	}
+	return ppos
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// fakePageExtractor is a PageTextExtractor that returns made up text. It is a {pageNum: text} map.
+// Pages that aren't in the map have no text. Each word in the text is on its own line.
+// It checks that it is given the contents of a PDF.
+type fakePageExtractor map[uint32]string
+
+func (e fakePageExtractor) ExtractPageText(inPath string, pdf io.ReadSeeker, pageNum uint32) (
+	string, []TextMark, error) {
+	header := make([]byte, 5)
+	if _, err := pdf.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	if _, err := io.ReadFull(pdf, header); err != nil || string(header) != "%PDF-" {
+		return "", nil, errors.New("not given the contents of a PDF")
+	}
+	words := strings.Fields(e[pageNum])
+	var sb strings.Builder
+	var marks []TextMark
+	for i, word := range words {
+		marks = append(marks, TextMark{Offset: uint32(sb.Len()), BBox: fakeWordBBox(i)})
+		sb.WriteString(word)
+		marks = append(marks, TextMark{Offset: uint32(sb.Len())})
+		sb.WriteString("\n")
+	}
+	if len(words) > 0 {
+		marks = append(marks, TextMark{Offset: uint32(sb.Len())})
+	}
+	return sb.String(), marks, nil
+}
+
+// fakeWordBBox returns the bounding box of the `i`th word on a page in fakePageExtractor.
+func fakeWordBBox(i int) model.PdfRectangle {
+	y := float64(700 - 20*i)
+	return model.PdfRectangle{Llx: 72, Lly: y, Urx: 172, Ury: y + 12}
+}
+
+// TestPageTextExtractor checks that PDFs are indexed with the text and text positions returned
+// by IndexOptions.Extractor and that searches find the text at those positions.
+func TestPageTextExtractor(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "fake.pdf")
+	makeBlankPagePdf(t, inPath, "This text is not indexed")
+	extractor := fakePageExtractor{1: "quick brown fox", 2: "lazy purple dog"}
+
+	persistDir := filepath.Join(dir, "store")
+	opts := IndexOptions{Extractor: extractor}
+	blevePdf, index, result, err := IndexPdfFilesContext(context.Background(), []string{inPath},
+		persistDir, true, opts)
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	defer index.Close()
+	if result.NumAdded != 1 || result.NumPages != 2 {
+		t.Fatalf("Unexpected result %s", result)
+	}
+
+	matches, err := blevePdf.SearchBleveIndex(index, "purple", 10)
+	if err != nil {
+		t.Fatalf("SearchBleveIndex failed. err=%v", err)
+	}
+	if len(matches.Matches) != 1 {
+		t.Fatalf("%d matches. Expected 1. matches=%s", len(matches.Matches), matches)
+	}
+	m := matches.Matches[0]
+	if m.PageNum != 2 || len(m.Spans) != 1 {
+		t.Fatalf("Unexpected match %s", m)
+	}
+	bbox, ok := m.PagePositions.BBox(m.Spans[0].Start, m.Spans[0].End)
+	if expected := fakeWordBBox(1); !ok || bbox != expected {
+		t.Fatalf("bbox=%+v ok=%t. Expected %+v", bbox, ok, expected)
+	}
+
+	matches, err = blevePdf.SearchBleveIndex(index, "indexed", 10)
+	if err != nil {
+		t.Fatalf("SearchBleveIndex failed. err=%v", err)
+	}
+	if len(matches.Matches) != 0 {
+		t.Fatalf("Text from the PDF was indexed. matches=%s", matches)
+	}
+}
@@ -3,10 +3,12 @@
 package doclib
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 
 	"github.com/unidoc/unipdf/v3/common"
@@ -92,7 +94,18 @@ func PdfOpenFileLazy(inPath string) (*os.File, *model.PdfReader, error) {
 
 // PdfOpenReader opens the PDF accessed by `rs` and attempts to handle null encryption schemes.
 // If `lazy` is true, a lazy PDF reader is opened.
+// Returns ErrEncrypted if the PDF is encrypted with a password.
 func PdfOpenReader(rs io.ReadSeeker, lazy bool) (*model.PdfReader, error) {
+	return PdfOpenReaderPasswords(rs, lazy, "", nil)
+}
+
+// PdfOpenReaderPasswords opens the PDF `inPath` accessed by `rs`. If the PDF is encrypted, it
+// tries to decrypt it with the empty password then with each of the passwords supplied by
+// `passwords`, which may be nil.
+// If `lazy` is true, a lazy PDF reader is opened.
+// Returns ErrEncrypted if none of the passwords decrypt the PDF.
+func PdfOpenReaderPasswords(rs io.ReadSeeker, lazy bool, inPath string,
+	passwords PasswordProvider) (*model.PdfReader, error) {
 	var pdfReader *model.PdfReader
 	var err error
 	if lazy {
@@ -108,8 +121,7 @@ func PdfOpenReader(rs io.ReadSeeker, lazy bool) (*model.PdfReader, error) {
 		return nil, err
 	}
 	if isEncrypted {
-		_, err = pdfReader.Decrypt([]byte(""))
-		if err != nil {
+		if err := decryptPdf(pdfReader, inPath, passwords); err != nil {
 			return nil, err
 		}
 	}
@@ -138,22 +150,63 @@ func ExtractPageTextMarks(page *model.PdfPage) (string, *extractor.TextMarkArray
 	return pageText.Text(), pageText.Marks(), nil
 }
 
+// UniDocExtractor is a PageTextExtractor that extracts text with UniDoc's extractor package. It is
+// the default PageTextExtractor.
+// Without a UniDoc license key, the extracted text is truncated and a watermark added to it.
+type UniDocExtractor struct{}
+
+// ExtractPageText returns the text of page `pageNum` of the PDF read from `pdf` and the
+// locations of the text on the page. Encrypted PDFs can only be read if they have no password.
+func (UniDocExtractor) ExtractPageText(inPath string, pdf io.ReadSeeker, pageNum uint32) (string,
+	[]TextMark, error) {
+	if _, err := pdf.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	pdfReader, err := PdfOpenReader(pdf, true)
+	if err != nil {
+		return "", nil, err
+	}
+	page, err := pdfReader.GetPage(int(pageNum))
+	if err != nil {
+		return "", nil, err
+	}
+	return uniDocPageText(page)
+}
+
+// uniDocPageText returns the text of `page` and the locations of the text on the page.
+func uniDocPageText(page *model.PdfPage) (string, []TextMark, error) {
+	text, textMarks, err := ExtractPageTextMarks(page)
+	if err != nil {
+		return "", nil, err
+	}
+	elements := textMarks.Elements()
+	marks := make([]TextMark, len(elements))
+	for i, m := range elements {
+		marks[i] = TextMark{Offset: uint32(m.Offset), BBox: m.BBox}
+	}
+	return text, marks, nil
+}
+
 // PDFPageProcessor is used for processing a PDF one page at a time.
 // It is an opaque struct.
 type PDFPageProcessor struct {
 	inPath    string
 	pdfFile   *os.File
 	pdfReader *model.PdfReader
+	rs        io.ReadSeeker // The contents of the PDF.
+	data      []byte        // Copy of the contents of the PDF for contents(). Read as needed.
 }
 
 // CreatePDFPageProcessorFile creates a PDFPageProcessor for reading the PDF `inPath`.
-func CreatePDFPageProcessorFile(inPath string) (*PDFPageProcessor, error) {
+// Encrypted PDFs are decrypted with the passwords supplied by `passwords`, which may be nil.
+func CreatePDFPageProcessorFile(inPath string, passwords PasswordProvider) (*PDFPageProcessor,
+	error) {
 	f, err := os.Open(inPath)
 	if err != nil {
 		common.Log.Error("CreatePDFPageProcessorFile: Could not open inPath=%q. err=%v", inPath, err)
 		return nil, err
 	}
-	processor, err := CreatePDFPageProcessorReader(inPath, f)
+	processor, err := CreatePDFPageProcessorReader(inPath, f, passwords)
 	if err != nil {
 		f.Close()
 		return nil, err
@@ -164,11 +217,14 @@ func CreatePDFPageProcessorFile(inPath string) (*PDFPageProcessor, error) {
 
 // CreatePDFPageProcessorReader creates a PDFPageProcessor for reading the PDF referenced by
 // `rs`.
-// `inPath` is provided for logging only. It is expected to be the path referenced by `rs`.
-func CreatePDFPageProcessorReader(inPath string, rs io.ReadSeeker) (*PDFPageProcessor, error) {
-	processor := PDFPageProcessor{inPath: inPath}
+// `inPath` is provided for logging and password lookup only. It is expected to be the path
+// referenced by `rs`.
+// Encrypted PDFs are decrypted with the passwords supplied by `passwords`, which may be nil.
+func CreatePDFPageProcessorReader(inPath string, rs io.ReadSeeker, passwords PasswordProvider) (
+	*PDFPageProcessor, error) {
+	processor := PDFPageProcessor{inPath: inPath, rs: rs}
 	var err error
-	processor.pdfReader, err = PdfOpenReader(rs, true)
+	processor.pdfReader, err = PdfOpenReaderPasswords(rs, true, inPath, passwords)
 	if err != nil {
 		common.Log.Debug("CreatePDFPageProcessor: PdfOpenReader failed. inPath=%q. err=%v",
 			inPath, err)
@@ -187,12 +243,99 @@ func (p *PDFPageProcessor) Close() error {
 	return err
 }
 
+// contents returns a reader of the contents of the PDF referenced by `p` for PageTextExtractors.
+// It has its own read offset so that reading it doesn't disturb p.pdfReader.
+func (p *PDFPageProcessor) contents() (io.ReadSeeker, error) {
+	if ra, ok := p.rs.(io.ReaderAt); ok {
+		switch rs := p.rs.(type) {
+		case *os.File:
+			fi, err := rs.Stat()
+			if err != nil {
+				return nil, err
+			}
+			return io.NewSectionReader(ra, 0, fi.Size()), nil
+		case interface{ Size() int64 }:
+			return io.NewSectionReader(ra, 0, rs.Size()), nil
+		}
+	}
+	if p.data == nil {
+		if _, err := p.rs.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(p.rs)
+		if err != nil {
+			return nil, err
+		}
+		p.data = data
+	}
+	return bytes.NewReader(p.data), nil
+}
+
+// extractPageText returns the text of `page`, which is page `pageNum` of the PDF referenced by
+// `p`, and the locations of the text on the page as extracted by `extractor`.
+func (p *PDFPageProcessor) extractPageText(extractor PageTextExtractor, pageNum uint32,
+	page *model.PdfPage) (string, []TextMark, error) {
+	if isUniDocExtractor(extractor) {
+		return uniDocPageText(page)
+	}
+	pdf, err := p.contents()
+	if err != nil {
+		return "", nil, err
+	}
+	return extractor.ExtractPageText(p.inPath, pdf, pageNum)
+}
+
 // NumPages return the number of pages in the PDF referenced by `p`.
 func (p PDFPageProcessor) NumPages() (uint32, error) {
 	numPages, err := p.pdfReader.GetNumPages()
 	return uint32(numPages), err
 }
 
+// Metadata returns the metadata of the PDF referenced by `p` or nil if it has none.
+// Metadata is not essential, so it is also nil if the metadata can't be read.
+func (p PDFPageProcessor) Metadata() (meta *DocMetadata) {
+	if !ExposeErrors {
+		defer func() {
+			if r := recover(); r != nil {
+				common.Log.Error("Recovering from a panic reading metadata!!!: %q r=%#v", p.inPath, r)
+				meta = nil
+			}
+		}()
+	}
+	return pdfMetadata(p.pdfReader)
+}
+
+// Outline returns the outline (bookmarks) of the PDF referenced by `p` or nil if it has none.
+// Like the metadata, the outline is not essential, so it is also nil if it can't be read.
+func (p PDFPageProcessor) Outline() (outline []outlineEntry) {
+	if !ExposeErrors {
+		defer func() {
+			if r := recover(); r != nil {
+				common.Log.Error("Recovering from a panic reading outline!!!: %q r=%#v", p.inPath, r)
+				outline = nil
+			}
+		}()
+	}
+	return pdfOutline(p.pdfReader)
+}
+
+// EmbeddedFiles returns the files embedded in the PDF referenced by `p`, including the files in PDF
+// portfolios. Files larger than `maxSizeMB` megabytes are skipped without being decoded. 0 means
+// no limit. Like the outline, embedded files are not essential, so it returns nil if they can't
+// be read.
+func (p PDFPageProcessor) EmbeddedFiles(maxSizeMB float64) (files []embeddedFile) {
+	if !ExposeErrors {
+		defer func() {
+			if r := recover(); r != nil {
+				common.Log.Error("Recovering from a panic reading embedded files!!!: %q r=%#v",
+					p.inPath, r)
+				files = nil
+			}
+		}()
+	}
+	return embeddedFiles(p.pdfReader, maxSizeMB)
+}
+
 // Process runs `processPage` on every page in PDF `p.inPath`.
 // It can recover from errors in the libraries it calls if `ExposeErrors` is false.
 func (p *PDFPageProcessor) Process(processPage func(pageNum uint32, page *model.PdfPage) error) (
@@ -217,7 +360,7 @@ func (p *PDFPageProcessor) Process(processPage func(pageNum uint32, page *model.
 // ProcessPDFPagesFile runs `processPage` on every page in PDF`inPath`.
 // It is a convenience function.
 func ProcessPDFPagesFile(inPath string, processPage func(pageNum uint32, page *model.PdfPage) error) error {
-	p, err := CreatePDFPageProcessorFile(inPath)
+	p, err := CreatePDFPageProcessorFile(inPath, nil)
 	if err != nil {
 		return err
 	}
@@ -230,7 +373,7 @@ func ProcessPDFPagesFile(inPath string, processPage func(pageNum uint32, page *m
 func ProcessPDFPagesReader(inPath string, rs io.ReadSeeker,
 	processPage func(pageNum uint32, page *model.PdfPage) error) error {
 
-	p, err := CreatePDFPageProcessorReader(inPath, rs)
+	p, err := CreatePDFPageProcessorReader(inPath, rs, nil)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,262 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the limits on the resources used to extract the text of a PDF.
+ *  - ExtractLimits describes the limits.
+ *  - extractWithLimits() extracts the text of a PDF under a watchdog that abandons the PDF if it
+ *    takes too long. extractLimited() does the same with a supplied docExtractor. The PDFs
+ *    embedded in the PDF are read by the same extraction, so they are under the watchdog too.
+ *
+ * Go has no way of stopping a goroutine, so an abandoned extraction keeps running in the
+ * background until it next starts a page. It then sees that it has been abandoned and stops.
+ * The worker that started it moves on to the next PDF as soon as the PDF is abandoned, unless
+ * maxAbandoned abandoned extractions of the same indexing run are still running. It then waits for
+ * one of them to finish so that stuck extractions can't pile up without limit.
+ */
+
+package doclib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/unidoc/unipdf/v3/common"
+)
+
+// ExtractLimits limits the resources used to extract the text of each PDF. PDFs that exceed a
+// limit are abandoned and reported as failed. Zero fields mean no limit.
+// An abandoned extraction can't be stopped while it is working on a page, so the CPU and memory it
+// uses are not reclaimed until that page returns. The extraction stops when it starts its next
+// page. A run of IndexPdfFilesContext() waits for abandoned extractions to finish when there are
+// more than a few of them.
+type ExtractLimits struct {
+	FileTimeout   time.Duration // Maximum time to extract the text of a PDF.
+	PageTimeout   time.Duration // Maximum time to extract the text of a page.
+	MaxFileSizeMB float64       // Maximum size of a PDF in megabytes.
+	MaxPages      int           // Maximum number of pages in a PDF.
+}
+
+// String returns a human readable description of `l`.
+func (l ExtractLimits) String() string {
+	return fmt.Sprintf("{ExtractLimits: file=%s page=%s size=%.1f MB pages=%d}",
+		l.FileTimeout, l.PageTimeout, l.MaxFileSizeMB, l.MaxPages)
+}
+
+// timed returns true if `l` has time limits.
+func (l ExtractLimits) timed() bool {
+	return l.FileTimeout > 0 || l.PageTimeout > 0
+}
+
+// docExtractor is the signature of the functions that extract the text of a PDF. See
+// extractDocContents().
+type docExtractor func(fd fileDesc, opts extractOptions, watch *extractWatch) (
+	[]pageContents, []IndexFailure, error)
+
+// extractDoc extracts the text of the PDFs in IndexPdfFiles(). Tests replace it with fake
+// extractors.
+var extractDoc docExtractor = extractDocContents
+
+// maxAbandoned is the maximum number of abandoned extractions of an indexing run that may still be
+// running.
+const maxAbandoned = 4
+
+// newAbandonedSlots returns a channel with a slot for each abandoned extraction of an indexing run
+// that may still be running. See IndexOptions.abandoned.
+func newAbandonedSlots() chan struct{} {
+	return make(chan struct{}, maxAbandoned)
+}
+
+// errAbandoned is returned by extractWatch.startPage() when the watchdog has abandoned the
+// extraction.
+var errAbandoned = errors.New("extraction abandoned")
+
+// extractWatch tracks the progress of the extraction of the text of a PDF so that a watchdog can
+// see which page it is on and how long it has been working on that page. It also holds the PDFs
+// embedded in the PDF that the extraction found.
+type extractWatch struct {
+	mu        sync.Mutex
+	start     time.Time // When the extraction started.
+	pageNum   uint32    // 1-offset number of the page being extracted. 0 before the first page.
+	pageStart time.Time // When the extraction of page `pageNum` started.
+	abandoned bool      // The watchdog has abandoned the extraction.
+	finished  bool      // The extraction has returned.
+	// The IndexOptions.abandoned channel that the abandoned extraction holds a slot in. nil if none.
+	slots    chan struct{}
+	embedded []embeddedDoc // The PDFs embedded in the PDF. See setEmbedded().
+}
+
+// newExtractWatch returns an extractWatch for an extraction that is starting now.
+func newExtractWatch() *extractWatch {
+	now := time.Now()
+	return &extractWatch{start: now, pageStart: now}
+}
+
+// startPage is called by extractors when they start extracting page `pageNum`. It returns
+// errAbandoned if the extraction has been abandoned, in which case the extractor should stop.
+// A nil `watch` is valid and does nothing.
+func (watch *extractWatch) startPage(pageNum uint32) error {
+	if watch == nil {
+		return nil
+	}
+	watch.mu.Lock()
+	defer watch.mu.Unlock()
+	if watch.abandoned {
+		return errAbandoned
+	}
+	watch.pageNum = pageNum
+	watch.pageStart = time.Now()
+	return nil
+}
+
+// setEmbedded is called by extractors with the PDFs `docs` that are embedded in the PDF they are
+// extracting. A nil `watch` is valid and does nothing.
+func (watch *extractWatch) setEmbedded(docs []embeddedDoc) {
+	if watch == nil {
+		return
+	}
+	watch.mu.Lock()
+	defer watch.mu.Unlock()
+	watch.embedded = docs
+}
+
+// embeddedDocs returns the PDFs that the extractor found embedded in the PDF.
+func (watch *extractWatch) embeddedDocs() []embeddedDoc {
+	watch.mu.Lock()
+	defer watch.mu.Unlock()
+	return watch.embedded
+}
+
+// check returns an error if the extraction has exceeded the time limits in `limits` at time `now`.
+func (watch *extractWatch) check(limits ExtractLimits, now time.Time) error {
+	watch.mu.Lock()
+	defer watch.mu.Unlock()
+	if limits.FileTimeout > 0 {
+		if dt := now.Sub(watch.start); dt > limits.FileTimeout {
+			return fmt.Errorf("extraction took longer than %s (page %d)", limits.FileTimeout,
+				watch.pageNum)
+		}
+	}
+	if limits.PageTimeout > 0 && watch.pageNum > 0 {
+		if dt := now.Sub(watch.pageStart); dt > limits.PageTimeout {
+			return fmt.Errorf("page %d took longer than %s", watch.pageNum, limits.PageTimeout)
+		}
+	}
+	return nil
+}
+
+// abandon marks the extraction as abandoned and takes a slot in `slots` for it until it finishes.
+// If all the slots are taken, it waits for a slot or for `ctx` to be done. A nil `slots` means no
+// limit on the number of abandoned extractions.
+func (watch *extractWatch) abandon(ctx context.Context, slots chan struct{}) {
+	watch.mu.Lock()
+	watch.abandoned = true
+	watch.mu.Unlock()
+
+	if slots == nil {
+		return
+	}
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+	watch.mu.Lock()
+	defer watch.mu.Unlock()
+	if watch.finished {
+		<-slots
+		return
+	}
+	watch.slots = slots
+}
+
+// finish is called when the extraction returns. It frees the extraction's slot, if it has one.
+func (watch *extractWatch) finish() {
+	watch.mu.Lock()
+	defer watch.mu.Unlock()
+	watch.finished = true
+	if watch.slots != nil {
+		<-watch.slots
+		watch.slots = nil
+	}
+}
+
+// extractWithLimits extracts the text of PDF `fd` with extractDoc(), or of a document in another
+// format with the format's DocSource, according to `opts`.
+// The document is abandoned and an error returned if it exceeds any of the limits in `opts`.Limits or
+// if `ctx` is done.
+// It also returns the PDFs embedded in PDF `fd`. Their text is not extracted.
+func extractWithLimits(ctx context.Context, fd fileDesc, opts IndexOptions) ([]pageContents,
+	[]IndexFailure, []embeddedDoc, error) {
+	extract, err := docExtractorFor(fd)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return extractLimited(ctx, fd, opts, extract)
+}
+
+// extractLimited extracts the text of the document `fd` with `extract` under the limits in
+// `opts`.Limits. See extractWithLimits().
+func extractLimited(ctx context.Context, fd fileDesc, opts IndexOptions, extract docExtractor) (
+	[]pageContents, []IndexFailure, []embeddedDoc, error) {
+	limits := opts.Limits
+	if limits.MaxFileSizeMB > 0 && fd.SizeMB > limits.MaxFileSizeMB {
+		return nil, nil, nil, fmt.Errorf("size %.1f MB is over the limit of %.1f MB", fd.SizeMB,
+			limits.MaxFileSizeMB)
+	}
+	watch := newExtractWatch()
+	if !limits.timed() {
+		docContents, failures, err := extract(fd, opts.extractOptions(), watch)
+		return docContents, failures, watch.embeddedDocs(), err
+	}
+
+	type extraction struct {
+		docContents []pageContents
+		failures    []IndexFailure
+		err         error
+	}
+	done := make(chan extraction, 1) // Buffered so that abandoned extractions can finish.
+	go func() {
+		docContents, failures, err := extract(fd, opts.extractOptions(), watch)
+		watch.finish()
+		done <- extraction{docContents, failures, err}
+	}()
+
+	ticker := time.NewTicker(watchdogInterval(limits))
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-done:
+			return e.docContents, e.failures, watch.embeddedDocs(), e.err
+		case now := <-ticker.C:
+			if err := watch.check(limits, now); err != nil {
+				common.Log.Info("extractLimited: Abandoned %q. err=%v", fd.InPath, err)
+				watch.abandon(ctx, opts.abandoned)
+				return nil, nil, nil, err
+			}
+		case <-ctx.Done():
+			watch.abandon(ctx, opts.abandoned)
+			return nil, nil, nil, ctx.Err()
+		}
+	}
+}
+
+// watchdogInterval returns the interval at which the watchdog checks extractions against the time
+// limits in `limits`. It is a tenth of the shortest limit so that extractions are abandoned soon
+// after they exceed a limit.
+func watchdogInterval(limits ExtractLimits) time.Duration {
+	dt := limits.FileTimeout
+	if limits.PageTimeout > 0 && (dt == 0 || limits.PageTimeout < dt) {
+		dt = limits.PageTimeout
+	}
+	dt /= 10
+	if dt < time.Millisecond {
+		dt = time.Millisecond
+	}
+	if dt > time.Second {
+		dt = time.Second
+	}
+	return dt
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/papercutsoftware/pdfsearch/internal/serial"
+)
+
+// TestExtractLimits checks that PDFs that exceed the ExtractLimits are abandoned and reported as
+// failed while the other PDFs are indexed.
+func TestExtractLimits(t *testing.T) {
+	defer func(e docExtractor) { extractDoc = e }(extractDoc)
+	extractDoc = newFakeExtractor(t)
+
+	dir := t.TempDir()
+	names := []string{"fast1.pdf", "slow.pdf", "fast2.pdf", "stuck.pdf", "big.pdf", "fast3.pdf"}
+	var pathList []string
+	for _, name := range names {
+		inPath := filepath.Join(dir, name)
+		contents := name
+		if name == "big.pdf" {
+			contents = strings.Repeat("x", 2*1024*1024)
+		}
+		if err := ioutil.WriteFile(inPath, []byte(contents), 0666); err != nil {
+			t.Fatalf("WriteFile failed. err=%v", err)
+		}
+		pathList = append(pathList, inPath)
+	}
+
+	opts := IndexOptions{
+		Limits: ExtractLimits{
+			FileTimeout:   300 * time.Millisecond,
+			PageTimeout:   100 * time.Millisecond,
+			MaxFileSizeMB: 1.0,
+		},
+	}
+	t0 := time.Now()
+	persistDir := filepath.Join(dir, "store")
+	_, index, result, err := IndexPdfFilesContext(context.Background(), pathList, persistDir, true,
+		opts)
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	index.Close()
+	if dt := time.Since(t0); dt > 5*time.Second {
+		t.Fatalf("Indexing took %s. The slow PDFs were not abandoned", dt)
+	}
+
+	if result.NumAdded != 3 || result.NumFailed != 3 {
+		t.Fatalf("Expected 3 PDFs added and 3 failed. result=%s failures=%v", result, result.Failures)
+	}
+	expected := map[string]string{
+		"slow.pdf":  "longer than 300ms",
+		"stuck.pdf": "page 1 took longer than 100ms",
+		"big.pdf":   "over the limit of 1.0 MB",
+	}
+	for _, f := range result.Failures {
+		name := filepath.Base(f.InPath)
+		if f.Err == nil || !strings.Contains(f.Err.Error(), expected[name]) {
+			t.Fatalf("Unexpected failure %s. Expected %q", f, expected[name])
+		}
+		delete(expected, name)
+	}
+	if len(expected) > 0 {
+		t.Fatalf("Missing failures %v", expected)
+	}
+}
+
+// TestMaxAbandoned checks that extractLimited waits for an abandoned extraction to finish when
+// the maximum number of abandoned extractions are still running.
+func TestMaxAbandoned(t *testing.T) {
+	release := make(chan struct{})
+	extract := newFakeExtractorRelease(release)
+	defer close(release)
+	opts := IndexOptions{
+		Limits:    ExtractLimits{PageTimeout: 20 * time.Millisecond},
+		abandoned: make(chan struct{}, 1),
+	}
+	fd := fileDesc{InPath: "stuck.pdf"}
+
+	// The first stuck extraction is abandoned and takes the only slot.
+	if _, _, _, err := extractLimited(context.Background(), fd, opts, extract); err == nil {
+		t.Fatalf("First stuck extraction was not abandoned")
+	}
+	// The second stuck extraction waits for the first one to finish.
+	done := make(chan error, 1)
+	go func() {
+		_, _, _, err := extractLimited(context.Background(), fd, opts, extract)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatalf("Second stuck extraction returned while the first one was still running")
+	case <-time.After(300 * time.Millisecond):
+	}
+	// The limit is per indexing run, so a stuck extraction of another run doesn't wait.
+	otherRelease := make(chan struct{})
+	defer close(otherRelease)
+	other := opts
+	other.abandoned = make(chan struct{}, 1)
+	_, _, _, err := extractLimited(context.Background(), fd, other,
+		newFakeExtractorRelease(otherRelease))
+	if err == nil {
+		t.Fatalf("Stuck extraction of another run was not abandoned")
+	}
+	release <- struct{}{} // Unstick one of the extractions.
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Second stuck extraction was not abandoned")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Second stuck extraction didn't return after the first one finished")
+	}
+}
+
+// newFakeExtractor returns a fakeExtractor whose stuck pages are released when `t` finishes.
+func newFakeExtractor(t *testing.T) docExtractor {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	return newFakeExtractorRelease(release)
+}
+
+// newFakeExtractorRelease returns a docExtractor for testing ExtractLimits. It returns 10 pages
+// of made up text. Page extraction is fast except in "slow.pdf" where every page is slow and in
+// "stuck.pdf" where the first page doesn't finish until it receives from `release`.
+func newFakeExtractorRelease(release <-chan struct{}) docExtractor {
+	return func(fd fileDesc, opts extractOptions, watch *extractWatch) (
+		[]pageContents, []IndexFailure, error) {
+		name := filepath.Base(fd.InPath)
+		var docContents []pageContents
+		for pageNum := uint32(1); pageNum <= 10; pageNum++ {
+			if err := watch.startPage(pageNum); err != nil {
+				return nil, nil, err
+			}
+			switch name {
+			case "slow.pdf":
+				time.Sleep(50 * time.Millisecond)
+			case "stuck.pdf":
+				if pageNum == 1 {
+					<-release
+				}
+			}
+			text := fmt.Sprintf("Page %d of %s", pageNum, name)
+			ppos := PagePositions{[]serial.OffsetBBox{
+				{Offset: 0, Llx: 10, Lly: 20, Urx: 300, Ury: 40},
+			}}
+			docContents = append(docContents, pageContents{pageNum: pageNum, ppos: ppos, text: text})
+		}
+		return docContents, nil, nil
+	}
+}
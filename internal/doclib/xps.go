@@ -0,0 +1,487 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+/*
+ * This source file implements the extraction of text and glyph positions from XPS documents.
+ *  - An XPS document is a ZIP archive of XAML parts. The _rels/.rels part names the fixed document
+ *    sequence, which lists the fixed documents, which list the fixed pages.
+ *  - The text on a fixed page is in the UnicodeString attributes of its Glyphs elements. Each
+ *    Glyphs element has an origin, a font size and optional per-glyph advance widths, which give
+ *    the bounding boxes of its characters.
+ *  - XPSSource returns the text of each page with a TextMark for each character. The bounding boxes
+ *    are converted to PDF coordinates (points with the origin at the bottom left of the page) so
+ *    that they can be used in the same way as bounding boxes extracted from PDFs.
+ */
+
+package doclib
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// FormatXPS is the name of the XPS format.
+const FormatXPS = "xps"
+
+func init() {
+	err := RegisterFormat(DocFormat{
+		Name:       FormatXPS,
+		Extensions: []string{".xps", ".oxps"},
+		Source:     XPSSource{},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+const (
+	// xpsUnitsPerPoint is the number of XPS units (1/96 inch) in a PDF point (1/72 inch).
+	xpsUnitsPerPoint = 96.0 / 72.0
+	// xpsAscent and xpsDescent are the fractions of the font size above and below the baseline
+	// that are included in the bounding boxes of glyphs. XPS doesn't give the font metrics.
+	xpsAscent  = 0.8
+	xpsDescent = 0.2
+	// xpsAdvance is the advance width of glyphs with no advance width in their Glyphs element, as a
+	// fraction of the font size. The true advance widths are in the fonts.
+	xpsAdvance = 0.5
+	// xpsRelFixedRep is the relationship type of the fixed document sequence in _rels/.rels.
+	xpsRelFixedRep = "/fixedrepresentation"
+)
+
+// XPSSource is the DocSource for XPS and OpenXPS documents.
+type XPSSource struct{}
+
+// ExtractDoc returns the text of the pages of XPS document `inPath` with a TextMark for the
+// bounding box of each character.
+func (XPSSource) ExtractDoc(inPath string) ([]DocPage, error) {
+	zr, err := zip.OpenReader(inPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open XPS %q. err=%v", inPath, err)
+	}
+	defer zr.Close()
+	return extractXPS(&zr.Reader)
+}
+
+// extractXPS returns the pages of the XPS document in `zr`.
+func extractXPS(zr *zip.Reader) ([]DocPage, error) {
+	x := xpsReader{parts: map[string]*zip.File{}}
+	for _, f := range zr.File {
+		x.parts[strings.ToLower(f.Name)] = f
+	}
+	pagePaths, err := x.pagePaths()
+	if err != nil {
+		return nil, err
+	}
+	var pages []DocPage
+	for i, pagePath := range pagePaths {
+		text, marks, err := x.pageText(pagePath)
+		if err != nil {
+			return nil, fmt.Errorf("page %d %q: %v", i+1, pagePath, err)
+		}
+		pages = append(pages, DocPage{PageNum: uint32(i + 1), Text: text, Marks: marks})
+	}
+	return pages, nil
+}
+
+// xpsReader reads the parts of an XPS document.
+type xpsReader struct {
+	parts map[string]*zip.File // {lower case part name: part}
+}
+
+// open returns a reader for part `name`.
+func (x xpsReader) open(name string) (io.ReadCloser, error) {
+	f, ok := x.parts[strings.ToLower(strings.TrimPrefix(name, "/"))]
+	if !ok {
+		return nil, fmt.Errorf("no part %q", name)
+	}
+	return f.Open()
+}
+
+// sources returns the values of attribute `attr` of the elements named `element` in part `name`.
+func (x xpsReader) sources(name, element, attr string) ([]string, error) {
+	r, err := x.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var values []string
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse %q. err=%v", name, err)
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == element {
+			if v, ok := xmlAttr(se, attr); ok {
+				values = append(values, v)
+			}
+		}
+	}
+}
+
+// pagePaths returns the names of the fixed page parts of the document in page order.
+func (x xpsReader) pagePaths() ([]string, error) {
+	seqPath, err := x.sequencePath()
+	if err != nil {
+		return nil, err
+	}
+	docPaths, err := x.sources(seqPath, "DocumentReference", "Source")
+	if err != nil {
+		return nil, err
+	}
+	var pagePaths []string
+	for _, docPath := range docPaths {
+		docPath = xpsResolve(seqPath, docPath)
+		paths, err := x.sources(docPath, "PageContent", "Source")
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			pagePaths = append(pagePaths, xpsResolve(docPath, p))
+		}
+	}
+	return pagePaths, nil
+}
+
+// sequencePath returns the name of the fixed document sequence part.
+func (x xpsReader) sequencePath() (string, error) {
+	r, err := x.open("_rels/.rels")
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	var rels struct {
+		Relationship []struct {
+			Target string `xml:",attr"`
+			Type   string `xml:",attr"`
+		}
+	}
+	if err := xml.NewDecoder(r).Decode(&rels); err != nil {
+		return "", fmt.Errorf("Could not parse _rels/.rels. err=%v", err)
+	}
+	for _, rel := range rels.Relationship {
+		if strings.HasSuffix(rel.Type, xpsRelFixedRep) {
+			return xpsResolve("/", rel.Target), nil
+		}
+	}
+	return "", fmt.Errorf("no fixed document sequence")
+}
+
+// xpsResolve returns the part name of `target` referenced from part `base`.
+func xpsResolve(base, target string) string {
+	if strings.HasPrefix(target, "/") {
+		return target
+	}
+	return path.Join(path.Dir(base), target)
+}
+
+// xmlAttr returns the value of the attribute with local name `name` of `se`.
+func xmlAttr(se xml.StartElement, name string) (string, bool) {
+	for _, a := range se.Attr {
+		if a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// pageText returns the text of fixed page part `pagePath` and the locations of its characters.
+func (x xpsReader) pageText(pagePath string) (string, []TextMark, error) {
+	r, err := x.open(pagePath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+
+	var page xpsPage
+	transforms := []xpsMatrix{xpsIdentity} // Stack of the transforms of the enclosing Canvases.
+	var glyphs *xpsGlyphs                  // The Glyphs element being parsed.
+	var parents []string                   // Names of the enclosing elements.
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("Could not parse page. err=%v", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			top := transforms[len(transforms)-1]
+			switch t.Name.Local {
+			case "FixedPage":
+				page.height = xmlFloat(t, "Height", 0)
+			case "Canvas":
+				m := parseXPSMatrix(t)
+				transforms = append(transforms, m.times(top))
+			case "Glyphs":
+				glyphs = newXPSGlyphs(t, top)
+			case "MatrixTransform":
+				if len(parents) == 0 {
+					break
+				}
+				m, _ := parseXPSMatrixAttr(t, "Matrix")
+				switch parents[len(parents)-1] {
+				case "Canvas.RenderTransform":
+					i := len(transforms) - 1
+					transforms[i] = m.times(transforms[i])
+				case "Glyphs.RenderTransform":
+					if glyphs != nil {
+						glyphs.transform = m.times(glyphs.transform)
+					}
+				}
+			}
+			parents = append(parents, t.Name.Local)
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "Canvas":
+				if len(transforms) > 1 {
+					transforms = transforms[:len(transforms)-1]
+				}
+			case "Glyphs":
+				if glyphs != nil {
+					page.addGlyphs(*glyphs)
+					glyphs = nil
+				}
+			}
+			if len(parents) > 0 {
+				parents = parents[:len(parents)-1]
+			}
+		}
+	}
+	text, marks := page.text()
+	return text, marks, nil
+}
+
+// xpsMatrix is an XPS affine transform "m11,m12,m21,m22,dx,dy" that maps (x, y) to
+// (x*m11 + y*m21 + dx, x*m12 + y*m22 + dy).
+type xpsMatrix [6]float64
+
+// xpsIdentity is the identity transform.
+var xpsIdentity = xpsMatrix{1, 0, 0, 1, 0, 0}
+
+// times returns the transform that applies `m` then `n`.
+func (m xpsMatrix) times(n xpsMatrix) xpsMatrix {
+	return xpsMatrix{
+		m[0]*n[0] + m[1]*n[2],
+		m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2],
+		m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4],
+		m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+// apply returns (`x`, `y`) transformed by `m`.
+func (m xpsMatrix) apply(x, y float64) (float64, float64) {
+	return x*m[0] + y*m[2] + m[4], x*m[1] + y*m[3] + m[5]
+}
+
+// parseXPSMatrix returns the RenderTransform attribute of `se` or the identity if it doesn't have
+// one.
+func parseXPSMatrix(se xml.StartElement) xpsMatrix {
+	m, _ := parseXPSMatrixAttr(se, "RenderTransform")
+	return m
+}
+
+// parseXPSMatrixAttr returns the matrix in attribute `name` of `se`. It returns the identity and
+// false if there is no such attribute or it is not a matrix. Resource references such as
+// "{StaticResource ...}" are not supported.
+func parseXPSMatrixAttr(se xml.StartElement, name string) (xpsMatrix, bool) {
+	v, ok := xmlAttr(se, name)
+	if !ok {
+		return xpsIdentity, false
+	}
+	parts := strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(parts) != 6 {
+		return xpsIdentity, false
+	}
+	var m xpsMatrix
+	for i, s := range parts {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return xpsIdentity, false
+		}
+		m[i] = f
+	}
+	return m, true
+}
+
+// xmlFloat returns the value of number attribute `name` of `se` or `def` if there is no such
+// attribute.
+func xmlFloat(se xml.StartElement, name string, def float64) float64 {
+	v, ok := xmlAttr(se, name)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
+// xpsGlyphs is a run of glyphs from a Glyphs element.
+type xpsGlyphs struct {
+	text      []rune    // The characters.
+	advances  []float64 // Advance widths of the characters in 1/100 of the font size. <0 if unknown.
+	originX   float64   // Origin of the run in the element's coordinates.
+	originY   float64
+	size      float64   // Font size (FontRenderingEmSize).
+	transform xpsMatrix // Transform from the element's coordinates to page coordinates.
+}
+
+// newXPSGlyphs returns the xpsGlyphs for Glyphs element `se` which is in a Canvas with transform
+// `canvas`.
+func newXPSGlyphs(se xml.StartElement, canvas xpsMatrix) *xpsGlyphs {
+	unicode, _ := xmlAttr(se, "UnicodeString")
+	unicode = strings.TrimPrefix(unicode, "{}")
+	g := &xpsGlyphs{
+		text:      []rune(unicode),
+		originX:   xmlFloat(se, "OriginX", 0),
+		originY:   xmlFloat(se, "OriginY", 0),
+		size:      xmlFloat(se, "FontRenderingEmSize", 0),
+		transform: parseXPSMatrix(se).times(canvas),
+	}
+	indices, _ := xmlAttr(se, "Indices")
+	g.advances = parseXPSAdvances(indices, len(g.text))
+	return g
+}
+
+// parseXPSAdvances returns the advance widths of the `n` characters in Indices attribute value
+// `indices`. The advance widths that aren't given are -1. Cluster mappings are ignored, so the
+// advance widths are only correct for runs with one glyph per character.
+func parseXPSAdvances(indices string, n int) []float64 {
+	advances := make([]float64, n)
+	for i := range advances {
+		advances[i] = -1
+	}
+	if indices == "" {
+		return advances
+	}
+	for i, entry := range strings.Split(indices, ";") {
+		if i >= n {
+			break
+		}
+		if j := strings.IndexByte(entry, ')'); j >= 0 {
+			entry = entry[j+1:]
+		}
+		fields := strings.Split(entry, ",")
+		if len(fields) < 2 {
+			continue
+		}
+		if adv, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64); err == nil {
+			advances[i] = adv
+		}
+	}
+	return advances
+}
+
+// xpsChar is a character on a fixed page with its bounding box in XPS page coordinates.
+type xpsChar struct {
+	r                      rune
+	llx, lly, urx, ury     float64 // Bounding box with y increasing downwards.
+	baseline, size, startX float64 // Baseline y, font size and start x of the character's run.
+}
+
+// xpsPage accumulates the characters on a fixed page.
+type xpsPage struct {
+	height float64     // Height of the page in XPS units.
+	runs   [][]xpsChar // The characters in each Glyphs element in page order.
+}
+
+// addGlyphs adds the characters in `g` to `page`.
+func (page *xpsPage) addGlyphs(g xpsGlyphs) {
+	var run []xpsChar
+	x := g.originX
+	for i, r := range g.text {
+		adv := g.advances[i]
+		if adv < 0 {
+			adv = xpsAdvance * 100
+		}
+		w := adv / 100 * g.size
+		c := xpsChar{r: r, size: g.size}
+		c.llx, c.lly, c.urx, c.ury = xpsBounds(g.transform, x, g.originY-xpsAscent*g.size,
+			x+w, g.originY+xpsDescent*g.size)
+		_, c.baseline = g.transform.apply(x, g.originY)
+		run = append(run, c)
+		x += w
+	}
+	if len(run) > 0 {
+		page.runs = append(page.runs, run)
+	}
+}
+
+// xpsBounds returns the bounds of rectangle (`x0`, `y0`, `x1`, `y1`) transformed by `m`.
+func xpsBounds(m xpsMatrix, x0, y0, x1, y1 float64) (float64, float64, float64, float64) {
+	llx, lly := math.Inf(1), math.Inf(1)
+	urx, ury := math.Inf(-1), math.Inf(-1)
+	for _, p := range [][2]float64{{x0, y0}, {x1, y0}, {x0, y1}, {x1, y1}} {
+		x, y := m.apply(p[0], p[1])
+		llx, lly = math.Min(llx, x), math.Min(lly, y)
+		urx, ury = math.Max(urx, x), math.Max(ury, y)
+	}
+	return llx, lly, urx, ury
+}
+
+// text returns the text on `page` and the locations of its characters. Runs are separated by a
+// newline if they are on different baselines and by a space if there is a gap between them.
+func (page *xpsPage) text() (string, []TextMark) {
+	var sb strings.Builder
+	var marks []TextMark
+	var prev *xpsChar
+	for _, run := range page.runs {
+		first := run[0]
+		if prev != nil {
+			sep := ""
+			tol := 0.5 * math.Max(prev.size, first.size)
+			switch {
+			case math.Abs(first.baseline-prev.baseline) > tol:
+				sep = "\n"
+			case first.llx-prev.urx > 0.3*tol:
+				sep = " "
+			}
+			if sep != "" {
+				marks = append(marks, TextMark{Offset: uint32(sb.Len())})
+				sb.WriteString(sep)
+			}
+		}
+		for i := range run {
+			c := run[i]
+			if c.r == '\n' || c.r == '\r' {
+				c.r = ' '
+			}
+			marks = append(marks, TextMark{Offset: uint32(sb.Len()), BBox: page.pdfRect(c)})
+			sb.WriteRune(c.r)
+		}
+		prev = &run[len(run)-1]
+	}
+	if sb.Len() == 0 {
+		return "", nil
+	}
+	marks = append(marks, TextMark{Offset: uint32(sb.Len())})
+	sb.WriteString("\n")
+	marks = append(marks, TextMark{Offset: uint32(sb.Len())})
+	return sb.String(), marks
+}
+
+// pdfRect returns the bounding box of `c` in PDF coordinates.
+func (page *xpsPage) pdfRect(c xpsChar) model.PdfRectangle {
+	return model.PdfRectangle{
+		Llx: c.llx / xpsUnitsPerPoint,
+		Lly: (page.height - c.ury) / xpsUnitsPerPoint,
+		Urx: c.urx / xpsUnitsPerPoint,
+		Ury: (page.height - c.lly) / xpsUnitsPerPoint,
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package doclib
+
+import (
+	"archive/zip"
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// xpsTestParts are the parts of a two page XPS document. The second page has its text in a
+// translated Canvas and a run with advance widths.
+var xpsTestParts = map[string]string{
+	"_rels/.rels": `<?xml version="1.0" encoding="utf-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+  <Relationship Type="http://schemas.microsoft.com/xps/2005/06/fixedrepresentation"
+    Target="/FixedDocSeq.fdseq" Id="R0" />
+</Relationships>`,
+	"FixedDocSeq.fdseq": `<FixedDocumentSequence xmlns="http://schemas.microsoft.com/xps/2005/06">
+  <DocumentReference Source="Documents/1/FixedDoc.fdoc" />
+</FixedDocumentSequence>`,
+	"Documents/1/FixedDoc.fdoc": `<FixedDocument xmlns="http://schemas.microsoft.com/xps/2005/06">
+  <PageContent Source="Pages/1.fpage" />
+  <PageContent Source="/Documents/1/Pages/2.fpage" />
+</FixedDocument>`,
+	"Documents/1/Pages/1.fpage": `<FixedPage Width="816" Height="1056"
+    xmlns="http://schemas.microsoft.com/xps/2005/06">
+  <Glyphs OriginX="96" OriginY="96" FontRenderingEmSize="20" UnicodeString="Print" />
+  <Glyphs OriginX="160" OriginY="96" FontRenderingEmSize="20" UnicodeString="job" />
+  <Glyphs OriginX="96" OriginY="144" FontRenderingEmSize="20" UnicodeString="{}{summary}" />
+</FixedPage>`,
+	"Documents/1/Pages/2.fpage": `<FixedPage Width="816" Height="1056"
+    xmlns="http://schemas.microsoft.com/xps/2005/06">
+  <Canvas RenderTransform="1,0,0,1,96,192">
+    <Glyphs OriginX="0" OriginY="0" FontRenderingEmSize="24" UnicodeString="Invoice"
+      Indices=",50;,50;,50;,50;,50;,50;,50" />
+  </Canvas>
+</FixedPage>`,
+}
+
+// makeXPS writes an XPS document with parts `parts` to `outPath`.
+func makeXPS(t *testing.T, outPath string, parts map[string]string) {
+	f, err := os.Create(outPath)
+	if err != nil {
+		t.Fatalf("Create failed. err=%v", err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, contents := range parts {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("Create %q failed. err=%v", name, err)
+		}
+		if _, err := w.Write([]byte(contents)); err != nil {
+			t.Fatalf("Write %q failed. err=%v", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Close failed. err=%v", err)
+	}
+}
+
+// TestXPSSource checks the text and glyph positions extracted from an XPS document.
+func TestXPSSource(t *testing.T) {
+	inPath := filepath.Join(t.TempDir(), "job.xps")
+	makeXPS(t, inPath, xpsTestParts)
+	pages, err := XPSSource{}.ExtractDoc(inPath)
+	if err != nil {
+		t.Fatalf("ExtractDoc failed. err=%v", err)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("%d pages. Expected 2", len(pages))
+	}
+	if text := pages[0].Text; text != "Print job\n{summary}\n" {
+		t.Fatalf("page 1 text=%q", text)
+	}
+	if text := pages[1].Text; text != "Invoice\n" {
+		t.Fatalf("page 2 text=%q", text)
+	}
+
+	// "Invoice" is 7 glyphs with advance widths of half the 24 unit font size, starting 1 inch
+	// from the left and 2 inches from the top of an 11 inch page.
+	ppos := PagePositionsFromMarks(pages[1].Marks)
+	bbox, ok := ppos.BBox(0, uint32(len("Invoice")))
+	expected := model.PdfRectangle{
+		Llx: 72,
+		Lly: 72*9 - 0.2*18,
+		Urx: 72 + 7*0.5*18,
+		Ury: 72*9 + 0.8*18,
+	}
+	if !ok || !rectsClose(bbox, expected) {
+		t.Fatalf("bbox=%+v ok=%t. Expected %+v", bbox, ok, expected)
+	}
+}
+
+// TestXPSIndex checks that XPS documents are indexed and searched next to PDFs.
+func TestXPSIndex(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "job.xps")
+	makeXPS(t, inPath, xpsTestParts)
+	persistDir := filepath.Join(dir, "store")
+	blevePdf, index, result, err := IndexPdfFilesContext(context.Background(), []string{inPath},
+		persistDir, true, IndexOptions{})
+	if err != nil {
+		t.Fatalf("IndexPdfFilesContext failed. err=%v", err)
+	}
+	defer index.Close()
+	if result.NumAdded != 1 || result.NumPages != 2 {
+		t.Fatalf("Unexpected result %s", result)
+	}
+	matches, err := blevePdf.SearchBleveIndex(index, "invoice", 10)
+	if err != nil {
+		t.Fatalf("SearchBleveIndex failed. err=%v", err)
+	}
+	if len(matches.Matches) != 1 {
+		t.Fatalf("%d matches. Expected 1. matches=%s", len(matches.Matches), matches)
+	}
+	m := matches.Matches[0]
+	if m.Format != FormatXPS || m.PageNum != 2 || len(m.Spans) != 1 {
+		t.Fatalf("Unexpected match %s", m)
+	}
+	if _, ok := m.PagePositions.BBox(m.Spans[0].Start, m.Spans[0].End); !ok {
+		t.Fatalf("No bbox for match %s", m)
+	}
+}
+
+// TestXPSMatrix checks the composition of XPS transforms.
+func TestXPSMatrix(t *testing.T) {
+	rotate := xpsMatrix{0, 1, -1, 0, 0, 0} // 90 degrees.
+	translate := xpsMatrix{1, 0, 0, 1, 10, 20}
+	x, y := rotate.times(translate).apply(1, 2)
+	if x != 8 || y != 21 {
+		t.Fatalf("x=%g y=%g. Expected 8 21", x, y)
+	}
+	if advances := parseXPSAdvances("(1:2)12,60;;5", 3); advances[0] != 60 ||
+		advances[1] != -1 || advances[2] != -1 {
+		t.Fatalf("advances=%v", advances)
+	}
+}
+
+// rectsClose returns true if the coordinates of `r1` and `r2` are within 0.01 of each other.
+func rectsClose(r1, r2 model.PdfRectangle) bool {
+	return math.Abs(r1.Llx-r2.Llx) < 0.01 && math.Abs(r1.Lly-r2.Lly) < 0.01 &&
+		math.Abs(r1.Urx-r2.Urx) < 0.01 && math.Abs(r1.Ury-r2.Ury) < 0.01
+}
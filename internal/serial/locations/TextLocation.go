@@ -87,8 +87,20 @@ func (rcv *TextLocation) MutateUry(n float32) bool {
 	return rcv._tab.MutateFloat32Slot(12, n)
 }
 
+func (rcv *TextLocation) Source() byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(14))
+	if o != 0 {
+		return rcv._tab.GetByte(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *TextLocation) MutateSource(n byte) bool {
+	return rcv._tab.MutateByteSlot(14, n)
+}
+
 func TextLocationStart(builder *flatbuffers.Builder) {
-	builder.StartObject(5)
+	builder.StartObject(6)
 }
 func TextLocationAddOffset(builder *flatbuffers.Builder, offset uint32) {
 	builder.PrependUint32Slot(0, offset, 0)
@@ -105,6 +117,9 @@ func TextLocationAddUrx(builder *flatbuffers.Builder, urx float32) {
 func TextLocationAddUry(builder *flatbuffers.Builder, ury float32) {
 	builder.PrependFloat32Slot(4, ury, 0.0)
 }
+func TextLocationAddSource(builder *flatbuffers.Builder, source byte) {
+	builder.PrependByteSlot(5, source, 0)
+}
 func TextLocationEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
@@ -19,6 +19,7 @@ import (
 type OffsetBBox struct {
 	Offset             uint32  // Offset of the text fragment in extracted page text.
 	Llx, Lly, Urx, Ury float32 // Bounding box of fragment on PDF page.
+	Source             uint8   // Where the fragment came from. 0 for the page contents.
 }
 
 // BBox returns `t` as a UniDoc rectangle. This is convenient for drawing bounding rectangles around
@@ -114,6 +115,7 @@ func addTextLocation(b *flatbuffers.Builder, loc OffsetBBox) flatbuffers.UOffset
 	locations.TextLocationAddLly(b, loc.Lly)
 	locations.TextLocationAddUrx(b, loc.Urx)
 	locations.TextLocationAddUry(b, loc.Ury)
+	locations.TextLocationAddSource(b, loc.Source)
 	return locations.TextLocationEnd(b)
 }
 
@@ -131,5 +133,6 @@ func getTextLocation(loc *locations.TextLocation) OffsetBBox {
 		loc.Lly(),
 		loc.Urx(),
 		loc.Ury(),
+		loc.Source(),
 	}
 }
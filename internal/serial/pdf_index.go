@@ -0,0 +1,192 @@
+// Copyright 2019 PaperCut Software International Pty Ltd. All rights reserved.
+
+package serial
+
+import (
+	"errors"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/papercutsoftware/pdfsearch/internal/serial/locations"
+	"github.com/papercutsoftware/pdfsearch/internal/serial/pdf_index"
+)
+
+// DocEntry is the serializable form of the information about one PDF in a PdfIndex.
+// (Members need to be public because they are accessed by the doclib package.
+type DocEntry struct {
+	Hash          string         // Hash of the PDF's contents.
+	DocIdx        uint64         // Document index of the PDF in the bleve index.
+	Path          string         // Path of the PDF.
+	PageNums      []uint32       // PageNums[i] is the (1-offset) page number of the ith page.
+	PageTexts     []string       // PageTexts[i] is the text extracted from the ith page.
+	PagePositions [][]OffsetBBox // PagePositions[i] is the text positions on the ith page.
+	Outline       []OutlineEntry // Bookmarks of the PDF.
+	Parent        string         // Path of the PDF or ZIP archive that holds the PDF. May be empty.
+}
+
+// OutlineEntry is the serializable form of a bookmark in the outline of a PDF.
+type OutlineEntry struct {
+	Title string  // Title of the bookmark.
+	Level int32   // Depth in the outline tree. 0 for top level bookmarks.
+	Page  uint32  // 1-offset page number of the destination. 0 if unknown.
+	Top   float64 // Top of the destination on the page in PDF coordinates.
+}
+
+// MakePdfIndex returns a flatbuffers serialized byte array for a PdfIndex with `numFiles` PDFs,
+// `numPages` pages, the serialized bleve index `index` and the PDF descriptions `docs`.
+func MakePdfIndex(numFiles, numPages uint32, index []byte, docs []DocEntry) []byte {
+	b := flatbuffers.NewBuilder(len(index))
+
+	var hipdOffsets []flatbuffers.UOffsetT
+	for _, doc := range docs {
+		hipdOffsets = append(hipdOffsets, addHashIndexPathDoc(b, doc))
+	}
+	pdf_index.PdfIndexStartHipdVector(b, len(docs))
+	// Prepend HashIndexPathDocs in reverse order.
+	for i := len(hipdOffsets) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(hipdOffsets[i])
+	}
+	hipdOfs := b.EndVector(len(docs))
+	indexOfs := b.CreateByteVector(index)
+
+	pdf_index.PdfIndexStart(b)
+	pdf_index.PdfIndexAddNumFiles(b, numFiles)
+	pdf_index.PdfIndexAddNumPages(b, numPages)
+	pdf_index.PdfIndexAddIndex(b, indexOfs)
+	pdf_index.PdfIndexAddHipd(b, hipdOfs)
+	b.Finish(pdf_index.PdfIndexEnd(b))
+	return b.Bytes[b.Head():]
+}
+
+// addHashIndexPathDoc writes `doc` to builder `b` and returns the HashIndexPathDoc table offset.
+func addHashIndexPathDoc(b *flatbuffers.Builder, doc DocEntry) flatbuffers.UOffsetT {
+	pathOfs := b.CreateString(doc.Path)
+	hashOfs := b.CreateString(doc.Hash)
+	docOfs := addDocPositions(b, doc, pathOfs)
+	outlineOfs := addOutline(b, doc.Outline)
+	var parentOfs flatbuffers.UOffsetT
+	if doc.Parent != "" {
+		parentOfs = b.CreateString(doc.Parent)
+	}
+
+	pdf_index.HashIndexPathDocStart(b)
+	pdf_index.HashIndexPathDocAddHash(b, hashOfs)
+	pdf_index.HashIndexPathDocAddIndex(b, doc.DocIdx)
+	pdf_index.HashIndexPathDocAddPath(b, pathOfs)
+	pdf_index.HashIndexPathDocAddDoc(b, docOfs)
+	if len(doc.Outline) > 0 {
+		pdf_index.HashIndexPathDocAddOutline(b, outlineOfs)
+	}
+	if doc.Parent != "" {
+		pdf_index.HashIndexPathDocAddParent(b, parentOfs)
+	}
+	return pdf_index.HashIndexPathDocEnd(b)
+}
+
+// addOutline writes the bookmarks `outline` to builder `b` and returns the vector offset. It
+// writes nothing if `outline` is empty.
+func addOutline(b *flatbuffers.Builder, outline []OutlineEntry) flatbuffers.UOffsetT {
+	n := len(outline)
+	if n == 0 {
+		return 0
+	}
+	entryOffsets := make([]flatbuffers.UOffsetT, n)
+	for i, e := range outline {
+		titleOfs := b.CreateString(e.Title)
+		pdf_index.OutlineEntryStart(b)
+		pdf_index.OutlineEntryAddTitle(b, titleOfs)
+		pdf_index.OutlineEntryAddLevel(b, e.Level)
+		pdf_index.OutlineEntryAddPage(b, e.Page)
+		pdf_index.OutlineEntryAddTop(b, e.Top)
+		entryOffsets[i] = pdf_index.OutlineEntryEnd(b)
+	}
+	pdf_index.HashIndexPathDocStartOutlineVector(b, n)
+	for i := n - 1; i >= 0; i-- {
+		b.PrependUOffsetT(entryOffsets[i])
+	}
+	return b.EndVector(n)
+}
+
+// addDocPositions writes the pages of `doc` to builder `b` and returns the DocPositions table
+// offset. `pathOfs` is the offset of the already written `doc.Path`.
+func addDocPositions(b *flatbuffers.Builder, doc DocEntry, pathOfs flatbuffers.UOffsetT) flatbuffers.UOffsetT {
+	n := len(doc.PageNums)
+
+	var dplOffsets, textOffsets []flatbuffers.UOffsetT
+	for i := 0; i < n; i++ {
+		dplOffsets = append(dplOffsets, addDocPageLocations(b, doc.PagePositions[i]))
+		textOffsets = append(textOffsets, b.CreateString(doc.PageTexts[i]))
+	}
+
+	pdf_index.DocPositionsStartPageDplVector(b, n)
+	for i := n - 1; i >= 0; i-- {
+		b.PrependUOffsetT(dplOffsets[i])
+	}
+	dplOfs := b.EndVector(n)
+
+	pdf_index.DocPositionsStartPageNumsVector(b, n)
+	for i := n - 1; i >= 0; i-- {
+		b.PrependUint32(doc.PageNums[i])
+	}
+	numsOfs := b.EndVector(n)
+
+	pdf_index.DocPositionsStartPageTextsVector(b, n)
+	for i := n - 1; i >= 0; i-- {
+		b.PrependUOffsetT(textOffsets[i])
+	}
+	textsOfs := b.EndVector(n)
+
+	pdf_index.DocPositionsStart(b)
+	pdf_index.DocPositionsAddPath(b, pathOfs)
+	pdf_index.DocPositionsAddDocIdx(b, doc.DocIdx)
+	pdf_index.DocPositionsAddPageDpl(b, dplOfs)
+	pdf_index.DocPositionsAddPageNums(b, numsOfs)
+	pdf_index.DocPositionsAddPageTexts(b, textsOfs)
+	return pdf_index.DocPositionsEnd(b)
+}
+
+// ReadPdfIndex returns the PdfIndex serialized in `buf` by MakePdfIndex() and the serialized bleve
+// index it contains. Nothing is copied. The returned values reference `buf`.
+func ReadPdfIndex(buf []byte) (*pdf_index.PdfIndex, []byte, error) {
+	if len(buf) < flatbuffers.SizeUOffsetT {
+		return nil, nil, errors.New("PdfIndex buffer too small")
+	}
+	pdfIndex := pdf_index.GetRootAsPdfIndex(buf, 0)
+
+	// The generated PdfIndex code reads `index` one byte at a time, so we read it as a byte vector.
+	t := pdfIndex.Table()
+	var index []byte
+	if o := flatbuffers.UOffsetT(t.Offset(8)); o != 0 {
+		index = t.ByteVector(o + t.Pos)
+	}
+	return pdfIndex, index, nil
+}
+
+// ReadOutline returns the bookmarks of the PDF described by `hipd`.
+func ReadOutline(hipd *pdf_index.HashIndexPathDoc) ([]OutlineEntry, error) {
+	var outline []OutlineEntry
+	for i := 0; i < hipd.OutlineLength(); i++ {
+		var e pdf_index.OutlineEntry
+		if !hipd.Outline(&e, i) {
+			return nil, errors.New("bad OutlineEntry")
+		}
+		outline = append(outline, OutlineEntry{
+			Title: string(e.Title()),
+			Level: e.Level(),
+			Page:  e.Page(),
+			Top:   e.Top(),
+		})
+	}
+	return outline, nil
+}
+
+// ReadPagePositions returns the text positions of the page with index `pageIdx` in `doc`.
+func ReadPagePositions(doc *pdf_index.DocPositions, pageIdx int) ([]OffsetBBox, error) {
+	if pageIdx < 0 || pageIdx >= doc.PageDplLength() {
+		return nil, errors.New("bad page index")
+	}
+	var sdpl locations.PagePositions
+	if !doc.PageDpl(&sdpl, pageIdx) {
+		return nil, errors.New("no PagePositions")
+	}
+	return getDocPageLocations(&sdpl)
+}
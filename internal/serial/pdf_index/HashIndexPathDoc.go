@@ -67,8 +67,36 @@ func (rcv *HashIndexPathDoc) Doc(obj *DocPositions) *DocPositions {
 	return nil
 }
 
+func (rcv *HashIndexPathDoc) Outline(obj *OutlineEntry, j int) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(12))
+	if o != 0 {
+		x := rcv._tab.Vector(o)
+		x += flatbuffers.UOffsetT(j) * 4
+		x = rcv._tab.Indirect(x)
+		obj.Init(rcv._tab.Bytes, x)
+		return true
+	}
+	return false
+}
+
+func (rcv *HashIndexPathDoc) OutlineLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(12))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
+}
+
+func (rcv *HashIndexPathDoc) Parent() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(14))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
 func HashIndexPathDocStart(builder *flatbuffers.Builder) {
-	builder.StartObject(4)
+	builder.StartObject(6)
 }
 func HashIndexPathDocAddHash(builder *flatbuffers.Builder, hash flatbuffers.UOffsetT) {
 	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(hash), 0)
@@ -82,6 +110,15 @@ func HashIndexPathDocAddPath(builder *flatbuffers.Builder, path flatbuffers.UOff
 func HashIndexPathDocAddDoc(builder *flatbuffers.Builder, doc flatbuffers.UOffsetT) {
 	builder.PrependUOffsetTSlot(3, flatbuffers.UOffsetT(doc), 0)
 }
+func HashIndexPathDocAddOutline(builder *flatbuffers.Builder, outline flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(4, flatbuffers.UOffsetT(outline), 0)
+}
+func HashIndexPathDocStartOutlineVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(4, numElems, 4)
+}
+func HashIndexPathDocAddParent(builder *flatbuffers.Builder, parent flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(5, flatbuffers.UOffsetT(parent), 0)
+}
 func HashIndexPathDocEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
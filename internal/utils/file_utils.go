@@ -5,10 +5,61 @@ package utils
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"hash"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/user"
+	"sort"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/unidoc/unipdf/v3/common"
 )
 
+// PatternsToPaths returns a list of files matching the patterns in `patternList`.
+// ZIP archives that match are returned like other files. The indexer reads the PDFs in them.
+// The returned list is sorted alphabetically .
+func PatternsToPaths(patternList []string) ([]string, error) {
+	var pathList []string
+	common.Log.Debug("patternList=%d", len(patternList))
+	for i, pattern := range patternList {
+		pattern = ExpandUser(pattern)
+		files, err := doublestar.Glob(pattern)
+		if err != nil {
+			common.Log.Error("PatternsToPaths: Glob failed. pattern=%#q err=%v", pattern, err)
+			return pathList, err
+		}
+		common.Log.Debug("patternList[%d]=%q %d matches", i, pattern, len(files))
+		for _, filename := range files {
+			ok, err := RegularFile(filename)
+			if err != nil {
+				common.Log.Error("PatternsToPaths: RegularFile failed. pattern=%#q err=%v", pattern, err)
+				return pathList, err
+			}
+			if !ok {
+				continue
+			}
+			pathList = append(pathList, filename)
+		}
+	}
+	pathList = StringUniques(pathList)
+	sort.Strings(pathList)
+	return pathList, nil
+}
+
+// ExpandUser returns `filename` with "~" replaced with user's home directory.
+func ExpandUser(filename string) string {
+	if !strings.Contains(filename, "~") {
+		return filename
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return filename
+	}
+	return strings.Replace(filename, "~", usr.HomeDir, -1)
+}
+
 // RegularFile returns true if file `filename` is a regular file.
 func RegularFile(filename string) (bool, error) {
 	fi, err := os.Stat(filename)
@@ -45,10 +96,27 @@ func FileHash(filename string) (string, error) {
 	return makeHash(b), nil
 }
 
+// ReaderHash returns a hex encoded string of the SHA-256 digest of the contents of `r` and the
+// number of bytes read from `r`. The hash is the same as FileHash() returns for a file with the
+// same contents.
+func ReaderHash(r io.Reader) (string, int64, error) {
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, r)
+	if err != nil {
+		return "", size, err
+	}
+	return hashDigest(hasher), size, nil
+}
+
 // makeHash returns a hex encoded string of the SHA-256 digest of `b.
 func makeHash(b []byte) string {
 	hasher := sha256.New()
 	hasher.Write(b)
+	return hashDigest(hasher)
+}
+
+// hashDigest returns the hex encoded digest of `hasher` truncated to FileHashSize digits.
+func hashDigest(hasher hash.Hash) string {
 	digest := hex.EncodeToString(hasher.Sum(nil))
 	if FileHashSize > 0 && FileHashSize < len(digest) {
 		digest = digest[:FileHashSize]